@@ -0,0 +1,168 @@
+// Copyright 2017 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"fuchsia.googlesource.com/jiri"
+	"fuchsia.googlesource.com/jiri/cmdline"
+	"fuchsia.googlesource.com/jiri/git"
+	"fuchsia.googlesource.com/jiri/gitutil"
+	"fuchsia.googlesource.com/jiri/project"
+)
+
+var applyPatchesFlags struct {
+	force bool
+}
+
+func init() {
+	cmdApplyPatches.Flags.BoolVar(&applyPatchesFlags.force, "force", false, "Apply the patches even to projects with uncommitted changes.")
+}
+
+var cmdApplyPatches = &cmdline.Command{
+	Runner: jiri.RunnerFunc(runApplyPatches),
+	Name:   "apply-patches",
+	Short:  "Apply a series of patches across projects",
+	Long: `
+Applies the patches of a directory to the local projects, for changes spanning
+several projects.  The patches of a project are either in the file
+<project>.patch or, for a series, in the files matching <project>/*.patch,
+applied in lexical order, <project> being the name of the project.
+
+Patches in the mailbox format created by "git format-patch" are committed with
+"git am", other patches are applied to the working tree with "git apply".
+Projects with uncommitted changes are skipped unless -force is given.  A
+failure to apply the patches of a project is reported, and leaves it as it
+was, without stopping the patching of the other projects.
+`,
+	ArgsName: "<dir>",
+	ArgsLong: "<dir> is the directory of patches.",
+}
+
+func runApplyPatches(jirix *jiri.X, args []string) error {
+	if len(args) != 1 {
+		return jirix.UsageErrorf("unexpected number of arguments")
+	}
+	dir, err := filepath.Abs(args[0])
+	if err != nil {
+		return err
+	}
+	if fi, err := os.Stat(dir); err != nil {
+		return err
+	} else if !fi.IsDir() {
+		return fmt.Errorf("%q is not a directory", dir)
+	}
+	localProjects, err := project.LocalProjects(jirix, project.FastScan)
+	if err != nil {
+		return err
+	}
+
+	patches := make(map[project.ProjectKey][]string)
+	matched := make(map[string]bool)
+	for key, p := range localProjects {
+		files, err := projectPatches(dir, p.Name)
+		if err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			continue
+		}
+		for _, file := range files {
+			if matched[file] {
+				return fmt.Errorf("patch %q matches several projects named %q", file, p.Name)
+			}
+			matched[file] = true
+		}
+		patches[key] = files
+	}
+	if err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && strings.HasSuffix(path, ".patch") && !matched[path] {
+			jirix.Logger.Errorf("Cannot find project to apply patch %q\n", path)
+			jirix.IncrementFailures()
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	var keys project.ProjectKeys
+	for key := range patches {
+		keys = append(keys, key)
+	}
+	sort.Sort(keys)
+	for _, key := range keys {
+		p := localProjects[key]
+		if err := applyProjectPatches(jirix, p, patches[key]); err != nil {
+			jirix.Logger.Errorf("Cannot apply patches to project %s(%s): %v\n", p.Name, p.Path, err)
+			jirix.IncrementFailures()
+		}
+	}
+	if jirix.Failures() != 0 {
+		return fmt.Errorf("Applying patches failed")
+	}
+	return nil
+}
+
+// projectPatches returns the patches of the project with the given name in the
+// given directory, in the order to apply them.
+func projectPatches(dir, name string) ([]string, error) {
+	file := filepath.Join(dir, name+".patch")
+	if fi, err := os.Stat(file); err == nil && !fi.IsDir() {
+		return []string{file}, nil
+	} else if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(dir, name, "*.patch"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// applyProjectPatches commits the given patches to the project if they are
+// all in the mailbox format, and applies them to its working tree otherwise.
+func applyProjectPatches(jirix *jiri.X, p project.Project, files []string) error {
+	if !applyPatchesFlags.force {
+		if dirty, err := git.NewGit(context.Background(), p.Path).HasUncommittedChanges(); err != nil {
+			return err
+		} else if dirty {
+			return fmt.Errorf("project has uncommitted changes, use -force to apply the patches anyway")
+		}
+	}
+	mailbox := true
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if !bytes.HasPrefix(data, []byte("From ")) {
+			mailbox = false
+		}
+	}
+	jirix.Logger.Infof("Applying %d patch(es) to project %s(%s)\n", len(files), p.Name, p.Path)
+	scm := gitutil.New(context.Background(), jirix, gitutil.RootDirOpt(p.Path))
+	if !mailbox {
+		return scm.Apply(files...)
+	}
+	if err := scm.Am(files...); err != nil {
+		if err2 := scm.AmAbort(); err2 != nil {
+			return fmt.Errorf("%v\nCannot abort git am: %v", err, err2)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+// Copyright 2017 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestApplyPatches(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { applyPatchesFlags.force = false }()
+
+	// Create a patch for projects 0 and 2 from a new commit of their remotes.
+	dir, err := ioutil.TempDir("", "jiri-patches")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, p := range []int{0, 2} {
+		name := localProjects[p].Name
+		writeReadme(t, fake.X, fake.Projects[name], "patched readme")
+		patch, err := exec.Command("git", "-C", fake.Projects[name], "format-patch", "-1", "--stdout").Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name+".patch"), patch, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Project 2 has uncommitted changes.
+	if err := ioutil.WriteFile(filepath.Join(localProjects[2].Path, "README"), []byte("uncommitted"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := runfunc(func() {
+		if err := runApplyPatches(fake.X, []string{dir}); err == nil {
+			t.Errorf("patching a dirty project should have failed")
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	checkReadme(t, fake.X, localProjects[0].Path, "patched readme")
+	checkReadme(t, fake.X, localProjects[1].Path, "initial readme")
+	checkReadme(t, fake.X, localProjects[2].Path, "uncommitted")
+}
@@ -5,6 +5,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -158,7 +159,7 @@ func deleteBranches(jirix *jiri.X, branchToDelete string) error {
 					return err
 				}
 				fmt.Printf("Project %s(%s): ", localProject.Name, relativePath)
-				git := gitutil.New(jirix, gitutil.RootDirOpt(localProject.Path))
+				git := gitutil.New(context.Background(), jirix, gitutil.RootDirOpt(localProject.Path))
 
 				if err := git.DeleteBranch(branchToDelete, gitutil.ForceOpt(branchFlags.forceDeleteFlag)); err != nil {
 					errors = true
@@ -5,6 +5,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -66,7 +67,7 @@ func TestBranch(t *testing.T) {
 
 	gitLocals := make([]*gitutil.Git, numProjects)
 	for i, localProject := range localProjects {
-		gitLocal := gitutil.New(fake.X, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"), gitutil.RootDirOpt(localProject.Path))
+		gitLocal := gitutil.New(context.Background(), fake.X, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"), gitutil.RootDirOpt(localProject.Path))
 		gitLocals[i] = gitLocal
 	}
 
@@ -164,7 +165,7 @@ func TestDeleteBranch(t *testing.T) {
 
 	gitLocals := make([]*gitutil.Git, numProjects)
 	for i, localProject := range localProjects {
-		gitLocal := gitutil.New(fake.X, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"), gitutil.RootDirOpt(localProject.Path))
+		gitLocal := gitutil.New(context.Background(), fake.X, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"), gitutil.RootDirOpt(localProject.Path))
 		gitLocals[i] = gitLocal
 	}
 
@@ -0,0 +1,113 @@
+// Copyright 2017 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+
+	"fuchsia.googlesource.com/jiri"
+	"fuchsia.googlesource.com/jiri/cmdline"
+	"fuchsia.googlesource.com/jiri/project"
+)
+
+var buildFlags struct {
+	project string
+	target  string
+}
+
+func init() {
+	cmdBuild.Flags.StringVar(&buildFlags.project, "project", "", "Regular expression matching the names or keys of the projects to build. Defaults to all the projects with a build system.")
+	cmdBuild.Flags.StringVar(&buildFlags.target, "target", "", "Target to build. Defaults to the default target of the build system, or //... for bazel.")
+}
+
+var cmdBuild = &cmdline.Command{
+	Runner: jiri.RunnerFunc(runBuild),
+	Name:   "build",
+	Short:  "Build projects with their build system",
+	Long: `
+Builds the local projects with the build system given by their buildsystem
+attribute in the manifest, in the directory of each project:
+
+  cmake: cmake --build . [--target <target>]
+  bazel: bazel build <target>
+  make:  make [<target>]
+
+Projects without a build system, or with "none", are not built.  The projects
+are built one after the other, in the order of their keys, and the build stops
+at the first failure.
+`,
+}
+
+// buildCommand returns the command building target with the given build
+// system, or nil if the build system builds nothing.
+func buildCommand(buildSystem, target string) []string {
+	switch buildSystem {
+	case project.BuildSystemCMake:
+		if target != "" {
+			return []string{"cmake", "--build", ".", "--target", target}
+		}
+		return []string{"cmake", "--build", "."}
+	case project.BuildSystemBazel:
+		if target == "" {
+			target = "//..."
+		}
+		return []string{"bazel", "build", target}
+	case project.BuildSystemMake:
+		if target != "" {
+			return []string{"make", target}
+		}
+		return []string{"make"}
+	}
+	return nil
+}
+
+func runBuild(jirix *jiri.X, args []string) error {
+	if len(args) != 0 {
+		return jirix.UsageErrorf("unexpected number of arguments")
+	}
+	var projectRE *regexp.Regexp
+	if buildFlags.project != "" {
+		var err error
+		if projectRE, err = regexp.Compile(buildFlags.project); err != nil {
+			return jirix.UsageErrorf("invalid -project %q: %v", buildFlags.project, err)
+		}
+	}
+	projects, err := project.LocalProjects(jirix, project.FastScan)
+	if err != nil {
+		return err
+	}
+	var keys project.ProjectKeys
+	for key, p := range projects {
+		if buildCommand(p.BuildSystem, buildFlags.target) == nil {
+			continue
+		}
+		if projectRE != nil && !projectRE.MatchString(p.Name) && !projectRE.MatchString(string(key)) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no project with a build system to build")
+	}
+	sort.Sort(keys)
+	for _, key := range keys {
+		p := projects[key]
+		args := buildCommand(p.BuildSystem, buildFlags.target)
+		jirix.Logger.Infof("Building project %s(%s): %s", p.Name, p.Path, strings.Join(args, " "))
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Dir = p.Path
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("build of project %s(%s) failed: %v", p.Name, p.Path, err)
+		}
+	}
+	return nil
+}
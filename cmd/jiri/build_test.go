@@ -0,0 +1,96 @@
+// Copyright 2017 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"fuchsia.googlesource.com/jiri/jiritest"
+	"fuchsia.googlesource.com/jiri/project"
+)
+
+func TestBuild(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+	defer func() {
+		buildFlags.project = ""
+		buildFlags.target = ""
+	}()
+
+	// Fake build systems log their name, arguments and directory.
+	binDir := filepath.Join(fake.X.Root, "bin")
+	if err := os.MkdirAll(binDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	logFile := filepath.Join(fake.X.Root, "build.log")
+	script := "#!/bin/sh\necho \"$(basename \"$0\")\" \"$@\" in \"$(basename \"$(pwd)\")\" >> " + logFile + "\n"
+	for _, name := range []string{"cmake", "bazel", "make"} {
+		if err := ioutil.WriteFile(filepath.Join(binDir, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	for name, buildSystem := range map[string]string{
+		"c": project.BuildSystemCMake,
+		"b": project.BuildSystemBazel,
+		"m": project.BuildSystemMake,
+		"n": project.BuildSystemNone,
+		"p": "",
+	} {
+		if err := fake.CreateRemoteProject(name); err != nil {
+			t.Fatal(err)
+		}
+		if err := fake.AddProject(project.Project{Name: name, Path: name, Remote: fake.Projects[name], BuildSystem: buildSystem}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+
+	build := func(want string) {
+		if err := os.RemoveAll(logFile); err != nil {
+			t.Fatal(err)
+		}
+		if err := runBuild(fake.X, nil); err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadFile(logFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("got builds:\n%s\nwant:\n%s", got, want)
+		}
+	}
+	build(strings.Join([]string{
+		"bazel build //... in b",
+		"cmake --build . in c",
+		"make in m",
+		"",
+	}, "\n"))
+
+	buildFlags.target = "all"
+	build(strings.Join([]string{
+		"bazel build all in b",
+		"cmake --build . --target all in c",
+		"make all in m",
+		"",
+	}, "\n"))
+
+	buildFlags.project = "^m$"
+	build("make all in m\n")
+
+	buildFlags.project = "^n$"
+	if err := runBuild(fake.X, nil); err == nil {
+		t.Errorf("building only a project without a build system should have failed")
+	}
+}
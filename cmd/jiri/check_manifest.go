@@ -0,0 +1,106 @@
+// Copyright 2017 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"fuchsia.googlesource.com/jiri"
+	"fuchsia.googlesource.com/jiri/cmdline"
+	"fuchsia.googlesource.com/jiri/project"
+)
+
+var checkManifestFlags struct {
+	manifest      string
+	localManifest bool
+	checker       string
+}
+
+func init() {
+	flags := &cmdCheckManifest.Flags
+	flags.StringVar(&checkManifestFlags.manifest, "manifest", "", "Path of the manifest to check. Defaults to the .jiri_manifest file.")
+	flags.BoolVar(&checkManifestFlags.localManifest, "local-manifest", false, "Use local manifest")
+	flags.StringVar(&checkManifestFlags.checker, "checker", "", "Executable run with the path of the resolved manifest, in canonical form, as its only argument. A non-zero exit status fails the check.")
+}
+
+var cmdCheckManifest = &cmdline.Command{
+	Runner: jiri.RunnerFunc(runCheckManifest),
+	Name:   "check-manifest",
+	Short:  "Check a manifest, e.g. in a presubmit",
+	Long: `
+Resolves all the imports of a manifest, validates the resulting projects and
+hooks, and runs the optional checker on the resolved manifest, as printed by
+"jiri resolve-manifest", to enforce custom rules.  All the problems found are
+printed, and the command exits with status 1 if there are any.
+`,
+}
+
+func runCheckManifest(jirix *jiri.X, args []string) error {
+	if len(args) != 0 {
+		return jirix.UsageErrorf("unexpected number of arguments")
+	}
+	problems, err := checkManifest(jirix)
+	if err != nil {
+		return err
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	for _, problem := range problems {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n", problem)
+	}
+	return cmdline.ErrExitCode(1)
+}
+
+// checkManifest returns the problems found in the manifest to check, or an
+// error if it could not be checked.
+func checkManifest(jirix *jiri.X) ([]string, error) {
+	file := checkManifestFlags.manifest
+	if file == "" {
+		file = jirix.JiriManifestFile()
+	}
+	m, err := project.ResolveManifest(jirix, file, checkManifestFlags.localManifest)
+	if err != nil {
+		return []string{fmt.Sprintf("cannot resolve manifest %s: %v", file, err)}, nil
+	}
+	problems := []string{}
+	if err := m.Validate(); err != nil {
+		for _, e := range err.(project.MultiError) {
+			problems = append(problems, e.Error())
+		}
+	}
+	if checkManifestFlags.checker == "" {
+		return problems, nil
+	}
+	data, err := m.ToCanonicalBytes(jirix)
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempFile("", "jiri-check-manifest")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	output, err := exec.Command(checkManifestFlags.checker, tmp.Name()).CombinedOutput()
+	if err != nil {
+		problem := fmt.Sprintf("checker %s failed: %v", checkManifestFlags.checker, err)
+		if out := strings.TrimSpace(string(output)); out != "" {
+			problem += "\n" + out
+		}
+		problems = append(problems, problem)
+	}
+	return problems, nil
+}
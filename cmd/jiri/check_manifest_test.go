@@ -0,0 +1,108 @@
+// Copyright 2017 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"fuchsia.googlesource.com/jiri/cmdline"
+	"fuchsia.googlesource.com/jiri/jiritest"
+)
+
+func TestCheckManifest(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+	defer func() {
+		checkManifestFlags.manifest = ""
+		checkManifestFlags.checker = ""
+	}()
+	run := func() (string, error) {
+		var runErr error
+		_, stderr, err := runfunc(func() {
+			runErr = runCheckManifest(fake.X, nil)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stderr, runErr
+	}
+	writeManifest := func(name, data string) string {
+		file := filepath.Join(fake.X.Root, name)
+		if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	writeChecker := func(name, script string) string {
+		file := filepath.Join(fake.X.Root, name)
+		if err := ioutil.WriteFile(file, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+
+	checkManifestFlags.manifest = writeManifest("valid", `<manifest>
+  <projects>
+    <project name="a" path="a" remote="https://example.com/a"/>
+  </projects>
+  <hooks>
+    <hook name="setup" project="a" action="setup.sh"/>
+  </hooks>
+</manifest>
+`)
+	if stderr, err := run(); err != nil {
+		t.Fatalf("valid manifest rejected: %v\n%s", err, stderr)
+	}
+
+	// The checker gets the resolved manifest.
+	checkManifestFlags.checker = writeChecker("checker", `grep -q 'name="a"' "$1" || exit 1
+echo "no project may be named a"
+exit 1
+`)
+	stderr, err := run()
+	if err != cmdline.ErrExitCode(1) {
+		t.Errorf("got error %v, want %v", err, cmdline.ErrExitCode(1))
+	}
+	if !strings.Contains(stderr, "no project may be named a") {
+		t.Errorf("checker output missing from %q", stderr)
+	}
+
+	// All the problems are reported, validation and checker alike.
+	checkManifestFlags.manifest = writeManifest("invalid", `<manifest>
+  <projects>
+    <project name="a" path="a"/>
+    <project name="b" path="b" remote="https://example.com/b"/>
+  </projects>
+  <hooks>
+    <hook name="setup" project="b" action=""/>
+  </hooks>
+</manifest>
+`)
+	stderr, err = run()
+	if err != cmdline.ErrExitCode(1) {
+		t.Errorf("got error %v, want %v", err, cmdline.ErrExitCode(1))
+	}
+	for _, want := range []string{
+		`ERROR: project "a" has no remote`,
+		`ERROR: hook "setup" of project "b" has no action`,
+		"no project may be named a",
+	} {
+		if !strings.Contains(stderr, want) {
+			t.Errorf("%q missing from %q", want, stderr)
+		}
+	}
+
+	checkManifestFlags.manifest = writeManifest("unparsable", "<manifest>")
+	stderr, err = run()
+	if err != cmdline.ErrExitCode(1) {
+		t.Errorf("got error %v, want %v", err, cmdline.ErrExitCode(1))
+	}
+	if !strings.Contains(stderr, "ERROR: cannot resolve manifest") {
+		t.Errorf("resolution error missing from %q", stderr)
+	}
+}
@@ -54,19 +54,40 @@ Command jiri is a multi-purpose tool for multi-repo development.
 `,
 		LookPath: true,
 		Children: []*cmdline.Command{
+			cmdApplyPatches,
 			cmdBranch,
+			cmdBuild,
+			cmdCheckManifest,
+			cmdConvertRepoManifest,
 			cmdGrep,
 			cmdImport,
 			cmdInit,
+			cmdManifestGraph,
 			cmdPatch,
 			cmdProject,
+			cmdProjectCheckClean,
+			cmdProjectCheckUpdates,
 			cmdProjectConfig,
+			cmdProjectEdit,
+			cmdProjectForeach,
+			cmdProjectImportLocal,
+			cmdProjectImportSnapshot,
+			cmdProjectInit,
+			cmdProjectManifestPath,
+			cmdProjectOwner,
+			cmdProjectRemoteBranches,
+			cmdProjectSetNoPush,
+			cmdRealize,
+			cmdResolveManifest,
 			cmdRunP,
 			cmdSelfUpdate,
 			cmdSnapshot,
+			cmdSnapshotDrift,
 			cmdStatus,
+			cmdTargets,
 			cmdUpdate,
 			cmdUpload,
+			cmdVerifyLockfile,
 			cmdVersion,
 		},
 		Topics: []cmdline.Topic{
@@ -165,7 +186,7 @@ Manifests have the following XML schema:
           action="update.sh"/>
     ...
   </hooks>
-
+  <jiri-config jobs="10" update-history-retention="20"/>
 </manifest>
 
 The <import> and <localimport> tags can be used to share common projects across
@@ -191,6 +212,10 @@ the manifest remote, then the "name" attribute of on the <import> tag should
 match the "name" attribute on the <project>.  Otherwise, jiri will clone the
 manifest repository on every update.
 
+* fetchprotocol (optional) - The protocol used to fetch the manifest
+repository, one of "ssh", "https" or "git".  The scheme of the "remote"
+attribute is rewritten accordingly, for this import only.
+
 The <project> tags describe the projects to sync, and what state they should
 sync to, accoring to the following attributes:
 
@@ -208,16 +233,72 @@ Currently "git" is the default and only supported protocol.
 Defaults to "master".  The "remotebranch" attribute is ignored if "revision"
 is specified.
 
+* remote-name (optional) - The name of the git remote of the project.
+Defaults to "origin".
+
 * revision (optional) - The specific revision (usually a git SHA) that the
 project will sync to.  If "revision" is  specified then the "remotebranch"
-attribute is ignored.
+attribute is ignored.  A tag can be specified as "refs/tags/<tag>", in which
+case only that tag is fetched.
+
+* fetchdepth (optional) - The number of commits to fetch when cloning and
+updating the project.  Defaults to 0, which fetches the full history.
+"historydepth" is accepted as a deprecated alias.
+
+* clone-filter (optional) - A git filter spec, e.g. "blob:none", "tree:0" or
+"blob:limit=1m", passed as --filter to git clone and git fetch to create a
+partial clone of the project.  It cannot be combined with "fetchdepth".
+
+* shallow-since (optional) - A date, e.g. "2017-01-31", "2017-01-31 15:04:05"
+or "2017-01-31T15:04:05Z", passed as --shallow-since to git clone and git
+fetch to only fetch the history after it.  It cannot be combined with
+"fetchdepth".
+
+* single-branch (optional) - If "true", only the remote branch of the project
+is cloned and fetched, instead of all the branches of its remote.  All the
+branches are fetched when the pinned revision isn't on the remote branch.
+
+* mirror-of (optional) - The name of the project this project mirrors, for
+projects only kept as the source of objects of other repositories.  Mirror
+projects are checked out, but their hooks aren't run and they are left out of
+the file written by "jiri update -env-file".
+
+* lazy (optional) - If "true", "jiri update" only registers the project, i.e.
+writes its metadata without checking it out, until "jiri realize" is run with
+its path.
+
+* ignore-nested (optional) - If "true", "jiri update" excludes the projects
+nested in the project through its .git/info/exclude file.  Otherwise the
+.gitignore of the project should list them, or "jiri update -strict-nesting"
+fails.
+
+* buildsystem (optional) - The build system "jiri build" runs in the project:
+"cmake", "bazel", "make" or "none".  Projects without one aren't built.
+
+* fetch-via (optional) - A command git runs instead of ssh to reach the remote of
+the project when it is cloned or fetched, through GIT_SSH_COMMAND, e.g. a
+transport helper of a locked-down network.  "jiri update" fails if it can't be
+found.
 
 * gerrithost (optional) - The url of the Gerrit host for the project.  If
 specified, then running "jiri cl upload" will upload a CL to this Gerrit host.
 
 * githooks (optional) - The path (relative to [root]) of a directory containing
 git hooks that will be installed in the projects .git/hooks directory during
-each update.
+each update.  The directory must exist and all the hooks in it must be
+executable, otherwise the update fails.
+
+* exclude (optional) - If "true", the project with the same name included by a
+previously loaded manifest or import is removed, and will not be checked out.
+Only the "name" attribute is needed along with it.
+
+* post-clone-hook (optional) - The path, relative to the project, of an
+executable run once in the project right after it is first cloned, e.g. to
+install its dependencies.  It does not run on later updates.
+
+* lfs (optional) - If "true", the project uses git-lfs: it is set up after the
+project is cloned, and its git-lfs objects are pulled after every update,
+unless the -lfs-skip flag is provided.
 
 The <hook> tag describes the hooks that must be executed after every 'jiri update'
 They are configured via the following attributes:
@@ -228,5 +309,51 @@ They are configured via the following attributes:
 
 * action (required) - Action to be performed inside the project.
 It is mostly identified by a script
+
+* after (optional) - Comma-separated list of the projects whose hooks must run
+before this hook.  By default, the hooks of a project run after those of the
+projects it is nested in, and other hooks run in parallel.
+
+* phase (optional) - "on-failure" for hooks which don't run after updates, but
+when the update of their project fails, e.g. to release external resources.
+They are given the path of the project and the error in the
+JIRI_FAILED_PROJECT_PATH and JIRI_UPDATE_ERROR environment variables, and
+their own failures are only reported.
+
+The optional <jiri-config> tag provides default jiri settings, e.g. for all the
+developers of a team.  The -j flag and the config of the jiri root take
+precedence over them, as do the settings of importing manifests over those of
+the manifests they import.  It has the following attributes:
+
+* jobs (optional) - The number of jobs run simultaneously, as set by the -j
+flag.
+
+* update-history-retention (optional) - The number of snapshots kept in the
+update history directory.  Older ones are deleted after each update.
+
+Manifests may also be written in TOML, where every tag is an element of the
+array of tables named after its enclosing tag, or the table named after the tag
+for <jiri-config>, and has the same attributes as keys:
+
+[[imports]]
+manifest = "public"
+name = "manifest"
+remote = "https://vanadium.googlesource.com/manifest"
+
+[[localimports]]
+file = "/path/to/local/manifest"
+
+[[projects]]
+name = "mojo"
+path = "mojo"
+remote = "https://github.com/domokit/mojo.git"
+
+[[hooks]]
+name = "mojo-install"
+project = "mojo/public"
+action = "update.sh"
+
+[jiri-config]
+jobs = 10
 `,
 }
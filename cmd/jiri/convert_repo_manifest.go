@@ -0,0 +1,60 @@
+// Copyright 2017 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"fuchsia.googlesource.com/jiri"
+	"fuchsia.googlesource.com/jiri/cmdline"
+	"fuchsia.googlesource.com/jiri/project"
+)
+
+var convertRepoManifestOutputFlag string
+
+func init() {
+	cmdConvertRepoManifest.Flags.StringVar(&convertRepoManifestOutputFlag, "output", "", "Path of the jiri manifest to write. Defaults to stdout.")
+}
+
+var cmdConvertRepoManifest = &cmdline.Command{
+	Runner: jiri.RunnerFunc(runConvertRepoManifest),
+	Name:   "convert-repo-manifest",
+	Short:  "Convert a repo manifest to a jiri manifest",
+	Long: `
+Converts a manifest of Android's repo tool to an equivalent jiri manifest.
+Remotes and defaults are resolved for every project. Repo features which have
+no jiri equivalent, such as copyfile, linkfile or groups, are dropped with a
+warning.
+`,
+	ArgsName: "<repo manifest>",
+	ArgsLong: "<repo manifest> is the path of the repo manifest to convert.",
+}
+
+func runConvertRepoManifest(jirix *jiri.X, args []string) error {
+	if len(args) != 1 {
+		return jirix.UsageErrorf("wrong number of arguments")
+	}
+	data, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	m, warnings, err := project.ManifestFromRepoManifest(data)
+	if err != nil {
+		return err
+	}
+	for _, warning := range warnings {
+		jirix.Logger.Warningf("%s\n", warning)
+	}
+	out, err := m.ToBytes()
+	if err != nil {
+		return err
+	}
+	if convertRepoManifestOutputFlag == "" {
+		fmt.Print(string(out))
+		return nil
+	}
+	return ioutil.WriteFile(convertRepoManifestOutputFlag, out, 0644)
+}
@@ -5,6 +5,7 @@
 package main
 
 import (
+	"context"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -95,7 +96,7 @@ func TestGrep(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
-		git := gitutil.New(fake.X, gitutil.RootDirOpt(project.Path))
+		git := gitutil.New(context.Background(), fake.X, gitutil.RootDirOpt(project.Path))
 		git.Add(path)
 	}
 
@@ -126,8 +126,8 @@ func TestImport(t *testing.T) {
 `,
 			Want: `<manifest>
   <imports>
-    <import manifest="bar" name="manifest" remote="https://github.com/orig.git"/>
     <import manifest="foo" name="manifest" remote="https://github.com/new.git"/>
+    <import manifest="bar" name="manifest" remote="https://github.com/orig.git"/>
   </imports>
 </manifest>
 `,
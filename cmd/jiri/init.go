@@ -6,11 +6,14 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"fuchsia.googlesource.com/jiri"
 	"fuchsia.googlesource.com/jiri/cmdline"
+	"fuchsia.googlesource.com/jiri/project"
 )
 
 var cmdInit = &cmdline.Command{
@@ -21,7 +24,12 @@ var cmdInit = &cmdline.Command{
 The "init" command creates new jiri "root" - basically a [root]/.jiri_root
 directory and template files.
 
-Running "init" in existing jiri [root] is safe.
+With the -import flag, it also writes a [root]/.jiri_manifest importing the
+given manifest, and checks that the manifest can be resolved, so that the root
+is ready for "jiri update".
+
+Running "init" in existing jiri [root] is safe, but an existing .jiri_manifest
+is only overwritten by -import if -force is also provided.
 `,
 	ArgsName: "[directory]",
 	ArgsLong: `
@@ -31,13 +39,34 @@ does not exists, it will be created.
 }
 
 var (
-	cacheFlag  string
-	sharedFlag bool
+	cacheFlag                  string
+	sharedFlag                 bool
+	forbidDetachedHeadFlag     bool
+	updateHistoryRetentionFlag int
+	metadataIgnoreFileFlag     string
+	initImportFlag             string
+	initForceFlag              bool
 )
 
 func init() {
 	cmdInit.Flags.StringVar(&cacheFlag, "cache", "", "Jiri cache directory")
 	cmdInit.Flags.BoolVar(&sharedFlag, "shared", false, "Use shared cache, which doesn't commit or push")
+	cmdInit.Flags.BoolVar(&forbidDetachedHeadFlag, "forbid-detached-head", false, "Always leave projects on a local branch tracking their remote branch after update")
+	cmdInit.Flags.IntVar(&updateHistoryRetentionFlag, "update-history-retention", 0, "Number of update history snapshots to keep, older ones are deleted after each update. Zero keeps all of them.")
+	cmdInit.Flags.StringVar(&metadataIgnoreFileFlag, "metadata-ignore-file", "", "Name of a file in the root, e.g. .ignore or .gitignore, which update keeps listing the jiri metadata directories, for tools which don't read .git/info/exclude.")
+	cmdInit.Flags.StringVar(&initImportFlag, "import", "", "Write a .jiri_manifest importing a manifest, given as <remote>@<manifest>, where <manifest> is the path of the manifest file in the <remote> repository.")
+	cmdInit.Flags.BoolVar(&initForceFlag, "force", false, "Overwrite an existing .jiri_manifest with -import.")
+}
+
+// parseInitImport parses the value of the -import flag.  The remote may
+// contain "@" itself, e.g. "git@host:repo", so the last one separates it from
+// the manifest.
+func parseInitImport(value string) (remote, manifest string, err error) {
+	i := strings.LastIndex(value, "@")
+	if i <= 0 || i == len(value)-1 {
+		return "", "", fmt.Errorf("invalid -import %q, want <remote>@<manifest>", value)
+	}
+	return value[:i], value[i+1:], nil
 }
 
 func runInit(env *cmdline.Env, args []string) error {
@@ -45,6 +74,20 @@ func runInit(env *cmdline.Env, args []string) error {
 		return fmt.Errorf("wrong number of arguments")
 	}
 
+	if updateHistoryRetentionFlag < 0 {
+		return fmt.Errorf("-update-history-retention must not be negative")
+	}
+	if name := metadataIgnoreFileFlag; name != "" && (name != filepath.Base(name) || name == "." || name == "..") {
+		return fmt.Errorf("-metadata-ignore-file must be a file name, got %q", name)
+	}
+	var importRemote, importManifest string
+	if initImportFlag != "" {
+		var err error
+		if importRemote, importManifest, err = parseInitImport(initImportFlag); err != nil {
+			return err
+		}
+	}
+
 	var dir string
 	var err error
 	if len(args) == 1 {
@@ -67,12 +110,18 @@ func runInit(env *cmdline.Env, args []string) error {
 		}
 	}
 
-	d := filepath.Join(dir, jiri.RootMetaDir)
-	if _, err := os.Stat(d); err != nil {
-		if !os.IsNotExist(err) {
+	manifestFile := filepath.Join(dir, jiri.JiriManifestFile)
+	if initImportFlag != "" && !initForceFlag {
+		if _, err := os.Stat(manifestFile); err == nil {
+			return fmt.Errorf("%q already exists, use -force to overwrite it", manifestFile)
+		} else if !os.IsNotExist(err) {
 			return err
 		}
-		if err := os.Mkdir(d, 0755); err != nil {
+	}
+
+	d := filepath.Join(dir, jiri.RootMetaDir)
+	for _, subdir := range []string{d, filepath.Join(d, "bin"), filepath.Join(d, "update_history")} {
+		if err := os.MkdirAll(subdir, 0755); err != nil {
 			return err
 		}
 	}
@@ -90,7 +139,10 @@ func runInit(env *cmdline.Env, args []string) error {
 	}
 
 	config := jiri.Config{
-		CachePath: cacheFlag,
+		CachePath:              cacheFlag,
+		ForbidDetachedHead:     forbidDetachedHeadFlag,
+		UpdateHistoryRetention: updateHistoryRetentionFlag,
+		MetadataIgnoreFile:     metadataIgnoreFileFlag,
 	}
 	if cacheFlag != "" {
 		config.Shared = sharedFlag
@@ -100,7 +152,42 @@ func runInit(env *cmdline.Env, args []string) error {
 		return err
 	}
 
-	// TODO(phosek): also create an empty manifest
+	if initImportFlag == "" {
+		return nil
+	}
+	return writeInitManifest(env, dir, importRemote, importManifest)
+}
 
+// writeInitManifest writes the .jiri_manifest of the jiri root at dir, which
+// imports the given manifest, and checks that it can be resolved.  The
+// previous .jiri_manifest, if any, is restored if it cannot.
+func writeInitManifest(env *cmdline.Env, dir, remote, manifest string) error {
+	jirix, err := jiri.NewXAtRoot(env, dir)
+	if err != nil {
+		return err
+	}
+	manifestFile := jirix.JiriManifestFile()
+	old, err := ioutil.ReadFile(manifestFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	m := &project.Manifest{
+		Imports: []project.Import{{
+			Manifest: manifest,
+			Name:     "manifest",
+			Remote:   remote,
+		}},
+	}
+	if err := m.ToFile(jirix, manifestFile); err != nil {
+		return err
+	}
+	if _, err := project.ResolveManifest(jirix, manifestFile, false); err != nil {
+		if old != nil {
+			ioutil.WriteFile(manifestFile, old, 0644)
+		} else {
+			os.Remove(manifestFile)
+		}
+		return fmt.Errorf("cannot resolve manifest %q from %q: %v", manifest, remote, err)
+	}
 	return nil
 }
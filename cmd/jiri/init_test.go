@@ -0,0 +1,115 @@
+// Copyright 2017 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"fuchsia.googlesource.com/jiri"
+	"fuchsia.googlesource.com/jiri/cmdline"
+	"fuchsia.googlesource.com/jiri/jiritest"
+	"fuchsia.googlesource.com/jiri/project"
+)
+
+func TestParseInitImport(t *testing.T) {
+	tests := []struct {
+		value, remote, manifest string
+	}{
+		{"https://example.com/manifest@public", "https://example.com/manifest", "public"},
+		{"git@example.com:manifest@path/to/default", "git@example.com:manifest", "path/to/default"},
+		{"https://example.com/manifest", "", ""},
+		{"@public", "", ""},
+		{"https://example.com/manifest@", "", ""},
+	}
+	for _, test := range tests {
+		remote, manifest, err := parseInitImport(test.value)
+		if test.remote == "" {
+			if err == nil {
+				t.Errorf("parseInitImport(%q) should have failed", test.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseInitImport(%q) failed: %v", test.value, err)
+		} else if remote != test.remote || manifest != test.manifest {
+			t.Errorf("parseInitImport(%q): got %q, %q, want %q, %q", test.value, remote, manifest, test.remote, test.manifest)
+		}
+	}
+}
+
+func TestInitWithImport(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+	if err := fake.CreateRemoteProject("project"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.AddProject(project.Project{
+		Name:   "project",
+		Path:   "project",
+		Remote: fake.Projects["project"],
+	}); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fake.X, fake.Projects["project"], "README", "readme")
+
+	dir, err := ioutil.TempDir("", "jiri-init")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "root")
+	env := cmdline.EnvFromOS()
+	defer func() {
+		initImportFlag = ""
+		initForceFlag = false
+	}()
+
+	// A manifest which cannot be resolved is not written.
+	initImportFlag = fake.Projects["manifest"] + "@missing"
+	if err := runInit(env, []string{root}); err == nil {
+		t.Error("init should have failed with a missing manifest")
+	}
+	if _, err := os.Stat(filepath.Join(root, jiri.JiriManifestFile)); !os.IsNotExist(err) {
+		t.Errorf("%s should not exist after a failed init: %v", jiri.JiriManifestFile, err)
+	}
+
+	initImportFlag = fake.Projects["manifest"] + "@public"
+	if err := runInit(env, []string{root}); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{jiri.RootMetaDir, filepath.Join(jiri.RootMetaDir, "bin"), filepath.Join(jiri.RootMetaDir, "update_history")} {
+		if info, err := os.Stat(filepath.Join(root, path)); err != nil {
+			t.Error(err)
+		} else if !info.IsDir() {
+			t.Errorf("%q is not a directory", path)
+		}
+	}
+
+	// The existing .jiri_manifest is kept unless -force is provided.
+	if err := runInit(env, []string{root}); err == nil {
+		t.Error("init should have failed with an existing .jiri_manifest")
+	}
+	initForceFlag = true
+	if err := runInit(env, []string{root}); err != nil {
+		t.Fatal(err)
+	}
+
+	jirix, err := jiri.NewXAtRoot(env, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := project.UpdateUniverse(context.Background(), jirix, project.UpdateUniverseOpts{RunHookTimeout: project.DefaultHookTimeout}); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(root, "project", "README")); err != nil {
+		t.Fatal(err)
+	} else if string(data) != "readme" {
+		t.Errorf("got README %q, want %q", data, "readme")
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2017 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"fuchsia.googlesource.com/jiri"
+	"fuchsia.googlesource.com/jiri/cmdline"
+	"fuchsia.googlesource.com/jiri/project"
+)
+
+var manifestGraphFlags struct {
+	format string
+}
+
+func init() {
+	cmdManifestGraph.Flags.StringVar(&manifestGraphFlags.format, "format", "dot", "Output format, dot or json.")
+}
+
+var cmdManifestGraph = &cmdline.Command{
+	Runner: jiri.RunnerFunc(runManifestGraph),
+	Name:   "manifest-graph",
+	Short:  "Print the graph of the manifest imports and projects",
+	Long: `
+Resolves the imports of the manifest and prints its graph: the manifest files,
+starting with .jiri_manifest, with edges to the manifest files they import and
+to the projects they declare.  The graph is printed in the DOT language of
+Graphviz by default, e.g. to render it with "dot -Tsvg", or in JSON.
+`,
+}
+
+// manifestGraphOutput defines JSON format for 'manifest-graph' output.
+type manifestGraphOutput struct {
+	File     string   `json:"file"`
+	Imports  []string `json:"imports,omitempty"`
+	Projects []string `json:"projects,omitempty"`
+}
+
+func runManifestGraph(jirix *jiri.X, args []string) error {
+	if len(args) != 0 {
+		return jirix.UsageErrorf("unexpected number of arguments")
+	}
+	if manifestGraphFlags.format != "dot" && manifestGraphFlags.format != "json" {
+		return jirix.UsageErrorf("invalid -format %q, want dot or json", manifestGraphFlags.format)
+	}
+	g, err := project.LoadManifestGraph(jirix)
+	if err != nil {
+		return err
+	}
+	output := []manifestGraphOutput{}
+	for _, file := range g.Files {
+		var names []string
+		for _, p := range g.Projects[file] {
+			names = append(names, p.Name)
+		}
+		sort.Strings(names)
+		output = append(output, manifestGraphOutput{file, g.Imports[file], names})
+	}
+
+	if manifestGraphFlags.format == "json" {
+		out, err := json.MarshalIndent(output, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to serialize JSON output: %s", err)
+		}
+		fmt.Println(string(out))
+		return nil
+	}
+	// Manifest files and projects are distinct nodes even if named alike.
+	fileNode := func(file string) string { return strconv.Quote("manifest:" + file) }
+	projectNode := func(name string) string { return strconv.Quote("project:" + name) }
+	fmt.Println("digraph manifest {")
+	for _, m := range output {
+		fmt.Printf("  %s [label=%s, shape=box];\n", fileNode(m.File), strconv.Quote(m.File))
+		for _, name := range m.Projects {
+			fmt.Printf("  %s [label=%s];\n", projectNode(name), strconv.Quote(name))
+		}
+	}
+	for _, m := range output {
+		for _, imported := range m.Imports {
+			fmt.Printf("  %s -> %s;\n", fileNode(m.File), fileNode(imported))
+		}
+		for _, name := range m.Projects {
+			fmt.Printf("  %s -> %s;\n", fileNode(m.File), projectNode(name))
+		}
+	}
+	fmt.Println("}")
+	return nil
+}
@@ -0,0 +1,97 @@
+// Copyright 2017 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"fuchsia.googlesource.com/jiri/gitutil"
+	"fuchsia.googlesource.com/jiri/jiritest"
+	"fuchsia.googlesource.com/jiri/project"
+)
+
+func TestManifestGraph(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+	defer func() { manifestGraphFlags.format = "dot" }()
+
+	for _, name := range []string{"top", "deep"} {
+		if err := fake.CreateRemoteProject(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fake.AddProject(project.Project{Name: "top", Path: "top", Remote: fake.Projects["top"]}); err != nil {
+		t.Fatal(err)
+	}
+	// The manifest imports core, declaring the deep project.
+	manifestDir := fake.Projects["manifest"]
+	core := &project.Manifest{
+		Projects: []project.Project{{Name: "deep", Path: "deep", Remote: fake.Projects["deep"]}},
+	}
+	if err := core.ToFile(fake.X, filepath.Join(manifestDir, "core")); err != nil {
+		t.Fatal(err)
+	}
+	scm := gitutil.New(context.Background(), fake.X, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"), gitutil.RootDirOpt(manifestDir))
+	if err := scm.Add("core"); err != nil {
+		t.Fatal(err)
+	}
+	if err := scm.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	m, err := fake.ReadRemoteManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.LocalImports = append(m.LocalImports, project.LocalImport{File: "core"})
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+
+	run := func() string {
+		var runErr error
+		stdout, _, err := runfunc(func() {
+			runErr = runManifestGraph(fake.X, nil)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if runErr != nil {
+			t.Fatal(runErr)
+		}
+		return stdout
+	}
+
+	dot := run()
+	for _, want := range []string{
+		`"manifest:.jiri_manifest" -> "manifest:manifest/public";`,
+		`"manifest:manifest/public" -> "manifest:manifest/core";`,
+		`"manifest:manifest/public" -> "project:top";`,
+		`"manifest:manifest/core" -> "project:deep";`,
+		`"project:deep" [label="deep"];`,
+	} {
+		if !strings.Contains(dot, want) {
+			t.Errorf("DOT output lacks %s:\n%s", want, dot)
+		}
+	}
+	if !strings.HasPrefix(dot, "digraph manifest {\n") || !strings.HasSuffix(dot, "}\n") {
+		t.Errorf("invalid DOT output:\n%s", dot)
+	}
+
+	manifestGraphFlags.format = "json"
+	var got []manifestGraphOutput
+	if err := json.Unmarshal([]byte(run()), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 || got[0].File != ".jiri_manifest" || got[2].File != "manifest/core" || len(got[2].Projects) != 1 || got[2].Projects[0] != "deep" {
+		t.Errorf("unexpected JSON output %+v", got)
+	}
+}
@@ -5,6 +5,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/url"
 	"os"
@@ -45,7 +46,9 @@ var cmdPatch = &cmdline.Command{
 	Long: `
 Command "patch" applies the existing changelist to the current project. The
 change can be identified either using change ID, in which case the latest
-patchset will be used, or the the full reference.
+patchset will be used, as "<change>/<patchset>", or the the full reference.
+The change is fetched from the Gerrit host of the project containing the
+current directory.
 
 A new branch will be created to apply the patch to. The default name of this
 branch is "change/<changeset>/<patchset>", but this can be overriden using the
@@ -60,7 +63,7 @@ would be same as topic. Currently patch does not support the scenario when
 change "B" is created on top of "A" and both have same topic.
 `,
 	ArgsName: "<change or topic>",
-	ArgsLong: "<change or topic> is a change ID, full reference or topic when -topic is true.",
+	ArgsLong: "<change or topic> is a change ID, <change>/<patchset>, full reference or topic when -topic is true.",
 }
 
 // patchProject checks out the given change.
@@ -73,11 +76,11 @@ func patchProject(jirix *jiri.X, project project.Project, ref, branch, remote st
 		branch = fmt.Sprintf("change/%v/%v", cl, ps)
 	}
 	jirix.Logger.Infof("Patching project %s(%s) on branch %q\n", project.Name, project.Path, branch)
-	scm := gitutil.New(jirix, gitutil.RootDirOpt(project.Path))
-	g := git.NewGit(project.Path)
+	scm := gitutil.New(context.Background(), jirix, gitutil.RootDirOpt(project.Path))
+	g := git.NewGit(context.Background(), project.Path)
 	if scm.BranchExists(branch) {
 		if patchDeleteFlag {
-			if err := scm.CheckoutBranch("origin/master"); err != nil {
+			if err := scm.CheckoutBranch(project.GitRemoteName() + "/master"); err != nil {
 				return false, err
 			}
 			if err := scm.DeleteBranch(branch, gitutil.ForceOpt(patchForceFlag)); err != nil {
@@ -91,7 +94,7 @@ func patchProject(jirix *jiri.X, project project.Project, ref, branch, remote st
 			return false, nil
 		}
 	}
-	if err := scm.FetchRefspec("origin", ref); err != nil {
+	if err := scm.FetchRefspec(project.GitRemoteName(), ref); err != nil {
 		return false, err
 	}
 
@@ -99,7 +102,7 @@ func patchProject(jirix *jiri.X, project project.Project, ref, branch, remote st
 		return false, err
 	}
 
-	if err := g.SetUpstream(branch, "origin/"+remote); err != nil {
+	if err := g.SetUpstream(branch, project.GitRemoteName()+"/"+remote); err != nil {
 		return false, err
 	}
 
@@ -113,13 +116,13 @@ func patchProject(jirix *jiri.X, project project.Project, ref, branch, remote st
 // rebaseProject rebases the current branch on top of a given branch.
 func rebaseProject(jirix *jiri.X, project project.Project, change gerrit.Change) error {
 	jirix.Logger.Infof("Rebasing project %s(%s)\n", project.Name, project.Path)
-	scm := gitutil.New(jirix, gitutil.UserNameOpt(change.Owner.Name), gitutil.UserEmailOpt(change.Owner.Email), gitutil.RootDirOpt(project.Path))
-	if err := scm.FetchRefspec("origin", change.Branch); err != nil {
+	scm := gitutil.New(context.Background(), jirix, gitutil.UserNameOpt(change.Owner.Name), gitutil.UserEmailOpt(change.Owner.Email), gitutil.RootDirOpt(project.Path))
+	if err := scm.FetchRefspec(project.GitRemoteName(), change.Branch); err != nil {
 		jirix.Logger.Errorf("Not able to fetch branch %q: %s", change.Branch, err)
 		jirix.IncrementFailures()
 		return nil
 	}
-	if err := scm.Rebase("origin/" + change.Branch); err != nil {
+	if err := scm.Rebase(project.GitRemoteName() + "/" + change.Branch); err != nil {
 		if err := scm.RebaseAbort(); err != nil {
 			return err
 		}
@@ -131,6 +134,28 @@ func rebaseProject(jirix *jiri.X, project project.Project, change gerrit.Change)
 	return nil
 }
 
+// parseChange parses a change given either as a full reference, as
+// "<change>/<patchset>" or as a change number, in which case the returned
+// patchset is -1.
+func parseChange(arg string) (int, int, error) {
+	if cl, ps, err := gerrit.ParseRefString(arg); err == nil {
+		return cl, ps, nil
+	}
+	parts := strings.Split(arg, "/")
+	cl, err := strconv.Atoi(parts[0])
+	if err != nil || len(parts) > 2 {
+		return -1, -1, fmt.Errorf("invalid argument: %v", arg)
+	}
+	if len(parts) == 1 {
+		return cl, -1, nil
+	}
+	ps, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return -1, -1, fmt.Errorf("invalid argument: %v", arg)
+	}
+	return cl, ps, nil
+}
+
 func runPatch(jirix *jiri.X, args []string) error {
 	if expected, got := 1, len(args); expected != got {
 		return jirix.UsageErrorf("unexpected number of arguments: expected %v, got %v", expected, got)
@@ -140,13 +165,14 @@ func runPatch(jirix *jiri.X, args []string) error {
 	var cl int
 	var ps int
 	var err error
+	changeRef := arg
 	if !patchTopicFlag {
-		cl, ps, err = gerrit.ParseRefString(arg)
+		cl, ps, err = parseChange(arg)
 		if err != nil {
-			cl, err = strconv.Atoi(arg)
-			if err != nil {
-				return fmt.Errorf("invalid argument: %v", arg)
-			}
+			return err
+		}
+		if ps != -1 {
+			changeRef = gerrit.ChangeRef(cl, ps)
 		}
 	}
 
@@ -172,7 +198,7 @@ func runPatch(jirix *jiri.X, args []string) error {
 		branch := patchBranchFlag
 		ok := false
 		if ps != -1 {
-			if ok, err = patchProject(jirix, p, arg, branch, change.Branch); err != nil {
+			if ok, err = patchProject(jirix, p, changeRef, branch, change.Branch); err != nil {
 				return err
 			}
 		} else {
@@ -236,7 +262,7 @@ func runPatch(jirix *jiri.X, args []string) error {
 		for _, change := range changes {
 			var ref string
 			if ps != -1 {
-				ref = arg
+				ref = changeRef
 			} else {
 				ref = change.Reference()
 			}
@@ -0,0 +1,137 @@
+// Copyright 2017 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"fuchsia.googlesource.com/jiri/gerrit"
+	"fuchsia.googlesource.com/jiri/git"
+	"fuchsia.googlesource.com/jiri/gitutil"
+	"fuchsia.googlesource.com/jiri/jiritest"
+	"fuchsia.googlesource.com/jiri/project"
+)
+
+func TestParseChange(t *testing.T) {
+	tests := []struct {
+		arg    string
+		cl, ps int
+		err    bool
+	}{
+		{"12345", 12345, -1, false},
+		{"12345/2", 12345, 2, false},
+		{"refs/changes/45/12345/2", 12345, 2, false},
+		{"12345/x", 0, 0, true},
+		{"12345/2/1", 0, 0, true},
+		{"change", 0, 0, true},
+	}
+	for _, test := range tests {
+		cl, ps, err := parseChange(test.arg)
+		if test.err {
+			if err == nil {
+				t.Errorf("parseChange(%q) should have failed", test.arg)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseChange(%q) failed: %v", test.arg, err)
+		} else if cl != test.cl || ps != test.ps {
+			t.Errorf("parseChange(%q): got %d, %d, want %d, %d", test.arg, cl, ps, test.cl, test.ps)
+		}
+	}
+}
+
+// TestPatchChange tests that a change is fetched from the Gerrit host of the
+// current project and checked out as a branch.
+func TestPatchChange(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+
+	ref := gerrit.ChangeRef(12345, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, ")]}'\n[{\"branch\": \"master\", \"current_revision\": \"r\", \"revisions\": {\"r\": {\"fetch\": {\"http\": {\"ref\": %q}}}}}]", ref)
+	}))
+	defer server.Close()
+
+	if err := fake.CreateRemoteProject("project"); err != nil {
+		t.Fatal(err)
+	}
+	remote := fake.Projects["project"]
+	setDummyUser(t, fake.X, remote)
+	writeFile(t, fake.X, remote, "file", "base")
+	if err := fake.AddProject(project.Project{
+		Name:       "project",
+		Path:       "project",
+		Remote:     remote,
+		GerritHost: server.URL,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Expose a change ref on the remote, which is not on any of its branches.
+	scm := gitutil.New(context.Background(), fake.X, gitutil.RootDirOpt(remote))
+	if err := scm.CreateAndCheckoutBranch("change"); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fake.X, remote, "file", "change")
+	changeRev, err := git.NewGit(context.Background(), remote).CurrentRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := scm.Push(".", "change:"+ref); err != nil {
+		t.Fatal(err)
+	}
+	if err := scm.CheckoutBranch("master"); err != nil {
+		t.Fatal(err)
+	}
+	if err := scm.DeleteBranch("change", gitutil.ForceOpt(true)); err != nil {
+		t.Fatal(err)
+	}
+
+	localDir := filepath.Join(fake.X.Root, "project")
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+	if err := os.Chdir(localDir); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { patchBranchFlag = "" }()
+
+	tests := []struct {
+		arg, branchFlag, branch string
+	}{
+		{"12345/2", "", "change/12345/2"},
+		// The latest patchset is looked up on the Gerrit host.
+		{"12345", "latest", "latest"},
+	}
+	local := gitutil.New(context.Background(), fake.X, gitutil.RootDirOpt(localDir))
+	for _, test := range tests {
+		patchBranchFlag = test.branchFlag
+		if err := runPatch(fake.X, []string{test.arg}); err != nil {
+			t.Fatalf("patch %q failed: %v", test.arg, err)
+		}
+		if branch, err := local.CurrentBranchName(); err != nil {
+			t.Fatal(err)
+		} else if branch != test.branch {
+			t.Errorf("patch %q: got branch %q, want %q", test.arg, branch, test.branch)
+		}
+		if rev, err := git.NewGit(context.Background(), localDir).CurrentRevision(); err != nil {
+			t.Fatal(err)
+		} else if rev != changeRev {
+			t.Errorf("patch %q: got revision %q, want %q", test.arg, rev, changeRev)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2017 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"fuchsia.googlesource.com/jiri"
+	"fuchsia.googlesource.com/jiri/cmdline"
+	"fuchsia.googlesource.com/jiri/project"
+)
+
+var cmdProjectCheckClean = &cmdline.Command{
+	Runner: jiri.RunnerFunc(runProjectCheckClean),
+	Name:   "project-check-clean",
+	Short:  "Check that no project has uncommitted changes",
+	Long: `
+Checks all the local projects for uncommitted changes and untracked files, and
+lists the dirty ones.  The command exits with code 1 if any project is dirty,
+which makes it suitable to verify that generated files are up to date in
+continuous integration.
+`,
+}
+
+var checkCleanFlags struct {
+	project   string
+	porcelain bool
+}
+
+func init() {
+	flags := &cmdProjectCheckClean.Flags
+	flags.StringVar(&checkCleanFlags.project, "project", "", "Only check projects whose name matches this glob pattern.")
+	flags.BoolVar(&checkCleanFlags.porcelain, "porcelain", false, "Print the path of each dirty project, relative to the root, one per line.")
+}
+
+func runProjectCheckClean(jirix *jiri.X, args []string) error {
+	if len(args) != 0 {
+		return jirix.UsageErrorf("unexpected number of arguments")
+	}
+	if checkCleanFlags.project != "" {
+		if _, err := path.Match(checkCleanFlags.project, ""); err != nil {
+			return fmt.Errorf("invalid project pattern %q: %v", checkCleanFlags.project, err)
+		}
+	}
+	localProjects, err := project.LocalProjects(jirix, project.FastScan)
+	if err != nil {
+		return err
+	}
+	projects := make(project.Projects)
+	for key, p := range localProjects {
+		if checkCleanFlags.project != "" {
+			if ok, _ := path.Match(checkCleanFlags.project, p.Name); !ok {
+				continue
+			}
+		}
+		projects[key] = p
+	}
+	states, err := project.GetProjectStates(jirix, projects, true)
+	if err != nil {
+		return err
+	}
+
+	var dirty project.ProjectKeys
+	for key, state := range states {
+		if state.HasUncommitted || state.HasUntracked {
+			dirty = append(dirty, key)
+		}
+	}
+	if len(dirty) == 0 {
+		return nil
+	}
+	sort.Sort(dirty)
+	for _, key := range dirty {
+		state := states[key]
+		relPath, err := filepath.Rel(jirix.Root, state.Project.Path)
+		if err != nil {
+			return err
+		}
+		if checkCleanFlags.porcelain {
+			fmt.Println(relPath)
+			continue
+		}
+		var problems []string
+		if state.HasUncommitted {
+			problems = append(problems, "uncommitted changes")
+		}
+		if state.HasUntracked {
+			problems = append(problems, "untracked files")
+		}
+		fmt.Printf("%s(%s): %s\n", state.Project.Name, relPath, strings.Join(problems, ", "))
+	}
+	return cmdline.ErrExitCode(1)
+}
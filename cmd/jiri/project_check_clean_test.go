@@ -0,0 +1,83 @@
+// Copyright 2017 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"fuchsia.googlesource.com/jiri/cmdline"
+	"fuchsia.googlesource.com/jiri/jiritest"
+	"fuchsia.googlesource.com/jiri/project"
+)
+
+func TestProjectCheckClean(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+
+	for _, name := range []string{"project-a", "project-b", "other"} {
+		if err := fake.CreateRemoteProject(name); err != nil {
+			t.Fatal(err)
+		}
+		if err := fake.AddProject(project.Project{
+			Name:   name,
+			Path:   name,
+			Remote: fake.Projects[name],
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		checkCleanFlags.project = ""
+		checkCleanFlags.porcelain = false
+	}()
+	run := func() (string, error) {
+		var runErr error
+		stdout, _, err := runfunc(func() {
+			runErr = runProjectCheckClean(fake.X, nil)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stdout, runErr
+	}
+
+	if stdout, err := run(); err != nil {
+		t.Fatalf("clean checkout reported dirty: %v\n%s", err, stdout)
+	}
+
+	for _, name := range []string{"project-b", "other"} {
+		file := filepath.Join(fake.X.Root, name, "generated")
+		if err := ioutil.WriteFile(file, []byte("generated"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkCleanFlags.porcelain = true
+	stdout, err := run()
+	if err != cmdline.ErrExitCode(1) {
+		t.Errorf("got error %v, want %v", err, cmdline.ErrExitCode(1))
+	}
+	if want := "other\nproject-b\n"; stdout != want {
+		t.Errorf("got output %q, want %q", stdout, want)
+	}
+
+	checkCleanFlags.project = "project-*"
+	stdout, err = run()
+	if err != cmdline.ErrExitCode(1) {
+		t.Errorf("got error %v, want %v", err, cmdline.ErrExitCode(1))
+	}
+	if want := "project-b\n"; stdout != want {
+		t.Errorf("got output %q, want %q", stdout, want)
+	}
+
+	checkCleanFlags.project = "project-a"
+	if stdout, err := run(); err != nil {
+		t.Errorf("clean project reported dirty: %v\n%s", err, stdout)
+	}
+}
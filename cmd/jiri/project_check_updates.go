@@ -0,0 +1,145 @@
+// Copyright 2017 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"fuchsia.googlesource.com/jiri"
+	"fuchsia.googlesource.com/jiri/cmdline"
+	"fuchsia.googlesource.com/jiri/git"
+	"fuchsia.googlesource.com/jiri/gitutil"
+	"fuchsia.googlesource.com/jiri/project"
+)
+
+var checkUpdatesFlags struct {
+	format string
+}
+
+func init() {
+	cmdProjectCheckUpdates.Flags.StringVar(&checkUpdatesFlags.format, "format", "table", "Output format, table or json.")
+}
+
+var cmdProjectCheckUpdates = &cmdline.Command{
+	Runner: jiri.RunnerFunc(runProjectCheckUpdates),
+	Name:   "project-check-updates",
+	Short:  "List the projects with pending updates",
+	Long: `
+Lists the local projects whose revision in the manifest, or the current tip of
+their remote branch as listed by "git ls-remote", differs from the revision
+they were last updated to (JIRI_HEAD), along with the number of commits
+between the two.  The number of commits is unknown (-1 in JSON) when the new
+revision wasn't fetched yet.
+
+Nothing is fetched nor updated, not even the manifest projects, so this can
+safely be run periodically.
+`,
+}
+
+// checkUpdateOutput defines JSON format for 'project-check-updates' output.
+type checkUpdateOutput struct {
+	Name    string `json:"name"`
+	Path    string `json:"path"`
+	Current string `json:"current"`
+	Target  string `json:"target"`
+	Commits int    `json:"commits"`
+}
+
+func runProjectCheckUpdates(jirix *jiri.X, args []string) error {
+	if len(args) != 0 {
+		return jirix.UsageErrorf("unexpected number of arguments")
+	}
+	if checkUpdatesFlags.format != "table" && checkUpdatesFlags.format != "json" {
+		return jirix.UsageErrorf("invalid -format %q, want table or json", checkUpdatesFlags.format)
+	}
+	localProjects, err := project.LocalProjects(jirix, project.FastScan)
+	if err != nil {
+		return err
+	}
+	remoteProjects, _, err := project.LoadManifestFile(jirix, jirix.JiriManifestFile(), localProjects, false /*localManifest*/)
+	if err != nil {
+		return err
+	}
+	projects := make(project.Projects)
+	for key, p := range remoteProjects {
+		if local, ok := localProjects[key]; ok {
+			p.Path = local.Path
+			projects[key] = p
+		}
+	}
+	targets, err := project.TargetRevisions(jirix, projects)
+	if err != nil {
+		return err
+	}
+	var keys project.ProjectKeys
+	for key := range projects {
+		keys = append(keys, key)
+	}
+	sort.Sort(keys)
+	output := []checkUpdateOutput{}
+	for _, key := range keys {
+		p := projects[key]
+		current, err := project.JiriHead(p)
+		if err != nil {
+			jirix.Logger.Errorf("Cannot read JIRI_HEAD of project %s(%s): %v\n", p.Name, p.Path, err)
+			jirix.IncrementFailures()
+			continue
+		}
+		if targets[key] == current {
+			continue
+		}
+		commits := -1
+		if _, err := git.NewGit(context.Background(), p.Path).CurrentRevisionForRef(targets[key]); err == nil {
+			scm := gitutil.New(context.Background(), jirix, gitutil.RootDirOpt(p.Path))
+			if commits, err = scm.CountCommits(targets[key], current); err != nil {
+				jirix.Logger.Errorf("Cannot count commits of project %s(%s): %v\n", p.Name, p.Path, err)
+				jirix.IncrementFailures()
+				continue
+			}
+		}
+		output = append(output, checkUpdateOutput{p.Name, p.Path, current, targets[key], commits})
+	}
+
+	if checkUpdatesFlags.format == "json" {
+		out, err := json.MarshalIndent(output, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to serialize JSON output: %s", err)
+		}
+		fmt.Println(string(out))
+		return checkUpdatesFailures(jirix)
+	}
+	width := 0
+	for _, u := range output {
+		if len(u.Name) > width {
+			width = len(u.Name)
+		}
+	}
+	for _, u := range output {
+		commits := "unknown number of commits"
+		if u.Commits >= 0 {
+			commits = fmt.Sprintf("%d commit(s)", u.Commits)
+		}
+		fmt.Printf("%-*s %s..%s %s\n", width, u.Name, shortRevision(u.Current), shortRevision(u.Target), commits)
+	}
+	return checkUpdatesFailures(jirix)
+}
+
+func checkUpdatesFailures(jirix *jiri.X) error {
+	if jirix.Failures() != 0 {
+		return fmt.Errorf("Checking updates of %d project(s) failed", jirix.Failures())
+	}
+	return nil
+}
+
+// shortRevision abbreviates the given revision to 12 characters.
+func shortRevision(revision string) string {
+	if len(revision) > 12 {
+		return revision[:12]
+	}
+	return revision
+}
@@ -0,0 +1,145 @@
+// Copyright 2017 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"fuchsia.googlesource.com/jiri/git"
+	"fuchsia.googlesource.com/jiri/gitutil"
+	"fuchsia.googlesource.com/jiri/project"
+)
+
+func TestProjectCheckUpdates(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Project 0 gets two new commits, and project 1 one which is fetched.
+	writeReadme(t, fake.X, fake.Projects[localProjects[0].Name], "second readme")
+	writeReadme(t, fake.X, fake.Projects[localProjects[0].Name], "third readme")
+	writeReadme(t, fake.X, fake.Projects[localProjects[1].Name], "second readme")
+	if err := gitutil.New(context.Background(), fake.X, gitutil.RootDirOpt(localProjects[1].Path)).Fetch("origin"); err != nil {
+		t.Fatal(err)
+	}
+	revisions := make(map[string]string)
+	for _, p := range localProjects[:2] {
+		rev, err := git.NewGit(context.Background(), fake.Projects[p.Name]).CurrentRevision()
+		if err != nil {
+			t.Fatal(err)
+		}
+		revisions[p.Name] = rev
+	}
+
+	checkUpdatesFlags.format = "json"
+	defer func() { checkUpdatesFlags.format = "table" }()
+	var runErr error
+	stdout, _, err := runfunc(func() {
+		runErr = runProjectCheckUpdates(fake.X, nil)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runErr != nil {
+		t.Fatal(runErr)
+	}
+	var output []checkUpdateOutput
+	if err := json.Unmarshal([]byte(stdout), &output); err != nil {
+		t.Fatalf("failed to unmarshal %q: %v", stdout, err)
+	}
+	want := map[string]int{localProjects[0].Name: -1, localProjects[1].Name: 1}
+	if len(output) != len(want) {
+		t.Fatalf("got updates %+v, want updates of %v", output, want)
+	}
+	for _, u := range output {
+		if commits, ok := want[u.Name]; !ok {
+			t.Errorf("unexpected update of project %s", u.Name)
+		} else if u.Commits != commits || u.Target != revisions[u.Name] {
+			t.Errorf("project %s: got %d commits to %s, want %d to %s", u.Name, u.Commits, u.Target, commits, revisions[u.Name])
+		}
+	}
+
+	// The projects weren't updated.
+	checkReadme(t, fake.X, localProjects[0].Path, "initial readme")
+	checkReadme(t, fake.X, localProjects[1].Path, "initial readme")
+}
+
+func TestProjectCheckUpdatesPinned(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Project 0 is pinned to an annotated tag of a new commit, and project 1
+	// to the short SHA of the commit it is at.
+	remote0 := fake.Projects[localProjects[0].Name]
+	writeReadme(t, fake.X, remote0, "second readme")
+	tagged, err := git.NewGit(context.Background(), remote0).CurrentRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("git", "-c", "user.name=John Doe", "-c", "user.email=john.doe@example.com", "tag", "-a", "-m", "release", "v1")
+	cmd.Dir = remote0
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	current1, err := git.NewGit(context.Background(), localProjects[1].Path).CurrentRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := fake.ReadRemoteManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mp, err := m.FindProject(localProjects[0].Name); err != nil {
+		t.Fatal(err)
+	} else {
+		mp.Revision = "v1"
+	}
+	if mp, err := m.FindProject(localProjects[1].Name); err != nil {
+		t.Fatal(err)
+	} else {
+		mp.Revision = current1[:8]
+	}
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+	// Only the manifest is updated.
+	if err := project.UpdateUniverseProjects(context.Background(), fake.X, []string{"manifest"}, project.UpdateUniverseOpts{RunHookTimeout: project.DefaultHookTimeout}); err != nil {
+		t.Fatal(err)
+	}
+	// Project 2 has no JIRI_HEAD.
+	if err := os.Remove(filepath.Join(localProjects[2].Path, ".git", "JIRI_HEAD")); err != nil {
+		t.Fatal(err)
+	}
+
+	checkUpdatesFlags.format = "json"
+	defer func() { checkUpdatesFlags.format = "table" }()
+	var runErr error
+	stdout, _, err := runfunc(func() {
+		runErr = runProjectCheckUpdates(fake.X, nil)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runErr == nil {
+		t.Errorf("expected an error for the project without JIRI_HEAD")
+	}
+	var output []checkUpdateOutput
+	if err := json.Unmarshal([]byte(stdout), &output); err != nil {
+		t.Fatalf("failed to unmarshal %q: %v", stdout, err)
+	}
+	if len(output) != 1 || output[0].Name != localProjects[0].Name || output[0].Target != tagged {
+		t.Errorf("got updates %+v, want one of project %s to %s", output, localProjects[0].Name, tagged)
+	}
+}
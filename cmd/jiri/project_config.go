@@ -26,12 +26,17 @@ var (
 	configIgnoreFlag   string
 	configNoUpdateFlag string
 	configNoRebaseFlag string
+	configNoPushFlag   string
+
+	configDefaultBranchFlag string
 )
 
 func init() {
 	cmdProjectConfig.Flags.StringVar(&configIgnoreFlag, "ignore", "", `This can be true or false. If set to true project would be completely ignored while updating`)
 	cmdProjectConfig.Flags.StringVar(&configNoUpdateFlag, "no-update", "", `This can be true or false. If set to true project won't be updated`)
 	cmdProjectConfig.Flags.StringVar(&configNoRebaseFlag, "no-rebase", "", `This can be true or false. If set to true local branch won't be rebased or merged.`)
+	cmdProjectConfig.Flags.StringVar(&configNoPushFlag, "no-push", "", `This can be true or false. If set to true "jiri upload" will refuse to push the project.`)
+	cmdProjectConfig.Flags.StringVar(&configDefaultBranchFlag, "default-branch", "", `Local branch, e.g. main, checked out by "jiri update" instead of a detached HEAD if it exists remotely. "-" unsets it.`)
 }
 
 func runProjectConfig(jirix *jiri.X, args []string) error {
@@ -39,7 +44,7 @@ func runProjectConfig(jirix *jiri.X, args []string) error {
 	if err != nil {
 		return err
 	}
-	if configIgnoreFlag == "" && configNoUpdateFlag == "" && configNoRebaseFlag == "" {
+	if configIgnoreFlag == "" && configNoUpdateFlag == "" && configNoRebaseFlag == "" && configNoPushFlag == "" && configDefaultBranchFlag == "" {
 		displayConfig(p.LocalConfig)
 		return nil
 	}
@@ -53,6 +58,16 @@ func runProjectConfig(jirix *jiri.X, args []string) error {
 	if err := setBoolVar(configNoRebaseFlag, &lc.NoRebase, "no-rebase"); err != nil {
 		return err
 	}
+	if err := setBoolVar(configNoPushFlag, &lc.NoPush, "no-push"); err != nil {
+		return err
+	}
+	switch configDefaultBranchFlag {
+	case "":
+	case "-":
+		lc.DefaultBranch = ""
+	default:
+		lc.DefaultBranch = configDefaultBranchFlag
+	}
 	return project.WriteLocalConfig(jirix, p, lc)
 }
 
@@ -73,4 +88,6 @@ func displayConfig(lc project.LocalConfig) {
 	fmt.Printf("ignore: %t\n", lc.Ignore)
 	fmt.Printf("no-update: %t\n", lc.NoUpdate)
 	fmt.Printf("no-rebase: %t\n", lc.NoRebase)
+	fmt.Printf("no-push: %t\n", lc.NoPush)
+	fmt.Printf("default-branch: %s\n", lc.DefaultBranch)
 }
@@ -17,6 +17,8 @@ func setDefaultConfigFlags() {
 	configIgnoreFlag = ""
 	configNoUpdateFlag = ""
 	configNoRebaseFlag = ""
+	configNoPushFlag = ""
+	configDefaultBranchFlag = ""
 }
 
 func testConfig(t *testing.T, fake *jiritest.FakeJiriRoot, localProjects []project.Project) {
@@ -62,6 +64,28 @@ func testConfig(t *testing.T, fake *jiritest.FakeJiriRoot, localProjects []proje
 	if newConfig.NoRebase != expectedOutput {
 		t.Errorf("local config no-rebase: got %t, want %t", newConfig.NoRebase, expectedOutput)
 	}
+
+	expectedOutput = oldConfig.NoPush
+	if configNoPushFlag != "" {
+		if expectedOutput, err = strconv.ParseBool(configNoPushFlag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if newConfig.NoPush != expectedOutput {
+		t.Errorf("local config no-push: got %t, want %t", newConfig.NoPush, expectedOutput)
+	}
+
+	expectedBranch := oldConfig.DefaultBranch
+	switch configDefaultBranchFlag {
+	case "":
+	case "-":
+		expectedBranch = ""
+	default:
+		expectedBranch = configDefaultBranchFlag
+	}
+	if newConfig.DefaultBranch != expectedBranch {
+		t.Errorf("local config default-branch: got %q, want %q", newConfig.DefaultBranch, expectedBranch)
+	}
 }
 
 func TestConfig(t *testing.T) {
@@ -110,4 +134,23 @@ func TestConfig(t *testing.T) {
 	configNoUpdateFlag = "false"
 	configIgnoreFlag = "false"
 	testConfig(t, fake, localProjects)
+
+	setDefaultConfigFlags()
+	configNoPushFlag = "true"
+	testConfig(t, fake, localProjects)
+
+	setDefaultConfigFlags()
+	configNoPushFlag = "false"
+	testConfig(t, fake, localProjects)
+
+	setDefaultConfigFlags()
+	configDefaultBranchFlag = "main"
+	testConfig(t, fake, localProjects)
+
+	setDefaultConfigFlags()
+	testConfig(t, fake, localProjects)
+
+	setDefaultConfigFlags()
+	configDefaultBranchFlag = "-"
+	testConfig(t, fake, localProjects)
 }
@@ -0,0 +1,197 @@
+// Copyright 2017 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"fuchsia.googlesource.com/jiri"
+	"fuchsia.googlesource.com/jiri/cmdline"
+	"fuchsia.googlesource.com/jiri/osutil"
+	"fuchsia.googlesource.com/jiri/project"
+)
+
+var cmdProjectEdit = &cmdline.Command{
+	Runner: jiri.RunnerFunc(runProjectEdit),
+	Name:   "project-edit",
+	Short:  "Edit the manifest entry of a project",
+	Long: `
+Opens the manifest file declaring the given project, which may be the
+.jiri_manifest or any locally checked out imported manifest, in $EDITOR at the
+line of the project.  The edited manifest is validated once the editor exits,
+and it is only saved if it can be parsed.
+`,
+	ArgsName: "<project>",
+	ArgsLong: "<project> is the name or key of the project to edit.",
+}
+
+// lineEditors are the editors which accept a "+N" argument to open a file at
+// line N.
+var lineEditors = map[string]bool{
+	"emacs":       true,
+	"emacsclient": true,
+	"gvim":        true,
+	"joe":         true,
+	"mg":          true,
+	"nano":        true,
+	"nvim":        true,
+	"vi":          true,
+	"vim":         true,
+}
+
+func runProjectEdit(jirix *jiri.X, args []string) error {
+	if len(args) != 1 {
+		return jirix.UsageErrorf("wrong number of arguments")
+	}
+	file, name, err := project.ProjectManifestFile(jirix, args[0])
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	line, err := projectLine(data, name)
+	if err != nil {
+		return fmt.Errorf("cannot find project %q in %q: %v", name, file, err)
+	}
+
+	// Edit a copy of the manifest, so that it is left untouched if the edited
+	// version is invalid.
+	tmpDir, err := ioutil.TempDir("", "jiri-project-edit")
+	if err != nil {
+		return fmt.Errorf("TempDir() failed: %v", err)
+	}
+	tmpFile := filepath.Join(tmpDir, filepath.Base(file))
+	if err := ioutil.WriteFile(tmpFile, data, 0644); err != nil {
+		os.RemoveAll(tmpDir)
+		return err
+	}
+	if err := runEditor(tmpFile, line); err != nil {
+		os.RemoveAll(tmpDir)
+		return err
+	}
+	edited, err := ioutil.ReadFile(tmpFile)
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return err
+	}
+	if _, err := project.ManifestFromBytes(edited); err != nil {
+		return fmt.Errorf("%v\nThe manifest was not saved, the edited version is kept in %q", err, tmpFile)
+	}
+	os.RemoveAll(tmpDir)
+	if bytes.Equal(data, edited) {
+		return nil
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	// Replace the manifest atomically, so that it isn't left truncated if
+	// writing fails.
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, edited, info.Mode()); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := osutil.Rename(tmp, file); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// projectLine returns the line number of the project element with the given
+// name in the manifest data, which may be XML or TOML.
+func projectLine(data []byte, name string) (int, error) {
+	if project.IsTOML(data) {
+		return projectTOMLLine(data, name)
+	}
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		offset := decoder.InputOffset()
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return 0, fmt.Errorf("no such project")
+		} else if err != nil {
+			return 0, err
+		}
+		elem, ok := token.(xml.StartElement)
+		if !ok || elem.Name.Local != "project" {
+			continue
+		}
+		for _, attr := range elem.Attr {
+			if attr.Name.Local == "name" && attr.Value == name {
+				return bytes.Count(data[:offset], []byte("\n")) + 1, nil
+			}
+		}
+	}
+}
+
+// projectTOMLLine returns the line number of the header of the [[projects]]
+// table with the given name in the TOML manifest data.
+func projectTOMLLine(data []byte, name string) (int, error) {
+	m, err := project.ManifestFromBytes(data)
+	if err != nil {
+		return 0, err
+	}
+	index := -1
+	for i, p := range m.Projects {
+		if p.Name == name {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return 0, fmt.Errorf("no such project")
+	}
+	// The projects are parsed in the order of their tables.
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "[[") {
+			continue
+		}
+		end := strings.Index(line, "]]")
+		if end < 0 || strings.TrimSpace(line[2:end]) != "projects" {
+			continue
+		}
+		if index == 0 {
+			return i + 1, nil
+		}
+		index--
+	}
+	return 0, fmt.Errorf("no such project")
+}
+
+// runEditor opens file in $EDITOR, at the given line if the editor supports
+// it.
+func runEditor(file string, line int) error {
+	editor := strings.Fields(os.Getenv("EDITOR"))
+	if len(editor) == 0 {
+		editor = []string{"vi"}
+	}
+	args := editor[1:]
+	if lineEditors[filepath.Base(editor[0])] {
+		args = append(args, "+"+strconv.Itoa(line))
+	}
+	args = append(args, file)
+	cmd := exec.Command(editor[0], args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("editor %q failed: %v", editor[0], err)
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+// Copyright 2017 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"fuchsia.googlesource.com/jiri/jiritest"
+	"fuchsia.googlesource.com/jiri/project"
+)
+
+// setEditor makes $EDITOR a script named vim, which records its first argument
+// in the returned file and replaces the edited file with content.
+func setEditor(t *testing.T, dir, content string) (string, func()) {
+	contentFile := filepath.Join(dir, "content")
+	if err := ioutil.WriteFile(contentFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	argFile := filepath.Join(dir, "arg")
+	script := fmt.Sprintf("#!/bin/sh\necho \"$1\" > %q\ncat %q > \"$2\"\n", argFile, contentFile)
+	editor := filepath.Join(dir, "vim")
+	if err := ioutil.WriteFile(editor, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	oldEditor := os.Getenv("EDITOR")
+	os.Setenv("EDITOR", editor)
+	return argFile, func() { os.Setenv("EDITOR", oldEditor) }
+}
+
+func TestProjectEdit(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+
+	for _, name := range []string{"project1", "project2"} {
+		if err := fake.CreateRemoteProject(name); err != nil {
+			t.Fatal(err)
+		}
+		if err := fake.AddProject(project.Project{
+			Name:   name,
+			Path:   name,
+			Remote: fake.Projects[name],
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	file, name, err := project.ProjectManifestFile(fake.X, "project2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "project2" {
+		t.Errorf("got project name %q, want %q", name, "project2")
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := string(data)
+	wantLine := 0
+	for i, line := range strings.Split(original, "\n") {
+		if strings.Contains(line, `name="project2"`) {
+			wantLine = i + 1
+		}
+	}
+
+	// An invalid manifest must not be saved.
+	argFile, restore := setEditor(t, fake.X.Root, "<manifest>")
+	defer restore()
+	if err := runProjectEdit(fake.X, []string{"project2"}); err == nil {
+		t.Error("runProjectEdit() should have failed on an invalid manifest")
+	}
+	if data, err := ioutil.ReadFile(file); err != nil {
+		t.Fatal(err)
+	} else if string(data) != original {
+		t.Errorf("invalid manifest was saved:\n%s", data)
+	}
+
+	// A valid manifest is saved, and the editor is opened at the project line.
+	edited := strings.Replace(original, `path="project2"`, `path="project2-edited"`, 1)
+	argFile, restore = setEditor(t, fake.X.Root, edited)
+	defer restore()
+	if err := runProjectEdit(fake.X, []string{"project2"}); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(file); err != nil {
+		t.Fatal(err)
+	} else if string(data) != edited {
+		t.Errorf("got manifest:\n%s\nwant:\n%s", data, edited)
+	}
+	if _, err := os.Stat(file + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary manifest %q was left behind: %v", file+".tmp", err)
+	}
+	if data, err := ioutil.ReadFile(argFile); err != nil {
+		t.Fatal(err)
+	} else if got, want := strings.TrimSpace(string(data)), fmt.Sprintf("+%d", wantLine); got != want {
+		t.Errorf("editor got line argument %q, want %q", got, want)
+	}
+}
+
+func TestProjectLineTOML(t *testing.T) {
+	data := []byte(`# Projects.
+[[projects]]
+name = "project1"
+path = "project1"
+remote = "https://example.com/project1"
+
+[[hooks]]
+name = "hook"
+action = "hook.sh"
+project = "project1"
+
+[[projects]]
+path = "project2"
+name = "project2" # Not first.
+remote = "https://example.com/project2"
+`)
+	if line, err := projectLine(data, "project2"); err != nil {
+		t.Fatal(err)
+	} else if line != 12 {
+		t.Errorf("got line %d, want 12", line)
+	}
+	if _, err := projectLine(data, "project3"); err == nil {
+		t.Errorf("projectLine() should have failed on a missing project")
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2017 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"fuchsia.googlesource.com/jiri"
+	"fuchsia.googlesource.com/jiri/cmdline"
+	"fuchsia.googlesource.com/jiri/envvar"
+	"fuchsia.googlesource.com/jiri/project"
+)
+
+var projectForeachFlags struct {
+	outputDir   string
+	stopOnError bool
+}
+
+func init() {
+	cmdProjectForeach.Flags.StringVar(&projectForeachFlags.outputDir, "output-dir", "", "Directory to write the output of the command in each project to, as <project path>.log, the path being relative to the root. The output goes to the standard output and error of jiri when empty.")
+	cmdProjectForeach.Flags.BoolVar(&projectForeachFlags.stopOnError, "stop-on-error", false, "Stop at the first project in which the command fails, instead of running it in all the projects.")
+}
+
+var cmdProjectForeach = &cmdline.Command{
+	Runner: jiri.RunnerFunc(runProjectForeach),
+	Name:   "project-foreach",
+	Short:  "Run a command in each project",
+	Long: `
+Runs the command in the directory of each local project, one project after the
+other in the order of their keys, e.g. to build or test them.  Unlike "jiri
+runp", the command isn't run by a shell, and with -output-dir its standard
+output and error are written to a separate log file per project.
+
+The projects in which the command failed are listed at the end, and the exit
+code is then 1.  Use "--" to separate the flags of the command from those of
+jiri, e.g. "jiri project-foreach -output-dir=logs -- make -k test".
+`,
+	ArgsName: "<command> [args]",
+	ArgsLong: "<command> [args] is the command to run in each project.",
+}
+
+func runProjectForeach(jirix *jiri.X, args []string) error {
+	if len(args) == 0 {
+		return jirix.UsageErrorf("no command to run")
+	}
+	if dir := projectForeachFlags.outputDir; dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	projects, err := project.LocalProjects(jirix, project.FastScan)
+	if err != nil {
+		return err
+	}
+	var keys project.ProjectKeys
+	for key := range projects {
+		keys = append(keys, key)
+	}
+	sort.Sort(keys)
+
+	var failed []string
+	for _, key := range keys {
+		p := projects[key]
+		if err := runInProject(jirix, p, args); err != nil {
+			failed = append(failed, fmt.Sprintf("%s(%s): %v", p.Name, p.Path, err))
+			if projectForeachFlags.stopOnError {
+				break
+			}
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	fmt.Fprintf(jirix.Stderr(), "Command %q failed in %d project(s):\n%s\n", strings.Join(args, " "), len(failed), strings.Join(failed, "\n"))
+	return cmdline.ErrExitCode(1)
+}
+
+// runInProject runs the command given by args in the directory of the
+// project, writing its output to its log file of -output-dir, if any.
+func runInProject(jirix *jiri.X, p project.Project, args []string) (e error) {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = p.Path
+	cmd.Env = envvar.MapToSlice(jirix.Env())
+	cmd.Stdout, cmd.Stderr = jirix.Stdout(), jirix.Stderr()
+	if dir := projectForeachFlags.outputDir; dir != "" {
+		// The log files follow the layout of the projects, whose paths are
+		// unique unlike their names.
+		rel, err := filepath.Rel(jirix.Root, p.Path)
+		if err != nil {
+			return err
+		}
+		file := filepath.Join(dir, rel+".log")
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			return err
+		}
+		f, err := os.Create(file)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := f.Close(); err != nil && e == nil {
+				e = err
+			}
+		}()
+		cmd.Stdout, cmd.Stderr = f, f
+	}
+	return cmd.Run()
+}
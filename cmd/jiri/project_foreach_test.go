@@ -0,0 +1,85 @@
+// Copyright 2017 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"fuchsia.googlesource.com/jiri"
+	"fuchsia.googlesource.com/jiri/cmdline"
+	"fuchsia.googlesource.com/jiri/project"
+)
+
+// logFile returns the log file of project-foreach in -output-dir for the
+// project.
+func logFile(t *testing.T, jirix *jiri.X, p project.Project) string {
+	rel, err := filepath.Rel(jirix.Root, p.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(projectForeachFlags.outputDir, rel+".log")
+}
+
+func TestProjectForeach(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	defer func() {
+		projectForeachFlags.outputDir = ""
+		projectForeachFlags.stopOnError = false
+	}()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	// The command fails in the second project.
+	if err := ioutil.WriteFile(filepath.Join(localProjects[1].Path, "fail"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	args := []string{"sh", "-c", "pwd; test ! -f fail"}
+
+	projectForeachFlags.outputDir = filepath.Join(fake.X.Root, "logs")
+	if err := runProjectForeach(fake.X, args); err != cmdline.ErrExitCode(1) {
+		t.Fatalf("got error %v, want exit code 1", err)
+	}
+	for _, p := range localProjects {
+		b, err := ioutil.ReadFile(logFile(t, fake.X, p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.TrimSpace(string(b)); got != p.Path {
+			t.Errorf("project %s: got output %q, want %q", p.Name, got, p.Path)
+		}
+	}
+
+	// The projects after the failing one are skipped with -stop-on-error.
+	projectForeachFlags.outputDir = filepath.Join(fake.X.Root, "logs-stop")
+	projectForeachFlags.stopOnError = true
+	if err := runProjectForeach(fake.X, args); err != cmdline.ErrExitCode(1) {
+		t.Fatalf("got error %v, want exit code 1", err)
+	}
+	for i, p := range localProjects {
+		_, err := os.Stat(logFile(t, fake.X, p))
+		if i <= 1 && err != nil {
+			t.Errorf("project %s: %v", p.Name, err)
+		}
+		if i > 1 && !os.IsNotExist(err) {
+			t.Errorf("project %s: command should not have run, got %v", p.Name, err)
+		}
+	}
+
+	// The command succeeds in all the projects without the failing one.
+	if err := os.Remove(filepath.Join(localProjects[1].Path, "fail")); err != nil {
+		t.Fatal(err)
+	}
+	if err := runProjectForeach(fake.X, args); err != nil {
+		t.Fatal(err)
+	}
+	if err := runProjectForeach(fake.X, nil); err == nil {
+		t.Errorf("running no command should have failed")
+	}
+}
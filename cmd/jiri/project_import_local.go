@@ -0,0 +1,63 @@
+// Copyright 2017 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"path/filepath"
+
+	"fuchsia.googlesource.com/jiri"
+	"fuchsia.googlesource.com/jiri/cmdline"
+	"fuchsia.googlesource.com/jiri/gitutil"
+	"fuchsia.googlesource.com/jiri/project"
+)
+
+var importLocalFlags struct {
+	name   string
+	remote string
+}
+
+func init() {
+	cmdProjectImportLocal.Flags.StringVar(&importLocalFlags.name, "name", "", "Name of the project, defaulting to the base name of its path.")
+	cmdProjectImportLocal.Flags.StringVar(&importLocalFlags.remote, "remote", "", "Remote of the project, defaulting to the URL of the origin remote of the repository.")
+}
+
+var cmdProjectImportLocal = &cmdline.Command{
+	Runner: jiri.RunnerFunc(runProjectImportLocal),
+	Name:   "project-import-local",
+	Short:  "Put an existing git repository under jiri management",
+	Long: `
+Puts a git repository which was checked out by hand, in the root directory,
+under jiri management: the jiri metadata of the project is written to the
+repository, and the project is added to the [root]/.jiri_manifest file, so that
+"jiri update" keeps and updates it like the other projects.
+`,
+	ArgsName: "<path>",
+	ArgsLong: "<path> is the path of the repository, relative to the current directory if not absolute.",
+}
+
+func runProjectImportLocal(jirix *jiri.X, args []string) error {
+	if len(args) != 1 {
+		return jirix.UsageErrorf("wrong number of arguments")
+	}
+	path, err := filepath.Abs(args[0])
+	if err != nil {
+		return err
+	}
+	p := project.Project{
+		Name:   importLocalFlags.name,
+		Path:   path,
+		Remote: importLocalFlags.remote,
+	}
+	if p.Name == "" {
+		p.Name = filepath.Base(path)
+	}
+	if p.Remote == "" {
+		if p.Remote, err = gitutil.New(context.Background(), jirix, gitutil.RootDirOpt(path)).RemoteUrl(p.GitRemoteName()); err != nil {
+			return jirix.UsageErrorf("cannot get the remote of %q, use -remote: %v", path, err)
+		}
+	}
+	return project.ImportLocalProject(jirix, p)
+}
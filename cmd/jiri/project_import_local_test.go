@@ -0,0 +1,67 @@
+// Copyright 2017 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"fuchsia.googlesource.com/jiri"
+	"fuchsia.googlesource.com/jiri/project"
+)
+
+func TestProjectImportLocal(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	defer func() { importLocalFlags.name = "" }()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	remote := fake.Projects[localProjects[0].Name]
+	path := filepath.Join(fake.X.Root, "manual")
+	if out, err := exec.Command("git", "clone", remote, path).CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+
+	importLocalFlags.name = "manual"
+	if err := runProjectImportLocal(fake.X, []string{path}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(path, jiri.ProjectMetaDir, jiri.ProjectMetaFile)); err != nil {
+		t.Errorf("metadata not written: %v", err)
+	}
+	want := project.Project{Name: "manual", Path: path, Remote: remote}
+	for _, scanMode := range []project.ScanMode{project.FastScan, project.FullScan} {
+		projects, err := project.LocalProjects(fake.X, scanMode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p, ok := projects[want.Key()]; !ok {
+			t.Errorf("imported project not found by LocalProjects(%v)", scanMode)
+		} else if p.Path != path {
+			t.Errorf("got path %q, want %q", p.Path, path)
+		}
+	}
+	m, err := fake.ReadJiriManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.FindProject(want.Name); err != nil {
+		t.Error(err)
+	}
+
+	// The project is now updated like the others.
+	writeReadme(t, fake.X, remote, "new readme")
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	checkReadme(t, fake.X, path, "new readme")
+
+	if err := runProjectImportLocal(fake.X, []string{path}); err == nil {
+		t.Errorf("importing a jiri project again should have failed")
+	}
+}
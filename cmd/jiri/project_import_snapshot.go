@@ -0,0 +1,72 @@
+// Copyright 2017 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fuchsia.googlesource.com/jiri"
+	"fuchsia.googlesource.com/jiri/cmdline"
+	"fuchsia.googlesource.com/jiri/project"
+)
+
+var importSnapshotFlags struct {
+	merge bool
+}
+
+func init() {
+	cmdProjectImportSnapshot.Flags.BoolVar(&importSnapshotFlags.merge, "merge", false, "Keep the projects, local imports and hooks of .jiri_manifest, those of the snapshot replacing the ones with the same key.")
+}
+
+var cmdProjectImportSnapshot = &cmdline.Command{
+	Runner: jiri.RunnerFunc(runProjectImportSnapshot),
+	Name:   "project-import-snapshot",
+	Short:  "Pin the projects of a snapshot in .jiri_manifest",
+	Long: `
+Writes the projects of a snapshot to the [root]/.jiri_manifest file as explicit
+<project> elements pinned to their revisions, along with the hooks of the
+snapshot, e.g. to onboard a developer at a known-good state.  The <import>
+elements of .jiri_manifest are removed since the projects they provided are
+now explicit, and so are its other elements unless -merge is provided.
+
+Run "jiri update" afterwards to check out the projects.
+`,
+	ArgsName: "<snapshot>",
+	ArgsLong: "<snapshot> is the snapshot manifest file or URL.",
+}
+
+func runProjectImportSnapshot(jirix *jiri.X, args []string) error {
+	if len(args) != 1 {
+		return jirix.UsageErrorf("wrong number of arguments")
+	}
+	projects, hooks, err := project.LoadSnapshotFile(jirix, args[0])
+	if err != nil {
+		return err
+	}
+	manifest := &project.Manifest{}
+	if importSnapshotFlags.merge {
+		if manifest, err = project.ManifestFromFile(jirix, jirix.JiriManifestFile()); err != nil {
+			return err
+		}
+		manifest.Imports = nil
+	}
+	for _, p := range manifest.Projects {
+		if _, ok := projects[p.Key()]; !ok {
+			projects[p.Key()] = p
+		}
+	}
+	for _, h := range manifest.Hooks {
+		if _, ok := hooks[h.Key()]; !ok {
+			hooks[h.Key()] = h
+		}
+	}
+	manifest.Projects = nil
+	for _, p := range projects {
+		manifest.Projects = append(manifest.Projects, p)
+	}
+	manifest.Hooks = nil
+	for _, h := range hooks {
+		manifest.Hooks = append(manifest.Hooks, h)
+	}
+	return manifest.ToFile(jirix, jirix.JiriManifestFile())
+}
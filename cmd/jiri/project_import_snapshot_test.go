@@ -0,0 +1,80 @@
+// Copyright 2017 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"fuchsia.googlesource.com/jiri/project"
+)
+
+func TestProjectImportSnapshot(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	defer func() { importSnapshotFlags.merge = false }()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := filepath.Join(fake.X.Root, "snapshot")
+	if err := project.CreateSnapshot(fake.X, snapshot, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range localProjects {
+		writeReadme(t, fake.X, fake.Projects[p.Name], "new revision")
+	}
+
+	// checkManifest checks that .jiri_manifest has no imports and the given
+	// number of projects, and returns it.
+	checkManifest := func(want int) *project.Manifest {
+		m, err := fake.ReadJiriManifest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(m.Imports) != 0 {
+			t.Errorf("got imports %v, want none", m.Imports)
+		}
+		if got := len(m.Projects); got != want {
+			t.Errorf("got %d projects, want %d", got, want)
+		}
+		return m
+	}
+
+	// The snapshot has the manifest project along with the local projects.
+	if err := runProjectImportSnapshot(fake.X, []string{snapshot}); err != nil {
+		t.Fatal(err)
+	}
+	m := checkManifest(len(localProjects) + 1)
+	for _, p := range m.Projects {
+		if p.Revision == "" || p.Revision == "HEAD" {
+			t.Errorf("project %s is not pinned", p.Name)
+		}
+	}
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range localProjects {
+		checkReadme(t, fake.X, p.Path, "initial readme")
+	}
+
+	// Existing entries are only kept with -merge.
+	extra := project.Project{Name: "extra", Path: "extra", Remote: fake.Projects[localProjects[0].Name]}
+	m.Projects = append(m.Projects, extra)
+	if err := fake.WriteJiriManifest(m); err != nil {
+		t.Fatal(err)
+	}
+	importSnapshotFlags.merge = true
+	if err := runProjectImportSnapshot(fake.X, []string{snapshot}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := checkManifest(len(localProjects) + 2).FindProject(extra.Name); err != nil {
+		t.Error(err)
+	}
+	importSnapshotFlags.merge = false
+	if err := runProjectImportSnapshot(fake.X, []string{snapshot}); err != nil {
+		t.Fatal(err)
+	}
+	checkManifest(len(localProjects) + 1)
+}
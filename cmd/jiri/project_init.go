@@ -0,0 +1,101 @@
+// Copyright 2017 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"fuchsia.googlesource.com/jiri"
+	"fuchsia.googlesource.com/jiri/cmdline"
+	"fuchsia.googlesource.com/jiri/project"
+)
+
+var projectInitFlags struct {
+	path     string
+	branch   string
+	revision string
+	update   bool
+}
+
+func init() {
+	cmdProjectInit.Flags.StringVar(&projectInitFlags.path, "path", "", "Path of the project, relative to the root. Defaults to the name of the project.")
+	cmdProjectInit.Flags.StringVar(&projectInitFlags.branch, "branch", "", "Remote branch of the project. Defaults to master.")
+	cmdProjectInit.Flags.StringVar(&projectInitFlags.revision, "revision", "", "Revision to pin the project to. Defaults to the tip of its remote branch.")
+	cmdProjectInit.Flags.BoolVar(&projectInitFlags.update, "update", false, "Check out the new project afterwards, leaving the other projects untouched.")
+}
+
+var cmdProjectInit = &cmdline.Command{
+	Runner: jiri.RunnerFunc(runProjectInit),
+	Name:   "project-init",
+	Short:  "Add a new project to .jiri_manifest",
+	Long: `
+Adds a <project> element for a new remote project to the [root]/.jiri_manifest
+file, instead of editing it by hand.  The name and the path of the project must
+not be used by another project of the manifest.
+
+Run "jiri update" afterwards, or provide -update to only update the new
+project, to check out the project.
+`,
+	ArgsName: "<name> <remote>",
+	ArgsLong: "<name> is the name of the new project and <remote> its remote URL.",
+}
+
+func runProjectInit(jirix *jiri.X, args []string) error {
+	if len(args) != 2 {
+		return jirix.UsageErrorf("wrong number of arguments")
+	}
+	p := project.Project{
+		Name:         args[0],
+		Remote:       args[1],
+		Path:         projectInitFlags.path,
+		RemoteBranch: projectInitFlags.branch,
+		Revision:     projectInitFlags.revision,
+	}
+	if p.Path == "" {
+		p.Path = p.Name
+	}
+	if filepath.IsAbs(p.Path) {
+		return jirix.UsageErrorf("-path %q must be relative to the root", p.Path)
+	}
+	absPath := filepath.Join(jirix.Root, p.Path)
+
+	localProjects, err := project.LocalProjects(jirix, project.FastScan)
+	if err != nil {
+		return err
+	}
+	projects, _, err := project.LoadManifestFile(jirix, jirix.JiriManifestFile(), localProjects, false /*localManifest*/)
+	if err != nil {
+		return err
+	}
+	loaded := project.Manifest{}
+	for _, other := range projects {
+		loaded.Projects = append(loaded.Projects, other)
+	}
+	if _, err := loaded.FindProject(p.Name); err == nil {
+		return fmt.Errorf("project %q is already in the manifest", p.Name)
+	}
+	if other, err := loaded.FindProjectByPath(absPath); err == nil {
+		return fmt.Errorf("path %q is already used by project %q", p.Path, other.Name)
+	}
+
+	m, err := project.ManifestFromFile(jirix, jirix.JiriManifestFile())
+	if err != nil {
+		return err
+	}
+	m.Projects = append(m.Projects, p)
+	if err := m.ToFile(jirix, jirix.JiriManifestFile()); err != nil {
+		return err
+	}
+	if !projectInitFlags.update {
+		return nil
+	}
+	opts := project.UpdateUniverseOpts{RunHookTimeout: project.DefaultHookTimeout}
+	if err := project.UpdateUniverseProjects(context.Background(), jirix, []string{string(p.Key())}, opts); err != nil {
+		return err
+	}
+	return project.WriteUpdateHistorySnapshot(jirix, "", false)
+}
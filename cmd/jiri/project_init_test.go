@@ -0,0 +1,63 @@
+// Copyright 2017 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"fuchsia.googlesource.com/jiri/project"
+)
+
+func TestProjectInit(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	defer func() {
+		projectInitFlags.path = ""
+		projectInitFlags.branch = ""
+		projectInitFlags.update = false
+	}()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.CreateRemoteProject("new"); err != nil {
+		t.Fatal(err)
+	}
+	writeReadme(t, fake.X, fake.Projects["new"], "new readme")
+	// The other projects are left untouched by -update.
+	writeReadme(t, fake.X, fake.Projects[localProjects[1].Name], "other readme")
+
+	projectInitFlags.path = "sub/new"
+	projectInitFlags.branch = "master"
+	projectInitFlags.update = true
+	if err := runProjectInit(fake.X, []string{"new", fake.Projects["new"]}); err != nil {
+		t.Fatal(err)
+	}
+	m, err := project.ManifestFromFile(fake.X, fake.X.JiriManifestFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := m.FindProject("new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Remote != fake.Projects["new"] || p.Path != "sub/new" {
+		t.Errorf("got project %+v, want remote %q and path %q", p, fake.Projects["new"], "sub/new")
+	}
+	checkReadme(t, fake.X, filepath.Join(fake.X.Root, "sub", "new"), "new readme")
+	checkReadme(t, fake.X, localProjects[1].Path, "initial readme")
+
+	// Names and paths can't collide with those of other projects.
+	projectInitFlags.update = false
+	for _, test := range []struct{ name, path string }{
+		{localProjects[0].Name, "other"},
+		{"other", "sub/new"},
+	} {
+		projectInitFlags.path = test.path
+		if err := runProjectInit(fake.X, []string{test.name, fake.Projects["new"]}); err == nil {
+			t.Errorf("adding project %q at %q should have failed", test.name, test.path)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+// Copyright 2017 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+
+	"fuchsia.googlesource.com/jiri"
+	"fuchsia.googlesource.com/jiri/cmdline"
+	"fuchsia.googlesource.com/jiri/project"
+)
+
+var cmdProjectManifestPath = &cmdline.Command{
+	Runner: jiri.RunnerFunc(runProjectManifestPath),
+	Name:   "project-manifest-path",
+	Short:  "Print the manifest file declaring a project",
+	Long: `
+Resolves the imports of the manifest and prints the path of the manifest file
+declaring the given project, i.e. the file to edit to change it.  The file must
+be checked out locally.
+`,
+	ArgsName: "<project>",
+	ArgsLong: "<project> is the name or key of the project.",
+}
+
+func runProjectManifestPath(jirix *jiri.X, args []string) error {
+	if len(args) != 1 {
+		return jirix.UsageErrorf("wrong number of arguments")
+	}
+	file, _, err := project.ProjectManifestFile(jirix, args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Println(file)
+	return nil
+}
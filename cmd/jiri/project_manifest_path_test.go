@@ -0,0 +1,91 @@
+// Copyright 2017 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"fuchsia.googlesource.com/jiri/gitutil"
+	"fuchsia.googlesource.com/jiri/jiritest"
+	"fuchsia.googlesource.com/jiri/project"
+)
+
+func TestProjectManifestPath(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+
+	for _, name := range []string{"top", "deep"} {
+		if err := fake.CreateRemoteProject(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fake.AddProject(project.Project{Name: "top", Path: "top", Remote: fake.Projects["top"]}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The manifest imports core, which imports nested/deep declaring the deep
+	// project.
+	manifestDir := fake.Projects["manifest"]
+	if err := os.MkdirAll(filepath.Join(manifestDir, "nested"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	deep := &project.Manifest{
+		Projects: []project.Project{{Name: "deep", Path: "deep", Remote: fake.Projects["deep"]}},
+	}
+	if err := deep.ToFile(fake.X, filepath.Join(manifestDir, "nested", "deep")); err != nil {
+		t.Fatal(err)
+	}
+	core := &project.Manifest{LocalImports: []project.LocalImport{{File: "nested/deep"}}}
+	if err := core.ToFile(fake.X, filepath.Join(manifestDir, "core")); err != nil {
+		t.Fatal(err)
+	}
+	scm := gitutil.New(context.Background(), fake.X, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"), gitutil.RootDirOpt(manifestDir))
+	if err := scm.Add("."); err != nil {
+		t.Fatal(err)
+	}
+	if err := scm.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	m, err := fake.ReadRemoteManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.LocalImports = append(m.LocalImports, project.LocalImport{File: "core"})
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+
+	localManifestDir := filepath.Join(fake.X.Root, "manifest")
+	for name, want := range map[string]string{
+		"top":  filepath.Join(localManifestDir, "public"),
+		"deep": filepath.Join(localManifestDir, "nested", "deep"),
+	} {
+		var runErr error
+		stdout, _, err := runfunc(func() {
+			runErr = runProjectManifestPath(fake.X, []string{name})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if runErr != nil {
+			t.Errorf("project %s: %v", name, runErr)
+			continue
+		}
+		if got := strings.TrimSpace(stdout); got != want {
+			t.Errorf("project %s: got %s, want %s", name, got, want)
+		}
+	}
+
+	if err := runProjectManifestPath(fake.X, []string{"missing"}); err == nil {
+		t.Error("found the manifest of a missing project")
+	}
+}
@@ -0,0 +1,38 @@
+// Copyright 2017 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+
+	"fuchsia.googlesource.com/jiri"
+	"fuchsia.googlesource.com/jiri/cmdline"
+	"fuchsia.googlesource.com/jiri/project"
+)
+
+var cmdProjectOwner = &cmdline.Command{
+	Runner: jiri.RunnerFunc(runProjectOwner),
+	Name:   "project-owner",
+	Short:  "Print the name of the project containing a path",
+	Long: `
+Prints the name of the project owning the given file or directory, i.e. the
+innermost project whose path contains it.  This is useful for editor plugins
+and build scripts.
+`,
+	ArgsName: "<path>",
+	ArgsLong: "<path> is the path of a file or directory, relative to the current directory if not absolute.",
+}
+
+func runProjectOwner(jirix *jiri.X, args []string) error {
+	if len(args) != 1 {
+		return jirix.UsageErrorf("wrong number of arguments")
+	}
+	p, err := project.FindProjectForPath(jirix, args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Println(p.Name)
+	return nil
+}
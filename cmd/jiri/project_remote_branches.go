@@ -0,0 +1,116 @@
+// Copyright 2017 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+
+	"fuchsia.googlesource.com/jiri"
+	"fuchsia.googlesource.com/jiri/cmdline"
+	"fuchsia.googlesource.com/jiri/gitutil"
+	"fuchsia.googlesource.com/jiri/project"
+)
+
+var cmdProjectRemoteBranches = &cmdline.Command{
+	Runner: jiri.RunnerFunc(runProjectRemoteBranches),
+	Name:   "project-remote-branches",
+	Short:  "List branches on a project's remote",
+	Long: `
+Lists the branches available on the remote of a project, along with the
+revisions they point to, without cloning it. The project is the one containing
+the current directory unless the -project flag is provided.
+`,
+}
+
+var remoteBranchesFlags struct {
+	project string
+	filter  string
+	json    bool
+}
+
+func init() {
+	flags := &cmdProjectRemoteBranches.Flags
+	flags.StringVar(&remoteBranchesFlags.project, "project", "", "Name of the project. Defaults to the project containing the current directory.")
+	flags.StringVar(&remoteBranchesFlags.filter, "filter", "", "Only list branches matching this glob pattern.")
+	flags.BoolVar(&remoteBranchesFlags.json, "json", false, "Print the branches in JSON format.")
+}
+
+// remoteBranchOutput defines JSON format for 'project-remote-branches' output.
+type remoteBranchOutput struct {
+	Name     string `json:"name"`
+	Revision string `json:"revision"`
+}
+
+func runProjectRemoteBranches(jirix *jiri.X, args []string) error {
+	if len(args) != 0 {
+		return jirix.UsageErrorf("unexpected number of arguments")
+	}
+	if remoteBranchesFlags.filter != "" {
+		if _, err := path.Match(remoteBranchesFlags.filter, ""); err != nil {
+			return fmt.Errorf("invalid filter %q: %v", remoteBranchesFlags.filter, err)
+		}
+	}
+	var p project.Project
+	if remoteBranchesFlags.project == "" {
+		var err error
+		if p, err = currentProject(jirix); err != nil {
+			return err
+		}
+	} else {
+		localProjects, err := project.LocalProjects(jirix, project.FastScan)
+		if err != nil {
+			return err
+		}
+		remoteProjects, _, err := project.LoadManifestFile(jirix, jirix.JiriManifestFile(), localProjects, false /*localManifest*/)
+		if err != nil {
+			return err
+		}
+		if p, err = remoteProjects.FindUnique(remoteBranchesFlags.project); err != nil {
+			return err
+		}
+	}
+
+	branches, err := gitutil.New(context.Background(), jirix).RemoteBranches(p.Remote)
+	if err != nil {
+		return fmt.Errorf("Cannot list branches of project %q: %s", p.Name, err)
+	}
+	var names []string
+	for name := range branches {
+		if remoteBranchesFlags.filter != "" {
+			if ok, _ := path.Match(remoteBranchesFlags.filter, name); !ok {
+				continue
+			}
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	output := []remoteBranchOutput{}
+	for _, name := range names {
+		output = append(output, remoteBranchOutput{name, branches[name]})
+	}
+
+	if remoteBranchesFlags.json {
+		out, err := json.MarshalIndent(output, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to serialize JSON output: %s", err)
+		}
+		fmt.Println(string(out))
+		return nil
+	}
+	width := 0
+	for _, b := range output {
+		if len(b.Name) > width {
+			width = len(b.Name)
+		}
+	}
+	for _, b := range output {
+		fmt.Printf("%-*s %s\n", width, b.Name, b.Revision)
+	}
+	return nil
+}
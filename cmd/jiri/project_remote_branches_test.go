@@ -0,0 +1,76 @@
+// Copyright 2017 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"fuchsia.googlesource.com/jiri/git"
+	"fuchsia.googlesource.com/jiri/gitutil"
+	"fuchsia.googlesource.com/jiri/jiritest"
+	"fuchsia.googlesource.com/jiri/project"
+)
+
+func TestProjectRemoteBranches(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+
+	if err := fake.CreateRemoteProject("project"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.AddProject(project.Project{
+		Name:   "project",
+		Path:   "path",
+		Remote: fake.Projects["project"],
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	gitRemote := gitutil.New(context.Background(), fake.X, gitutil.RootDirOpt(fake.Projects["project"]))
+	for _, branch := range []string{"feature-1", "feature-2", "other"} {
+		if err := gitRemote.CreateBranch(branch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	revision, err := git.NewGit(context.Background(), fake.Projects["project"]).CurrentRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	remoteBranchesFlags.project = "project"
+	remoteBranchesFlags.filter = "feature-*"
+	remoteBranchesFlags.json = true
+	defer func() {
+		remoteBranchesFlags.project = ""
+		remoteBranchesFlags.filter = ""
+		remoteBranchesFlags.json = false
+	}()
+	var runErr error
+	stdout, _, err := runfunc(func() {
+		runErr = runProjectRemoteBranches(fake.X, nil)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runErr != nil {
+		t.Fatal(runErr)
+	}
+	var got []remoteBranchOutput
+	if err := json.Unmarshal([]byte(stdout), &got); err != nil {
+		t.Fatalf("cannot parse output %q: %v", stdout, err)
+	}
+	want := []remoteBranchOutput{
+		{"feature-1", revision},
+		{"feature-2", revision},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
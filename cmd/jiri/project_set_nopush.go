@@ -0,0 +1,42 @@
+// Copyright 2017 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fuchsia.googlesource.com/jiri"
+	"fuchsia.googlesource.com/jiri/cmdline"
+	"fuchsia.googlesource.com/jiri/project"
+)
+
+var cmdProjectSetNoPush = &cmdline.Command{
+	Runner: jiri.RunnerFunc(runProjectSetNoPush),
+	Name:   "project-set-nopush",
+	Short:  "Forbid uploading changes of a project",
+	Long: `
+Sets the no-push local config of the given project, so that "jiri upload"
+refuses to push its changes.  This is useful for projects which are forks that
+must not be pushed upstream.  Use "jiri project-config -no-push=false" from
+inside the project to allow uploading it again.
+`,
+	ArgsName: "<project>",
+	ArgsLong: "<project> is the name or key of the project.",
+}
+
+func runProjectSetNoPush(jirix *jiri.X, args []string) error {
+	if len(args) != 1 {
+		return jirix.UsageErrorf("wrong number of arguments")
+	}
+	localProjects, err := project.LocalProjects(jirix, project.FastScan)
+	if err != nil {
+		return err
+	}
+	p, err := localProjects.FindUnique(args[0])
+	if err != nil {
+		return err
+	}
+	lc := p.LocalConfig
+	lc.NoPush = true
+	return project.WriteLocalConfig(jirix, p, lc)
+}
@@ -0,0 +1,38 @@
+// Copyright 2017 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"path/filepath"
+
+	"fuchsia.googlesource.com/jiri"
+	"fuchsia.googlesource.com/jiri/cmdline"
+	"fuchsia.googlesource.com/jiri/project"
+)
+
+var cmdRealize = &cmdline.Command{
+	Runner: jiri.RunnerFunc(runRealize),
+	Name:   "realize",
+	Short:  "Check out a lazy project",
+	Long: `
+Checks out the lazy project at the given path.  "jiri update" only registers
+the projects with the "lazy" manifest attribute, i.e. writes their metadata
+without checking them out, until they are realized with this command.  They
+are then updated like other projects.
+`,
+	ArgsName: "<path>",
+	ArgsLong: "<path> is the path of the lazy project.",
+}
+
+func runRealize(jirix *jiri.X, args []string) error {
+	if len(args) != 1 {
+		return jirix.UsageErrorf("wrong number of arguments")
+	}
+	path, err := filepath.Abs(args[0])
+	if err != nil {
+		return err
+	}
+	return project.RealizeProject(jirix, path)
+}
@@ -0,0 +1,54 @@
+// Copyright 2017 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+
+	"fuchsia.googlesource.com/jiri"
+	"fuchsia.googlesource.com/jiri/cmdline"
+	"fuchsia.googlesource.com/jiri/project"
+)
+
+var resolveManifestLocalManifestFlag bool
+
+func init() {
+	cmdResolveManifest.Flags.BoolVar(&resolveManifestLocalManifestFlag, "local-manifest", false, "Use local manifest")
+}
+
+var cmdResolveManifest = &cmdline.Command{
+	Runner: jiri.RunnerFunc(runResolveManifest),
+	Name:   "resolve-manifest",
+	Short:  "Print the resolved projects and hooks of a manifest",
+	Long: `
+Resolves all the imports of a manifest and prints the resulting projects and
+hooks as a single manifest in canonical form: projects are sorted by path,
+hooks by name, and paths are relative to the jiri root.  The output is
+deterministic, so the output of two jiri versions can be compared to check
+that they resolve the manifest identically.
+`,
+	ArgsName: "[<manifest>]",
+	ArgsLong: "<manifest> is the path of the manifest to resolve. Defaults to the .jiri_manifest file.",
+}
+
+func runResolveManifest(jirix *jiri.X, args []string) error {
+	if len(args) > 1 {
+		return jirix.UsageErrorf("wrong number of arguments")
+	}
+	file := jirix.JiriManifestFile()
+	if len(args) == 1 {
+		file = args[0]
+	}
+	m, err := project.ResolveManifest(jirix, file, resolveManifestLocalManifestFlag)
+	if err != nil {
+		return err
+	}
+	data, err := m.ToCanonicalBytes(jirix)
+	if err != nil {
+		return err
+	}
+	fmt.Print(string(data))
+	return nil
+}
@@ -0,0 +1,86 @@
+// Copyright 2017 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"fuchsia.googlesource.com/jiri/gitutil"
+	"fuchsia.googlesource.com/jiri/jiritest"
+	"fuchsia.googlesource.com/jiri/project"
+)
+
+func TestResolveManifest(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+
+	for _, name := range []string{"b", "a", "c"} {
+		if err := fake.CreateRemoteProject(name); err != nil {
+			t.Fatal(err)
+		}
+		script := filepath.Join(fake.Projects[name], "setup.sh")
+		if err := ioutil.WriteFile(script, []byte("#!/bin/sh\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := gitutil.New(context.Background(), fake.X, gitutil.RootDirOpt(fake.Projects[name])).CommitFile(script, "add setup.sh"); err != nil {
+			t.Fatal(err)
+		}
+		if err := fake.AddProject(project.Project{
+			Name:   name,
+			Path:   "src/" + name,
+			Remote: fake.Projects[name],
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := fake.AddHook(project.Hook{
+			Name:        "setup",
+			ProjectName: name,
+			Action:      "setup.sh",
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+
+	resolve := func() string {
+		var runErr error
+		stdout, _, err := runfunc(func() {
+			runErr = runResolveManifest(fake.X, nil)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if runErr != nil {
+			t.Fatal(runErr)
+		}
+		return stdout
+	}
+	got := resolve()
+	for i := 0; i < 5; i++ {
+		if again := resolve(); again != got {
+			t.Fatalf("resolved manifest is not stable, got:\n%s\nthen:\n%s", got, again)
+		}
+	}
+	if strings.Contains(got, fake.X.Root) {
+		t.Errorf("resolved manifest contains the jiri root %q:\n%s", fake.X.Root, got)
+	}
+	a := strings.Index(got, `path="src/a"`)
+	b := strings.Index(got, `path="src/b"`)
+	c := strings.Index(got, `path="src/c"`)
+	if a < 0 || b < a || c < b {
+		t.Errorf("resolved manifest does not list the projects sorted by relative path:\n%s", got)
+	}
+	if m, err := project.ManifestFromBytes([]byte(got)); err != nil {
+		t.Fatal(err)
+	} else if len(m.Hooks) != 3 {
+		t.Errorf("got %d hooks, want 3:\n%s", len(m.Hooks), got)
+	}
+}
@@ -5,6 +5,7 @@
 package main
 
 import (
+	"context"
 	"os"
 	"path/filepath"
 	"sort"
@@ -162,7 +163,7 @@ func TestRunP(t *testing.T) {
 	}
 
 	git := func(dir string) *gitutil.Git {
-		return gitutil.New(fake.X, gitutil.RootDirOpt(dir))
+		return gitutil.New(context.Background(), fake.X, gitutil.RootDirOpt(dir))
 	}
 
 	newfile(rb, "untracked.go")
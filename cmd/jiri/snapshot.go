@@ -5,26 +5,75 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
 	"fuchsia.googlesource.com/jiri"
 	"fuchsia.googlesource.com/jiri/cmdline"
+	"fuchsia.googlesource.com/jiri/gitutil"
 	"fuchsia.googlesource.com/jiri/project"
 )
 
+var snapshotFlags struct {
+	timeFormat string
+	updateRef  string
+}
+
+func init() {
+	flags := &cmdSnapshot.Flags
+	flags.StringVar(&snapshotFlags.timeFormat, "time-format", "", "Treat <snapshot> as a directory and name the snapshot file after the current time in this format, e.g. 2006-01-02T15:04:05Z07:00.")
+	flags.StringVar(&snapshotFlags.updateRef, "update-ref", "", "Git ref, e.g. refs/tags/release, to point at the snapshot revision in every project.")
+}
+
 var cmdSnapshot = &cmdline.Command{
 	Runner: jiri.RunnerFunc(runSnapshot),
 	Name:   "snapshot",
 	Short:  "Create a new project snapshot",
 	Long: `
 The "jiri snapshot <snapshot>" command captures the current project state
-in a manifest.
+in a manifest.  Unlike the snapshots kept in the update history, it lets
+users checkpoint their state deliberately; "jiri update <snapshot>" restores
+it.
+
+With -time-format, <snapshot> is a directory of snapshots, and the path of the
+new snapshot is printed.  With -update-ref, the given ref is also updated in
+every project, so that the snapshot revisions can be found with git alone.
 `,
 	ArgsName: "<snapshot>",
-	ArgsLong: "<snapshot> is the snapshot manifest file.",
+	ArgsLong: "<snapshot> is the snapshot manifest file, or the snapshot directory with -time-format.",
 }
 
 func runSnapshot(jirix *jiri.X, args []string) error {
 	if len(args) != 1 {
 		return jirix.UsageErrorf("unexpected number of arguments")
 	}
-	return project.CreateSnapshot(jirix, args[0], false)
+	file := args[0]
+	if snapshotFlags.timeFormat != "" {
+		if err := os.MkdirAll(file, 0755); err != nil {
+			return err
+		}
+		file = filepath.Join(file, time.Now().Format(snapshotFlags.timeFormat))
+	}
+	if err := project.CreateSnapshot(jirix, file, false); err != nil {
+		return err
+	}
+	if snapshotFlags.updateRef != "" {
+		projects, _, err := project.LoadSnapshotFile(jirix, file)
+		if err != nil {
+			return err
+		}
+		for _, p := range projects {
+			git := gitutil.New(context.Background(), jirix, gitutil.RootDirOpt(p.Path))
+			if err := git.UpdateRef(snapshotFlags.updateRef, p.Revision); err != nil {
+				return fmt.Errorf("cannot update %s in project %q: %v", snapshotFlags.updateRef, p.Name, err)
+			}
+		}
+	}
+	if snapshotFlags.timeFormat != "" {
+		fmt.Println(file)
+	}
+	return nil
 }
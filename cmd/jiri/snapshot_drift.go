@@ -0,0 +1,60 @@
+// Copyright 2017 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"fuchsia.googlesource.com/jiri"
+	"fuchsia.googlesource.com/jiri/cmdline"
+	"fuchsia.googlesource.com/jiri/project"
+)
+
+var cmdSnapshotDrift = &cmdline.Command{
+	Runner: jiri.RunnerFunc(runSnapshotDrift),
+	Name:   "snapshot-drift",
+	Short:  "Print how the checkout differs from a snapshot",
+	Long: `
+Prints for each project of a snapshot how its checkout differs from the
+revision of the snapshot: "at-snapshot", "ahead N" and/or "behind N" commits,
+"missing" if it isn't checked out, or "unknown snapshot revision" if the
+revision isn't in the local repository.  Projects with uncommitted changes are
+also reported as "dirty".  Nothing is fetched nor updated.
+`,
+	ArgsName: "<snapshot>",
+	ArgsLong: "<snapshot> is the snapshot manifest file or URL.",
+}
+
+func runSnapshotDrift(jirix *jiri.X, args []string) error {
+	if len(args) != 1 {
+		return jirix.UsageErrorf("wrong number of arguments")
+	}
+	snapshotProjects, _, err := project.LoadSnapshotFile(jirix, args[0])
+	if err != nil {
+		return err
+	}
+	localProjects, err := project.LocalProjects(jirix, project.FastScan)
+	if err != nil {
+		return err
+	}
+	drifts, err := project.SnapshotDrifts(jirix, snapshotProjects, localProjects)
+	if err != nil {
+		return err
+	}
+	var keys project.ProjectKeys
+	width := 0
+	for key, p := range snapshotProjects {
+		keys = append(keys, key)
+		if len(p.Name) > width {
+			width = len(p.Name)
+		}
+	}
+	sort.Sort(keys)
+	for _, key := range keys {
+		fmt.Printf("%-*s %s\n", width, snapshotProjects[key].Name, drifts[key])
+	}
+	return nil
+}
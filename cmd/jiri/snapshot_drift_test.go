@@ -0,0 +1,79 @@
+// Copyright 2017 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"fuchsia.googlesource.com/jiri/gitutil"
+	"fuchsia.googlesource.com/jiri/project"
+)
+
+func TestSnapshotDrift(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	writeReadme(t, fake.X, fake.Projects[localProjects[0].Name], "second readme")
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := filepath.Join(fake.X.Root, "snapshot")
+	if err := project.CreateSnapshot(fake.X, snapshot, false); err != nil {
+		t.Fatal(err)
+	}
+	m, err := project.ManifestFromFile(fake.X, snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Projects = append(m.Projects, project.Project{Name: "missing", Path: "missing", Remote: "https://example.com/missing"})
+	if err := m.ToFile(fake.X, snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	// Project 0 goes back one commit, project 1 gets a new commit and project
+	// 2 uncommitted changes.
+	g := gitutil.New(context.Background(), fake.X, gitutil.RootDirOpt(localProjects[0].Path))
+	if err := g.CheckoutBranch("HEAD~1", gitutil.DetachOpt(true)); err != nil {
+		t.Fatal(err)
+	}
+	writeReadme(t, fake.X, localProjects[1].Path, "local readme")
+	if err := ioutil.WriteFile(filepath.Join(localProjects[2].Path, "README"), []byte("uncommitted"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var runErr error
+	stdout, _, err := runfunc(func() {
+		runErr = runSnapshotDrift(fake.X, []string{snapshot})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runErr != nil {
+		t.Fatal(runErr)
+	}
+	drifts := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(stdout), "\n") {
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			t.Fatalf("unexpected output line %q", line)
+		}
+		drifts[fields[0]] = strings.TrimSpace(fields[1])
+	}
+	want := map[string]string{
+		"manifest":            "at-snapshot",
+		localProjects[0].Name: "behind 1",
+		localProjects[1].Name: "ahead 1",
+		localProjects[2].Name: "at-snapshot, dirty",
+		"missing":             "missing",
+	}
+	for name, drift := range want {
+		if got := drifts[name]; got != drift {
+			t.Errorf("project %s: got %q, want %q", name, got, drift)
+		}
+	}
+}
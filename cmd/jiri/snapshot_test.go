@@ -6,13 +6,17 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"fuchsia.googlesource.com/jiri"
+	"fuchsia.googlesource.com/jiri/git"
 	"fuchsia.googlesource.com/jiri/gitutil"
 	"fuchsia.googlesource.com/jiri/jiritest"
 	"fuchsia.googlesource.com/jiri/project"
@@ -54,7 +58,7 @@ func writeReadme(t *testing.T, jirix *jiri.X, projectDir, message string) {
 	if err := os.Chdir(projectDir); err != nil {
 		t.Fatalf("%v", err)
 	}
-	if err := gitutil.New(jirix, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com")).CommitFile(path, "creating README"); err != nil {
+	if err := gitutil.New(context.Background(), jirix, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com")).CommitFile(path, "creating README"); err != nil {
 		t.Fatalf("%v", err)
 	}
 }
@@ -84,7 +88,7 @@ func TestSnapshot(t *testing.T) {
 	for i := 0; i < numProjects; i++ {
 		writeReadme(t, fake.X, fake.Projects[remoteProjectName(i)], "revision 1")
 	}
-	if err := project.UpdateUniverse(fake.X, true, false, false, false, false, project.DefaultHookTimeout); err != nil {
+	if err := project.UpdateUniverse(context.Background(), fake.X, project.UpdateUniverseOpts{GC: true, RunHookTimeout: project.DefaultHookTimeout}); err != nil {
 		t.Fatalf("%v", err)
 	}
 
@@ -116,7 +120,7 @@ func TestSnapshot(t *testing.T) {
 	localX := fake.X.Clone(tool.ContextOpts{
 		Manifest: &snapshotFile,
 	})
-	if err := project.UpdateUniverse(localX, true, false, false, false, false, project.DefaultHookTimeout); err != nil {
+	if err := project.UpdateUniverse(context.Background(), localX, project.UpdateUniverseOpts{GC: true, RunHookTimeout: project.DefaultHookTimeout}); err != nil {
 		t.Fatalf("%v", err)
 	}
 	for i, _ := range remoteProjects {
@@ -124,3 +128,76 @@ func TestSnapshot(t *testing.T) {
 		checkReadme(t, fake.X, localProject, "revision 1")
 	}
 }
+
+// TestSnapshotTimeFormatAndRef tests creating a snapshot in a snapshot
+// directory, tagging it, and checking it out.
+func TestSnapshotTimeFormatAndRef(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+	defer func() {
+		snapshotFlags.timeFormat = ""
+		snapshotFlags.updateRef = ""
+	}()
+
+	numProjects := 2
+	for i := 0; i < numProjects; i++ {
+		if err := fake.CreateRemoteProject(remoteProjectName(i)); err != nil {
+			t.Fatal(err)
+		}
+		if err := fake.AddProject(project.Project{
+			Name:   remoteProjectName(i),
+			Path:   localProjectName(i),
+			Remote: fake.Projects[remoteProjectName(i)],
+		}); err != nil {
+			t.Fatal(err)
+		}
+		writeReadme(t, fake.X, fake.Projects[remoteProjectName(i)], "revision 1")
+	}
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(fake.X.Root, "snapshots")
+	snapshotFlags.timeFormat = "2006-01-02"
+	snapshotFlags.updateRef = "refs/tags/checkpoint"
+	stdout, _, err := runfunc(func() {
+		if err := runSnapshot(fake.X, []string{dir}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, time.Now().Format(snapshotFlags.timeFormat))
+	if got := strings.TrimSpace(stdout); got != file {
+		t.Errorf("got snapshot %q, want %q", got, file)
+	}
+
+	// Move the projects past the snapshot.
+	for i := 0; i < numProjects; i++ {
+		writeReadme(t, fake.X, fake.Projects[remoteProjectName(i)], "revision 2")
+	}
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := project.CheckoutSnapshot(context.Background(), fake.X, file, project.UpdateUniverseOpts{RunHookTimeout: project.DefaultHookTimeout}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < numProjects; i++ {
+		localProject := filepath.Join(fake.X.Root, localProjectName(i))
+		checkReadme(t, fake.X, localProject, "revision 1")
+		g := git.NewGit(context.Background(), localProject)
+		head, err := g.CurrentRevision()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tagged, err := g.CurrentRevisionForRef(snapshotFlags.updateRef)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tagged != head {
+			t.Errorf("project %s: got %s at %s, want %s", localProjectName(i), tagged, snapshotFlags.updateRef, head)
+		}
+	}
+}
@@ -5,6 +5,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -32,7 +33,8 @@ var cmdStatus = &cmdline.Command{
 	Long: `
 Prints status for the the projects. It runs git status -s across all the projects
 and prints it if there are some changes. It also shows status if the project is on
-a rev other then the one according to manifest(Named as JIRI_HEAD in git)
+a rev other then the one according to manifest(Named as JIRI_HEAD in git), and
+the submodules checked out at another commit than the one recorded in the project.
 `,
 }
 
@@ -94,7 +96,7 @@ func runStatus(jirix *jiri.X, args []string) error {
 			return fmt.Errorf("Error while getting status for project %q :%s", localProject.Name, err)
 		}
 		revisionMessage := ""
-		git := gitutil.New(jirix, gitutil.RootDirOpt(state.Project.Path))
+		git := gitutil.New(context.Background(), jirix, gitutil.RootDirOpt(state.Project.Path))
 		currentLog, err := git.OneLineLog(state.CurrentBranch.Revision)
 		if err != nil {
 			return fmt.Errorf("Error while getting status for project %q :%s", localProject.Name, err)
@@ -114,15 +116,18 @@ func runStatus(jirix *jiri.X, args []string) error {
 			}
 		}
 		if statusFlags.branch != "" || changes != "" || revisionMessage != "" ||
-			len(extraCommits) != 0 {
+			len(extraCommits) != 0 || len(state.DivergedSubmodules) != 0 || state.SubmodulesError != nil {
 			relativePath, err := filepath.Rel(cDir, localProject.Path)
 			if err != nil {
 				return err
 			}
+			if mirrorOf := remoteProject.MirrorOf; mirrorOf != "" {
+				relativePath += fmt.Sprintf(" (mirror of %s)", mirrorOf)
+			}
 			fmt.Printf("%s: %s", jirix.Color.Yellow(relativePath), revisionMessage)
 			fmt.Println()
 			branch := state.CurrentBranch.Name
-			if branch == "" {
+			if state.IsDetached() {
 				branch = fmt.Sprintf("DETACHED-HEAD(%s)", currentLog)
 			}
 			fmt.Printf("%s: %s\n", jirix.Color.Yellow("Branch"), branch)
@@ -132,6 +137,15 @@ func runStatus(jirix *jiri.X, args []string) error {
 					fmt.Println(colorFormatGitLog(jirix, commitLog))
 				}
 			}
+			if state.SubmodulesError != nil {
+				fmt.Printf("%s: %v\n", jirix.Color.Yellow("Submodules"), state.SubmodulesError)
+			}
+			if len(state.DivergedSubmodules) != 0 {
+				fmt.Printf("%s: %d submodule(s) not at their recorded commit\n", jirix.Color.Yellow("Submodules"), len(state.DivergedSubmodules))
+				for _, s := range state.DivergedSubmodules {
+					fmt.Printf("%s %s (recorded %s)\n", jirix.Color.Red("%s", s.Path), s.Revision, s.Recorded)
+				}
+			}
 			if changes != "" {
 				changesArr := strings.Split(changes, "\n")
 				for _, change := range changesArr {
@@ -149,8 +163,8 @@ func getStatus(jirix *jiri.X, local project.Project, remote project.Project, cur
 	var extraCommits []string
 	headRev := ""
 	changes := ""
-	scm := gitutil.New(jirix, gitutil.RootDirOpt(local.Path))
-	g := git.NewGit(local.Path)
+	scm := gitutil.New(context.Background(), jirix, gitutil.RootDirOpt(local.Path))
+	g := git.NewGit(context.Background(), local.Path)
 	var err error
 	if statusFlags.changes {
 		changes, err = scm.ShortStatus()
@@ -169,7 +183,7 @@ func getStatus(jirix *jiri.X, local project.Project, remote project.Project, cur
 	}
 
 	if currentBranch.Name != "" && statusFlags.commits {
-		remoteBranch := "remotes/origin/" + remote.RemoteBranch
+		remoteBranch := "remotes/" + local.GitRemoteName() + "/" + remote.RemoteBranch
 		if currentBranch.Tracking != nil {
 			remoteBranch = currentBranch.Tracking.Name
 		}
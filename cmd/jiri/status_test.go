@@ -5,6 +5,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -39,8 +40,8 @@ func createCommits(t *testing.T, fake *jiritest.FakeJiriRoot, localProjects []pr
 	var relativePaths []string
 	for i, localProject := range localProjects {
 		setDummyUser(t, fake.X, fake.Projects[localProject.Name])
-		gr := git.NewGit(fake.Projects[localProject.Name])
-		gitRemote := gitutil.New(fake.X, gitutil.RootDirOpt(fake.Projects[localProject.Name]))
+		gr := git.NewGit(context.Background(), fake.Projects[localProject.Name])
+		gitRemote := gitutil.New(context.Background(), fake.X, gitutil.RootDirOpt(fake.Projects[localProject.Name]))
 		writeFile(t, fake.X, fake.Projects[localProject.Name], "file1"+strconv.Itoa(i), "file1"+strconv.Itoa(i))
 		gitRemote.CreateAndCheckoutBranch("file-1")
 		gitRemote.CheckoutBranch("master")
@@ -91,7 +92,7 @@ func expectedOutput(t *testing.T, fake *jiritest.FakeJiriRoot, localProjects []p
 		includeProject := (statusFlags.branch == "" && (includeForNotHead || includeForChanges || includeForCommits)) ||
 			(statusFlags.branch != "" && statusFlags.branch == currentBranch[i])
 		if includeProject {
-			gitLocal := gitutil.New(fake.X, gitutil.RootDirOpt(localProject.Path))
+			gitLocal := gitutil.New(context.Background(), fake.X, gitutil.RootDirOpt(localProject.Path))
 			currentLog, err := gitLocal.OneLineLog(currentCommits[i])
 			if err != nil {
 				t.Error(err)
@@ -152,9 +153,9 @@ func TestStatus(t *testing.T) {
 	}
 
 	// Test when HEAD is on different revsion
-	gitLocal := gitutil.New(fake.X, gitutil.RootDirOpt(localProjects[1].Path))
+	gitLocal := gitutil.New(context.Background(), fake.X, gitutil.RootDirOpt(localProjects[1].Path))
 	gitLocal.CheckoutBranch("HEAD~1")
-	gitLocal = gitutil.New(fake.X, gitutil.RootDirOpt(localProjects[2].Path))
+	gitLocal = gitutil.New(context.Background(), fake.X, gitutil.RootDirOpt(localProjects[2].Path))
 	gitLocal.CheckoutBranch("file-2")
 	got = executeStatus(t, fake, "")
 	currentCommits := []string{latestCommitRevs[0], file2CommitRevs[1], file1CommitRevs[2]}
@@ -202,7 +203,7 @@ func statusFlagsTest(t *testing.T) {
 	}
 	gitLocals := make([]*gitutil.Git, numProjects)
 	for i, localProject := range localProjects {
-		gitLocal := gitutil.New(fake.X, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"), gitutil.RootDirOpt(localProject.Path))
+		gitLocal := gitutil.New(context.Background(), fake.X, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"), gitutil.RootDirOpt(localProject.Path))
 		gitLocals[i] = gitLocal
 	}
 
@@ -244,7 +245,7 @@ func statusFlagsTest(t *testing.T) {
 		}
 		extraCommits5 = append([]string{log}, extraCommits5...)
 	}
-	gl5 := git.NewGit(localProjects[5].Path)
+	gl5 := git.NewGit(context.Background(), localProjects[5].Path)
 	currentCommit5, err := gl5.CurrentRevision()
 	if err != nil {
 		t.Error(err)
@@ -316,6 +317,42 @@ func TestStatusFlags(t *testing.T) {
 	statusFlagsTest(t)
 }
 
+// TestStatusRemoteName checks that the commits not merged to the remote are
+// listed for projects whose git remote isn't named origin.
+func TestStatusRemoteName(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+	if err := fake.CreateRemoteProject("project"); err != nil {
+		t.Fatal(err)
+	}
+	p := project.Project{
+		Name:       "project",
+		Path:       filepath.Join(fake.X.Root, "project"),
+		Remote:     fake.Projects["project"],
+		RemoteName: "upstream",
+	}
+	if err := fake.AddProject(p); err != nil {
+		t.Fatal(err)
+	}
+	setDummyUser(t, fake.X, fake.Projects[p.Name])
+	writeFile(t, fake.X, fake.Projects[p.Name], "file", "initial")
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	setDummyUser(t, fake.X, p.Path)
+	if err := gitutil.New(context.Background(), fake.X, gitutil.RootDirOpt(p.Path)).CreateAndCheckoutBranch("feature"); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fake.X, p.Path, "file", "local")
+
+	setDefaultStatusFlags()
+	statusFlags.changes = false
+	got := executeStatus(t, fake, "project")
+	if want := "1 commit(s) not merged to remote"; !strings.Contains(got, want) {
+		t.Errorf("got status %q, want it to contain %q", got, want)
+	}
+}
+
 func equal(first, second string) bool {
 	firstStrings := strings.Split(first, "\n\n")
 	secondStrings := strings.Split(second, "\n\n")
@@ -351,7 +388,7 @@ func writeFile(t *testing.T, jirix *jiri.X, projectDir, fileName, message string
 	if err := ioutil.WriteFile(path, []byte(message), perm); err != nil {
 		t.Fatalf("WriteFile(%s, %d) failed: %s", path, perm, err)
 	}
-	if err := gitutil.New(jirix, gitutil.RootDirOpt(projectDir),
+	if err := gitutil.New(context.Background(), jirix, gitutil.RootDirOpt(projectDir),
 		gitutil.UserNameOpt("John Doe"),
 		gitutil.UserEmailOpt("john.doe@example.com")).CommitFile(path,
 		message); err != nil {
@@ -360,7 +397,7 @@ func writeFile(t *testing.T, jirix *jiri.X, projectDir, fileName, message string
 }
 
 func setDummyUser(t *testing.T, jirix *jiri.X, projectDir string) {
-	git := gitutil.New(jirix, gitutil.RootDirOpt(projectDir))
+	git := gitutil.New(context.Background(), jirix, gitutil.RootDirOpt(projectDir))
 	if err := git.Config("user.email", "john.doe@example.com"); err != nil {
 		t.Fatal(err)
 	}
@@ -0,0 +1,79 @@
+// Copyright 2017 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"fuchsia.googlesource.com/jiri"
+	"fuchsia.googlesource.com/jiri/cmdline"
+	"fuchsia.googlesource.com/jiri/project"
+)
+
+var targetsFlags struct {
+	localManifest bool
+}
+
+func init() {
+	cmdTargets.Flags.BoolVar(&targetsFlags.localManifest, "local-manifest", false, "Use local manifest")
+}
+
+var cmdTargets = &cmdline.Command{
+	Runner: jiri.RunnerFunc(runTargets),
+	Name:   "targets",
+	Short:  "Print the revisions projects would be updated to",
+	Long: `
+Resolves the manifest like "jiri update" does, and prints for each project the
+revision it would be checked out at: the revision it is pinned to, or the
+current tip of its remote branch.  The projects themselves are not fetched nor
+updated.
+`,
+}
+
+func runTargets(jirix *jiri.X, args []string) (e error) {
+	if len(args) != 0 {
+		return jirix.UsageErrorf("unexpected number of arguments")
+	}
+	localProjects, err := project.LocalProjects(jirix, project.FastScan)
+	if err != nil {
+		return err
+	}
+	remoteProjects, _, tmpLoadDir, err := project.LoadUpdatedManifest(jirix, localProjects, targetsFlags.localManifest)
+	if tmpLoadDir != "" {
+		defer func() {
+			if err := os.RemoveAll(tmpLoadDir); err != nil && e == nil {
+				e = err
+			}
+		}()
+	}
+	if err != nil {
+		return err
+	}
+	// Lazy projects which are not checked out yet are not updated.
+	for key, p := range remoteProjects {
+		if _, ok := localProjects[key]; !ok && p.Lazy {
+			delete(remoteProjects, key)
+		}
+	}
+	targets, err := project.TargetRevisions(jirix, remoteProjects)
+	if err != nil {
+		return err
+	}
+	var keys project.ProjectKeys
+	width := 0
+	for key, p := range remoteProjects {
+		keys = append(keys, key)
+		if len(p.Name) > width {
+			width = len(p.Name)
+		}
+	}
+	sort.Sort(keys)
+	for _, key := range keys {
+		fmt.Printf("%-*s %s\n", width, remoteProjects[key].Name, targets[key])
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+// Copyright 2017 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"fuchsia.googlesource.com/jiri/git"
+)
+
+func TestTargets(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Move the remote branches of all the projects forward, after pinning
+	// project 2 to its current revision.
+	pinned, err := git.NewGit(context.Background(), fake.Projects[localProjects[2].Name]).CurrentRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := fake.ReadRemoteManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mp, err := m.FindProject(localProjects[2].Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mp.Revision = pinned
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range localProjects {
+		writeReadme(t, fake.X, fake.Projects[p.Name], "new readme")
+	}
+
+	var runErr error
+	stdout, _, err := runfunc(func() {
+		runErr = runTargets(fake.X, nil)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runErr != nil {
+		t.Fatal(runErr)
+	}
+	targets := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(stdout), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			t.Fatalf("unexpected output line %q", line)
+		}
+		targets[fields[0]] = fields[1]
+	}
+	if got, want := targets[localProjects[2].Name], pinned; got != want {
+		t.Errorf("got target %s for pinned project, want %s", got, want)
+	}
+
+	// The projects are not updated, and end up at their targets once they are.
+	for _, p := range localProjects {
+		if rev, err := git.NewGit(context.Background(), p.Path).CurrentRevision(); err != nil {
+			t.Fatal(err)
+		} else if rev == targets[p.Name] && p.Name != localProjects[2].Name {
+			t.Errorf("project %s was updated to its target", p.Name)
+		}
+	}
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range localProjects {
+		if rev, err := git.NewGit(context.Background(), p.Path).CurrentRevision(); err != nil {
+			t.Fatal(err)
+		} else if got, want := rev, targets[p.Name]; got != want {
+			t.Errorf("project %s updated to %s, want its target %s", p.Name, got, want)
+		}
+	}
+}
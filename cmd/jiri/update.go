@@ -5,7 +5,15 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"math"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
 	"fuchsia.googlesource.com/jiri"
 	"fuchsia.googlesource.com/jiri/cmdline"
@@ -16,6 +24,7 @@ import (
 
 var (
 	gcFlag              bool
+	gcForceFlag         bool
 	localManifestFlag   bool
 	attemptsFlag        int
 	autoupdateFlag      bool
@@ -25,12 +34,42 @@ var (
 	rebaseAllFlag       bool
 	rebaseCurrentFlag   bool
 	rebaseTrackedFlag   bool
+	shallowBelowFlag    uint64
+	moveRecloneFlag     bool
+	ephemeralRootFlag   string
+	envFileFlag         string
+	strictNestingFlag   bool
+	mirrorFlag          string
+	strictGitFlag       bool
+	skipHookFlags       repeatedFlag
+	hookJobsFlag        uint
+	referenceFlags      repeatedFlag
+	networkTimeoutFlag  time.Duration
+	snapshotFileFlag    string
+	requirePinnedFlag   bool
+	runHooksFlag        bool
+	metricsAddrFlag     string
+	missingRevisionFlag string
 )
 
+// repeatedFlag is a flag which can be provided several times, collecting all
+// its values.
+type repeatedFlag []string
+
+func (f *repeatedFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *repeatedFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
 func init() {
 	tool.InitializeProjectFlags(&cmdUpdate.Flags)
 
 	cmdUpdate.Flags.BoolVar(&gcFlag, "gc", false, "Garbage collect obsolete repositories.")
+	cmdUpdate.Flags.BoolVar(&gcForceFlag, "gc-force", false, "Garbage collect obsolete repositories even if they contain local branches or unpushed commits. Implies -gc.")
 	cmdUpdate.Flags.BoolVar(&localManifestFlag, "local-manifest", false, "Use local manifest")
 	cmdUpdate.Flags.IntVar(&attemptsFlag, "attempts", 1, "Number of attempts before failing.")
 	cmdUpdate.Flags.BoolVar(&autoupdateFlag, "autoupdate", true, "Automatically update to the new version.")
@@ -40,6 +79,22 @@ func init() {
 	cmdUpdate.Flags.BoolVar(&rebaseAllFlag, "rebase-all", false, "Rebase all tracked branches. Also rebase all untracked bracnhes if -rebase-untracked is passed")
 	cmdUpdate.Flags.BoolVar(&rebaseCurrentFlag, "rebase-current", false, "Deprecated. Implies -rebase-tracked. Would be removed in future.")
 	cmdUpdate.Flags.BoolVar(&rebaseTrackedFlag, "rebase-tracked", false, "Rebase current tracked branches instead of fast-forwarding them.")
+	cmdUpdate.Flags.Uint64Var(&shallowBelowFlag, "shallow-below-free-space", 0, "Clone new projects with a history depth of 1 when free disk space under the jiri root is below this many MiB. Disabled when 0.")
+	cmdUpdate.Flags.BoolVar(&moveRecloneFlag, "move-reclone", false, "Clone projects whose path changed at their new path, discarding their local branches and changes, instead of moving them.")
+	cmdUpdate.Flags.StringVar(&envFileFlag, "env-file", "", "After a successful update, write this file setting JIRI_PROJECT_<NAME> to the absolute path of every project, to be sourced by shells or included by makefiles.  Paths which shells or make would need quoted are refused.")
+	cmdUpdate.Flags.BoolVar(&strictNestingFlag, "strict-nesting", false, "Fail instead of warning when a project is nested in another project which doesn't ignore it.")
+	cmdUpdate.Flags.StringVar(&mirrorFlag, "mirror", "", "URL prefix of a read-through mirror to fetch projects from, falling back to their remotes when the mirror fails or lacks a revision. The mirror of https://host/repo is <mirror>/host/repo.")
+	cmdUpdate.Flags.BoolVar(&strictGitFlag, "strict-git", false, "Log all the stderr output of git clones and fetches, including the warnings known to be benign, for debugging.")
+	cmdUpdate.Flags.BoolVar(&runHooksFlag, "run-hooks", true, "Run the hooks of the manifest. Along with -autoupdate, which controls the update of jiri itself, this allows updating the projects without running the hooks, or without updating jiri.")
+	cmdUpdate.Flags.Var(&skipHookFlags, "skip-hook", "Don't run the hooks with this name. Can be repeated.")
+	cmdUpdate.Flags.UintVar(&hookJobsFlag, "hook-jobs", 0, "Maximum number of hooks to run at once. All the hooks which don't depend on each other run at once when 0.")
+	cmdUpdate.Flags.Var(&referenceFlags, "reference", "Existing repository, unmanaged by jiri, which new clones borrow objects from through git alternates, as <path> for all the projects or <project>=<path> for the project with that name. Can be repeated.")
+	cmdUpdate.Flags.DurationVar(&networkTimeoutFlag, "network-timeout", 0, "Abort git fetches and clones transferring less than 1 KB/s over HTTP for this long, e.g. 2m. Disabled when 0.")
+	cmdUpdate.Flags.StringVar(&snapshotFileFlag, "snapshot-manifest", "", "Update to this snapshot, a file, URL or name of a snapshot of the update history like \"second-latest\", instead of the manifest, handling moved and deleted projects like updates from the manifest. Useful to bisect regressions.")
+	cmdUpdate.Flags.BoolVar(&requirePinnedFlag, "require-pinned", false, "Fail when a project of the manifest isn't pinned to a revision, i.e. tracks the tip of its remote branch, listing these projects.")
+	cmdUpdate.Flags.StringVar(&missingRevisionFlag, "allow-missing-revision", "fail", "What to do when the revision of a project is no longer present on its remote, e.g. after a force push: fail, or skip the project, leaving it untouched or not creating it.")
+	cmdUpdate.Flags.StringVar(&metricsAddrFlag, "metrics-addr", "", "Address, e.g. :9090, on which to serve the metrics of the update while it runs, in the Prometheus text format at /metrics and through expvar at /debug/vars.")
+	cmdUpdate.Flags.StringVar(&ephemeralRootFlag, "ephemeral-root", "", "Check out the manifest of the jiri root in this new or empty directory instead, leaving the projects of the jiri root untouched.")
 }
 
 // cmdUpdate represents the "jiri update" command.
@@ -52,15 +107,69 @@ Updates all projects. The sequence in which the individual updates happen
 guarantees that we end up with a consistent workspace. The set of projects
 to update is described in the manifest.
 
+Given the keys or names of projects of the manifest, only these projects and
+the projects nested in them are updated, along with their hooks, leaving the
+other projects untouched.  Obsolete projects aren't deleted then.
+
+With -ephemeral-root, the manifest is checked out in a new jiri root in the
+given directory instead, e.g. to test that it can be checked out without
+disturbing the current one.  The directory can be deleted afterwards.
+
 Run "jiri help manifest" for details on manifests.
 `,
-	ArgsName: "<file or url>",
-	ArgsLong: "<file or url> points to snapshot to checkout.",
+	ArgsName: "<file or url> | <project ...>",
+	ArgsLong: `
+<file or url> points to snapshot to checkout.  <project ...> are the keys or
+names of the projects to update, when the single argument isn't an existing
+file or a URL.
+`,
 }
 
 func runUpdate(jirix *jiri.X, args []string) error {
-	if len(args) > 1 {
-		return jirix.UsageErrorf("unexpected number of arguments")
+	var snapshot string
+	var projects []string
+	if len(args) == 1 && isSnapshotArg(args[0]) {
+		snapshot = args[0]
+	} else {
+		projects = args
+	}
+
+	if snapshot != "" && snapshotFileFlag != "" {
+		return jirix.UsageErrorf("-snapshot-manifest cannot be combined with a snapshot argument")
+	}
+	if len(projects) != 0 && snapshotFileFlag != "" {
+		return jirix.UsageErrorf("-snapshot-manifest cannot be combined with project arguments")
+	}
+	if len(projects) != 0 && (gcFlag || gcForceFlag) {
+		return jirix.UsageErrorf("-gc cannot be combined with project arguments")
+	}
+	// The flag is in MiB, which must fit in bytes.
+	if shallowBelowFlag > math.MaxUint64>>20 {
+		return jirix.UsageErrorf("-shallow-below-free-space %d is too large, want at most %d MiB", shallowBelowFlag, uint64(math.MaxUint64>>20))
+	}
+	opts := project.UpdateUniverseOpts{
+		GC:                    gcFlag || gcForceFlag,
+		GCForce:               gcForceFlag,
+		LocalManifest:         localManifestFlag,
+		RebaseTracked:         rebaseTrackedFlag,
+		RebaseUntracked:       rebaseUntrackedFlag,
+		RebaseAll:             rebaseAllFlag,
+		RunHookTimeout:        hookTimeoutFlag,
+		HookJobs:              hookJobsFlag,
+		SkipHooks:             skipHookFlags,
+		NoHooks:               !runHooksFlag,
+		RequirePinned:         requirePinnedFlag,
+		MoveReclone:           moveRecloneFlag,
+		StrictNesting:         strictNestingFlag,
+		ShallowBelowFreeSpace: shallowBelowFlag << 20,
+		Mirror:                mirrorFlag,
+	}
+	switch missingRevisionFlag {
+	case "fail":
+	case "skip":
+		opts.SkipMissingRevisions = true
+	default:
+		return jirix.UsageErrorf("invalid -allow-missing-revision %q, want fail or skip", missingRevisionFlag)
 	}
 
 	if autoupdateFlag {
@@ -72,18 +181,61 @@ func runUpdate(jirix *jiri.X, args []string) error {
 	}
 	if rebaseCurrentFlag {
 		jirix.Logger.Warningf("Flag -rebase-current has been deprecated, please use -rebase-tracked.\n\n")
-		rebaseTrackedFlag = true
+		opts.RebaseTracked = true
+	}
+	jirix.StrictGit = strictGitFlag
+	jirix.NetworkTimeout = networkTimeoutFlag
+	jirix.MetricsAddr = metricsAddrFlag
+	if len(referenceFlags) != 0 {
+		references, err := parseReferences(referenceFlags)
+		if err != nil {
+			return jirix.UsageErrorf("%v", err)
+		}
+		opts.References = references
 	}
+	if ephemeralRootFlag != "" {
+		var err error
+		if jirix, err = project.NewEphemeralRoot(jirix, ephemeralRootFlag); err != nil {
+			return err
+		}
+	}
+
+	if jirix.MetricsAddr != "" {
+		l, err := project.ServeMetrics(jirix.MetricsAddr)
+		if err != nil {
+			return err
+		}
+		defer l.Close()
+	}
+
+	// Interrupting or terminating jiri kills the git fetches and clones of the
+	// update and stops it before its next project, instead of leaving them
+	// running.  A second interrupt kills jiri right away.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
 
 	// Update all projects to their latest version.
-	// Attempt <attemptsFlag> times before failing.
+	// Attempt <attemptsFlag> times before failing, unless interrupted.  The
+	// on-failure hooks only run when the last attempt fails.
+	attempt := 0
 	err := retry.Function(jirix.Context, func() error {
-		if len(args) > 0 {
-			return project.CheckoutSnapshot(jirix, args[0], gcFlag, hookTimeoutFlag)
+		attempt++
+		opts := opts
+		opts.SkipOnFailureHooks = attempt < attemptsFlag
+		if snapshot != "" {
+			return project.CheckoutSnapshot(ctx, jirix, snapshot, opts)
+		} else if snapshotFileFlag != "" {
+			return project.UpdateUniverseFromSnapshot(ctx, jirix, snapshotFileFlag, opts)
+		} else if len(projects) != 0 {
+			return project.UpdateUniverseProjects(ctx, jirix, projects, opts)
 		} else {
-			return project.UpdateUniverse(jirix, gcFlag, localManifestFlag, rebaseTrackedFlag, rebaseUntrackedFlag, rebaseAllFlag, hookTimeoutFlag)
+			return project.UpdateUniverse(ctx, jirix, opts)
 		}
-	}, retry.AttemptsOpt(attemptsFlag))
+	}, retry.AttemptsOpt(attemptsFlag), retry.ContextOpt{Context: ctx})
 
 	if err2 := project.WriteUpdateHistorySnapshot(jirix, "", localManifestFlag); err2 != nil {
 		if err != nil {
@@ -97,5 +249,43 @@ func runUpdate(jirix *jiri.X, args []string) error {
 	if jirix.Failures() != 0 {
 		return fmt.Errorf("Project update completed with non-fatal errors")
 	}
+	if envFileFlag != "" {
+		return project.WriteProjectEnvFile(jirix, envFileFlag)
+	}
 	return nil
 }
+
+// isSnapshotArg returns whether the argument of update is a snapshot, i.e. a
+// URL or an existing file, rather than a project.
+func isSnapshotArg(arg string) bool {
+	if strings.Contains(arg, "://") {
+		return true
+	}
+	fi, err := os.Stat(arg)
+	return err == nil && !fi.IsDir()
+}
+
+// parseReferences returns the absolute paths of the repositories given by the
+// -reference flags, keyed by project name, the empty name standing for all the
+// projects.
+func parseReferences(flags []string) (map[string]string, error) {
+	references := make(map[string]string)
+	for _, flag := range flags {
+		name, path := "", flag
+		if i := strings.Index(flag, "="); i >= 0 {
+			name, path = flag[:i], flag[i+1:]
+		}
+		if path == "" {
+			return nil, fmt.Errorf("invalid -reference %q, want <path> or <project>=<path>", flag)
+		}
+		if _, ok := references[name]; ok {
+			return nil, fmt.Errorf("several -reference flags for project %q", name)
+		}
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		references[name] = abs
+	}
+	return references, nil
+}
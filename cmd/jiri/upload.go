@@ -5,6 +5,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/url"
 	"os"
@@ -92,7 +93,7 @@ func runUpload(jirix *jiri.X, _ []string) error {
 			currentBranch = uploadBranchFlag
 		}
 	} else {
-		scm := gitutil.New(jirix, gitutil.RootDirOpt(p.Path))
+		scm := gitutil.New(context.Background(), jirix, gitutil.RootDirOpt(p.Path))
 		if !scm.IsOnBranch() {
 			return fmt.Errorf("Current project is not on any branch.")
 		}
@@ -114,7 +115,7 @@ func runUpload(jirix *jiri.X, _ []string) error {
 	}
 	if uploadMultipartFlag {
 		for _, project := range localProjects {
-			scm := gitutil.New(jirix, gitutil.RootDirOpt(project.Path))
+			scm := gitutil.New(context.Background(), jirix, gitutil.RootDirOpt(project.Path))
 			if scm.IsOnBranch() {
 				branch, err := scm.CurrentBranchName()
 				if err != nil {
@@ -151,14 +152,17 @@ func runUpload(jirix *jiri.X, _ []string) error {
 		return err
 	}
 	for _, project := range projectsToProcess {
-		scm := gitutil.New(jirix, gitutil.RootDirOpt(project.Path))
+		scm := gitutil.New(context.Background(), jirix, gitutil.RootDirOpt(project.Path))
 		relativePath, err := filepath.Rel(cwd, project.Path)
 		if err != nil {
 			// Just use the full path if an error occurred.
 			relativePath = project.Path
 		}
+		if project.LocalConfig.NoPush {
+			return fmt.Errorf("Project %s(%s) is configured with no-push, use 'jiri project-config -no-push=false' to allow uploading it.", project.Name, relativePath)
+		}
 		if uploadRebaseFlag {
-			if changes, err := git.NewGit(project.Path).HasUncommittedChanges(); err != nil {
+			if changes, err := git.NewGit(context.Background(), project.Path).HasUncommittedChanges(); err != nil {
 				return err
 			} else if changes {
 				return fmt.Errorf("Project %s(%s) has uncommited changes, please commit them or stash them. Cannot rebase before pushing.", project.Name, relativePath)
@@ -218,11 +222,12 @@ func runUpload(jirix *jiri.X, _ []string) error {
 	// Rebase all projects before pushing
 	if uploadRebaseFlag {
 		for _, gerritPushOption := range gerritPushOptions {
-			scm := gitutil.New(jirix, gitutil.RootDirOpt(gerritPushOption.Project.Path))
-			if err := scm.Fetch("origin"); err != nil {
+			scm := gitutil.New(context.Background(), jirix, gitutil.RootDirOpt(gerritPushOption.Project.Path))
+			remote := gerritPushOption.Project.GitRemoteName()
+			if err := scm.Fetch(remote); err != nil {
 				return err
 			}
-			remoteBranch := "remotes/origin/" + gerritPushOption.CLOpts.RemoteBranch
+			remoteBranch := "remotes/" + remote + "/" + gerritPushOption.CLOpts.RemoteBranch
 			if err = scm.Rebase(remoteBranch); err != nil {
 				if err2 := scm.RebaseAbort(); err2 != nil {
 					return err2
@@ -5,6 +5,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -86,7 +87,7 @@ func assertUploadPushedFilesToRef(t *testing.T, jirix *jiri.X, gerritPath, pushe
 	if err := os.Chdir(gerritPath); err != nil {
 		t.Fatal(err)
 	}
-	if err := gitutil.New(jirix).CheckoutBranch(pushedRef); err != nil {
+	if err := gitutil.New(context.Background(), jirix).CheckoutBranch(pushedRef); err != nil {
 		t.Fatal(err)
 	}
 	assertFilesCommitted(t, jirix, files)
@@ -122,7 +123,7 @@ func TestUpload(t *testing.T) {
 		t.Fatal(err)
 	}
 	branch := "my-branch"
-	git := gitutil.New(fake.X, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"))
+	git := gitutil.New(context.Background(), fake.X, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"))
 	if err := git.CreateBranchWithUpstream(branch, "origin/master"); err != nil {
 		t.Fatal(err)
 	}
@@ -169,7 +170,7 @@ func TestUploadMultipart(t *testing.T) {
 		if err := os.Chdir(localProjects[i].Path); err != nil {
 			t.Fatal(err)
 		}
-		git := gitutil.New(fake.X, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"))
+		git := gitutil.New(context.Background(), fake.X, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"))
 		if err := git.CreateBranchWithUpstream(branch, "origin/master"); err != nil {
 			t.Fatal(err)
 		}
@@ -221,7 +222,7 @@ func TestUploadMultipartWithBranchFlagSimple(t *testing.T) {
 		if err := os.Chdir(localProjects[i].Path); err != nil {
 			t.Fatal(err)
 		}
-		git := gitutil.New(fake.X, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"))
+		git := gitutil.New(context.Background(), fake.X, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"))
 		if err := git.CreateBranchWithUpstream(branch, "origin/master"); err != nil {
 			t.Fatalf("%v", err)
 		}
@@ -268,7 +269,7 @@ func TestUploadRebase(t *testing.T) {
 		t.Fatal(err)
 	}
 	branch := "my-branch"
-	git := gitutil.New(fake.X, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"))
+	git := gitutil.New(context.Background(), fake.X, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"))
 	if err := git.Config("user.email", "john.doe@example.com"); err != nil {
 		t.Fatal(err)
 	}
@@ -324,7 +325,7 @@ func TestUploadMultipleCommits(t *testing.T) {
 		t.Fatal(err)
 	}
 	branch := "my-branch"
-	git := gitutil.New(fake.X, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"))
+	git := gitutil.New(context.Background(), fake.X, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"))
 	if err := git.CreateBranchWithUpstream(branch, "origin/master"); err != nil {
 		t.Fatal(err)
 	}
@@ -364,7 +365,7 @@ func TestUploadThrowsErrorWhenNotOnBranch(t *testing.T) {
 	if err := os.Chdir(localProjects[1].Path); err != nil {
 		t.Fatal(err)
 	}
-	git := gitutil.New(fake.X, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"))
+	git := gitutil.New(context.Background(), fake.X, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"))
 	if err := git.CheckoutBranch("HEAD", gitutil.DetachOpt(true)); err != nil {
 		t.Fatal(err)
 	}
@@ -395,7 +396,7 @@ func TestUploadFailsWhenNoGerritHost(t *testing.T) {
 		t.Fatal(err)
 	}
 	branch := "my-branch"
-	git := gitutil.New(fake.X, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"))
+	git := gitutil.New(context.Background(), fake.X, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"))
 	if err := git.CreateBranchWithUpstream(branch, "origin/master"); err != nil {
 		t.Fatal(err)
 	}
@@ -412,6 +413,45 @@ func TestUploadFailsWhenNoGerritHost(t *testing.T) {
 	}
 }
 
+func TestUploadFailsWhenNoPush(t *testing.T) {
+	defer resetFlags()
+	fake, localProjects, cleanup := setupUploadTest(t)
+	defer cleanup()
+	currentDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.Chdir(currentDir); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	if err := os.Chdir(localProjects[1].Path); err != nil {
+		t.Fatal(err)
+	}
+	branch := "my-branch"
+	git := gitutil.New(context.Background(), fake.X, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"))
+	if err := git.CreateBranchWithUpstream(branch, "origin/master"); err != nil {
+		t.Fatal(err)
+	}
+	if err := git.CheckoutBranch(branch); err != nil {
+		t.Fatal(err)
+	}
+	files := []string{"file1"}
+	commitFiles(t, fake.X, files)
+
+	if err := runProjectSetNoPush(fake.X, []string{localProjects[1].Name}); err != nil {
+		t.Fatal(err)
+	}
+	gerritPath := fake.Projects[localProjects[1].Name]
+	uploadHostFlag = gerritPath
+	if err := runUpload(fake.X, []string{}); err == nil {
+		t.Fatalf("Should have got a error here.")
+	} else if !strings.Contains(err.Error(), "no-push") {
+		t.Fatalf("Wrong error: %s", err)
+	}
+}
+
 func TestUploadUntrackedBranch(t *testing.T) {
 	defer resetFlags()
 	fake, localProjects, cleanup := setupUploadTest(t)
@@ -429,7 +469,7 @@ func TestUploadUntrackedBranch(t *testing.T) {
 		t.Fatal(err)
 	}
 	branch := "my-branch"
-	git := gitutil.New(fake.X, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"))
+	git := gitutil.New(context.Background(), fake.X, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"))
 	if err := git.CreateAndCheckoutBranch(branch); err != nil {
 		t.Fatal(err)
 	}
@@ -461,7 +501,7 @@ func commitFile(t *testing.T, jirix *jiri.X, filename string, content string) {
 		t.Fatalf("%v", err)
 	}
 	commitMessage := "Commit " + filename
-	if err := gitutil.New(jirix, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com")).CommitFile(filename, commitMessage); err != nil {
+	if err := gitutil.New(context.Background(), jirix, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com")).CommitFile(filename, commitMessage); err != nil {
 		t.Fatalf("%v", err)
 	}
 }
@@ -480,7 +520,7 @@ func commitFiles(t *testing.T, jirix *jiri.X, filenames []string) {
 func assertFilesCommitted(t *testing.T, jirix *jiri.X, files []string) {
 	assertFilesExist(t, jirix, files)
 	for _, file := range files {
-		if !gitutil.New(jirix).IsFileCommitted(file) {
+		if !gitutil.New(context.Background(), jirix).IsFileCommitted(file) {
 			t.Fatalf("expected file %v to be committed but it is not", file)
 		}
 	}
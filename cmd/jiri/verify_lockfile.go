@@ -0,0 +1,89 @@
+// Copyright 2017 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"fuchsia.googlesource.com/jiri"
+	"fuchsia.googlesource.com/jiri/cmdline"
+	"fuchsia.googlesource.com/jiri/git"
+	"fuchsia.googlesource.com/jiri/project"
+)
+
+var cmdVerifyLockfile = &cmdline.Command{
+	Runner: jiri.RunnerFunc(runVerifyLockfile),
+	Name:   "verify-lockfile",
+	Short:  "Check that the projects are at the revisions of the lock file",
+	Long: `
+Checks that the checked out projects are exactly the projects of the lock file,
+each at its locked revision.  The lock file is a snapshot, as created by "jiri
+snapshot", and defaults to the .jiri_lock file in the root directory.
+
+The mismatches are listed, i.e. the projects at another revision, the projects
+of the lock file that aren't checked out and the checked out projects missing
+from the lock file, and the command exits with code 1 if there are any.
+`,
+	ArgsName: "[<lockfile>]",
+	ArgsLong: "<lockfile> is the lock file, defaulting to <root>/.jiri_lock.",
+}
+
+func runVerifyLockfile(jirix *jiri.X, args []string) error {
+	if len(args) > 1 {
+		return jirix.UsageErrorf("unexpected number of arguments")
+	}
+	lockfile := jirix.JiriLockFile()
+	if len(args) == 1 {
+		lockfile = args[0]
+	}
+	lockedProjects, _, err := project.LoadSnapshotFile(jirix, lockfile)
+	if err != nil {
+		return err
+	}
+	localProjects, err := project.LocalProjects(jirix, project.FastScan)
+	if err != nil {
+		return err
+	}
+
+	mismatches := make(map[project.ProjectKey]string)
+	for key, p := range lockedProjects {
+		local, ok := localProjects[key]
+		if !ok {
+			mismatches[key] = "not checked out"
+			continue
+		}
+		revision, err := git.NewGit(context.Background(), local.Path).CurrentRevision()
+		if err != nil {
+			return fmt.Errorf("Cannot get revision of project %q: %v", local.Name, err)
+		}
+		if revision != p.Revision {
+			mismatches[key] = fmt.Sprintf("at %s, locked at %s", shortRevision(revision), shortRevision(p.Revision))
+		}
+	}
+	for key := range localProjects {
+		if _, ok := lockedProjects[key]; !ok {
+			mismatches[key] = "not in the lock file"
+		}
+	}
+	if len(mismatches) == 0 {
+		return nil
+	}
+
+	var keys project.ProjectKeys
+	for key := range mismatches {
+		keys = append(keys, key)
+	}
+	sort.Sort(keys)
+	for _, key := range keys {
+		p, ok := localProjects[key]
+		if !ok {
+			p = lockedProjects[key]
+		}
+		fmt.Printf("%s: %s\n", p.Name, mismatches[key])
+	}
+	return cmdline.ErrExitCode(1)
+}
@@ -0,0 +1,47 @@
+// Copyright 2017 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+
+	"fuchsia.googlesource.com/jiri/cmdline"
+	"fuchsia.googlesource.com/jiri/project"
+)
+
+func TestVerifyLockfile(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := project.CreateSnapshot(fake.X, fake.X.JiriLockFile(), false); err != nil {
+		t.Fatal(err)
+	}
+	run := func() (string, error) {
+		var runErr error
+		stdout, _, err := runfunc(func() {
+			runErr = runVerifyLockfile(fake.X, nil)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stdout, runErr
+	}
+
+	if stdout, err := run(); err != nil {
+		t.Fatalf("checkout matching the lock file reported mismatches: %v\n%s", err, stdout)
+	}
+
+	// Project 1 drifts from the lock file.
+	writeReadme(t, fake.X, localProjects[1].Path, "local readme")
+	stdout, err := run()
+	if err != cmdline.ErrExitCode(1) {
+		t.Errorf("got error %v, want %v", err, cmdline.ErrExitCode(1))
+	}
+	if want := localProjects[1].Name + ": at "; len(stdout) < len(want) || stdout[:len(want)] != want {
+		t.Errorf("got output %q, want a mismatch of project %s", stdout, localProjects[1].Name)
+	}
+}
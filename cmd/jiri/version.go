@@ -7,6 +7,9 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
 
 	"fuchsia.googlesource.com/jiri"
 	"fuchsia.googlesource.com/jiri/cmdline"
@@ -19,7 +22,9 @@ var cmdVersion = &cmdline.Command{
 	Name:   "version",
 	Short:  "Print the jiri version",
 	Long: `
-Print the Git commit revision jiri was built from and the build date.
+Print the Git commit revision jiri was built from and the build date, followed
+by the version of jiri which last updated the root, as recorded in its
+.jiri_version file.
 `,
 }
 
@@ -34,5 +39,14 @@ func runVersion(jirix *jiri.X, args []string) error {
 
 	fmt.Printf("%s\n", versionString.String())
 
+	data, err := ioutil.ReadFile(jirix.JiriVersionFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	fmt.Printf("Last update: Jiri %s\n", strings.TrimSpace(string(data)))
+
 	return nil
 }
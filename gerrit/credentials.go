@@ -6,6 +6,7 @@ package gerrit
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
 	"net/url"
@@ -47,7 +48,7 @@ func hostCredentials(jirix *jiri.X, hostUrl *url.URL) (_ *credentials, e error)
 	}
 
 	// Look for the host credentials in the git cookie file.
-	if cookieFilePath, err := gitutil.New(jirix).ConfigGetKey("http.cookiefile"); err == nil {
+	if cookieFilePath, err := gitutil.New(context.Background(), jirix).ConfigGetKey("http.cookiefile"); err == nil {
 		cookieFilePath = strings.TrimSpace(cookieFilePath)
 		file, err := os.Open(cookieFilePath)
 		if err != nil {
@@ -541,3 +541,9 @@ func ParseRefString(ref string) (int, int, error) {
 	}
 	return cl, patchset, nil
 }
+
+// ChangeRef returns the reference of the given patchset of a change, which
+// Gerrit shards by the last two digits of the change number.
+func ChangeRef(cl, patchset int) string {
+	return fmt.Sprintf("refs/changes/%02d/%d/%d", cl%100, cl, patchset)
+}
@@ -358,5 +358,26 @@ func TestParseRefString(t *testing.T) {
 	}
 }
 
+func TestChangeRef(t *testing.T) {
+	tests := []struct {
+		cl, patchset int
+		want         string
+	}{
+		{3412, 2, "refs/changes/12/3412/2"},
+		{5, 1, "refs/changes/05/5/1"},
+		{100, 3, "refs/changes/00/100/3"},
+	}
+	for _, test := range tests {
+		if got := ChangeRef(test.cl, test.patchset); got != test.want {
+			t.Errorf("ChangeRef(%d, %d): got %q, want %q", test.cl, test.patchset, got, test.want)
+		}
+		if cl, patchset, err := ParseRefString(test.want); err != nil {
+			t.Errorf("ParseRefString(%q) failed: %v", test.want, err)
+		} else if cl != test.cl || patchset != test.patchset {
+			t.Errorf("ParseRefString(%q): got %d, %d, want %d, %d", test.want, cl, patchset, test.cl, test.patchset)
+		}
+	}
+}
+
 // TODO(jsimsa): Add a test for the hostCredentials function that
 // exercises the logic that reads the .netrc and git cookie files.
@@ -5,16 +5,27 @@
 package git
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+
 	git2go "github.com/libgit2/git2go"
 )
 
 type Git struct {
+	ctx     context.Context
 	rootDir string
 }
 
-func NewGit(path string) *Git {
+// NewGit returns a Git for the repository at path.  Its operations are
+// cancelled when ctx is done, only before they start for those run by
+// libgit2.
+func NewGit(ctx context.Context, path string) *Git {
 	return &Git{
+		ctx:     ctx,
 		rootDir: path,
 	}
 }
@@ -40,6 +51,9 @@ func (g *Git) Fetch(remote string, opts ...FetchOpt) error {
 
 // FetchRefspec fetches refs and tags from the given remote for a particular refspec.
 func (g *Git) FetchRefspec(remoteName, refspec string, opts ...FetchOpt) error {
+	if err := g.ctx.Err(); err != nil {
+		return err
+	}
 	repo, err := git2go.OpenRepository(g.rootDir)
 	if err != nil {
 		return err
@@ -86,6 +100,54 @@ func (g *Git) SetRemoteUrl(remote, url string) error {
 	return repo.Remotes.SetUrl(remote, url)
 }
 
+// PushBranchOpts are the options of PushBranchWithOpts.
+type PushBranchOpts struct {
+	// Force overwrites the remote branch, with --force.
+	Force bool
+	// ForceWithLease overwrites the remote branch only if it is at its
+	// remote-tracking revision, with --force-with-lease.
+	ForceWithLease bool
+	// DryRun only reports what would be pushed, with --dry-run.
+	DryRun bool
+}
+
+// PushBranch pushes the given local branch to the given branch of the remote.
+func (g *Git) PushBranch(branch, remote, remoteBranch string) error {
+	return g.PushBranchWithOpts(branch, remote, remoteBranch, PushBranchOpts{})
+}
+
+// PushBranchWithOpts is like PushBranch, with the given options.
+func (g *Git) PushBranchWithOpts(branch, remote, remoteBranch string, opts PushBranchOpts) error {
+	if branch == "" || remote == "" || remoteBranch == "" {
+		return fmt.Errorf("PushBranch needs a branch, a remote and a remote branch")
+	}
+	// libgit2 supports neither --force-with-lease nor --dry-run, so run git.
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(g.ctx, "git", pushBranchArgs(branch, remote, remoteBranch, opts)...)
+	cmd.Dir = g.rootDir
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("git push %s %s:%s failed: %v\n%s", remote, branch, remoteBranch, err, stderr.String())
+	}
+	return nil
+}
+
+// pushBranchArgs returns the arguments of the git command pushing the given
+// local branch to the given branch of the remote.
+func pushBranchArgs(branch, remote, remoteBranch string, opts PushBranchOpts) []string {
+	args := []string{"push"}
+	if opts.Force {
+		args = append(args, "--force")
+	}
+	if opts.ForceWithLease {
+		args = append(args, "--force-with-lease")
+	}
+	if opts.DryRun {
+		args = append(args, "--dry-run")
+	}
+	return append(args, remote, "refs/heads/"+branch+":refs/heads/"+remoteBranch)
+}
+
 type Reference struct {
 	Name     string
 	Revision string
@@ -301,3 +363,165 @@ func (g *Git) GetAllBranchesInfo() ([]Branch, error) {
 	})
 	return branches, err
 }
+
+// notesRef returns the reference of the given notes namespace, which is
+// interpreted like the --ref flag of "git notes".
+func notesRef(namespace string) string {
+	switch {
+	case namespace == "":
+		return "refs/notes/commits"
+	case strings.HasPrefix(namespace, "refs/notes/"):
+		return namespace
+	case strings.HasPrefix(namespace, "notes/"):
+		return "refs/" + namespace
+	}
+	return "refs/notes/" + namespace
+}
+
+// commitOid returns the id of the commit the given revision points to.
+func commitOid(repo *git2go.Repository, commitRev string) (*git2go.Oid, error) {
+	obj, err := repo.RevparseSingle(commitRev)
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Free()
+	c, err := obj.Peel(git2go.ObjectCommit)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Free()
+	return c.Id(), nil
+}
+
+// AddNote adds a note with the given message to the commit, under the given
+// notes namespace.  It fails if the commit already has a note in that
+// namespace.
+func (g *Git) AddNote(commitRev, namespace, message string) error {
+	repo, err := git2go.OpenRepository(g.rootDir)
+	if err != nil {
+		return err
+	}
+	defer repo.Free()
+	oid, err := commitOid(repo, commitRev)
+	if err != nil {
+		return err
+	}
+	sig, err := repo.DefaultSignature()
+	if err != nil {
+		return err
+	}
+	_, err = repo.Notes.Create(notesRef(namespace), sig, sig, oid, message, false)
+	return err
+}
+
+// GetNote returns the message of the note of the commit under the given notes
+// namespace.
+func (g *Git) GetNote(commitRev, namespace string) (string, error) {
+	repo, err := git2go.OpenRepository(g.rootDir)
+	if err != nil {
+		return "", err
+	}
+	defer repo.Free()
+	oid, err := commitOid(repo, commitRev)
+	if err != nil {
+		return "", err
+	}
+	note, err := repo.Notes.Read(notesRef(namespace), oid)
+	if err != nil {
+		return "", err
+	}
+	defer note.Free()
+	return note.Message(), nil
+}
+
+// RemoveNote removes the note of the commit under the given notes namespace.
+func (g *Git) RemoveNote(commitRev, namespace string) error {
+	repo, err := git2go.OpenRepository(g.rootDir)
+	if err != nil {
+		return err
+	}
+	defer repo.Free()
+	oid, err := commitOid(repo, commitRev)
+	if err != nil {
+		return err
+	}
+	sig, err := repo.DefaultSignature()
+	if err != nil {
+		return err
+	}
+	return repo.Notes.Remove(notesRef(namespace), sig, sig, oid)
+}
+
+// LsFiles returns the paths, relative to the repository root, of the files
+// tracked by git which match the given pathspec pattern, like "git ls-files
+// <pattern>".  An empty pattern matches all files.
+func (g *Git) LsFiles(pattern string) ([]string, error) {
+	return g.lsFiles(pattern, git2go.StatusOptIncludeUnmodified, func(s git2go.Status) bool {
+		return s&(git2go.StatusWtNew|git2go.StatusIgnored|git2go.StatusIndexDeleted) == 0
+	})
+}
+
+// LsFilesUntracked returns the paths, relative to the repository root, of the
+// untracked files which match the given pathspec pattern and are not ignored,
+// like "git ls-files --others --exclude-standard <pattern>".
+func (g *Git) LsFilesUntracked(pattern string) ([]string, error) {
+	flags := git2go.StatusOptIncludeUntracked | git2go.StatusOptRecurseUntrackedDirs
+	return g.lsFiles(pattern, flags, func(s git2go.Status) bool {
+		return s&git2go.StatusWtNew != 0
+	})
+}
+
+// LsFilesIgnored returns the paths, relative to the repository root, of the
+// ignored files which match the given pathspec pattern, like "git ls-files
+// --others --ignored --exclude-standard <pattern>".
+func (g *Git) LsFilesIgnored(pattern string) ([]string, error) {
+	flags := git2go.StatusOptIncludeIgnored | git2go.StatusOptRecurseIgnoredDirs
+	return g.lsFiles(pattern, flags, func(s git2go.Status) bool {
+		return s&git2go.StatusIgnored != 0
+	})
+}
+
+// lsFiles returns the sorted paths of the status entries matching pattern
+// for which keep returns true.
+func (g *Git) lsFiles(pattern string, flags git2go.StatusOpt, keep func(git2go.Status) bool) ([]string, error) {
+	repo, err := git2go.OpenRepository(g.rootDir)
+	if err != nil {
+		return nil, err
+	}
+	defer repo.Free()
+	opts := &git2go.StatusOptions{}
+	opts.Show = git2go.StatusShowIndexAndWorkdir
+	opts.Flags = flags
+	if pattern != "" {
+		opts.Pathspec = []string{pattern}
+	}
+
+	statusList, err := repo.StatusList(opts)
+	if err != nil {
+		return nil, err
+	}
+	defer statusList.Free()
+	entryCount, err := statusList.EntryCount()
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for i := 0; i < entryCount; i++ {
+		entry, err := statusList.ByIndex(i)
+		if err != nil {
+			return nil, err
+		}
+		if !keep(entry.Status) {
+			continue
+		}
+		// Entries which only differ between HEAD and the index have no index
+		// to workdir delta.
+		path := entry.IndexToWorkdir.OldFile.Path
+		if path == "" {
+			path = entry.HeadToIndex.NewFile.Path
+		}
+		files = append(files, path)
+	}
+	sort.Strings(files)
+	return files, nil
+}
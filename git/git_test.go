@@ -0,0 +1,250 @@
+// Copyright 2017 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package git_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"fuchsia.googlesource.com/jiri/git"
+	"fuchsia.googlesource.com/jiri/gitutil"
+	"fuchsia.googlesource.com/jiri/jiritest"
+)
+
+// initRepo creates a git repository with a dummy user in a new jiri root.
+func initRepo(t *testing.T) (string, *gitutil.Git, func()) {
+	jirix, cleanup := jiritest.NewX(t)
+	dir := filepath.Join(jirix.Root, "repo")
+	if err := gitutil.New(context.Background(), jirix).Init(dir); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	scm := gitutil.New(context.Background(), jirix, gitutil.RootDirOpt(dir))
+	if err := scm.Config("user.name", "John Doe"); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	if err := scm.Config("user.email", "john.doe@example.com"); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return dir, scm, cleanup
+}
+
+func TestNotes(t *testing.T) {
+	dir, scm, cleanup := initRepo(t)
+	defer cleanup()
+	if err := scm.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	g := git.NewGit(context.Background(), dir)
+	if _, err := g.GetNote("HEAD", "jiri"); err == nil {
+		t.Fatal("GetNote() should fail when there is no note")
+	}
+	want := "snapshot: 0123456789abcdef"
+	if err := g.AddNote("HEAD", "jiri", want); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.AddNote("HEAD", "jiri", want); err == nil {
+		t.Error("AddNote() should fail when the commit already has a note")
+	}
+	if got, err := g.GetNote("HEAD", "jiri"); err != nil {
+		t.Fatal(err)
+	} else if got != want {
+		t.Errorf("got note %q, want %q", got, want)
+	}
+	// Notes of other namespaces are separate.
+	if _, err := g.GetNote("HEAD", "other"); err == nil {
+		t.Error("GetNote() should fail for a namespace without note")
+	}
+	if err := g.RemoveNote("HEAD", "refs/notes/jiri"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.GetNote("HEAD", "jiri"); err == nil {
+		t.Error("GetNote() should fail after the note is removed")
+	}
+}
+
+func TestLsFiles(t *testing.T) {
+	dir, scm, cleanup := initRepo(t)
+	defer cleanup()
+
+	writeFiles := func(files ...string) {
+		for _, file := range files {
+			path := filepath.Join(dir, file)
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(path, []byte(file), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	writeFiles("a.txt", "dir/b.txt", "dir/c.go")
+	if err := ioutil.WriteFile(filepath.Join(dir, ".gitignore"), []byte("*.log\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := scm.CommitFiles([]string{".gitignore", "a.txt", "dir/b.txt", "dir/c.go"}, "initial commit"); err != nil {
+		t.Fatal(err)
+	}
+	// A staged file is tracked, even if it was never committed.
+	writeFiles("staged.txt")
+	if err := scm.Add("staged.txt"); err != nil {
+		t.Fatal(err)
+	}
+	// Files which are modified or deleted are still tracked.
+	writeFiles("dir/c.go")
+	if err := os.Remove(filepath.Join(dir, "a.txt")); err != nil {
+		t.Fatal(err)
+	}
+	writeFiles("untracked.txt", "dir/untracked.go", "ignored.log", "dir/ignored.log")
+
+	g := git.NewGit(context.Background(), dir)
+	tests := []struct {
+		ls      func(string) ([]string, error)
+		name    string
+		pattern string
+		want    []string
+	}{
+		{g.LsFiles, "LsFiles", "", []string{".gitignore", "a.txt", "dir/b.txt", "dir/c.go", "staged.txt"}},
+		{g.LsFiles, "LsFiles", "dir", []string{"dir/b.txt", "dir/c.go"}},
+		{g.LsFiles, "LsFiles", "*.txt", []string{"a.txt", "dir/b.txt", "staged.txt"}},
+		{g.LsFilesUntracked, "LsFilesUntracked", "", []string{"dir/untracked.go", "untracked.txt"}},
+		{g.LsFilesUntracked, "LsFilesUntracked", "*.go", []string{"dir/untracked.go"}},
+		{g.LsFilesIgnored, "LsFilesIgnored", "", []string{"dir/ignored.log", "ignored.log"}},
+		{g.LsFilesIgnored, "LsFilesIgnored", "dir", []string{"dir/ignored.log"}},
+	}
+	for _, test := range tests {
+		got, err := test.ls(test.pattern)
+		if err != nil {
+			t.Fatalf("%s(%q) failed: %v", test.name, test.pattern, err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s(%q): got %v, want %v", test.name, test.pattern, got, test.want)
+		}
+	}
+}
+
+func TestPushBranchArgs(t *testing.T) {
+	tests := []struct {
+		opts git.PushBranchOpts
+		want []string
+	}{
+		{git.PushBranchOpts{}, []string{"push", "origin", "refs/heads/local:refs/heads/remote"}},
+		{git.PushBranchOpts{Force: true}, []string{"push", "--force", "origin", "refs/heads/local:refs/heads/remote"}},
+		{git.PushBranchOpts{ForceWithLease: true, DryRun: true}, []string{"push", "--force-with-lease", "--dry-run", "origin", "refs/heads/local:refs/heads/remote"}},
+	}
+	for _, test := range tests {
+		if got := git.InternalPushBranchArgs("local", "origin", "remote", test.opts); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("pushBranchArgs with %+v: got %q, want %q", test.opts, got, test.want)
+		}
+	}
+}
+
+func TestPushBranch(t *testing.T) {
+	dir, scm, cleanup := initRepo(t)
+	defer cleanup()
+	remoteDir := filepath.Join(filepath.Dir(dir), "remote")
+	if err := scm.Init(remoteDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := scm.AddRemote("origin", remoteDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := scm.CommitWithMessage("first"); err != nil {
+		t.Fatal(err)
+	}
+	g := git.NewGit(context.Background(), dir)
+	first, err := g.CurrentRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := git.NewGit(context.Background(), remoteDir)
+
+	// The local branch is pushed to the given remote branch.
+	if err := g.PushBranch("master", "origin", "other"); err != nil {
+		t.Fatal(err)
+	}
+	if rev, err := remote.CurrentRevisionForRef("refs/heads/other"); err != nil {
+		t.Fatal(err)
+	} else if rev != first {
+		t.Errorf("got refs/heads/other at %s, want %s", rev, first)
+	}
+
+	// A dry run doesn't create the remote branch.
+	if err := g.PushBranchWithOpts("master", "origin", "dry", git.PushBranchOpts{DryRun: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := remote.CurrentRevisionForRef("refs/heads/dry"); err == nil {
+		t.Error("refs/heads/dry should not exist after a dry run")
+	}
+
+	// A rewritten branch is only pushed when forced.
+	if err := scm.CommitAmendWithMessage("amended"); err != nil {
+		t.Fatal(err)
+	}
+	amended, err := g.CurrentRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.PushBranch("master", "origin", "other"); err == nil {
+		t.Error("a non fast-forward push should fail")
+	}
+	if err := g.PushBranchWithOpts("master", "origin", "other", git.PushBranchOpts{Force: true}); err != nil {
+		t.Fatal(err)
+	}
+	if rev, err := remote.CurrentRevisionForRef("refs/heads/other"); err != nil {
+		t.Fatal(err)
+	} else if rev != amended {
+		t.Errorf("got refs/heads/other at %s, want %s", rev, amended)
+	}
+}
+
+// TestCancel checks that cancelling the context of a Git kills the git
+// processes it runs, and that operations don't start once it is done.
+func TestCancel(t *testing.T) {
+	dir, scm, cleanup := initRepo(t)
+	defer cleanup()
+	if err := scm.CommitWithMessage("first"); err != nil {
+		t.Fatal(err)
+	}
+	// Fetches from this remote hang until the sleep is killed.
+	if err := scm.Config("protocol.ext.allow", "always"); err != nil {
+		t.Fatal(err)
+	}
+	if err := scm.AddRemote("origin", "ext::sleep 60"); err != nil {
+		t.Fatal(err)
+	}
+	jirix, cleanupX := jiritest.NewX(t)
+	defer cleanupX()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- gitutil.New(ctx, jirix, gitutil.RootDirOpt(dir)).Fetch("origin")
+	}()
+	time.Sleep(500 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("fetch should have failed once cancelled")
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("fetch not terminated after being cancelled")
+	}
+
+	if err := git.NewGit(ctx, dir).Fetch("origin"); err != context.Canceled {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+	if err := git.NewGit(ctx, dir).PushBranch("master", "origin", "master"); err == nil {
+		t.Error("push should have failed once cancelled")
+	}
+}
@@ -0,0 +1,8 @@
+// Copyright 2017 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package git
+
+// InternalPushBranchArgs exports pushBranchArgs for tests.
+var InternalPushBranchArgs = pushBranchArgs
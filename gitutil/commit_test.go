@@ -0,0 +1,77 @@
+// Copyright 2017 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gitutil_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"fuchsia.googlesource.com/jiri/gitutil"
+	"fuchsia.googlesource.com/jiri/jiritest"
+)
+
+// TestCommitFiles tests that CommitFiles commits all the given files in a
+// single commit.
+func TestCommitFiles(t *testing.T) {
+	jirix, cleanup := jiritest.NewX(t)
+	defer cleanup()
+	dir := filepath.Join(jirix.Root, "repo")
+	g := gitutil.New(context.Background(), jirix, gitutil.RootDirOpt(dir), gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"))
+	if err := gitutil.New(context.Background(), jirix).Init(dir); err != nil {
+		t.Fatal(err)
+	}
+	write := func(files ...string) {
+		for _, file := range files {
+			path := filepath.Join(dir, file)
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(path, []byte(file), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	write("README")
+	if err := g.CommitFile("README", "initial commit"); err != nil {
+		t.Fatal(err)
+	}
+
+	files := []string{"a.txt", "dir/b.txt", "dir/sub/c.go"}
+	// Files which aren't given stay uncommitted.
+	write(append(files, "other.txt")...)
+	if err := g.CommitFiles(files, "add files"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := g.CountCommits("HEAD", ""); err != nil {
+		t.Fatal(err)
+	} else if got != 2 {
+		t.Errorf("got %d commits, want 2", got)
+	}
+	got, err := g.ModifiedFiles("HEAD~1", "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, files) {
+		t.Errorf("got committed files %v, want %v", got, files)
+	}
+	if msg, err := g.LatestCommitMessage(); err != nil {
+		t.Fatal(err)
+	} else if msg != "add files" {
+		t.Errorf("got commit message %q, want %q", msg, "add files")
+	}
+	if g.IsFileCommitted("other.txt") {
+		t.Errorf("other.txt should not have been committed")
+	}
+
+	if err := g.CommitFiles(nil, "empty"); err == nil {
+		t.Errorf("CommitFiles() with no files should have failed")
+	}
+}
@@ -6,6 +6,7 @@ package gitutil
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"os"
@@ -13,6 +14,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"fuchsia.googlesource.com/jiri"
 	"fuchsia.googlesource.com/jiri/envvar"
@@ -40,7 +42,52 @@ func (ge GitError) Error() string {
 	return result
 }
 
+// benignWarnings are the prefixes of the warnings git prints to stderr which
+// don't indicate a problem with the operations run by jiri, e.g. because jiri
+// checks out the projects itself after cloning them.
+var benignWarnings = []string{
+	"warning: redirecting to ",
+	"warning: ignoring broken ref ",
+	"warning: ignoring dangling symref ",
+	"warning: remote HEAD refers to nonexistent ref",
+	"warning: You appear to have cloned an empty repository.",
+	"warning: Clone succeeded, but checkout failed.",
+}
+
+// IsBenignWarning returns true if the given line of git stderr output is a
+// warning known to be benign.
+func IsBenignWarning(line string) bool {
+	for _, prefix := range benignWarnings {
+		if strings.HasPrefix(line, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// significantStderr returns the lines of the given git stderr output which
+// are worth reporting: all of them if strict, or those which aren't benign
+// warnings otherwise.
+func significantStderr(stderr string, strict bool) []string {
+	var lines []string
+	for _, line := range strings.Split(stderr, "\n") {
+		if line = strings.TrimRight(line, "\r"); line == "" {
+			continue
+		}
+		if !strict && IsBenignWarning(line) {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// waitDelay is how long to wait for the output of a killed git process to be
+// closed.
+const waitDelay = 5 * time.Second
+
 type Git struct {
+	ctx       context.Context
 	jirix     *jiri.X
 	opts      map[string]string
 	rootDir   string
@@ -57,11 +104,16 @@ type RootDirOpt string
 type UserNameOpt string
 type UserEmailOpt string
 
+// SSHCommandOpt is the command git runs instead of ssh to reach ssh remotes,
+// through GIT_SSH_COMMAND.  Empty leaves it unset.
+type SSHCommandOpt string
+
 func (AuthorDateOpt) gitOpt()    {}
 func (CommitterDateOpt) gitOpt() {}
 func (RootDirOpt) gitOpt()       {}
 func (UserNameOpt) gitOpt()      {}
 func (UserEmailOpt) gitOpt()     {}
+func (SSHCommandOpt) gitOpt()    {}
 
 type TrackingBranch string
 type Revision string
@@ -72,8 +124,9 @@ const (
 	LocalType  = "local"
 )
 
-// New is the Git factory.
-func New(jirix *jiri.X, opts ...gitOpt) *Git {
+// New is the Git factory.  The git processes it runs are killed when ctx is
+// done.
+func New(ctx context.Context, jirix *jiri.X, opts ...gitOpt) *Git {
 	rootDir := ""
 	userName := ""
 	userEmail := ""
@@ -90,9 +143,14 @@ func New(jirix *jiri.X, opts ...gitOpt) *Git {
 			userName = string(typedOpt)
 		case UserEmailOpt:
 			userEmail = string(typedOpt)
+		case SSHCommandOpt:
+			if typedOpt != "" {
+				env["GIT_SSH_COMMAND"] = string(typedOpt)
+			}
 		}
 	}
 	return &Git{
+		ctx:       ctx,
 		jirix:     jirix,
 		opts:      env,
 		rootDir:   rootDir,
@@ -116,6 +174,23 @@ func (g *Git) AddRemote(name, path string) error {
 	return g.run("remote", "add", name, path)
 }
 
+// Am commits the patches of the given mailbox files, e.g. created by "git
+// format-patch", on top of the current branch.
+func (g *Git) Am(files ...string) error {
+	return g.run(append([]string{"am"}, files...)...)
+}
+
+// AmAbort aborts an in-progress "git am", restoring the original branch.
+func (g *Git) AmAbort() error {
+	return g.run("am", "--abort")
+}
+
+// Apply applies the given patch files to the working tree, without committing
+// them.  Nothing is applied if any of the patches doesn't apply.
+func (g *Git) Apply(files ...string) error {
+	return g.run(append([]string{"apply"}, files...)...)
+}
+
 // BranchExists tests whether a branch with the given name exists in
 // the local repository.
 func (g *Git) BranchExists(branch string) bool {
@@ -160,16 +235,54 @@ func (g *Git) CheckoutBranch(branch string, opts ...CheckoutOpt) error {
 }
 
 // Clone clones the given repository to the given local path.  If reference is
-// not empty it uses the given path as a reference/shared repo.
+// not empty it uses the given path as a reference/shared repo.  If the server
+// doesn't support the partial clone requested by FilterOpt, the repository is
+// cloned in full.
 func (g *Git) Clone(repo, path string, opts ...CloneOpt) error {
+	var progress ProgressOpt
+	filter := false
+	for _, opt := range opts {
+		switch typedOpt := opt.(type) {
+		case ProgressOpt:
+			progress = typedOpt
+		case FilterOpt:
+			if typedOpt != "" {
+				filter = true
+			}
+		}
+	}
+	err := g.runProgress(progress, cloneArgs(repo, path, opts...)...)
+	if err == nil || !filter || !isFilterUnsupported(err) {
+		return err
+	}
+	g.jirix.Logger.Warningf("Server of %s doesn't support partial clones, cloning it in full\n\n", repo)
+	var fullOpts []CloneOpt
+	for _, opt := range opts {
+		if _, ok := opt.(FilterOpt); !ok {
+			fullOpts = append(fullOpts, opt)
+		}
+	}
+	return g.runProgress(progress, cloneArgs(repo, path, fullOpts...)...)
+}
+
+// cloneArgs returns the arguments of the git command cloning the given
+// repository to the given local path.
+func cloneArgs(repo, path string, opts ...CloneOpt) []string {
 	args := []string{"clone"}
+	progress := false
 	for _, opt := range opts {
 		switch typedOpt := opt.(type) {
+		case ProgressOpt:
+			progress = typedOpt != nil
 		case ReferenceOpt:
 			reference := string(typedOpt)
 			if reference != "" {
 				args = append(args, []string{"--reference", reference}...)
 			}
+		case ReferenceIfAbleOpt:
+			if typedOpt != "" {
+				args = append(args, "--reference-if-able", string(typedOpt))
+			}
 		case SharedOpt:
 			if typedOpt {
 				args = append(args, []string{"--shared", "--local"}...)
@@ -182,21 +295,76 @@ func (g *Git) Clone(repo, path string, opts ...CloneOpt) error {
 			if typedOpt > 0 {
 				args = append(args, []string{"--depth", strconv.Itoa(int(typedOpt))}...)
 			}
+		case NoTagsOpt:
+			if typedOpt {
+				args = append(args, "--no-tags")
+			}
+		case FilterOpt:
+			if typedOpt != "" {
+				args = append(args, "--filter="+string(typedOpt))
+			}
+		case ShallowSinceOpt:
+			if typedOpt != "" {
+				args = append(args, "--shallow-since="+string(typedOpt))
+			}
+		case SingleBranchOpt:
+			if typedOpt != "" {
+				args = append(args, "--single-branch", "--branch", string(typedOpt))
+			}
+		case OriginOpt:
+			if typedOpt != "" {
+				args = append(args, "--origin", string(typedOpt))
+			}
 		}
 	}
+	if progress {
+		args = append(args, "--progress")
+	}
 	args = append(args, repo)
 	args = append(args, path)
-	return g.run(args...)
+	return args
+}
+
+// filterUnsupportedErrors are the errors git reports when a server refuses a
+// partial clone.
+var filterUnsupportedErrors = []string{
+	"filtering capability not negotiated",
+	"filter not supported",
+	"does not support filter",
+}
+
+// isFilterUnsupported returns whether the given error is that of a git
+// command failing because the server doesn't support partial clones.
+func isFilterUnsupported(err error) bool {
+	gitErr, ok := err.(GitError)
+	if !ok {
+		return false
+	}
+	for _, e := range filterUnsupportedErrors {
+		if strings.Contains(gitErr.ErrorOutput, e) {
+			return true
+		}
+	}
+	return false
 }
 
 // CloneMirror clones the given repository using mirror flag.
-func (g *Git) CloneMirror(repo, path string, depth int) error {
+func (g *Git) CloneMirror(repo, path string, depth int, opts ...CloneOpt) error {
 	args := []string{"clone", "--mirror"}
 	if depth > 0 {
 		args = append(args, []string{"--depth", strconv.Itoa(depth)}...)
 	}
+	var progress ProgressOpt
+	for _, opt := range opts {
+		if typedOpt, ok := opt.(ProgressOpt); ok {
+			progress = typedOpt
+		}
+	}
+	if progress != nil {
+		args = append(args, "--progress")
+	}
 	args = append(args, []string{repo, path}...)
-	return g.run(args...)
+	return g.runProgress(progress, args...)
 }
 
 // CloneRecursive clones the given repository recursively to the given local path.
@@ -231,7 +399,16 @@ func (g *Git) CommitAndEdit() error {
 
 // CommitFile commits the given file with the given commit message.
 func (g *Git) CommitFile(fileName, message string) error {
-	if err := g.Add(fileName); err != nil {
+	return g.CommitFiles([]string{fileName}, message)
+}
+
+// CommitFiles commits the given files in a single commit with the given
+// commit message.
+func (g *Git) CommitFiles(fileNames []string, message string) error {
+	if len(fileNames) == 0 {
+		return fmt.Errorf("no files to commit")
+	}
+	if err := g.run(append([]string{"add", "--"}, fileNames...)...); err != nil {
 		return err
 	}
 	return g.CommitWithMessage(message)
@@ -283,6 +460,12 @@ func (g *Git) ExtraCommits(rev, base string) ([]string, error) {
 	return g.runOutput("rev-list", base+".."+rev)
 }
 
+// UnpushedCommits returns the commits reachable from HEAD or from a local
+// branch which are not reachable from any remote-tracking branch.
+func (g *Git) UnpushedCommits() ([]string, error) {
+	return g.runOutput("rev-list", "HEAD", "--branches", "--not", "--remotes")
+}
+
 // CountCommits returns the number of commits on <branch> that are not
 // on <base>.
 func (g *Git) CountCommits(branch, base string) (int, error) {
@@ -322,6 +505,17 @@ func (g *Git) CreateBranch(branch string) error {
 	return g.run("branch", branch)
 }
 
+// CreateLightweightTag creates a lightweight tag with the given name at HEAD.
+func (g *Git) CreateLightweightTag(tag string) error {
+	return g.run("tag", tag)
+}
+
+// UpdateRef points the given ref at the given revision, creating the ref if
+// it does not exist.
+func (g *Git) UpdateRef(ref, rev string) error {
+	return g.run("update-ref", ref, rev)
+}
+
 // CreateAndCheckoutBranch creates a new branch with the given name
 // and checks it out.
 func (g *Git) CreateAndCheckoutBranch(branch string) error {
@@ -469,17 +663,57 @@ func (g *Git) Fetch(remote string, opts ...FetchOpt) error {
 	return g.FetchRefspec(remote, "", opts...)
 }
 
-// FetchRefspec fetches refs and tags from the given remote for a particular refspec.
+// FetchRefspec fetches refs and tags from the given remote for a particular
+// refspec.  If git doesn't support the atomic fetch requested by AtomicOpt, the
+// refs are fetched without it.
 func (g *Git) FetchRefspec(remote, refspec string, opts ...FetchOpt) error {
+	var progress ProgressOpt
+	atomic := false
+	for _, opt := range opts {
+		switch typedOpt := opt.(type) {
+		case ProgressOpt:
+			progress = typedOpt
+		case AtomicOpt:
+			atomic = bool(typedOpt)
+		}
+	}
+	err := g.runProgress(progress, fetchArgs(remote, refspec, opts...)...)
+	if err == nil || !atomic || !isAtomicUnsupported(err) {
+		return err
+	}
+	g.jirix.Logger.Debugf("Atomic fetches are not supported, fetching %s without them\n", remote)
+	var nonAtomicOpts []FetchOpt
+	for _, opt := range opts {
+		if _, ok := opt.(AtomicOpt); !ok {
+			nonAtomicOpts = append(nonAtomicOpts, opt)
+		}
+	}
+	return g.runProgress(progress, fetchArgs(remote, refspec, nonAtomicOpts...)...)
+}
+
+// fetchArgs returns the arguments of the git command fetching the given
+// refspec from the given remote.
+func fetchArgs(remote, refspec string, opts ...FetchOpt) []string {
 	tags := false
+	noTags := false
 	all := false
 	prune := false
 	updateShallow := false
 	depth := 0
+	filter := ""
+	shallowSince := ""
+	atomic := false
+	progress := false
 	for _, opt := range opts {
 		switch typedOpt := opt.(type) {
+		case ProgressOpt:
+			progress = typedOpt != nil
+		case AtomicOpt:
+			atomic = bool(typedOpt)
 		case TagsOpt:
 			tags = bool(typedOpt)
+		case NoTagsOpt:
+			noTags = bool(typedOpt)
 		case AllOpt:
 			all = bool(typedOpt)
 		case PruneOpt:
@@ -488,6 +722,10 @@ func (g *Git) FetchRefspec(remote, refspec string, opts ...FetchOpt) error {
 			depth = int(typedOpt)
 		case UpdateShallowOpt:
 			updateShallow = bool(typedOpt)
+		case FilterOpt:
+			filter = string(typedOpt)
+		case ShallowSinceOpt:
+			shallowSince = string(typedOpt)
 		}
 	}
 	args := []string{}
@@ -495,26 +733,62 @@ func (g *Git) FetchRefspec(remote, refspec string, opts ...FetchOpt) error {
 	if prune {
 		args = append(args, "-p")
 	}
+	if atomic {
+		args = append(args, "--atomic")
+	}
 	if tags {
 		args = append(args, "--tags")
 	}
+	if noTags {
+		args = append(args, "--no-tags")
+	}
 	if depth > 0 {
 		args = append(args, "--depth", strconv.Itoa(depth))
 	}
+	if shallowSince != "" {
+		args = append(args, "--shallow-since="+shallowSince)
+	}
 	if updateShallow {
 		args = append(args, "--update-shallow")
 	}
+	if filter != "" {
+		args = append(args, "--filter="+filter)
+	}
 	if all {
 		args = append(args, "--all")
 	}
+	if progress {
+		args = append(args, "--progress")
+	}
 	if remote != "" {
 		args = append(args, remote)
 	}
 	if refspec != "" {
 		args = append(args, refspec)
 	}
+	return args
+}
 
-	return g.run(args...)
+// atomicUnsupportedErrors are the errors git reports when it can't fetch
+// atomically, e.g. because it is older than 2.31.
+var atomicUnsupportedErrors = []string{
+	"unknown option `atomic'",
+	"does not support atomic",
+}
+
+// isAtomicUnsupported returns whether the given error is that of a git command
+// failing because atomic fetches aren't supported.
+func isAtomicUnsupported(err error) bool {
+	gitErr, ok := err.(GitError)
+	if !ok {
+		return false
+	}
+	for _, e := range atomicUnsupportedErrors {
+		if strings.Contains(gitErr.ErrorOutput, e) {
+			return true
+		}
+	}
+	return false
 }
 
 // FilesWithUncommittedChanges returns the list of files that have
@@ -585,6 +859,21 @@ func (g *Git) Init(path string) error {
 	return g.run("init", path)
 }
 
+// IsIgnored tests whether the given path is ignored by the repository, e.g.
+// by a .gitignore file.
+func (g *Git) IsIgnored(path string) (bool, error) {
+	var stdout, stderr bytes.Buffer
+	args := []string{"check-ignore", "-q", path}
+	if err := g.runGit(&stdout, &stderr, args...); err != nil {
+		// check-ignore exits with 1 when the path is not ignored.
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+			return false, nil
+		}
+		return false, Error(stdout.String(), stderr.String(), args...)
+	}
+	return true, nil
+}
+
 // IsFileCommitted tests whether the given file has been committed to
 // the repository.
 func (g *Git) IsFileCommitted(file string) bool {
@@ -596,6 +885,49 @@ func (g *Git) IsFileCommitted(file string) bool {
 	return g.run("ls-files", file, "--error-unmatch") == nil
 }
 
+// Submodule is a submodule of a repository.
+type Submodule struct {
+	Path string
+	// Revision is the commit checked out in the submodule.
+	Revision string
+	// Recorded is the commit recorded for the submodule in the index of
+	// the repository.
+	Recorded string
+}
+
+// DivergedSubmodules returns the initialized submodules of the repository
+// whose checked out commit differs from the one recorded in its index.
+func (g *Git) DivergedSubmodules() ([]Submodule, error) {
+	out, err := g.runOutput("submodule", "status")
+	if err != nil {
+		return nil, err
+	}
+	var submodules []Submodule
+	for _, line := range out {
+		// Diverged submodules are prefixed by "+".
+		if !strings.HasPrefix(line, "+") {
+			continue
+		}
+		fields := strings.Fields(line[1:])
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("unexpected submodule status %q", line)
+		}
+		recorded, err := g.runOutput("rev-parse", ":"+fields[1])
+		if err != nil {
+			return nil, err
+		}
+		if got, want := len(recorded), 1; got != want {
+			return nil, fmt.Errorf("unexpected length of %v: got %v, want %v", recorded, got, want)
+		}
+		submodules = append(submodules, Submodule{
+			Path:     fields[1],
+			Revision: fields[0],
+			Recorded: recorded[0],
+		})
+	}
+	return submodules, nil
+}
+
 func (g *Git) ShortStatus() (string, error) {
 	out, err := g.runOutput("status", "-s")
 	if err != nil {
@@ -635,6 +967,69 @@ func (g *Git) Log(branch, base, format string) ([][]string, error) {
 	return result, nil
 }
 
+// LogLines returns the commits on <branch> that are not on <base>, newest
+// first, using the specified format, which must print a single line per
+// commit.  Unlike Log, the commits are listed by a single git command.
+func (g *Git) LogLines(branch, base, format string) ([]string, error) {
+	return g.runOutput("log", fmt.Sprintf("--format=%s", format), fmt.Sprintf("%v..%v", base, branch))
+}
+
+// RemoteBranches returns a map from the names of the branches of the given
+// remote, which can be a remote name or a URL, to the revisions they point to.
+func (g *Git) RemoteBranches(remote string) (map[string]string, error) {
+	out, err := g.runOutput("ls-remote", "--heads", remote)
+	if err != nil {
+		return nil, err
+	}
+	branches := make(map[string]string)
+	for _, line := range out {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("unexpected ls-remote output line %q", line)
+		}
+		branches[strings.TrimPrefix(fields[1], "refs/heads/")] = fields[0]
+	}
+	return branches, nil
+}
+
+// RemoteTags returns a map from the names of the tags of the given remote,
+// which can be a remote name or a URL, to the commits they point to.
+// Annotated tags are peeled to their commit.
+func (g *Git) RemoteTags(remote string) (map[string]string, error) {
+	out, err := g.runOutput("ls-remote", "--tags", remote)
+	if err != nil {
+		return nil, err
+	}
+	tags := make(map[string]string)
+	peeled := make(map[string]bool)
+	for _, line := range out {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("unexpected ls-remote output line %q", line)
+		}
+		name := strings.TrimPrefix(fields[1], "refs/tags/")
+		if strings.HasSuffix(name, "^{}") {
+			name = strings.TrimSuffix(name, "^{}")
+			tags[name] = fields[0]
+			peeled[name] = true
+		} else if !peeled[name] {
+			tags[name] = fields[0]
+		}
+	}
+	return tags, nil
+}
+
+// LFSInstall sets up git-lfs in the repository.
+func (g *Git) LFSInstall() error {
+	return g.run("lfs", "install", "--local")
+}
+
+// LFSPull fetches the git-lfs objects of the current revision and checks them
+// out.
+func (g *Git) LFSPull() error {
+	return g.run("lfs", "pull")
+}
+
 // Merge merges all commits from <branch> to the current branch. If
 // <squash> is set, then all merged commits are squashed into a single
 // commit.
@@ -711,9 +1106,18 @@ func (g *Git) Pull(remote, branch string) error {
 
 // Push pushes the given branch to the given remote.
 func (g *Git) Push(remote, branch string, opts ...PushOpt) error {
+	return g.run(pushArgs(remote, branch, opts...)...)
+}
+
+// pushArgs returns the arguments of the git command pushing the given branch
+// to the given remote.
+func pushArgs(remote, branch string, opts ...PushOpt) []string {
 	args := []string{"push"}
 	force := false
+	forceWithLease := false
+	forceWithLeaseRef := ""
 	verify := true
+	dryRun := false
 	// TODO(youngseokyoon): consider making followTags option default to true, after verifying that
 	// it works well for the madb repository.
 	followTags := false
@@ -721,15 +1125,26 @@ func (g *Git) Push(remote, branch string, opts ...PushOpt) error {
 		switch typedOpt := opt.(type) {
 		case ForceOpt:
 			force = bool(typedOpt)
+		case ForceWithLeaseOpt:
+			forceWithLease = bool(typedOpt)
+		case ForceWithLeaseRefOpt:
+			forceWithLeaseRef = string(typedOpt)
 		case VerifyOpt:
 			verify = bool(typedOpt)
 		case FollowTagsOpt:
 			followTags = bool(typedOpt)
+		case DryRunOpt:
+			dryRun = bool(typedOpt)
 		}
 	}
 	if force {
 		args = append(args, "--force")
 	}
+	if forceWithLeaseRef != "" {
+		args = append(args, "--force-with-lease="+forceWithLeaseRef)
+	} else if forceWithLease {
+		args = append(args, "--force-with-lease")
+	}
 	if verify {
 		args = append(args, "--verify")
 	} else {
@@ -738,13 +1153,42 @@ func (g *Git) Push(remote, branch string, opts ...PushOpt) error {
 	if followTags {
 		args = append(args, "--follow-tags")
 	}
-	args = append(args, remote, branch)
-	return g.run(args...)
+	if dryRun {
+		args = append(args, "--dry-run")
+	}
+	return append(args, remote, branch)
+}
+
+// PushBranch pushes the given local branch to the given branch of the remote.
+func (g *Git) PushBranch(branch, remote, remoteBranch string, opts ...PushOpt) error {
+	if branch == "" || remote == "" || remoteBranch == "" {
+		return fmt.Errorf("PushBranch needs a branch, a remote and a remote branch")
+	}
+	return g.Push(remote, "refs/heads/"+branch+":refs/heads/"+remoteBranch, opts...)
 }
 
 // Rebase rebases to a particular upstream branch.
-func (g *Git) Rebase(upstream string) error {
-	return g.run("rebase", upstream)
+func (g *Git) Rebase(upstream string, opts ...RebaseOpt) error {
+	var config []string
+	args := []string{"rebase"}
+	for _, opt := range opts {
+		switch typedOpt := opt.(type) {
+		case AutoStashOpt:
+			if typedOpt {
+				args = append(args, "--autostash")
+			}
+		case AutoSquashOpt:
+			if typedOpt {
+				// Git before 2.44 ignores --autosquash outside of
+				// interactive rebases, whose todo list and squashed
+				// commit messages are then accepted as is.
+				config = append(config, "-c", "sequence.editor=:", "-c", "core.editor=:")
+				args = append(args, "--interactive", "--autosquash")
+			}
+		}
+	}
+	args = append(args, upstream)
+	return g.run(append(config, args...)...)
 }
 
 // RebaseAbort aborts an in-progress rebase operation.
@@ -917,6 +1361,32 @@ func (g *Git) run(args ...string) error {
 	return nil
 }
 
+// reportWarnings logs the warnings of a successful clone or fetch which
+// aren't benign, or all its stderr output if jirix.StrictGit is set.
+func (g *Git) reportWarnings(stderr string, args ...string) {
+	for _, line := range significantStderr(stderr, g.jirix.StrictGit) {
+		if g.jirix.StrictGit || strings.HasPrefix(line, "warning: ") {
+			g.jirix.Logger.Warningf("git %s: %s\n\n", strings.Join(args, " "), line)
+		}
+	}
+}
+
+// runProgress runs the clones and fetches like run, reports the progress git
+// writes to stderr to the given function, if any, and logs their warnings,
+// see reportWarnings.
+func (g *Git) runProgress(progress ProgressOpt, args ...string) error {
+	var stdout, stderr bytes.Buffer
+	var stderrWriter io.Writer = &stderr
+	if progress != nil {
+		stderrWriter = io.MultiWriter(&stderr, &progressWriter{fn: progress})
+	}
+	if err := g.runGit(&stdout, stderrWriter, args...); err != nil {
+		return Error(stdout.String(), stderr.String(), args...)
+	}
+	g.reportWarnings(stderr.String(), args...)
+	return nil
+}
+
 func trimOutput(o string) []string {
 	output := strings.TrimSpace(o)
 	if len(output) == 0 {
@@ -950,13 +1420,21 @@ func (g *Git) runGit(stdout, stderr io.Writer, args ...string) error {
 	if g.userEmail != "" {
 		args = append([]string{"-c", fmt.Sprintf("user.email=%s", g.userEmail)}, args...)
 	}
-	command := exec.Command("git", args...)
+	command := exec.CommandContext(g.ctx, "git", args...)
+	// Processes started by git, e.g. ssh, may keep its output open after it
+	// is killed; don't wait for them.
+	command.WaitDelay = waitDelay
 	command.Dir = g.rootDir
 	command.Stdin = os.Stdin
 	command.Stdout = stdout
 	command.Stderr = stderr
 	env := g.jirix.Env()
 	env = envvar.MergeMaps(g.opts, env)
+	if timeout := g.jirix.NetworkTimeout; timeout > 0 {
+		// Abort HTTP transfers slower than 1 KB/s for the timeout.
+		env["GIT_HTTP_LOW_SPEED_LIMIT"] = "1000"
+		env["GIT_HTTP_LOW_SPEED_TIME"] = strconv.Itoa(int((timeout + time.Second - 1) / time.Second))
+	}
 	command.Env = envvar.MapToSlice(env)
 	dir := g.rootDir
 	if dir == "" {
@@ -0,0 +1,252 @@
+// Copyright 2017 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gitutil
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"fuchsia.googlesource.com/jiri"
+	"fuchsia.googlesource.com/jiri/cmdline"
+	"fuchsia.googlesource.com/jiri/color"
+	"fuchsia.googlesource.com/jiri/log"
+	"fuchsia.googlesource.com/jiri/tool"
+)
+
+func TestPushArgs(t *testing.T) {
+	tests := []struct {
+		opts []PushOpt
+		want []string
+	}{
+		{
+			nil,
+			[]string{"push", "--verify", "origin", "master"},
+		},
+		{
+			[]PushOpt{ForceOpt(true)},
+			[]string{"push", "--force", "--verify", "origin", "master"},
+		},
+		{
+			[]PushOpt{ForceWithLeaseOpt(true)},
+			[]string{"push", "--force-with-lease", "--verify", "origin", "master"},
+		},
+		{
+			[]PushOpt{ForceWithLeaseOpt(false)},
+			[]string{"push", "--verify", "origin", "master"},
+		},
+		{
+			[]PushOpt{ForceWithLeaseRefOpt("refs/heads/master")},
+			[]string{"push", "--force-with-lease=refs/heads/master", "--verify", "origin", "master"},
+		},
+		{
+			[]PushOpt{ForceWithLeaseOpt(true), ForceWithLeaseRefOpt("master:abc123"), VerifyOpt(false)},
+			[]string{"push", "--force-with-lease=master:abc123", "--no-verify", "origin", "master"},
+		},
+		{
+			[]PushOpt{ForceOpt(true), DryRunOpt(true)},
+			[]string{"push", "--force", "--verify", "--dry-run", "origin", "master"},
+		},
+	}
+	for _, test := range tests {
+		if got := pushArgs("origin", "master", test.opts...); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("pushArgs(%v): got %v, want %v", test.opts, got, test.want)
+		}
+	}
+}
+
+func TestCloneArgs(t *testing.T) {
+	tests := []struct {
+		opts []CloneOpt
+		want []string
+	}{
+		{
+			nil,
+			[]string{"clone", "repo", "path"},
+		},
+		{
+			[]CloneOpt{FilterOpt("blob:none")},
+			[]string{"clone", "--filter=blob:none", "repo", "path"},
+		},
+		{
+			[]CloneOpt{FilterOpt("")},
+			[]string{"clone", "repo", "path"},
+		},
+		{
+			[]CloneOpt{NoCheckoutOpt(true), DepthOpt(1), FilterOpt("tree:0"), ProgressOpt(func(string, int) {})},
+			[]string{"clone", "--no-checkout", "--depth", "1", "--filter=tree:0", "--progress", "repo", "path"},
+		},
+		{
+			[]CloneOpt{ReferenceOpt("cache"), ReferenceIfAbleOpt("reference")},
+			[]string{"clone", "--reference", "cache", "--reference-if-able", "reference", "repo", "path"},
+		},
+	}
+	for _, test := range tests {
+		if got := cloneArgs("repo", "path", test.opts...); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("cloneArgs(%v): got %v, want %v", test.opts, got, test.want)
+		}
+	}
+}
+
+func TestFetchArgs(t *testing.T) {
+	tests := []struct {
+		opts []FetchOpt
+		want []string
+	}{
+		{
+			nil,
+			[]string{"fetch", "origin", "refspec"},
+		},
+		{
+			[]FetchOpt{PruneOpt(true), AtomicOpt(true)},
+			[]string{"fetch", "-p", "--atomic", "origin", "refspec"},
+		},
+		{
+			[]FetchOpt{AtomicOpt(false), DepthOpt(1), UpdateShallowOpt(true), ProgressOpt(func(string, int) {})},
+			[]string{"fetch", "--depth", "1", "--update-shallow", "--progress", "origin", "refspec"},
+		},
+	}
+	for _, test := range tests {
+		if got := fetchArgs("origin", "refspec", test.opts...); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("fetchArgs(%v): got %v, want %v", test.opts, got, test.want)
+		}
+	}
+}
+
+func TestIsAtomicUnsupported(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{Error("", "error: unknown option `atomic'\n", "fetch"), true},
+		{Error("", "fatal: the receiving end does not support atomic\n", "fetch"), true},
+		{Error("", "fatal: couldn't find remote ref refs/heads/foo\n", "fetch"), false},
+		{fmt.Errorf("unknown option `atomic'"), false},
+	}
+	for _, test := range tests {
+		if got := isAtomicUnsupported(test.err); got != test.want {
+			t.Errorf("isAtomicUnsupported(%v): got %v, want %v", test.err, got, test.want)
+		}
+	}
+}
+
+func TestIsFilterUnsupported(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{Error("", "fatal: git upload-pack: filtering capability not negotiated\n", "clone"), true},
+		{Error("", "fatal: repository 'repo' does not exist\n", "clone"), false},
+		{fmt.Errorf("filtering capability not negotiated"), false},
+	}
+	for _, test := range tests {
+		if got := isFilterUnsupported(test.err); got != test.want {
+			t.Errorf("isFilterUnsupported(%v): got %v, want %v", test.err, got, test.want)
+		}
+	}
+}
+
+func TestProgressWriter(t *testing.T) {
+	type update struct {
+		phase   string
+		percent int
+	}
+	var got []update
+	w := &progressWriter{fn: func(phase string, percent int) {
+		got = append(got, update{phase, percent})
+	}}
+	// Write the output in chunks which don't match lines, like a pipe would.
+	output := "Cloning into bare repository 'cache'...\n" +
+		"remote: Counting objects: 100% (10/10), done.\n" +
+		"Receiving objects:   0% (0/200)\rReceiving objects:  45% (90/200), 1.20 MiB | 500.00 KiB/s\r" +
+		"Receiving objects: 100% (200/200), 2.40 MiB | 600.00 KiB/s, done.\n" +
+		"Resolving deltas:  50% (5/10)\rResolving deltas: 100% (10/10), done.\n"
+	for len(output) > 0 {
+		n := 7
+		if n > len(output) {
+			n = len(output)
+		}
+		if _, err := w.Write([]byte(output[:n])); err != nil {
+			t.Fatal(err)
+		}
+		output = output[n:]
+	}
+	want := []update{
+		{"Counting objects", 100},
+		{"Receiving objects", 0},
+		{"Receiving objects", 45},
+		{"Receiving objects", 100},
+		{"Resolving deltas", 50},
+		{"Resolving deltas", 100},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestSignificantStderr(t *testing.T) {
+	stderr := "Cloning into 'project'...\n" +
+		"warning: redirecting to https://example.com/project/\n" +
+		"warning: remote HEAD refers to nonexistent ref, unable to checkout.\n" +
+		"warning: unknown warning\n" +
+		"fatal: genuine failure\n"
+	tests := []struct {
+		strict bool
+		want   []string
+	}{
+		{
+			false,
+			[]string{"Cloning into 'project'...", "warning: unknown warning", "fatal: genuine failure"},
+		},
+		{
+			true,
+			[]string{
+				"Cloning into 'project'...",
+				"warning: redirecting to https://example.com/project/",
+				"warning: remote HEAD refers to nonexistent ref, unable to checkout.",
+				"warning: unknown warning",
+				"fatal: genuine failure",
+			},
+		},
+	}
+	for _, test := range tests {
+		if got := significantStderr(stderr, test.strict); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("significantStderr(strict=%v): got %q, want %q", test.strict, got, test.want)
+		}
+	}
+}
+
+// TestNetworkTimeoutEnv tests that the network timeout is passed to git
+// through its environment.
+func TestNetworkTimeoutEnv(t *testing.T) {
+	jirix := &jiri.X{
+		Context: tool.NewContextFromEnv(cmdline.EnvFromOS(), false),
+		Logger:  log.NewLogger(log.InfoLevel, color.NewColor(false)),
+	}
+	// The alias runs env as a child process of git.
+	env := func() map[string]bool {
+		lines, err := New(context.Background(), jirix).runOutput("-c", "alias.printenv=!env", "printenv")
+		if err != nil {
+			t.Fatal(err)
+		}
+		vars := make(map[string]bool)
+		for _, line := range lines {
+			vars[line] = true
+		}
+		return vars
+	}
+	if vars := env(); vars["GIT_HTTP_LOW_SPEED_LIMIT=1000"] {
+		t.Errorf("GIT_HTTP_LOW_SPEED_LIMIT set without a network timeout")
+	}
+	jirix.NetworkTimeout = 90500 * time.Millisecond
+	vars := env()
+	for _, want := range []string{"GIT_HTTP_LOW_SPEED_LIMIT=1000", "GIT_HTTP_LOW_SPEED_TIME=91"} {
+		if !vars[want] {
+			t.Errorf("%s not in the environment of git", want)
+		}
+	}
+}
@@ -27,6 +27,9 @@ type MergeOpt interface {
 type PushOpt interface {
 	pushOpt()
 }
+type RebaseOpt interface {
+	rebaseOpt()
+}
 type ResetOpt interface {
 	resetOpt()
 }
@@ -41,6 +44,22 @@ func (ForceOpt) checkoutOpt()     {}
 func (ForceOpt) deleteBranchOpt() {}
 func (ForceOpt) pushOpt()         {}
 
+// ForceWithLeaseOpt makes push use --force-with-lease, which refuses to
+// overwrite a remote ref that doesn't match its remote-tracking branch.
+type ForceWithLeaseOpt bool
+
+func (ForceWithLeaseOpt) pushOpt() {}
+
+// DryRunOpt makes push only report what would be pushed.
+type DryRunOpt bool
+
+func (DryRunOpt) pushOpt() {}
+
+// ForceWithLeaseRefOpt makes push use --force-with-lease=<refname>.
+type ForceWithLeaseRefOpt string
+
+func (ForceWithLeaseRefOpt) pushOpt() {}
+
 type DetachOpt bool
 
 func (DetachOpt) checkoutOpt() {}
@@ -65,6 +84,18 @@ type StrategyOpt string
 
 func (StrategyOpt) mergeOpt() {}
 
+// AutoStashOpt makes rebase stash the uncommitted changes before rebasing,
+// and apply them back afterwards.
+type AutoStashOpt bool
+
+func (AutoStashOpt) rebaseOpt() {}
+
+// AutoSquashOpt makes rebase squash the "fixup!" and "squash!" commits into
+// the commits they refer to, without prompting for the messages.
+type AutoSquashOpt bool
+
+func (AutoSquashOpt) rebaseOpt() {}
+
 type FfOnlyOpt bool
 
 func (FfOnlyOpt) mergeOpt() {}
@@ -89,6 +120,23 @@ type UpdateShallowOpt bool
 
 func (UpdateShallowOpt) fetchOpt() {}
 
+// AtomicOpt makes fetch update the local refs in a single transaction, either
+// all or none of them being updated.  It can't be combined with AllOpt.
+type AtomicOpt bool
+
+func (AtomicOpt) fetchOpt() {}
+
+type NoTagsOpt bool
+
+func (NoTagsOpt) cloneOpt() {}
+func (NoTagsOpt) fetchOpt() {}
+
+// SingleBranchOpt makes clone only fetch the history of the given branch or
+// tag.
+type SingleBranchOpt string
+
+func (SingleBranchOpt) cloneOpt() {}
+
 type VerifyOpt bool
 
 func (VerifyOpt) pushOpt() {}
@@ -101,8 +149,41 @@ type ReferenceOpt string
 
 func (ReferenceOpt) cloneOpt() {}
 
+// ReferenceIfAbleOpt makes clone borrow objects from the given repository like
+// ReferenceOpt, only warning if it isn't a repository.
+type ReferenceIfAbleOpt string
+
+func (ReferenceIfAbleOpt) cloneOpt() {}
+
 type NoCheckoutOpt bool
 
 func (NoCheckoutOpt) cloneOpt() {}
 
+// OriginOpt makes clone name the remote it clones from after the given name
+// instead of "origin".
+type OriginOpt string
+
+func (OriginOpt) cloneOpt() {}
+
 func (DepthOpt) cloneOpt() {}
+
+// FilterOpt makes clone and fetch omit the objects excluded by the given
+// filter spec, e.g. "blob:none", creating a partial clone.
+type FilterOpt string
+
+func (FilterOpt) cloneOpt() {}
+func (FilterOpt) fetchOpt() {}
+
+// ShallowSinceOpt makes clone and fetch only fetch the history after the
+// given date, e.g. "2017-01-31".
+type ShallowSinceOpt string
+
+func (ShallowSinceOpt) cloneOpt() {}
+func (ShallowSinceOpt) fetchOpt() {}
+
+// ProgressOpt is called with the progress git reports while cloning or
+// fetching, e.g. ("Receiving objects", 45).
+type ProgressOpt func(phase string, percent int)
+
+func (ProgressOpt) cloneOpt() {}
+func (ProgressOpt) fetchOpt() {}
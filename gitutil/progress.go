@@ -0,0 +1,41 @@
+// Copyright 2017 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gitutil
+
+import (
+	"regexp"
+	"strconv"
+)
+
+// progressRE matches the progress lines git writes with --progress, e.g.
+// "Receiving objects:  45% (450/1000), 1.20 MiB | 500.00 KiB/s".
+var progressRE = regexp.MustCompile(`^(?:remote: )?([A-Za-z][A-Za-z ]*):\s+(\d+)%`)
+
+// progressWriter parses the progress git writes to stderr.  Git separates
+// updates of the same phase with carriage returns, and phases with newlines.
+type progressWriter struct {
+	fn   ProgressOpt
+	line []byte
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	for _, b := range p {
+		if b == '\r' || b == '\n' {
+			w.flush()
+			continue
+		}
+		w.line = append(w.line, b)
+	}
+	return len(p), nil
+}
+
+func (w *progressWriter) flush() {
+	if m := progressRE.FindSubmatch(w.line); m != nil {
+		if percent, err := strconv.Atoi(string(m[2])); err == nil {
+			w.fn(string(m[1]), percent)
+		}
+	}
+	w.line = w.line[:0]
+}
@@ -0,0 +1,81 @@
+// Copyright 2017 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gitutil_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"fuchsia.googlesource.com/jiri/git"
+	"fuchsia.googlesource.com/jiri/gitutil"
+	"fuchsia.googlesource.com/jiri/jiritest"
+)
+
+func TestPushBranch(t *testing.T) {
+	jirix, cleanup := jiritest.NewX(t)
+	defer cleanup()
+	dir := filepath.Join(jirix.Root, "repo")
+	remoteDir := filepath.Join(jirix.Root, "remote")
+	for _, d := range []string{dir, remoteDir} {
+		if err := gitutil.New(context.Background(), jirix).Init(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	g := gitutil.New(context.Background(), jirix, gitutil.RootDirOpt(dir), gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"))
+	if err := g.AddRemote("origin", remoteDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.CommitWithMessage("first"); err != nil {
+		t.Fatal(err)
+	}
+	branch, err := g.CurrentBranchName()
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := git.NewGit(context.Background(), dir).CurrentRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := git.NewGit(context.Background(), remoteDir)
+
+	// The local branch is pushed to the given remote branch.
+	if err := g.PushBranch(branch, "origin", "other"); err != nil {
+		t.Fatal(err)
+	}
+	if rev, err := remote.CurrentRevisionForRef("refs/heads/other"); err != nil {
+		t.Fatal(err)
+	} else if rev != first {
+		t.Errorf("got refs/heads/other at %s, want %s", rev, first)
+	}
+
+	// A dry run doesn't create the remote branch.
+	if err := g.PushBranch(branch, "origin", "dry", gitutil.DryRunOpt(true)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := remote.CurrentRevisionForRef("refs/heads/dry"); err == nil {
+		t.Error("refs/heads/dry should not exist after a dry run")
+	}
+
+	// A rewritten branch is only pushed when forced.
+	if err := g.CommitAmendWithMessage("amended"); err != nil {
+		t.Fatal(err)
+	}
+	amended, err := git.NewGit(context.Background(), dir).CurrentRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.PushBranch(branch, "origin", "other"); err == nil {
+		t.Error("a non fast-forward push should fail")
+	}
+	if err := g.PushBranch(branch, "origin", "other", gitutil.ForceOpt(true)); err != nil {
+		t.Fatal(err)
+	}
+	if rev, err := remote.CurrentRevisionForRef("refs/heads/other"); err != nil {
+		t.Fatal(err)
+	} else if rev != amended {
+		t.Errorf("got refs/heads/other at %s, want %s", rev, amended)
+	}
+}
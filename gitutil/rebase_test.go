@@ -0,0 +1,126 @@
+// Copyright 2017 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gitutil_test
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"fuchsia.googlesource.com/jiri/gitutil"
+	"fuchsia.googlesource.com/jiri/jiritest"
+)
+
+// TestRebaseAutoStash tests that uncommitted changes survive a rebase with
+// AutoStashOpt, which fails without it.
+func TestRebaseAutoStash(t *testing.T) {
+	jirix, cleanup := jiritest.NewX(t)
+	defer cleanup()
+	dir := filepath.Join(jirix.Root, "repo")
+	g := gitutil.New(context.Background(), jirix, gitutil.RootDirOpt(dir), gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"))
+	if err := gitutil.New(context.Background(), jirix).Init(dir); err != nil {
+		t.Fatal(err)
+	}
+	commit := func(file, data string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, file), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := g.CommitFile(file, "commit "+file); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Create a feature branch and move its base forward.
+	commit("a", "a")
+	base, err := g.CurrentBranchName()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.CreateAndCheckoutBranch("feature"); err != nil {
+		t.Fatal(err)
+	}
+	commit("b", "b")
+	if err := g.CheckoutBranch(base); err != nil {
+		t.Fatal(err)
+	}
+	commit("c", "c")
+	if err := g.CheckoutBranch("feature"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "a"), []byte("uncommitted"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := g.Rebase(base); err == nil {
+		t.Fatal("rebase with uncommitted changes succeeded without AutoStashOpt")
+	}
+	if err := g.Rebase(base, gitutil.AutoStashOpt(true)); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "a")); err != nil {
+		t.Fatal(err)
+	} else if got, want := string(data), "uncommitted"; got != want {
+		t.Errorf("got %q after rebase, want %q", got, want)
+	}
+	for _, file := range []string{"b", "c"} {
+		if _, err := ioutil.ReadFile(filepath.Join(dir, file)); err != nil {
+			t.Errorf("file %s missing after rebase: %v", file, err)
+		}
+	}
+}
+
+// TestRebaseAutoSquash tests that the fixup commits of a branch are squashed
+// into the commits they refer to by a rebase with AutoSquashOpt.
+func TestRebaseAutoSquash(t *testing.T) {
+	jirix, cleanup := jiritest.NewX(t)
+	defer cleanup()
+	dir := filepath.Join(jirix.Root, "repo")
+	g := gitutil.New(context.Background(), jirix, gitutil.RootDirOpt(dir), gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"))
+	if err := gitutil.New(context.Background(), jirix).Init(dir); err != nil {
+		t.Fatal(err)
+	}
+	commit := func(file, data, message string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, file), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := g.CommitFile(file, message); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	commit("a", "a", "commit a")
+	base, err := g.CurrentBranchName()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.CreateAndCheckoutBranch("feature"); err != nil {
+		t.Fatal(err)
+	}
+	commit("b", "b", "commit b")
+	commit("c", "c", "commit c")
+	commit("b", "fixed b", "fixup! commit b")
+	if err := g.CheckoutBranch(base); err != nil {
+		t.Fatal(err)
+	}
+	commit("d", "d", "commit d")
+	if err := g.CheckoutBranch("feature"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := g.Rebase(base, gitutil.AutoSquashOpt(true)); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := g.CountCommits("HEAD", base); err != nil {
+		t.Fatal(err)
+	} else if n != 2 {
+		t.Errorf("got %d commits on top of %s after rebase, want 2", n, base)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "b")); err != nil {
+		t.Fatal(err)
+	} else if got, want := string(data), "fixed b"; got != want {
+		t.Errorf("got %q after rebase, want %q", got, want)
+	}
+}
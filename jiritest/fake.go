@@ -5,6 +5,7 @@
 package jiritest
 
 import (
+	"context"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -121,7 +122,7 @@ func (fake FakeJiriRoot) AddHook(hook project.Hook) error {
 // repository.
 func (fake FakeJiriRoot) DisableRemoteManifestPush() error {
 	dir := gitutil.RootDirOpt(filepath.Join(fake.remote, manifestProjectPath))
-	if err := gitutil.New(fake.X, dir).CheckoutBranch("master"); err != nil {
+	if err := gitutil.New(context.Background(), fake.X, dir).CheckoutBranch("master"); err != nil {
 		return err
 	}
 	return nil
@@ -131,12 +132,12 @@ func (fake FakeJiriRoot) DisableRemoteManifestPush() error {
 // repository.
 func (fake FakeJiriRoot) EnableRemoteManifestPush() error {
 	dir := gitutil.RootDirOpt(filepath.Join(fake.remote, manifestProjectPath))
-	if !gitutil.New(fake.X, dir).BranchExists("non-master") {
-		if err := gitutil.New(fake.X, dir).CreateBranch("non-master"); err != nil {
+	if !gitutil.New(context.Background(), fake.X, dir).BranchExists("non-master") {
+		if err := gitutil.New(context.Background(), fake.X, dir).CreateBranch("non-master"); err != nil {
 			return err
 		}
 	}
-	if err := gitutil.New(fake.X, dir).CheckoutBranch("non-master"); err != nil {
+	if err := gitutil.New(context.Background(), fake.X, dir).CheckoutBranch("non-master"); err != nil {
 		return err
 	}
 	return nil
@@ -148,10 +149,10 @@ func (fake FakeJiriRoot) CreateRemoteProject(name string) error {
 	if err := os.MkdirAll(projectDir, os.FileMode(0700)); err != nil {
 		return err
 	}
-	if err := gitutil.New(fake.X).Init(projectDir); err != nil {
+	if err := gitutil.New(context.Background(), fake.X).Init(projectDir); err != nil {
 		return err
 	}
-	git := gitutil.New(fake.X, gitutil.RootDirOpt(projectDir))
+	git := gitutil.New(context.Background(), fake.X, gitutil.RootDirOpt(projectDir))
 	if err := git.Config("user.email", "john.doe@example.com"); err != nil {
 		return err
 	}
@@ -175,10 +176,17 @@ func (fake FakeJiriRoot) ReadRemoteManifest() (*project.Manifest, error) {
 // UpdateUniverse synchronizes the content of the Vanadium fake based
 // on the content of the remote manifest.
 func (fake FakeJiriRoot) UpdateUniverse(gc bool) error {
-	if err := project.UpdateUniverse(fake.X, gc, false, false, false, false, project.DefaultHookTimeout); err != nil {
-		return err
+	return fake.UpdateUniverseWithOpts(project.UpdateUniverseOpts{GC: gc})
+}
+
+// UpdateUniverseWithOpts is like UpdateUniverse, with the given options of the
+// update.  The hooks time out after project.DefaultHookTimeout unless
+// opts.RunHookTimeout is set.
+func (fake FakeJiriRoot) UpdateUniverseWithOpts(opts project.UpdateUniverseOpts) error {
+	if opts.RunHookTimeout == 0 {
+		opts.RunHookTimeout = project.DefaultHookTimeout
 	}
-	return nil
+	return project.UpdateUniverse(context.Background(), fake.X, opts)
 }
 
 // ReadJiriManifest reads the .jiri_manifest manifest.
@@ -200,7 +208,7 @@ func (fake FakeJiriRoot) WriteRemoteManifest(manifest *project.Manifest) error {
 }
 
 func (fake FakeJiriRoot) writeManifest(manifest *project.Manifest, dir, path string) error {
-	git := gitutil.New(fake.X, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"), gitutil.RootDirOpt(dir))
+	git := gitutil.New(context.Background(), fake.X, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"), gitutil.RootDirOpt(dir))
 	if err := manifest.ToFile(fake.X, path); err != nil {
 		return err
 	}
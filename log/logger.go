@@ -9,7 +9,9 @@ import (
 	"io"
 	glog "log"
 	"os"
+	"strings"
 	"sync"
+	"time"
 
 	"fuchsia.googlesource.com/jiri/color"
 )
@@ -26,9 +28,14 @@ import (
 // log.Debugf(....)
 // By default Error logger prints to os.Stderr and others print to os.Stdout.
 // Capture function can be used to temporarily capture the logs.
+//
+// When LogFile is set, every message logged at the logger level is also
+// written to it, uncolored, on a line of its own prefixed with the time and
+// the level, e.g. "2017-06-01T12:00:00.000Z WARN message".
 type Logger struct {
 	lock          *sync.Mutex
 	LoggerLevel   LogLevel
+	LogFile       io.Writer
 	goLogger      *glog.Logger
 	goErrorLogger *glog.Logger
 	color         color.Color
@@ -44,6 +51,22 @@ const (
 	TraceLevel
 )
 
+func (l LogLevel) String() string {
+	switch l {
+	case ErrorLevel:
+		return "ERROR"
+	case WarningLevel:
+		return "WARN"
+	case InfoLevel:
+		return "INFO"
+	case DebugLevel:
+		return "DEBUG"
+	case TraceLevel:
+		return "TRACE"
+	}
+	return fmt.Sprintf("LogLevel(%d)", int(l))
+}
+
 func NewLogger(loggerLevel LogLevel, color color.Color) *Logger {
 	return &Logger{
 		LoggerLevel:   loggerLevel,
@@ -68,40 +91,47 @@ func (l Logger) Capture(stdout, stderr io.Writer) Logger {
 	return l
 }
 
-func (l Logger) log(prefix, format string, a ...interface{}) {
+func (l Logger) log(level LogLevel, prefix, format string, a ...interface{}) {
 	l.lock.Lock()
 	defer l.lock.Unlock()
-	l.goLogger.Printf("%s%s", prefix, fmt.Sprintf(format, a...))
+	msg := fmt.Sprintf(format, a...)
+	if level == ErrorLevel {
+		l.goErrorLogger.Printf("%s%s", prefix, msg)
+	} else {
+		l.goLogger.Printf("%s%s", prefix, msg)
+	}
+	if l.LogFile != nil {
+		// Failing to write the log file must not fail the logged operation.
+		fmt.Fprintf(l.LogFile, "%s %s %s\n", time.Now().UTC().Format("2006-01-02T15:04:05.000Z07:00"), level, strings.TrimRight(msg, "\n"))
+	}
 }
 
 func (l Logger) Infof(format string, a ...interface{}) {
 	if l.LoggerLevel >= InfoLevel {
-		l.log("", format, a...)
+		l.log(InfoLevel, "", format, a...)
 	}
 }
 
 func (l Logger) Debugf(format string, a ...interface{}) {
 	if l.LoggerLevel >= DebugLevel {
-		l.log(l.color.Cyan("DEBUG: "), format, a...)
+		l.log(DebugLevel, l.color.Cyan("DEBUG: "), format, a...)
 	}
 }
 
 func (l Logger) Tracef(format string, a ...interface{}) {
 	if l.LoggerLevel >= TraceLevel {
-		l.log(l.color.Blue("TRACE: "), format, a...)
+		l.log(TraceLevel, l.color.Blue("TRACE: "), format, a...)
 	}
 }
 
 func (l Logger) Warningf(format string, a ...interface{}) {
 	if l.LoggerLevel >= WarningLevel {
-		l.log(l.color.Yellow("WARN: "), format, a...)
+		l.log(WarningLevel, l.color.Yellow("WARN: "), format, a...)
 	}
 }
 
 func (l Logger) Errorf(format string, a ...interface{}) {
 	if l.LoggerLevel >= ErrorLevel {
-		l.lock.Lock()
-		defer l.lock.Unlock()
-		l.goErrorLogger.Printf("%s%s", l.color.Red("ERROR: "), fmt.Sprintf(format, a...))
+		l.log(ErrorLevel, l.color.Red("ERROR: "), format, a...)
 	}
 }
@@ -6,3 +6,23 @@ package project
 
 // InternalWriteMetadata exports writeMetadata for tests.
 var InternalWriteMetadata = writeMetadata
+
+// InternalWriteUpdateHistoryFile exports writeUpdateHistoryFile for tests.
+var InternalWriteUpdateHistoryFile = writeUpdateHistoryFile
+
+// InternalFreeDiskSpace allows tests to fake the free disk space.
+var InternalFreeDiskSpace = &freeDiskSpace
+
+// InternalImportFetchRemote returns the remote used to fetch an import.
+var InternalImportFetchRemote = (*Import).fetchRemote
+
+// InternalUpdateHistoryNow allows tests to fake the time of update history
+// snapshots.
+var InternalUpdateHistoryNow = &updateHistoryNow
+
+// InternalMirrorRemote exports mirrorRemote for tests.
+var InternalMirrorRemote = mirrorRemote
+
+// InternalFetchManifestProject allows tests to count the fetches of remote
+// manifest projects.
+var InternalFetchManifestProject = &fetchManifestProject
@@ -0,0 +1,126 @@
+// Copyright 2017 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package project
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"fuchsia.googlesource.com/jiri"
+)
+
+// The .jiriignore file in the root lists the patterns of the paths which the
+// scans of the root for projects skip, e.g. vendor directories containing
+// copies of jiri projects.  Its format is that of .gitignore, restricted to
+// directories:
+//
+//   # Comment.
+//   vendor
+//   /out/
+//   third_party/**/testdata
+//   !third_party/foo/testdata
+//
+// A pattern without a slash, other than a trailing one, matches directories
+// at any depth, while the others are relative to the root.  "*", "?" and
+// character classes match within a path component, "**" matches any number
+// of them, and "!" negates a pattern.  The last matching pattern wins.
+
+// ignorePattern is a pattern of the .jiriignore file.
+type ignorePattern struct {
+	segments []string
+	negate   bool
+}
+
+// jiriIgnore holds the patterns of the .jiriignore file.
+type jiriIgnore []ignorePattern
+
+// readJiriIgnore reads the .jiriignore file of the root, if any.
+func readJiriIgnore(jirix *jiri.X) (jiriIgnore, error) {
+	b, err := ioutil.ReadFile(jirix.JiriIgnoreFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmtError(err)
+	}
+	ignore, err := parseJiriIgnore(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", jirix.JiriIgnoreFile(), err)
+	}
+	return ignore, nil
+}
+
+// parseJiriIgnore parses the contents of a .jiriignore file.
+func parseJiriIgnore(b []byte) (jiriIgnore, error) {
+	var ignore jiriIgnore
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var p ignorePattern
+		if strings.HasPrefix(line, "!") {
+			p.negate = true
+			line = line[1:]
+		}
+		line = strings.TrimSuffix(line, "/")
+		if line == "" {
+			continue
+		}
+		if !strings.Contains(line, "/") {
+			line = "**/" + line
+		}
+		p.segments = strings.Split(strings.TrimPrefix(line, "/"), "/")
+		for _, s := range p.segments {
+			if _, err := path.Match(s, ""); err != nil {
+				return nil, fmt.Errorf("pattern %q: %v", scanner.Text(), err)
+			}
+		}
+		ignore = append(ignore, p)
+	}
+	return ignore, scanner.Err()
+}
+
+// match returns whether the directory at rel, a slash separated path
+// relative to the root, is ignored.
+func (ignore jiriIgnore) match(rel string) bool {
+	segments := strings.Split(rel, "/")
+	ignored := false
+	for _, p := range ignore {
+		if matchSegments(p.segments, segments) {
+			ignored = !p.negate
+		}
+	}
+	return ignored
+}
+
+// matchSegments returns whether the segments of a path match those of a
+// pattern, where "**" matches any number of segments.
+func matchSegments(pattern, segments []string) bool {
+	if len(pattern) == 0 {
+		return len(segments) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(segments); i++ {
+			if matchSegments(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segments) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(pattern[0], segments[0]); !ok {
+		return false
+	}
+	return matchSegments(pattern[1:], segments[1:])
+}
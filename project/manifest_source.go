@@ -0,0 +1,148 @@
+// Copyright 2017 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package project
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"fuchsia.googlesource.com/jiri"
+	"fuchsia.googlesource.com/jiri/gitutil"
+)
+
+// ManifestSource provides the contents of manifests given their reference,
+// e.g. a file path or a URL.
+//
+// Manifests are read from the local filesystem unless their reference is a
+// URL whose scheme has a registered source.  Sources for "http" and "https"
+// are registered by default, and embedders can register their own with
+// RegisterManifestSource.  The local imports of a manifest fetched from a
+// registered source are resolved relative to its URL.
+type ManifestSource interface {
+	// Fetch returns the contents of the manifest with the given reference.
+	Fetch(ref string) ([]byte, error)
+}
+
+// FileManifestSource reads manifests from the local filesystem, references
+// being file paths.  Gzip compressed manifests are detected by their ".gz"
+// extension, after symlinks have been resolved.
+type FileManifestSource struct{}
+
+func (FileManifestSource) Fetch(ref string) ([]byte, error) {
+	return readManifestFile(ref)
+}
+
+// HTTPManifestSource fetches manifests from HTTP and HTTPS URLs.
+type HTTPManifestSource struct{}
+
+func (HTTPManifestSource) Fetch(ref string) ([]byte, error) {
+	resp, err := http.Get(ref)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+// GitManifestSource reads manifests from a branch of a git repository,
+// references being the paths of the manifests in the repository.  Every Fetch
+// clones the repository with depth 1 into a temporary directory that is
+// removed afterwards.
+type GitManifestSource struct {
+	X      *jiri.X
+	Remote string
+	Branch string
+}
+
+func (s GitManifestSource) Fetch(ref string) ([]byte, error) {
+	tmpDir, err := ioutil.TempDir("", "jiri-remote-manifest")
+	if err != nil {
+		return nil, fmt.Errorf("TempDir() failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	opts := []gitutil.CloneOpt{gitutil.DepthOpt(1), gitutil.NoTagsOpt(true), gitutil.SingleBranchOpt(s.Branch)}
+	if err := gitutil.New(context.Background(), s.X).Clone(s.Remote, tmpDir, opts...); err != nil {
+		return nil, fmt.Errorf("cannot clone %s at %s: %v", s.Remote, s.Branch, err)
+	}
+	return readManifestFile(filepath.Join(tmpDir, ref))
+}
+
+var (
+	manifestSourcesMu sync.Mutex
+	// manifestSources are the registered manifest sources, keyed by URL
+	// scheme.
+	manifestSources = map[string]ManifestSource{
+		"http":  HTTPManifestSource{},
+		"https": HTTPManifestSource{},
+	}
+)
+
+// RegisterManifestSource makes manifests whose reference is a URL with the
+// given scheme, e.g. "<scheme>://host/manifest", fetched from the given
+// source, replacing any source previously registered for the scheme.
+func RegisterManifestSource(scheme string, source ManifestSource) {
+	manifestSourcesMu.Lock()
+	defer manifestSourcesMu.Unlock()
+	manifestSources[scheme] = source
+}
+
+// registeredManifestSource returns the source registered for the URL scheme of
+// the given manifest reference, if any.
+func registeredManifestSource(ref string) (ManifestSource, bool) {
+	i := strings.Index(ref, "://")
+	if i <= 0 {
+		return nil, false
+	}
+	manifestSourcesMu.Lock()
+	defer manifestSourcesMu.Unlock()
+	source, ok := manifestSources[ref[:i]]
+	return source, ok
+}
+
+// manifestSource returns the source of the manifest with the given reference.
+func manifestSource(ref string) ManifestSource {
+	if source, ok := registeredManifestSource(ref); ok {
+		return source
+	}
+	return FileManifestSource{}
+}
+
+// manifestFromSource returns the manifest with the given reference, fetched
+// from its source, with defaults filled in.
+func manifestFromSource(ref string) (*Manifest, error) {
+	data, err := manifestSource(ref).Fetch(ref)
+	if err != nil {
+		return nil, fmtError(err)
+	}
+	m, err := ManifestFromBytes(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %v", ref, err)
+	}
+	return m, nil
+}
+
+// resolveManifestRef returns the reference of the manifest imported with the
+// given relative reference by the manifest with the given reference.
+func resolveManifestRef(ref, rel string) (string, error) {
+	if _, ok := registeredManifestSource(ref); !ok {
+		return filepath.Join(filepath.Dir(ref), rel), nil
+	}
+	base, err := url.Parse(ref)
+	if err != nil {
+		return "", fmt.Errorf("invalid manifest URL %q: %v", ref, err)
+	}
+	relURL, err := url.Parse(rel)
+	if err != nil {
+		return "", fmt.Errorf("invalid manifest reference %q: %v", rel, err)
+	}
+	return base.ResolveReference(relURL).String(), nil
+}
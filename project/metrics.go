@@ -0,0 +1,160 @@
+// Copyright 2017 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package project
+
+import (
+	"bytes"
+	"context"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"fuchsia.googlesource.com/jiri/git"
+)
+
+// The metrics of the updates of the process, exported through expvar and in
+// the Prometheus text format by ServeMetrics.
+var (
+	metricProjectsUpdated = expvar.NewInt("jiri_projects_updated_total")
+	metricFetchErrors     = expvar.NewInt("jiri_fetch_errors_total")
+	metricUpdateDuration  = newHistogram("jiri_update_duration_seconds", []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600})
+)
+
+// histogram counts observations in cumulative buckets, like Prometheus
+// histograms.  It implements expvar.Var.
+type histogram struct {
+	mu      sync.Mutex
+	bounds  []float64
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+// newHistogram returns a histogram with the given increasing upper bounds,
+// published through expvar with the given name.
+func newHistogram(name string, bounds []float64) *histogram {
+	h := &histogram{bounds: bounds, buckets: make([]uint64, len(bounds))}
+	expvar.Publish(name, h)
+	return h
+}
+
+// Observe records the value v.
+func (h *histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// String returns the histogram as JSON, for expvar.
+func (h *histogram) String() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var buf bytes.Buffer
+	buf.WriteString(`{"buckets": {`)
+	for i, bound := range h.bounds {
+		if i != 0 {
+			buf.WriteString(", ")
+		}
+		fmt.Fprintf(&buf, "%q: %d", formatFloat(bound), h.buckets[i])
+	}
+	fmt.Fprintf(&buf, `}, "count": %d, "sum": %s}`, h.count, formatFloat(h.sum))
+	return buf.String()
+}
+
+// writePrometheus writes the histogram with the given name in the Prometheus
+// text format.
+func (h *histogram) writePrometheus(buf *bytes.Buffer, name, help string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for i, bound := range h.bounds {
+		fmt.Fprintf(buf, "%s_bucket{le=%q} %d\n", name, formatFloat(bound), h.buckets[i])
+	}
+	fmt.Fprintf(buf, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(buf, "%s_sum %s\n", name, formatFloat(h.sum))
+	fmt.Fprintf(buf, "%s_count %d\n", name, h.count)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// observeUpdateDuration records the duration of an update which started at
+// start.
+func observeUpdateDuration(start time.Time) {
+	metricUpdateDuration.Observe(time.Since(start).Seconds())
+}
+
+// observeOperation counts the project of op, which ran successfully, in the
+// updated projects if op created, moved or updated it.  The projects tracking
+// their remote branch get an update operation whether or not their revision
+// changed, so they are only counted if it did.
+func observeOperation(op operation) {
+	switch o := op.(type) {
+	case createOperation, moveOperation:
+		metricProjectsUpdated.Add(1)
+	case updateOperation:
+		if rev, err := git.NewGit(context.Background(), o.project.Path).CurrentRevision(); err == nil && rev != o.state.CurrentBranch.Revision {
+			metricProjectsUpdated.Add(1)
+		}
+	}
+}
+
+// observeFetchErrors counts the projects which failed to fetch in err, the
+// error of an update.  Only the error of the last attempt of an update must
+// be given, so that the projects failing the fast and full scans are counted
+// once.
+func observeFetchErrors(err error) {
+	switch e := err.(type) {
+	case fetchError:
+		metricFetchErrors.Add(1)
+	case MultiError:
+		for _, err := range e {
+			observeFetchErrors(err)
+		}
+	}
+}
+
+// metricsHandler serves the metrics in the Prometheus text format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	for _, counter := range []struct {
+		name, help string
+		v          *expvar.Int
+	}{
+		{"jiri_projects_updated_total", "Number of projects updated.", metricProjectsUpdated},
+		{"jiri_fetch_errors_total", "Number of projects which failed to fetch.", metricFetchErrors},
+	} {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", counter.name, counter.help, counter.name, counter.name, counter.v.Value())
+	}
+	metricUpdateDuration.writePrometheus(&buf, "jiri_update_duration_seconds", "Duration of the updates in seconds.")
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+// ServeMetrics serves the metrics of the updates on addr, e.g. ":9090", in
+// the Prometheus text format at /metrics and through expvar at /debug/vars,
+// until the returned listener is closed.
+func ServeMetrics(addr string) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("cannot serve metrics: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.Handle("/debug/vars", expvar.Handler())
+	go http.Serve(l, mux)
+	return l, nil
+}
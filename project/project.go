@@ -6,7 +6,10 @@ package project
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"hash/fnv"
 	"io"
@@ -14,12 +17,15 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"sort"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"fuchsia.googlesource.com/jiri"
 	"fuchsia.googlesource.com/jiri/collect"
@@ -29,6 +35,8 @@ import (
 	"fuchsia.googlesource.com/jiri/log"
 	"fuchsia.googlesource.com/jiri/osutil"
 	"fuchsia.googlesource.com/jiri/runutil"
+	"fuchsia.googlesource.com/jiri/tool"
+	"fuchsia.googlesource.com/jiri/version"
 )
 
 var (
@@ -58,14 +66,31 @@ type Manifest struct {
 	LocalImports []LocalImport `xml:"imports>localimport"`
 	Projects     []Project     `xml:"projects>project"`
 	Hooks        []Hook        `xml:"hooks>hook"`
+	JiriConfig   *JiriConfig   `xml:"jiri-config"`
 	XMLName      struct{}      `xml:"manifest"`
 }
 
+// JiriConfig holds default jiri settings shipped with a manifest, e.g. by a
+// team for all its developers.  The flags and the config of the jiri root take
+// precedence over them.
+type JiriConfig struct {
+	// Jobs is the number of jobs run simultaneously, as set by the -j flag.
+	Jobs int `xml:"jobs,attr,omitempty"`
+	// UpdateHistoryRetention is the number of update history snapshots kept.
+	UpdateHistoryRetention int      `xml:"update-history-retention,attr,omitempty"`
+	XMLName                struct{} `xml:"jiri-config"`
+}
+
 // ManifestFromBytes returns a manifest parsed from data, with defaults filled
-// in.
+// in.  Both XML and TOML manifests are accepted.
 func ManifestFromBytes(data []byte) (*Manifest, error) {
 	m := new(Manifest)
-	if err := xml.Unmarshal(data, m); err != nil {
+	if IsTOML(data) {
+		var err error
+		if m, err = manifestFromTOML(data); err != nil {
+			return nil, err
+		}
+	} else if err := manifestFromXML(data, m); err != nil {
 		return nil, err
 	}
 	if err := m.fillDefaults(); err != nil {
@@ -74,6 +99,46 @@ func ManifestFromBytes(data []byte) (*Manifest, error) {
 	return m, nil
 }
 
+// ManifestParseError is the error of a manifest which can't be parsed, at the
+// given position of its data.  Lines and columns start at 1.
+type ManifestParseError struct {
+	Line    int
+	Column  int
+	Message string
+}
+
+func (e *ManifestParseError) Error() string {
+	return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Message)
+}
+
+// manifestFromXML unmarshals the XML manifest data into m, returning a
+// ManifestParseError located where the decoder stopped on errors.
+func manifestFromXML(data []byte, m *Manifest) error {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	err := decoder.Decode(m)
+	if err == nil {
+		return nil
+	}
+	offset := int(decoder.InputOffset())
+	if offset > len(data) {
+		offset = len(data)
+	}
+	e := &ManifestParseError{Line: 1, Column: 1, Message: err.Error()}
+	if err == io.EOF {
+		e.Message = "no manifest element"
+	}
+	if syntaxErr, ok := err.(*xml.SyntaxError); ok {
+		e.Message = syntaxErr.Msg
+	}
+	if i := bytes.LastIndexByte(data[:offset], '\n'); i >= 0 {
+		e.Line += bytes.Count(data[:offset], []byte("\n"))
+		e.Column += utf8.RuneCount(data[i+1 : offset])
+	} else {
+		e.Column += utf8.RuneCount(data[:offset])
+	}
+	return e
+}
+
 func isFile(file string) (bool, error) {
 	fileInfo, err := os.Stat(file)
 	if err != nil {
@@ -101,8 +166,11 @@ func fmtError(err error) error {
 // specific root directory different from jirix.Root.  The usual way to load a
 // manifest is through LoadManifest, which does absolutize the paths, and uses
 // the correct root directory.
+//
+// Gzip compressed manifests, as written to the update history, are detected by
+// their ".gz" extension, after symlinks have been resolved.
 func ManifestFromFile(jirix *jiri.X, filename string) (*Manifest, error) {
-	data, err := ioutil.ReadFile(filename)
+	data, err := readManifestFile(filename)
 	if err != nil {
 		return nil, fmtError(err)
 	}
@@ -113,6 +181,47 @@ func ManifestFromFile(jirix *jiri.X, filename string) (*Manifest, error) {
 	return m, nil
 }
 
+// RemoteManifest returns the manifest file on the given branch of the remote
+// git repository, which need not be part of any manifest.  The repository is
+// cloned with depth 1 into a temporary directory that is removed afterwards.
+// Imports in the returned manifest are not resolved.
+func RemoteManifest(jirix *jiri.X, remote, branch, file string) (*Manifest, error) {
+	data, err := GitManifestSource{X: jirix, Remote: remote, Branch: branch}.Fetch(file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read manifest %s from %s at %s: %v", file, remote, branch, err)
+	}
+	m, err := ManifestFromBytes(data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read manifest %s from %s at %s: invalid manifest: %v", file, remote, branch, err)
+	}
+	return m, nil
+}
+
+// readManifestFile returns the contents of filename, decompressing them if
+// filename (or the file it links to) is gzip compressed.
+func readManifestFile(filename string) ([]byte, error) {
+	if !strings.HasSuffix(filename, ".gz") {
+		resolved, err := filepath.EvalSymlinks(filename)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasSuffix(resolved, ".gz") {
+			return ioutil.ReadFile(filename)
+		}
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
 var (
 	newlineBytes       = []byte("\n")
 	emptyImportsBytes  = []byte("\n  <imports></imports>\n")
@@ -124,6 +233,7 @@ var (
 	endLocalImportBytes = []byte("></localimport>\n")
 	endProjectBytes     = []byte("></project>\n")
 	endHookBytes        = []byte("></hook>\n")
+	endJiriConfigBytes  = []byte("></jiri-config>\n")
 
 	endImportSoloBytes  = []byte("></import>")
 	endProjectSoloBytes = []byte("></project>")
@@ -137,15 +247,44 @@ func (m *Manifest) deepCopy() *Manifest {
 	x.LocalImports = append([]LocalImport(nil), m.LocalImports...)
 	x.Projects = append([]Project(nil), m.Projects...)
 	x.Hooks = append([]Hook(nil), m.Hooks...)
+	if m.JiriConfig != nil {
+		c := *m.JiriConfig
+		x.JiriConfig = &c
+	}
 	return x
 }
 
-// ToBytes returns m as serialized bytes, with defaults unfilled.
+// FindProject returns the first project of m with the given name.  The
+// project is returned by reference, so that changes to it are reflected in m.
+func (m *Manifest) FindProject(name string) (*Project, error) {
+	for i := range m.Projects {
+		if m.Projects[i].Name == name {
+			return &m.Projects[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no project named %q in manifest", name)
+}
+
+// FindProjectByPath returns the first project of m with the given path, by
+// reference like FindProject.
+func (m *Manifest) FindProjectByPath(path string) (*Project, error) {
+	path = filepath.Clean(path)
+	for i := range m.Projects {
+		if filepath.Clean(m.Projects[i].Path) == path {
+			return &m.Projects[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no project at path %q in manifest", path)
+}
+
+// ToBytes returns m as serialized bytes, with defaults unfilled.  Projects,
+// imports and hooks are sorted, see sortElements.
 func (m *Manifest) ToBytes() ([]byte, error) {
 	m = m.deepCopy() // avoid changing manifest when unfilling defaults.
 	if err := m.unfillDefaults(); err != nil {
 		return nil, err
 	}
+	m.sortElements()
 	data, err := xml.MarshalIndent(m, "", "  ")
 	if err != nil {
 		return nil, fmt.Errorf("manifest xml.Marshal failed: %v", err)
@@ -159,12 +298,49 @@ func (m *Manifest) ToBytes() ([]byte, error) {
 	data = bytes.Replace(data, endLocalImportBytes, endElemBytes, -1)
 	data = bytes.Replace(data, endProjectBytes, endElemBytes, -1)
 	data = bytes.Replace(data, endHookBytes, endElemBytes, -1)
+	data = bytes.Replace(data, endJiriConfigBytes, endElemBytes, -1)
 	if !bytes.HasSuffix(data, newlineBytes) {
 		data = append(data, '\n')
 	}
 	return data, nil
 }
 
+// sortElements sorts the projects by name, the imports by remote and manifest,
+// and the hooks by name, so that the serialized manifest doesn't depend on the
+// order they were added in.
+func (m *Manifest) sortElements() {
+	sort.SliceStable(m.Projects, func(i, j int) bool {
+		pi, pj := m.Projects[i], m.Projects[j]
+		switch {
+		case pi.Name != pj.Name:
+			return pi.Name < pj.Name
+		case pi.Remote != pj.Remote:
+			return pi.Remote < pj.Remote
+		}
+		return pi.Path < pj.Path
+	})
+	sort.SliceStable(m.Imports, func(i, j int) bool {
+		ii, ij := m.Imports[i], m.Imports[j]
+		switch {
+		case ii.Remote != ij.Remote:
+			return ii.Remote < ij.Remote
+		case ii.Manifest != ij.Manifest:
+			return ii.Manifest < ij.Manifest
+		}
+		return ii.Name < ij.Name
+	})
+	sort.SliceStable(m.Hooks, func(i, j int) bool {
+		hi, hj := m.Hooks[i], m.Hooks[j]
+		switch {
+		case hi.Name != hj.Name:
+			return hi.Name < hj.Name
+		case hi.ProjectName != hj.ProjectName:
+			return hi.ProjectName < hj.ProjectName
+		}
+		return hi.Action < hj.Action
+	})
+}
+
 func safeWriteFile(jirix *jiri.X, filename string, data []byte) error {
 	tmp := filename + ".tmp"
 	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
@@ -177,10 +353,15 @@ func safeWriteFile(jirix *jiri.X, filename string, data []byte) error {
 }
 
 type LocalConfig struct {
-	Ignore   bool     `xml:"ignore"`
-	NoUpdate bool     `xml:"no-update"`
-	NoRebase bool     `xml:"no-rebase"`
-	XMLName  struct{} `xml:"config"`
+	Ignore   bool `xml:"ignore"`
+	NoUpdate bool `xml:"no-update"`
+	NoRebase bool `xml:"no-rebase"`
+	NoPush   bool `xml:"no-push"`
+	// DefaultBranch is the local branch, e.g. "main", checked out by update
+	// instead of leaving the project on a detached HEAD, if the branch exists
+	// remotely.
+	DefaultBranch string   `xml:"default-branch,omitempty"`
+	XMLName       struct{} `xml:"config"`
 }
 
 // Reads localConfig from given reader. Returns incorrect bytes
@@ -227,12 +408,25 @@ func WriteLocalConfig(jirix *jiri.X, project Project, lc LocalConfig) error {
 
 // Hook represents a hook to run
 type Hook struct {
-	Name        string   `xml:"name,attr"`
-	Action      string   `xml:"action,attr"`
-	ProjectName string   `xml:"project,attr"`
-	XMLName     struct{} `xml:"hook"`
-	ActionPath  string   `xml:"-"`
-}
+	Name        string `xml:"name,attr"`
+	Action      string `xml:"action,attr"`
+	ProjectName string `xml:"project,attr"`
+	// After is a comma-separated list of the projects whose hooks must run
+	// before this hook.  By default, the hooks of a project run after those of
+	// the projects it is nested in.
+	After string `xml:"after,attr,omitempty"`
+	// Phase is when the hook runs: after every update if empty, or
+	// OnFailurePhase.
+	Phase      string   `xml:"phase,attr,omitempty"`
+	XMLName    struct{} `xml:"hook"`
+	ActionPath string   `xml:"-"`
+}
+
+// OnFailurePhase is the phase of the hooks which run when the update of their
+// project fails, e.g. to release external resources.  They are given the path
+// of the project and the error in the JIRI_FAILED_PROJECT_PATH and
+// JIRI_UPDATE_ERROR environment variables.
+const OnFailurePhase = "on-failure"
 
 // HookKey is a unique string for a project.
 type HookKey string
@@ -256,9 +450,24 @@ func (h *Hook) validate() error {
 	if strings.Contains(h.ProjectName, KeySeparator) {
 		return fmt.Errorf("bad hook: project cannot contain %q: %+v", KeySeparator, *h)
 	}
+	if h.Phase != "" && h.Phase != OnFailurePhase {
+		return fmt.Errorf("bad hook: phase must be empty or %q: %+v", OnFailurePhase, *h)
+	}
 	return nil
 }
 
+// afterProjects returns the names of the projects listed in the after
+// attribute of h.
+func (h Hook) afterProjects() []string {
+	var names []string
+	for _, name := range strings.Split(h.After, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
 // ProjectsByPath implements the Sort interface. It sorts Projects by
 // the Path field.
 type ProjectsByPath []Project
@@ -274,7 +483,7 @@ func (projects ProjectsByPath) Less(i, j int) bool {
 }
 
 // HooksByName implements the Sort interface. It sorts Hooks by the Name
-// field.
+// field, and then by the ProjectName field.
 type HooksByName []Hook
 
 func (hooks HooksByName) Len() int {
@@ -284,7 +493,62 @@ func (hooks HooksByName) Swap(i, j int) {
 	hooks[i], hooks[j] = hooks[j], hooks[i]
 }
 func (hooks HooksByName) Less(i, j int) bool {
-	return hooks[i].Name < hooks[j].Name
+	if hooks[i].Name != hooks[j].Name {
+		return hooks[i].Name < hooks[j].Name
+	}
+	return hooks[i].ProjectName < hooks[j].ProjectName
+}
+
+// Validate checks the consistency of the projects and hooks of a resolved
+// manifest, i.e. one without imports, such as the one returned by
+// ResolveManifest.  All the problems found are returned as a MultiError.
+func (m *Manifest) Validate() error {
+	var errs MultiError
+	keys := map[ProjectKey]bool{}
+	paths := map[string]string{}
+	names := map[string]bool{}
+	for _, p := range m.Projects {
+		if err := p.validate(); err != nil {
+			errs = append(errs, err)
+		}
+		if p.Name == "" {
+			errs = append(errs, fmt.Errorf("project at path %q has no name", p.Path))
+			continue
+		}
+		if p.Remote == "" {
+			errs = append(errs, fmt.Errorf("project %q has no remote", p.Name))
+		}
+		if keys[p.Key()] {
+			errs = append(errs, fmt.Errorf("project %q with remote %q is declared more than once", p.Name, p.Remote))
+		}
+		keys[p.Key()] = true
+		if other, ok := paths[p.Path]; ok {
+			errs = append(errs, fmt.Errorf("projects %q and %q have the same path %q", other, p.Name, p.Path))
+		} else {
+			paths[p.Path] = p.Name
+		}
+		names[p.Name] = true
+	}
+	for _, h := range m.Hooks {
+		if err := h.validate(); err != nil {
+			errs = append(errs, err)
+		}
+		if h.Action == "" {
+			errs = append(errs, fmt.Errorf("hook %q of project %q has no action", h.Name, h.ProjectName))
+		}
+		if !names[h.ProjectName] {
+			errs = append(errs, fmt.Errorf("hook %q is for project %q, which is not in the manifest", h.Name, h.ProjectName))
+		}
+		for _, name := range h.afterProjects() {
+			if !names[name] {
+				errs = append(errs, fmt.Errorf("hook %q of project %q runs after project %q, which is not in the manifest", h.Name, h.ProjectName, name))
+			}
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
 }
 
 // ToFile writes the manifest m to a file with the given filename, with
@@ -313,6 +577,21 @@ func (m *Manifest) ToFile(jirix *jiri.X, filename string) error {
 	return safeWriteFile(jirix, filename, data)
 }
 
+// ToCanonicalBytes returns m as bytes in the format written by ToFile, with
+// paths relative to the jiri root, and sorted like by ToBytes.  m is left
+// untouched.
+func (m *Manifest) ToCanonicalBytes(jirix *jiri.X) ([]byte, error) {
+	// Replace absolute paths with relative paths to make it possible to move
+	// the root directory locally.
+	m = m.deepCopy()
+	for i := range m.Projects {
+		if err := m.Projects[i].relativizePaths(jirix.Root); err != nil {
+			return nil, err
+		}
+	}
+	return m.ToBytes()
+}
+
 func (m *Manifest) fillDefaults() error {
 	for index := range m.Imports {
 		if err := m.Imports[index].fillDefaults(); err != nil {
@@ -386,8 +665,12 @@ type Import struct {
 	// RemoteBranch is the name of the remote branch to track.
 	RemoteBranch string `xml:"remotebranch,attr,omitempty"`
 	// Root path, prepended to all project paths specified in the manifest file.
-	Root    string   `xml:"root,attr,omitempty"`
-	XMLName struct{} `xml:"import"`
+	Root string `xml:"root,attr,omitempty"`
+	// FetchProtocol is the protocol used to fetch the remote manifest project,
+	// one of "ssh", "https" or "git".  The scheme of Remote is rewritten
+	// accordingly.  If empty, Remote is used as is.
+	FetchProtocol string   `xml:"fetchprotocol,attr,omitempty"`
+	XMLName       struct{} `xml:"import"`
 }
 
 func (i *Import) fillDefaults() error {
@@ -408,17 +691,58 @@ func (i *Import) validate() error {
 	if i.Manifest == "" || i.Remote == "" {
 		return fmt.Errorf("bad import: both manifest and remote must be specified")
 	}
+	switch i.FetchProtocol {
+	case "", "ssh", "https", "git":
+	default:
+		return fmt.Errorf("bad import: unknown fetch protocol %q", i.FetchProtocol)
+	}
 	return nil
 }
 
+// scpLikeRemoteRE matches the scp-like syntax of ssh remotes, e.g.
+// "user@host:path/to/repo".
+var scpLikeRemoteRE = regexp.MustCompile(`^(?:([^@/]+)@)?([^:/]+):(.+)$`)
+
+// fetchRemote returns the remote used to fetch the imported manifest project,
+// which is Remote with its scheme replaced by FetchProtocol.  The user and
+// port of Remote are kept.
+func (i *Import) fetchRemote() (string, error) {
+	if i.FetchProtocol == "" {
+		return i.Remote, nil
+	}
+	if u, err := url.Parse(i.Remote); err == nil && u.Scheme != "" && u.Host != "" {
+		if u.Scheme == i.FetchProtocol {
+			return i.Remote, nil
+		}
+		u.Scheme = i.FetchProtocol
+		return u.String(), nil
+	}
+	m := scpLikeRemoteRE.FindStringSubmatch(i.Remote)
+	if m == nil {
+		return "", fmt.Errorf("cannot fetch remote %q of import %q with protocol %q", i.Remote, i.Name, i.FetchProtocol)
+	}
+	if i.FetchProtocol == "ssh" {
+		return i.Remote, nil
+	}
+	u := url.URL{Scheme: i.FetchProtocol, Host: m[2], Path: "/" + strings.TrimPrefix(m[3], "/")}
+	if m[1] != "" {
+		u.User = url.User(m[1])
+	}
+	return u.String(), nil
+}
+
 func (i *Import) toProject(path string) (Project, error) {
+	remote, err := i.fetchRemote()
+	if err != nil {
+		return Project{}, err
+	}
 	p := Project{
 		Name:         i.Name,
 		Path:         path,
-		Remote:       i.Remote,
+		Remote:       remote,
 		RemoteBranch: i.RemoteBranch,
 	}
-	err := p.fillDefaults()
+	err = p.fillDefaults()
 	return p, err
 }
 
@@ -497,19 +821,68 @@ type Project struct {
 	Remote string `xml:"remote,attr,omitempty"`
 	// RemoteBranch is the name of the remote branch to track.
 	RemoteBranch string `xml:"remotebranch,attr,omitempty"`
+	// RemoteName is the name of the git remote of the project, "origin" if
+	// empty, for projects which must integrate with existing clones.
+	RemoteName string `xml:"remote-name,attr,omitempty"`
 	// Revision is the revision the project should be advanced to during "jiri
 	// update".  If Revision is set, RemoteBranch will be ignored.  If Revision
 	// is not set, "HEAD" is used as the default.
 	Revision string `xml:"revision,attr,omitempty"`
-	// HistoryDepth is the depth flag passed to git clone and git fetch
+	// FetchDepth is the depth flag passed to git clone and git fetch
 	// commands. It is used to limit downloading large histories for large
-	// projects.
+	// projects.  A FetchDepth of 0 means the full history is fetched, and a
+	// FetchDepth of N > 0 means only the last N commits are fetched.
+	FetchDepth int `xml:"fetchdepth,attr,omitempty"`
+	// HistoryDepth is the deprecated name of FetchDepth.  It is only read
+	// from manifests, and moved to FetchDepth when defaults are filled in.
 	HistoryDepth int `xml:"historydepth,attr,omitempty"`
+	// CloneFilter is the filter spec passed to git clone and git fetch to
+	// create a partial clone, e.g. "blob:none" or "tree:0".  It cannot be
+	// combined with FetchDepth.
+	CloneFilter string `xml:"clone-filter,attr,omitempty"`
+	// ShallowSince is the date passed as --shallow-since to git clone and
+	// git fetch, limiting the history fetched to the commits after it, e.g.
+	// "2017-01-31".  It cannot be combined with FetchDepth.
+	ShallowSince string `xml:"shallow-since,attr,omitempty"`
+	// SingleBranch makes update only clone and fetch the remote branch of
+	// the project, instead of all the branches of its remote.  A pinned
+	// revision which isn't on the remote branch makes update fetch all the
+	// branches.
+	SingleBranch bool `xml:"single-branch,attr,omitempty"`
+	// MirrorOf is the name of the project this project mirrors, e.g. to only
+	// serve as the object store of alternates.  Mirror projects are checked
+	// out but not built: their hooks aren't run and they are left out of the
+	// environment file.
+	MirrorOf string `xml:"mirror-of,attr,omitempty"`
+	// Lazy makes update only register the project, i.e. write its metadata,
+	// without checking it out until it is realized with RealizeProject.
+	Lazy bool `xml:"lazy,attr,omitempty"`
+	// IgnoreNested makes update exclude the projects nested in this project
+	// through its .git/info/exclude, for projects whose .gitignore can't
+	// list them.
+	IgnoreNested bool `xml:"ignore-nested,attr,omitempty"`
+	// BuildSystem is the build system "jiri build" runs in the project, one
+	// of the BuildSystem constants.  Projects without one aren't built.
+	BuildSystem string `xml:"buildsystem,attr,omitempty"`
+	// FetchVia is the command git runs instead of ssh to reach the remote of
+	// the project, through GIT_SSH_COMMAND, e.g. a transport helper of a
+	// locked-down network.
+	FetchVia string `xml:"fetch-via,attr,omitempty"`
 	// GerritHost is the gerrit host where project CLs will be sent.
 	GerritHost string `xml:"gerrithost,attr,omitempty"`
 	// GitHooks is a directory containing git hooks that will be installed for
 	// this project.
 	GitHooks string `xml:"githooks,attr,omitempty"`
+	// Exclude removes the project with the same name that was included by a
+	// previously loaded manifest or import.  The project is not checked out.
+	Exclude bool `xml:"exclude,attr,omitempty"`
+	// PostCloneHook is the path, relative to the project, of an executable
+	// run once in the project right after it is first cloned, e.g. to install
+	// its dependencies.
+	PostCloneHook string `xml:"post-clone-hook,attr,omitempty"`
+	// LFS makes update set up git-lfs in the project after cloning it, and
+	// pull its git-lfs objects after every update.
+	LFS bool `xml:"lfs,attr,omitempty"`
 
 	XMLName struct{} `xml:"project"`
 
@@ -519,8 +892,20 @@ type Project struct {
 
 	// This stores the local configuration file for the project
 	LocalConfig LocalConfig `xml:"-"`
+
+	// ManifestSource is the path of the manifest file declaring the project,
+	// set when imports are resolved.
+	ManifestSource string `xml:"-"`
 }
 
+// The build systems of projects, given by their buildsystem attribute.
+const (
+	BuildSystemCMake = "cmake"
+	BuildSystemBazel = "bazel"
+	BuildSystemMake  = "make"
+	BuildSystemNone  = "none"
+)
+
 // ProjectFromFile returns a project parsed from the contents of filename,
 // with defaults filled in and all paths absolute.
 func ProjectFromFile(jirix *jiri.X, filename string) (*Project, error) {
@@ -607,6 +992,10 @@ func (p *Project) fillDefaults() error {
 	if p.Revision == "" {
 		p.Revision = "HEAD"
 	}
+	if p.FetchDepth == 0 {
+		p.FetchDepth = p.HistoryDepth
+	}
+	p.HistoryDepth = 0
 	return p.validate()
 }
 
@@ -624,33 +1013,141 @@ func (p *Project) validate() error {
 	if strings.Contains(p.Name, KeySeparator) {
 		return fmt.Errorf("bad project: name cannot contain %q: %+v", KeySeparator, *p)
 	}
+	if p.CloneFilter != "" {
+		if err := validateCloneFilter(p.CloneFilter); err != nil {
+			return fmt.Errorf("bad project %q: %v", p.Name, err)
+		}
+		if p.FetchDepth > 0 {
+			return fmt.Errorf("bad project %q: clone-filter and fetchdepth cannot be combined", p.Name)
+		}
+	}
+	if p.ShallowSince != "" {
+		if err := validateShallowSince(p.ShallowSince); err != nil {
+			return fmt.Errorf("bad project %q: %v", p.Name, err)
+		}
+		if p.FetchDepth > 0 {
+			return fmt.Errorf("bad project %q: shallow-since and fetchdepth cannot be combined", p.Name)
+		}
+	}
+	switch p.BuildSystem {
+	case "", BuildSystemCMake, BuildSystemBazel, BuildSystemMake, BuildSystemNone:
+	default:
+		return fmt.Errorf("bad project %q: unknown buildsystem %q, want %s, %s, %s or %s", p.Name, p.BuildSystem, BuildSystemCMake, BuildSystemBazel, BuildSystemMake, BuildSystemNone)
+	}
+	if p.PostCloneHook != "" {
+		if hook := filepath.Clean(p.PostCloneHook); filepath.IsAbs(hook) || hook == ".." || strings.HasPrefix(hook, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("bad project %q: post-clone-hook %q is not a path inside the project", p.Name, p.PostCloneHook)
+		}
+	}
+	return nil
+}
+
+// shallowSinceLayouts are the date formats accepted for shallow-since.  Git
+// itself accepts many more, but silently guesses at the ones it can't parse,
+// which would make clones differ between machines.
+var shallowSinceLayouts = []string{
+	"2006-01-02",
+	"2006-01-02 15:04:05",
+	time.RFC3339,
+}
+
+// validateShallowSince checks that date is in one of shallowSinceLayouts.
+func validateShallowSince(date string) error {
+	for _, layout := range shallowSinceLayouts {
+		if _, err := time.Parse(layout, date); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid shallow-since %q, want a date like \"2017-01-31\", \"2017-01-31 15:04:05\" or \"2017-01-31T15:04:05Z\"", date)
+}
+
+// cloneFilterRE matches the git filter specs which can be used as
+// clone-filter, except "combine:", whose parts it matches.
+var cloneFilterRE = regexp.MustCompile(`^(blob:none|blob:limit=[0-9]+[kmgKMG]?|tree:[0-9]+|object:type=(blob|tree|commit|tag)|sparse:oid=\S+)$`)
+
+// validateCloneFilter checks the syntax of a git filter spec, which git would
+// only report when the project is cloned.
+func validateCloneFilter(spec string) error {
+	parts := []string{spec}
+	if strings.HasPrefix(spec, "combine:") {
+		parts = strings.Split(strings.TrimPrefix(spec, "combine:"), "+")
+	}
+	for _, part := range parts {
+		if !cloneFilterRE.MatchString(part) {
+			return fmt.Errorf("invalid clone-filter %q", spec)
+		}
+	}
 	return nil
 }
 
 // CacheDirPath returns a generated path to a directory that can be used as a reference repo
 // for the given project.
 func (p *Project) CacheDirPath(jirix *jiri.X) (string, error) {
-	if jirix.Cache != "" {
-		url, err := url.Parse(p.Remote)
-		if err != nil {
-			return "", err
+	return jirix.CacheDirPath(p.Remote)
+}
+
+// GitRemoteName returns the name of the git remote of the project, its
+// RemoteName or "origin" by default.
+func (p Project) GitRemoteName() string {
+	if p.RemoteName == "" {
+		return "origin"
+	}
+	return p.RemoteName
+}
+
+// JiriHead returns the revision the project was last updated to, recorded in
+// its JIRI_HEAD file.
+func JiriHead(p Project) (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(p.Path, ".git", "JIRI_HEAD"))
+	if err != nil {
+		return "", fmtError(err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// IsShallowClone returns true if the repository at the given path is a shallow
+// clone, i.e. has a non-empty .git/shallow file, so its history is truncated.
+func IsShallowClone(path string) (bool, error) {
+	fi, err := os.Stat(filepath.Join(path, ".git", "shallow"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, fmtError(err)
+	}
+	return fi.Size() > 0, nil
+}
+
+// warnShallowProjects warns about the local projects which are shallow clones
+// and whose remote project dropped the fetch depth or shallow-since date they
+// were last updated with, as update doesn't unshallow them.  It only warns
+// once, on the update dropping it.
+func warnShallowProjects(jirix *jiri.X, localProjects, remoteProjects Projects) {
+	for key, local := range localProjects {
+		if local.FetchDepth == 0 && local.ShallowSince == "" {
+			continue
+		}
+		remote, ok := remoteProjects[key]
+		if !ok || remote.FetchDepth != 0 || remote.ShallowSince != "" {
+			continue
+		}
+		if shallow, err := IsShallowClone(local.Path); err != nil {
+			jirix.Logger.Debugf("Cannot check if project %s(%s) is shallow: %v", local.Name, local.Path, err)
+		} else if shallow {
+			jirix.Logger.Warningf("Project %s(%s) is a shallow clone but its manifest entry doesn't set fetchdepth; run \"git fetch --unshallow\" in it to get its full history\n\n", local.Name, local.Path)
 		}
-		dirname := url.Host + strings.Replace(strings.Replace(url.Path, "-", "--", -1), "/", "-", -1)
-		referenceDir := filepath.Join(jirix.Cache, dirname)
-		return referenceDir, nil
 	}
-	return "", nil
 }
 
 func (p *Project) writeJiriRevisionFiles(jirix *jiri.X) error {
-	g := git.NewGit(p.Path)
+	g := git.NewGit(context.Background(), p.Path)
 	file := filepath.Join(p.Path, ".git", "JIRI_HEAD")
-	head := "refs/remotes/origin/master"
+	head := "refs/remotes/" + p.GitRemoteName() + "/master"
 	var err error
 	if p.Revision != "" && p.Revision != "HEAD" {
 		head = p.Revision
 	} else if p.RemoteBranch != "" {
-		head = "refs/remotes/origin/" + p.RemoteBranch
+		head = "refs/remotes/" + p.GitRemoteName() + "/" + p.RemoteBranch
 	}
 	head, err = g.CurrentRevisionForRef(head)
 	if err != nil {
@@ -749,12 +1246,22 @@ func CreateSnapshot(jirix *jiri.X, file string, localManifest bool) error {
 	jirix.TimerPush("create snapshot")
 	defer jirix.TimerPop()
 
-	manifest := Manifest{}
+	manifest, err := snapshotManifest(jirix, localManifest)
+	if err != nil {
+		return err
+	}
+	return manifest.ToFile(jirix, file)
+}
+
+// snapshotManifest returns a manifest that encodes the current state of HEAD
+// of all projects.
+func snapshotManifest(jirix *jiri.X, localManifest bool) (*Manifest, error) {
+	manifest := &Manifest{}
 
 	// Add all local projects to manifest.
 	localProjects, err := LocalProjects(jirix, FullScan)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	for _, project := range localProjects {
 		manifest.Projects = append(manifest.Projects, project)
@@ -762,21 +1269,21 @@ func CreateSnapshot(jirix *jiri.X, file string, localManifest bool) error {
 
 	_, hooks, err := LoadManifestFile(jirix, jirix.JiriManifestFile(), localProjects, localManifest)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	for _, hook := range hooks {
 		manifest.Hooks = append(manifest.Hooks, hook)
 	}
-
-	return manifest.ToFile(jirix, file)
+	return manifest, nil
 }
 
 // CheckoutSnapshot updates project state to the state specified in the given
 // snapshot file.  Note that the snapshot file must not contain remote imports.
-func CheckoutSnapshot(jirix *jiri.X, snapshot string, gc bool, runHookTimeout uint) error {
+// The rebase options and opts.LocalManifest are ignored.
+func CheckoutSnapshot(ctx context.Context, jirix *jiri.X, snapshot string, opts UpdateUniverseOpts) error {
 	// Find all local projects.
 	scanMode := FastScan
-	if gc {
+	if opts.GC {
 		scanMode = FullScan
 	}
 	localProjects, err := LocalProjects(jirix, scanMode)
@@ -787,7 +1294,8 @@ func CheckoutSnapshot(jirix *jiri.X, snapshot string, gc bool, runHookTimeout ui
 	if err != nil {
 		return err
 	}
-	if err := updateProjects(jirix, localProjects, remoteProjects, hooks, gc, runHookTimeout, false /*rebaseTracked*/, false /*rebaseUntracked*/, false /*rebaseAll*/, true /*snapshot*/); err != nil {
+	if err := updateProjects(ctx, jirix, localProjects, remoteProjects, hooks, opts, true /*snapshot*/); err != nil {
+		updateFailed(jirix, hooks, err, opts)
 		return err
 	}
 	return WriteUpdateHistorySnapshot(jirix, snapshot, false)
@@ -805,18 +1313,25 @@ func LoadSnapshotFile(jirix *jiri.X, snapshot string) (Projects, Hooks, error) {
 			return nil, nil, fmt.Errorf("%q is neither a URL nor a valid file path", snapshot)
 		}
 		jirix.Logger.Infof("Getting snapshot from URL %q", u)
-		resp, err := http.Get(u.String())
+		source, ok := registeredManifestSource(u.String())
+		if !ok {
+			source = HTTPManifestSource{}
+		}
+		data, err := source.Fetch(u.String())
 		if err != nil {
 			return nil, nil, fmt.Errorf("Error getting snapshot from URL %q: %v", u, err)
 		}
-		defer resp.Body.Close()
 		tmpFile, err := ioutil.TempFile("", "snapshot")
 		if err != nil {
 			return nil, nil, fmt.Errorf("Error creating tmp file: %v", err)
 		}
 		snapshot = tmpFile.Name()
 		defer os.Remove(snapshot)
-		if _, err = io.Copy(tmpFile, resp.Body); err != nil {
+		_, err = tmpFile.Write(data)
+		if closeErr := tmpFile.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
 			return nil, nil, fmt.Errorf("Error writing to tmp file: %v", err)
 		}
 
@@ -828,7 +1343,7 @@ func LoadSnapshotFile(jirix *jiri.X, snapshot string) (Projects, Hooks, error) {
 // directory by reading the jiri project metadata located in a directory at the
 // root of the current repository.
 func CurrentProjectKey(jirix *jiri.X) (ProjectKey, error) {
-	topLevel, err := gitutil.New(jirix).TopLevel()
+	topLevel, err := gitutil.New(context.Background(), jirix).TopLevel()
 	if err != nil {
 		return "", nil
 	}
@@ -843,13 +1358,63 @@ func CurrentProjectKey(jirix *jiri.X) (ProjectKey, error) {
 	return "", nil
 }
 
+// evalSymlinks returns the absolute path with its symlinks resolved.  The
+// trailing components of path which don't exist are kept as they are.
+func evalSymlinks(path string) string {
+	rest := ""
+	for {
+		if resolved, err := filepath.EvalSymlinks(path); err == nil {
+			return filepath.Join(resolved, rest)
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return filepath.Join(path, rest)
+		}
+		rest = filepath.Join(filepath.Base(path), rest)
+		path = parent
+	}
+}
+
+// FindProjectForPath returns the local project owning the given file, i.e.
+// the innermost project whose path is a prefix of it.  A relative path is
+// relative to the current directory.  The file doesn't need to exist.  The
+// paths are compared with their symlinks resolved, so that the file may be
+// reached through a symlink to the root or to a project.
+func FindProjectForPath(jirix *jiri.X, path string) (*Project, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmtError(err)
+	}
+	localProjects, err := LocalProjects(jirix, FastScan)
+	if err != nil {
+		return nil, err
+	}
+	resolved := evalSymlinks(path)
+	var owner *Project
+	ownerPath := ""
+	for _, p := range localProjects {
+		projectPath := evalSymlinks(p.Path)
+		if resolved != projectPath && !strings.HasPrefix(resolved, projectPath+string(filepath.Separator)) {
+			continue
+		}
+		if owner == nil || len(projectPath) > len(ownerPath) {
+			p := p
+			owner, ownerPath = &p, projectPath
+		}
+	}
+	if owner == nil {
+		return nil, fmt.Errorf("no project contains %q", path)
+	}
+	return owner, nil
+}
+
 // setProjectRevisions sets the current project revision for
 // each project as found on the filesystem
 func setProjectRevisions(jirix *jiri.X, projects Projects) (Projects, error) {
 	jirix.TimerPush("set revisions")
 	defer jirix.TimerPop()
 	for name, project := range projects {
-		g := git.NewGit(project.Path)
+		g := git.NewGit(context.Background(), project.Path)
 		revision, err := g.CurrentRevision()
 		if err != nil {
 			return nil, fmt.Errorf("Can't get revision for project %q: %v", project.Name, err)
@@ -874,6 +1439,13 @@ func LocalProjects(jirix *jiri.X, scanMode ScanMode) (Projects, error) {
 	if err != nil {
 		return nil, err
 	}
+	if scanMode == FastScan && !latestSnapshotExists {
+		// A dangling "latest" symlink can be left behind if the update history
+		// was partially removed.  Warn about it and fall back on the slow path.
+		if fi, err := os.Lstat(latestSnapshot); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			jirix.Logger.Warningf("Latest update history snapshot %q is a broken link, scanning the filesystem for projects.\n\n", latestSnapshot)
+		}
+	}
 	if scanMode == FastScan && latestSnapshotExists {
 		// Fast path: Full scan was not requested, and we have a snapshot containing
 		// the latest update.  Check that the projects listed in the snapshot exist
@@ -923,7 +1495,7 @@ func projectsExistLocally(jirix *jiri.X, projects Projects) (bool, error) {
 	jirix.TimerPush("match manifest")
 	defer jirix.TimerPop()
 	for _, p := range projects {
-		isLocal, err := isLocalProject(jirix, p.Path)
+		isLocal, err := IsJiriProject(p.Path)
 		if err != nil {
 			return false, err
 		}
@@ -963,19 +1535,139 @@ func LoadManifest(jirix *jiri.X) (Projects, Hooks, error) {
 // LoadManifestFile in parallel.
 func LoadManifestFile(jirix *jiri.X, file string, localProjects Projects, localManifest bool) (Projects, Hooks, error) {
 	ld := newManifestLoader(localProjects, false)
-	if err := ld.Load(jirix, "", file, "", localManifest); err != nil {
+	if err := ld.Load(context.Background(), jirix, "", file, "", localManifest); err != nil {
+		return nil, nil, err
+	}
+	if err := ld.checkDuplicatePaths(); err != nil {
 		return nil, nil, err
 	}
+	jirix.ApplyManifestConfig(uint(ld.config.Jobs), ld.config.UpdateHistoryRetention)
 	return ld.Projects, ld.Hooks, nil
 }
 
+// ProjectManifestFile loads the manifest, resolving remote and local imports
+// with the local projects, and returns the file declaring the project with the
+// given key or name, along with the name of the project in that file.
+func ProjectManifestFile(jirix *jiri.X, keyOrName string) (string, string, error) {
+	localProjects, err := LocalProjects(jirix, FastScan)
+	if err != nil {
+		return "", "", err
+	}
+	ld := newManifestLoader(localProjects, false)
+	defer func() {
+		if ld.TmpDir != "" {
+			os.RemoveAll(ld.TmpDir)
+		}
+	}()
+	if err := ld.Load(context.Background(), jirix, "", jirix.JiriManifestFile(), "", false); err != nil {
+		return "", "", err
+	}
+	p, err := ld.Projects.FindUnique(keyOrName)
+	if err != nil {
+		return "", "", err
+	}
+	if ld.TmpDir != "" && strings.HasPrefix(p.ManifestSource, ld.TmpDir+string(filepath.Separator)) {
+		return "", "", fmt.Errorf("project %q is declared in a manifest which is not checked out locally", p.Name)
+	}
+	return p.ManifestSource, ld.sourceNames[p.Key()], nil
+}
+
+// ManifestGraph is the graph of the manifest files loaded through the imports
+// of the .jiri_manifest file, and of the projects they declare.  The files are
+// relative to the jiri root, or to the temporary directory of the manifest
+// projects which are not checked out locally.
+type ManifestGraph struct {
+	// Files are the manifest files in the order they were loaded, starting
+	// with the .jiri_manifest file.
+	Files []string
+	// Imports are the files imported by each file, remotely or locally.
+	Imports map[string][]string
+	// Projects are the projects declared by each file.
+	Projects map[string]Projects
+}
+
+// LoadManifestGraph loads the manifest, resolving remote and local imports
+// with the local projects, and returns its graph.
+func LoadManifestGraph(jirix *jiri.X) (*ManifestGraph, error) {
+	localProjects, err := LocalProjects(jirix, FastScan)
+	if err != nil {
+		return nil, err
+	}
+	ld := newManifestLoader(localProjects, false)
+	defer func() {
+		if ld.TmpDir != "" {
+			os.RemoveAll(ld.TmpDir)
+		}
+	}()
+	if err := ld.Load(context.Background(), jirix, "", jirix.JiriManifestFile(), "", false); err != nil {
+		return nil, err
+	}
+	name := func(file string) string {
+		if ld.TmpDir != "" {
+			file = shortFileName(ld.TmpDir, file)
+		}
+		return shortFileName(jirix.Root, file)
+	}
+	g := &ManifestGraph{
+		Imports:  make(map[string][]string),
+		Projects: make(map[string]Projects),
+	}
+	for _, file := range ld.files {
+		g.Files = append(g.Files, name(file))
+		for _, imported := range ld.imports[file] {
+			g.Imports[name(file)] = append(g.Imports[name(file)], name(imported))
+		}
+	}
+	for key, p := range ld.Projects {
+		file := name(p.ManifestSource)
+		if g.Projects[file] == nil {
+			g.Projects[file] = make(Projects)
+		}
+		g.Projects[file][key] = p
+	}
+	return g, nil
+}
+
+// ResolveManifest loads the manifest starting with the given file, resolving
+// remote and local imports with the local projects, and returns the resolved
+// projects and hooks as a single manifest without imports.
+func ResolveManifest(jirix *jiri.X, file string, localManifest bool) (*Manifest, error) {
+	localProjects, err := LocalProjects(jirix, FastScan)
+	if err != nil {
+		return nil, err
+	}
+	projects, hooks, err := LoadManifestFile(jirix, file, localProjects, localManifest)
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{}
+	for _, project := range projects {
+		m.Projects = append(m.Projects, project)
+	}
+	for _, hook := range hooks {
+		m.Hooks = append(m.Hooks, hook)
+	}
+	return m, nil
+}
+
 func LoadUpdatedManifest(jirix *jiri.X, localProjects Projects, localManifest bool) (Projects, Hooks, string, error) {
+	return loadUpdatedManifest(context.Background(), jirix, localProjects, localManifest, "")
+}
+
+// loadUpdatedManifest is like LoadUpdatedManifest, fetching the remote manifest
+// projects from the given mirror, if any, like UpdateUniverseOpts.Mirror.
+func loadUpdatedManifest(ctx context.Context, jirix *jiri.X, localProjects Projects, localManifest bool, mirror string) (Projects, Hooks, string, error) {
 	jirix.TimerPush("load updated manifest")
 	defer jirix.TimerPop()
 	ld := newManifestLoader(localProjects, true)
-	if err := ld.Load(jirix, "", jirix.JiriManifestFile(), "", localManifest); err != nil {
+	ld.mirror = mirror
+	if err := ld.Load(ctx, jirix, "", jirix.JiriManifestFile(), "", localManifest); err != nil {
 		return nil, nil, ld.TmpDir, err
 	}
+	if err := ld.checkDuplicatePaths(); err != nil {
+		return nil, nil, ld.TmpDir, err
+	}
+	jirix.ApplyManifestConfig(uint(ld.config.Jobs), ld.config.UpdateHistoryRetention)
 	return ld.Projects, ld.Hooks, ld.TmpDir, nil
 }
 
@@ -1013,25 +1705,229 @@ func matchLocalWithRemote(localProjects, remoteProjects Projects) {
 	}
 }
 
-// UpdateUniverse updates all local projects and tools to match the remote
-// counterparts identified in the manifest. Optionally, the 'gc' flag can be
-// used to indicate that local projects that no longer exist remotely should be
-// removed.
-func UpdateUniverse(jirix *jiri.X, gc bool, localManifest bool, rebaseTracked bool, rebaseUntracked bool, rebaseAll bool, runHookTimeout uint) (e error) {
-	jirix.Logger.Infof("Updating all projects")
+// UpdateUniverseOpts holds the options of UpdateUniverse and its variants.
+type UpdateUniverseOpts struct {
+	// GC makes update delete the local projects which are no longer in the
+	// manifest, unless they might contain changes.
+	GC bool
 
-	updateFn := func(scanMode ScanMode) error {
-		jirix.TimerPush(fmt.Sprintf("update universe: %s", scanMode))
-		defer jirix.TimerPop()
+	// GCForce makes update delete obsolete projects even if they contain
+	// local branches or unpushed commits.  It only matters along with GC.
+	GCForce bool
 
-		// Find all local projects.
-		localProjects, err := LocalProjects(jirix, scanMode)
-		if err != nil {
-			return err
-		}
+	// LocalManifest makes update load the manifest projects as they are
+	// checked out, instead of updating them first.
+	LocalManifest bool
+
+	// RebaseTracked makes update rebase the current tracked branches instead
+	// of fast-forwarding them.
+	RebaseTracked bool
+
+	// RebaseUntracked makes update rebase the untracked branches onto HEAD.
+	RebaseUntracked bool
+
+	// RebaseAll makes update rebase all the tracked branches, and all the
+	// untracked ones too along with RebaseUntracked.
+	RebaseAll bool
+
+	// RunHookTimeout is the timeout of every hook, in minutes.  Zero means
+	// no timeout, the update command defaults it to DefaultHookTimeout.
+	RunHookTimeout uint
+
+	// HookJobs is the maximum number of hooks update runs at once.  Zero runs
+	// all the hooks which don't depend on each other at once.
+	HookJobs uint
+
+	// SkipHooks are the names of the hooks which update doesn't run.
+	SkipHooks []string
+
+	// NoHooks makes update run none of the hooks.
+	NoHooks bool
+
+	// SkipOnFailureHooks makes a failing update not run the OnFailurePhase
+	// hooks, e.g. because it will be retried.
+	SkipOnFailureHooks bool
+
+	// RequirePinned makes update fail when a project of the manifest isn't
+	// pinned to a revision, i.e. tracks the tip of its remote branch.
+	RequirePinned bool
+
+	// SkipMissingRevisions makes update leave the projects whose revision
+	// can't be fetched from their remote, e.g. because it was rewritten by a
+	// force push, untouched instead of failing, and not create such projects.
+	SkipMissingRevisions bool
+
+	// MoveReclone makes update clone projects whose path changed at their new
+	// path and delete the old directory, instead of moving it along with its
+	// local branches and changes.
+	MoveReclone bool
+
+	// StrictNesting makes update fail, instead of warning, when a project is
+	// nested in another project which doesn't ignore it.
+	StrictNesting bool
+
+	// ShallowBelowFreeSpace is the free disk space, in bytes, under which new
+	// projects are cloned with a history depth of 1.  Zero disables it.
+	ShallowBelowFreeSpace uint64
+
+	// Mirror is the URL prefix of a read-through mirror of the remotes,
+	// e.g. "https://mirror.example.com/", from which update fetches projects,
+	// falling back to their remotes when the mirror fails or lacks their
+	// revision.  The remote of "https://host.example.com/repo" on it is
+	// "https://mirror.example.com/host.example.com/repo".
+	Mirror string
+
+	// References are existing repositories, keyed by project name, which new
+	// clones of the projects borrow objects from through git alternates, the
+	// repository for the empty name being used for all the other projects.
+	// Unlike the cache, they are provided by the user and not maintained by
+	// jiri, so they must outlive the clones.
+	References map[string]string
+
+	// partial is set by UpdateUniverseProjects, whose update leaves the
+	// projects of the manifest it wasn't given alone.
+	partial bool
+}
+
+// UpdateUniverse updates all local projects and tools to match the remote
+// counterparts identified in the manifest. Optionally, opts.GC can be used to
+// indicate that local projects that no longer exist remotely should be
+// removed.  The version of the jiri binary is recorded in the .jiri_version
+// file after a successful update.
+func UpdateUniverse(ctx context.Context, jirix *jiri.X, opts UpdateUniverseOpts) error {
+	jirix.Logger.Infof("Updating all projects")
+	load := func(localProjects Projects) (Projects, Hooks, string, error) {
+		return loadUpdatedManifest(ctx, jirix, localProjects, opts.LocalManifest, opts.Mirror)
+	}
+	return updateUniverse(ctx, jirix, load, opts, false /*snapshot*/)
+}
+
+// UpdateUniverseProjects is like UpdateUniverse, but only updates the projects
+// of the manifest with the given keys or names, along with the projects
+// nested in them, and their hooks.  The other projects are left untouched,
+// and obsolete projects aren't deleted, whatever opts.GC.
+func UpdateUniverseProjects(ctx context.Context, jirix *jiri.X, keysOrNames []string, opts UpdateUniverseOpts) error {
+	jirix.Logger.Infof("Updating projects %s", strings.Join(keysOrNames, ", "))
+	load := func(localProjects Projects) (Projects, Hooks, string, error) {
+		projects, hooks, tmpLoadDir, err := loadUpdatedManifest(ctx, jirix, localProjects, opts.LocalManifest, opts.Mirror)
+		if err != nil {
+			return projects, hooks, tmpLoadDir, err
+		}
+		selected, err := selectProjects(projects, keysOrNames)
+		if err != nil {
+			return nil, nil, tmpLoadDir, err
+		}
+		// The local projects which aren't selected are left out of the
+		// update, instead of being seen as obsolete.
+		for key, p := range localProjects {
+			if _, ok := selected[key]; !ok && !containsPath(selected, p.Path) {
+				delete(localProjects, key)
+			}
+		}
+		names := make(map[string]bool)
+		for _, p := range selected {
+			names[p.Name] = true
+		}
+		for key, hook := range hooks {
+			if !names[hook.ProjectName] {
+				delete(hooks, key)
+			}
+		}
+		return selected, hooks, tmpLoadDir, nil
+	}
+	opts.GC = false
+	opts.partial = true
+	return updateUniverse(ctx, jirix, load, opts, false /*snapshot*/)
+}
+
+// selectProjects returns the projects with the given keys or names, along
+// with the projects nested in them.
+func selectProjects(projects Projects, keysOrNames []string) (Projects, error) {
+	selected := Projects{}
+	for _, keyOrName := range keysOrNames {
+		found := projects.Find(keyOrName)
+		if len(found) == 0 {
+			return nil, fmt.Errorf("no project of the manifest has key or name %q", keyOrName)
+		}
+		for key, p := range found {
+			selected[key] = p
+		}
+	}
+	for key, p := range projects {
+		if containsPath(selected, p.Path) {
+			selected[key] = p
+		}
+	}
+	return selected, nil
+}
+
+// containsPath returns whether path is nested in the path of one of the
+// projects.
+func containsPath(projects Projects, path string) bool {
+	for _, p := range projects {
+		if strings.HasPrefix(path, p.Path+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// UpdateUniverseFromSnapshot is like UpdateUniverse, with the given snapshot
+// instead of the manifest, e.g. to bisect a regression across all projects.
+// Unlike CheckoutSnapshot, projects whose path changed are matched like on
+// updates from the manifest.  The snapshot is a file, a URL, or the name of a
+// file of the update history directory, e.g. "second-latest".  The rebase
+// options and opts.LocalManifest are ignored.
+func UpdateUniverseFromSnapshot(ctx context.Context, jirix *jiri.X, snapshot string, opts UpdateUniverseOpts) error {
+	snapshot, err := resolveHistorySnapshot(jirix, snapshot)
+	if err != nil {
+		return err
+	}
+	jirix.Logger.Infof("Updating all projects to snapshot %q", snapshot)
+	load := func(localProjects Projects) (Projects, Hooks, string, error) {
+		projects, hooks, err := LoadSnapshotFile(jirix, snapshot)
+		return projects, hooks, "", err
+	}
+	return updateUniverse(ctx, jirix, load, opts, true /*snapshot*/)
+}
+
+// resolveHistorySnapshot returns the path of the snapshot of the update
+// history directory with the given name, or the given snapshot if there is
+// none or it is an existing file.
+func resolveHistorySnapshot(jirix *jiri.X, snapshot string) (string, error) {
+	if ok, err := isFile(snapshot); err != nil || ok {
+		return snapshot, err
+	}
+	if filepath.Base(snapshot) != snapshot {
+		return snapshot, nil
+	}
+	history := filepath.Join(jirix.UpdateHistoryDir(), snapshot)
+	if ok, err := isFile(history); err != nil || !ok {
+		return snapshot, err
+	}
+	return history, nil
+}
+
+// updateUniverse updates all the local projects to the remote projects
+// returned by load, along with the path of a temporary directory to remove
+// afterwards, if any.
+func updateUniverse(ctx context.Context, jirix *jiri.X, load func(localProjects Projects) (Projects, Hooks, string, error), opts UpdateUniverseOpts, snapshot bool) (e error) {
+	defer observeUpdateDuration(time.Now())
+	// The hooks of the last scan, for the on-failure hooks.
+	var hooks Hooks
+	updateFn := func(scanMode ScanMode) error {
+		jirix.TimerPush(fmt.Sprintf("update universe: %s", scanMode))
+		defer jirix.TimerPop()
+
+		// Find all local projects.
+		localProjects, err := LocalProjects(jirix, scanMode)
+		if err != nil {
+			return err
+		}
 
 		// Determine the set of remote projects and match them up with the locals.
-		remoteProjects, hooks, tmpLoadDir, err := LoadUpdatedManifest(jirix, localProjects, localManifest)
+		remoteProjects, h, tmpLoadDir, err := load(localProjects)
+		hooks = h
 		matchLocalWithRemote(localProjects, remoteProjects)
 
 		// Make sure we clean up the tmp dir used to load remote manifest projects.
@@ -1042,14 +1938,26 @@ func UpdateUniverse(jirix *jiri.X, gc bool, localManifest bool, rebaseTracked bo
 		if err != nil {
 			return err
 		}
+		if opts.RequirePinned {
+			if err := checkPinnedProjects(remoteProjects); err != nil {
+				return err
+			}
+		}
+		if err := checkFetchVia(remoteProjects); err != nil {
+			return err
+		}
 
 		// Actually update the projects.
-		return updateProjects(jirix, localProjects, remoteProjects, hooks, gc, runHookTimeout, rebaseTracked, rebaseUntracked, rebaseAll, false /*snapshot*/)
+		return updateProjects(ctx, jirix, localProjects, remoteProjects, hooks, opts, snapshot)
 	}
 
 	// Specifying gc should always force a full filesystem scan.
-	if gc {
-		return updateFn(FullScan)
+	if opts.GC {
+		if err := updateFn(FullScan); err != nil {
+			updateFailed(jirix, hooks, err, opts)
+			return err
+		}
+		return writeJiriVersion(jirix)
 	}
 
 	// Attempt a fast update, which uses the latest snapshot to avoid doing
@@ -1057,19 +1965,196 @@ func UpdateUniverse(jirix *jiri.X, gc bool, localManifest bool, rebaseTracked bo
 	// any errors come up, fallback to the slow path.
 	err := updateFn(FastScan)
 	if err != nil {
+		// An interrupted update isn't retried.
+		if ctx.Err() != nil {
+			updateFailed(jirix, hooks, err, opts)
+			return err
+		}
 		if err2 := updateFn(FullScan); err2 != nil {
+			updateFailed(jirix, hooks, err2, opts)
 			return fmt.Errorf("%v, %v", err, err2)
 		}
 	}
 
+	return writeJiriVersion(jirix)
+}
+
+// updateFailed records the error of the last attempt of an update, and runs
+// the on-failure hooks of the projects it failed to update unless
+// opts.SkipOnFailureHooks is set.
+func updateFailed(jirix *jiri.X, hooks Hooks, err error, opts UpdateUniverseOpts) {
+	observeFetchErrors(err)
+	if !opts.SkipOnFailureHooks {
+		runOnFailureHooks(jirix, hooks, err, opts)
+	}
+}
+
+// checkFetchVia returns an error if the fetch-via command of a project can't
+// be found.
+func checkFetchVia(projects Projects) error {
+	var keys ProjectKeys
+	for key := range projects {
+		keys = append(keys, key)
+	}
+	sort.Sort(keys)
+	for _, key := range keys {
+		p := projects[key]
+		fields := strings.Fields(p.FetchVia)
+		if len(fields) == 0 {
+			continue
+		}
+		if _, err := exec.LookPath(fields[0]); err != nil {
+			return fmt.Errorf("fetch-via command %q of project %s(%s) not found: %v", p.FetchVia, p.Name, p.Path, err)
+		}
+	}
 	return nil
 }
 
+// checkPinnedProjects returns an error listing the projects which aren't pinned
+// to a revision.  The revision of the projects tracking the tip of their
+// remote branch is "HEAD" once loaded, and empty in the manifest files.
+func checkPinnedProjects(projects Projects) error {
+	var floating []string
+	for _, p := range projects {
+		if p.Revision == "" || p.Revision == "HEAD" {
+			floating = append(floating, fmt.Sprintf("%s(%s)", p.Name, p.Path))
+		}
+	}
+	if len(floating) == 0 {
+		return nil
+	}
+	sort.Strings(floating)
+	return fmt.Errorf("Projects not pinned to a revision: %s", strings.Join(floating, ", "))
+}
+
+// writeJiriVersion records the version of the running jiri binary in the
+// .jiri_version file, to help debugging version skew between the binary and
+// the manifest.
+func writeJiriVersion(jirix *jiri.X) error {
+	v := version.FormattedVersion()
+	if v == "" {
+		v = "unknown"
+	}
+	return safeWriteFile(jirix, jirix.JiriVersionFile(), []byte(v+"\n"))
+}
+
+// NewEphemeralRoot creates a jiri root in dir, which must not exist or be
+// empty, with the .jiri_manifest of jirix, and returns a clone of jirix for
+// it.  Updating the universe of the returned X checks out the manifest of
+// jirix in dir without touching the projects of jirix.Root, e.g. to test that
+// a manifest can be checked out in a throwaway root.
+func NewEphemeralRoot(jirix *jiri.X, dir string) (*jiri.X, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, fmtError(err)
+	}
+	if entries, err := ioutil.ReadDir(dir); err != nil && !os.IsNotExist(err) {
+		return nil, fmtError(err)
+	} else if len(entries) > 0 {
+		return nil, fmt.Errorf("ephemeral root %q is not empty", dir)
+	}
+	m, err := ManifestFromFile(jirix, jirix.JiriManifestFile())
+	if err != nil {
+		return nil, err
+	}
+	// Local imports are relative to the directory of the importing manifest,
+	// which moves to dir.
+	for i := range m.LocalImports {
+		if !filepath.IsAbs(m.LocalImports[i].File) {
+			m.LocalImports[i].File = filepath.Join(jirix.Root, m.LocalImports[i].File)
+		}
+	}
+	data, err := m.ToBytes()
+	if err != nil {
+		return nil, err
+	}
+	ephemeral := jirix.Clone(tool.ContextOpts{})
+	ephemeral.Root = dir
+	if err := os.MkdirAll(ephemeral.RootMetaDir(), 0755); err != nil {
+		return nil, fmtError(err)
+	}
+	if err := safeWriteFile(ephemeral, ephemeral.JiriManifestFile(), data); err != nil {
+		return nil, err
+	}
+	return ephemeral, nil
+}
+
+// projectEnvVar returns the name of the variable holding the path of the
+// project with the given name in the file written by WriteProjectEnvFile.
+func projectEnvVar(name string) string {
+	return "JIRI_PROJECT_" + strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z':
+			return r - 'a' + 'A'
+		case 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// envFileSafe reports whether path can be written unquoted in the file written
+// by WriteProjectEnvFile.  Shells and make don't quote values the same way, so
+// the paths with other characters than these, e.g. spaces, '$' or '#', can't be
+// written so that both read them the same.
+func envFileSafe(path string) bool {
+	for _, r := range path {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+		case strings.ContainsRune("/._-+,:@%", r):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// WriteProjectEnvFile writes a file which can be sourced by shells and
+// included by makefiles, setting JIRI_PROJECT_<NAME> to the absolute path of
+// every local project, where <NAME> is the project name in upper case, with
+// the characters other than letters and digits replaced by underscores.  It
+// fails if a path has characters which would need quoting, see envFileSafe.
+func WriteProjectEnvFile(jirix *jiri.X, filename string) error {
+	projects, err := LocalProjects(jirix, FastScan)
+	if err != nil {
+		return err
+	}
+	vars := map[string]Project{}
+	names := []string{}
+	for _, p := range projects {
+		if p.MirrorOf != "" {
+			continue
+		}
+		if !envFileSafe(p.Path) {
+			return fmt.Errorf("path %q of project %s can't be written to %s: it has characters which shells or make would need quoted", p.Path, p.Name, filename)
+		}
+		name := projectEnvVar(p.Name)
+		if other, ok := vars[name]; ok {
+			return fmt.Errorf("projects %s(%s) and %s(%s) have the same variable %s", other.Name, other.Path, p.Name, p.Path, name)
+		}
+		vars[name] = p
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	buf.WriteString("# Generated by jiri update, do not edit.\n")
+	for _, name := range names {
+		fmt.Fprintf(&buf, "%s=%s\n", name, vars[name].Path)
+	}
+	return safeWriteFile(jirix, filename, buf.Bytes())
+}
+
 // WriteUpdateHistorySnapshot creates a snapshot of the current state of all
 // projects and writes it to the update history directory.
 func WriteUpdateHistorySnapshot(jirix *jiri.X, snapshotPath string, localManifest bool) error {
-	snapshotFile := filepath.Join(jirix.UpdateHistoryDir(), time.Now().Format(time.RFC3339))
-	if err := CreateSnapshot(jirix, snapshotFile, localManifest); err != nil {
+	jirix.TimerPush("create snapshot")
+	manifest, err := snapshotManifest(jirix, localManifest)
+	jirix.TimerPop()
+	if err != nil {
+		return err
+	}
+	snapshotFile, err := writeUpdateHistoryFile(jirix, manifest, updateHistoryNow())
+	if err != nil {
 		return err
 	}
 
@@ -1102,7 +2187,113 @@ func WriteUpdateHistorySnapshot(jirix *jiri.X, snapshotPath string, localManifes
 	if err := os.RemoveAll(latestLink); err != nil {
 		return fmtError(err)
 	}
-	return fmtError(os.Symlink(snapshotFile, latestLink))
+	if err := os.Symlink(snapshotFile, latestLink); err != nil {
+		return fmtError(err)
+	}
+	if jirix.UpdateHistoryRetention > 0 {
+		if err := pruneUpdateHistory(jirix, jirix.UpdateHistoryRetention); err != nil {
+			jirix.Logger.Warningf("Cannot prune update history: %v\n\n", err)
+		}
+	}
+	return nil
+}
+
+// updateHistoryNow returns the current time, which names update history
+// snapshots.  It is a variable so that tests can take several snapshots within
+// a second.
+var updateHistoryNow = time.Now
+
+// pruneUpdateHistory deletes the oldest update history snapshots, so that at
+// most keep of them remain.  The snapshot pointed to by the "latest" symlink
+// is never deleted, and the "second-latest" symlink is removed if it points to
+// a deleted snapshot.
+func pruneUpdateHistory(jirix *jiri.X, keep int) error {
+	dir := jirix.UpdateHistoryDir()
+	latest := ""
+	if target, err := os.Readlink(jirix.UpdateHistoryLatestLink()); err == nil {
+		latest = filepath.Base(target)
+		keep--
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return fmtError(err)
+	}
+	type snapshot struct {
+		name string
+		time time.Time
+	}
+	var snapshots []snapshot
+	for _, info := range infos {
+		if !info.Mode().IsRegular() || info.Name() == latest {
+			continue
+		}
+		name := strings.TrimSuffix(strings.TrimSuffix(info.Name(), ".gz"), ".xml")
+		t, err := time.Parse(time.RFC3339, name)
+		if err != nil {
+			// Not a snapshot written by jiri.
+			continue
+		}
+		snapshots = append(snapshots, snapshot{info.Name(), t})
+	}
+	if len(snapshots) <= keep {
+		return nil
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].time.Before(snapshots[j].time)
+	})
+	deleted := make(map[string]bool)
+	for _, s := range snapshots[:len(snapshots)-keep] {
+		if err := os.Remove(filepath.Join(dir, s.name)); err != nil {
+			return fmtError(err)
+		}
+		deleted[s.name] = true
+	}
+	secondLatestLink := jirix.UpdateHistorySecondLatestLink()
+	if target, err := os.Readlink(secondLatestLink); err == nil && deleted[filepath.Base(target)] {
+		if err := os.Remove(secondLatestLink); err != nil {
+			return fmtError(err)
+		}
+	}
+	return nil
+}
+
+// maxUncompressedSnapshotSize is the size above which update history
+// snapshots are compressed with gzip.
+const maxUncompressedSnapshotSize = 1 << 20
+
+// writeUpdateHistoryFile writes the given snapshot manifest to the update
+// history directory, in a file named after the given time, and returns the
+// path of that file.  Snapshots larger than maxUncompressedSnapshotSize are
+// compressed with gzip and get a ".xml.gz" extension instead of ".xml".
+func writeUpdateHistoryFile(jirix *jiri.X, manifest *Manifest, t time.Time) (string, error) {
+	data, err := manifest.ToCanonicalBytes(jirix)
+	if err != nil {
+		return "", err
+	}
+	snapshotFile := filepath.Join(jirix.UpdateHistoryDir(), t.Format(time.RFC3339)+".xml")
+	if len(data) > maxUncompressedSnapshotSize {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return "", fmtError(err)
+		}
+		if err := w.Close(); err != nil {
+			return "", fmtError(err)
+		}
+		data = buf.Bytes()
+		snapshotFile += ".gz"
+	}
+	if err := safeWriteFile(jirix, snapshotFile, data); err != nil {
+		return "", err
+	}
+	return snapshotFile, nil
+}
+
+// ReadUpdateHistorySnapshot reads a snapshot from the update history, such as
+// the one pointed to by jirix.UpdateHistoryLatestLink().  Compressed snapshots
+// are decompressed transparently.
+func ReadUpdateHistorySnapshot(jirix *jiri.X, file string) (*Manifest, error) {
+	return ManifestFromFile(jirix, file)
 }
 
 // CleanupProjects restores the given jiri projects back to their detached
@@ -1155,8 +2346,8 @@ func CleanupProjects(jirix *jiri.X, localProjects Projects, cleanupBranches bool
 // resetLocalProject checks out the detached_head, cleans up untracked files
 // and uncommitted changes, and optionally deletes all the branches except master.
 func resetLocalProject(jirix *jiri.X, local, remote Project, cleanupBranches bool) error {
-	scm := gitutil.New(jirix, gitutil.RootDirOpt(local.Path))
-	g := git.NewGit(local.Path)
+	scm := gitutil.New(context.Background(), jirix, gitutil.RootDirOpt(local.Path))
+	g := git.NewGit(context.Background(), local.Path)
 	headRev, err := GetHeadRevision(jirix, remote)
 	if err != nil {
 		return err
@@ -1191,12 +2382,18 @@ func resetLocalProject(jirix *jiri.X, local, remote Project, cleanupBranches boo
 	return nil
 }
 
-// isLocalProject returns true if there is a project at the given path.
-func isLocalProject(jirix *jiri.X, path string) (bool, error) {
-	// Existence of a metadata directory is how we know we've found a
-	// Jiri-maintained project.
-	metadataDir := filepath.Join(path, jiri.ProjectMetaDir)
-	if _, err := os.Stat(metadataDir); err != nil {
+// IsJiriProject returns true if the given directory is a git repository
+// managed by jiri, i.e. if it has both a .git directory, or a .git file like
+// worktrees and submodules, and a jiri metadata file.  Lazy projects which
+// have not been realized yet are not git repositories.
+func IsJiriProject(path string) (bool, error) {
+	if _, err := os.Stat(filepath.Join(path, ".git")); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, fmtError(err)
+	}
+	if _, err := os.Stat(filepath.Join(path, jiri.ProjectMetaDir, jiri.ProjectMetaFile)); err != nil {
 		if os.IsNotExist(err) {
 			return false, nil
 		}
@@ -1220,9 +2417,14 @@ func ProjectAtPath(jirix *jiri.X, path string) (Project, error) {
 	return *project, nil
 }
 
-// findLocalProjects scans the filesystem for all projects.  Note that project
+// findLocalProjects scans the filesystem for all projects, skipping the
+// directories matched by the .jiriignore file of the root.  Note that project
 // directories can be nested recursively.
 func findLocalProjects(jirix *jiri.X, path string, projects Projects) error {
+	ignore, err := readJiriIgnore(jirix)
+	if err != nil {
+		return err
+	}
 	log := make(chan string, 1)
 	var wg sync.WaitGroup
 	wg.Add(2)
@@ -1248,7 +2450,8 @@ func findLocalProjects(jirix *jiri.X, path string, projects Projects) error {
 		defer pwg.Done()
 		limit <- struct{}{}
 		defer func() { <-limit }()
-		isLocal, err := isLocalProject(jirix, path)
+		// Lazy projects are not local projects until realized.
+		isLocal, err := IsJiriProject(path)
 		if err != nil {
 			errs <- fmt.Errorf("Error while processing path %q: %v", path, err)
 			return
@@ -1259,6 +2462,16 @@ func findLocalProjects(jirix *jiri.X, path string, projects Projects) error {
 				errs <- fmt.Errorf("Error while processing path %q: %v", path, err)
 				return
 			}
+			if path != project.Path && !isPathDir(filepath.Join(project.Path, ".git")) {
+				// The project was renamed by a move which was interrupted
+				// before its metadata was updated, or moved by hand.
+				log <- fmt.Sprintf("Project %q has path %s, but was found in %s, which it was likely moved to by an interrupted update. Updating its metadata.\n\n", project.Name, project.Path, path)
+				project.Path = path
+				if err := writeMetadata(jirix, project, path); err != nil {
+					errs <- fmt.Errorf("Error while processing path %q: %v", path, err)
+					return
+				}
+			}
 			if path != project.Path {
 				logs := []string{fmt.Sprintf("Project %q has path %s, but was found in %s.", project.Name, project.Path, path),
 					fmt.Sprintf("jiri will treat it as a stale project. To remove this warning please delete this or move it out of your root folder\n\n")}
@@ -1283,8 +2496,12 @@ func findLocalProjects(jirix *jiri.X, path string, projects Projects) error {
 		}
 		for _, fileInfo := range fileInfos {
 			if fileInfo.IsDir() && !strings.HasPrefix(fileInfo.Name(), ".") {
+				subPath := filepath.Join(path, fileInfo.Name())
+				if rel, err := filepath.Rel(jirix.Root, subPath); err == nil && ignore.match(filepath.ToSlash(rel)) {
+					continue
+				}
 				pwg.Add(1)
-				go processPath(filepath.Join(path, fileInfo.Name()))
+				go processPath(subPath)
 			}
 		}
 	}
@@ -1300,71 +2517,605 @@ func findLocalProjects(jirix *jiri.X, path string, projects Projects) error {
 	return nil
 }
 
-func fetchAll(jirix *jiri.X, project Project) error {
-	if project.Remote == "" {
-		return fmt.Errorf("project %q does not have a remote", project.Name)
+// freeDiskSpace returns the free disk space under the given path.  It is a
+// variable so that tests can fake low disk space.
+var freeDiskSpace = osutil.FreeDiskSpace
+
+// userReference returns the repository given by the user in references, like
+// UpdateUniverseOpts.References, for the given project to borrow objects from,
+// if any.
+func userReference(references map[string]string, project Project) string {
+	if ref, ok := references[project.Name]; ok {
+		return ref
 	}
-	g := git.NewGit(project.Path)
-	if err := g.SetRemoteUrl("origin", project.Remote); err != nil {
-		return err
+	return references[""]
+}
+
+// lowOnDiskSpace returns true if threshold is set and the free disk space
+// under the jiri root, in bytes, is below it.
+func lowOnDiskSpace(jirix *jiri.X, threshold uint64) bool {
+	if threshold == 0 {
+		return false
 	}
-	if project.HistoryDepth > 0 {
-		return gitutil.New(jirix, gitutil.RootDirOpt(project.Path)).Fetch("origin", gitutil.PruneOpt(true),
-			gitutil.DepthOpt(project.HistoryDepth), gitutil.UpdateShallowOpt(true))
-	} else {
-		return gitutil.New(jirix, gitutil.RootDirOpt(project.Path)).Fetch("origin", gitutil.PruneOpt(true))
+	free, err := freeDiskSpace(jirix.Root)
+	if err != nil {
+		jirix.Logger.Warningf("Cannot get free disk space under %q: %v\n\n", jirix.Root, err)
+		return false
 	}
+	return free < threshold
 }
 
-func GetHeadRevision(jirix *jiri.X, project Project) (string, error) {
-	if err := project.fillDefaults(); err != nil {
-		return "", err
+const tagRefPrefix = "refs/tags/"
+
+// pinnedTag returns the name of the tag the project is pinned to, if its
+// revision is of the form "refs/tags/<tag>".
+func pinnedTag(project Project) (string, bool) {
+	if !strings.HasPrefix(project.Revision, tagRefPrefix) {
+		return "", false
 	}
-	// Having a specific revision trumps everything else.
-	if project.Revision != "HEAD" {
-		return project.Revision, nil
+	return strings.TrimPrefix(project.Revision, tagRefPrefix), true
+}
+
+// mirrorRemote returns the remote of the mirror with the given URL prefix
+// for the given remote, e.g. "https://mirror.example.com/host.example.com/repo"
+// for "https://host.example.com/repo".
+func mirrorRemote(prefix, remote string) string {
+	path := remote
+	if u, err := url.Parse(remote); err == nil && u.Scheme != "" && u.Host != "" {
+		path = u.Host + u.Path
 	}
-	return "origin/" + project.RemoteBranch, nil
+	return strings.TrimSuffix(prefix, "/") + "/" + strings.TrimPrefix(path, "/")
 }
 
-func checkoutHeadRevision(jirix *jiri.X, project Project, forceCheckout bool) error {
+// fetchFromMirror fetches the project from its remote on the mirror with the
+// given URL prefix into the refs of its git remote, and fails if the revision
+// the project should be advanced to is missing.
+func fetchFromMirror(ctx context.Context, jirix *jiri.X, project Project, prefix string) error {
+	mirror := mirrorRemote(prefix, project.Remote)
+	opts := []gitutil.FetchOpt{gitutil.DepthOpt(project.FetchDepth), gitutil.FilterOpt(project.CloneFilter),
+		gitutil.ShallowSinceOpt(project.ShallowSince)}
+	refspec := fmt.Sprintf("+refs/heads/*:refs/remotes/%s/*", project.GitRemoteName())
+	if project.SingleBranch {
+		refspec = singleBranchRefspec(project)
+	}
+	if tag, ok := pinnedTag(project); ok {
+		refspec = fmt.Sprintf("+%s%s:%s%s", tagRefPrefix, tag, tagRefPrefix, tag)
+		opts = append(opts, gitutil.NoTagsOpt(true))
+	} else {
+		opts = append(opts, gitutil.PruneOpt(true))
+		if project.FetchDepth > 0 || project.ShallowSince != "" {
+			opts = append(opts, gitutil.UpdateShallowOpt(true))
+		}
+	}
+	if err := gitutil.New(ctx, jirix, gitutil.RootDirOpt(project.Path), gitutil.SSHCommandOpt(project.FetchVia)).FetchRefspec(mirror, refspec, opts...); err != nil {
+		return err
+	}
 	revision, err := GetHeadRevision(jirix, project)
 	if err != nil {
 		return err
 	}
-	git := gitutil.New(jirix, gitutil.RootDirOpt(project.Path))
-	return git.CheckoutBranch(revision, gitutil.DetachOpt(true), gitutil.ForceOpt(forceCheckout))
-}
-
-func tryRebase(jirix *jiri.X, project Project, branch string) (bool, error) {
-	scm := gitutil.New(jirix, gitutil.RootDirOpt(project.Path))
-	if err := scm.Rebase(branch); err != nil {
-		err := scm.RebaseAbort()
-		return false, err
+	if _, err := git.NewGit(ctx, project.Path).CurrentRevisionForRef(revision); err != nil {
+		return fmt.Errorf("revision %q not found on mirror %q", revision, mirror)
 	}
-	return true, nil
+	return nil
 }
 
-// syncProjectMaster checks out latest detached head if project is on one
-// else it rebases current branch onto its tracking branch
-func syncProjectMaster(jirix *jiri.X, project Project, state ProjectState, rebaseTracked, rebaseUntracked, rebaseAll, snapshot bool) error {
-	cwd, err := os.Getwd()
-	if err != nil {
-		return fmtError(err)
+// fetchAll fetches the project from the mirror with the given URL prefix if
+// any, falling back to its remote if that fails, and from its remote
+// otherwise.
+func fetchAll(ctx context.Context, jirix *jiri.X, project Project, mirror string) error {
+	if project.Remote == "" {
+		return fmt.Errorf("project %q does not have a remote", project.Name)
 	}
-	relativePath, err := filepath.Rel(cwd, project.Path)
-	if err != nil {
-		// Just use the full path if an error occurred.
-		relativePath = project.Path
+	if err := setRemoteUrl(ctx, jirix, project); err != nil {
+		return err
 	}
-	if project.LocalConfig.Ignore || project.LocalConfig.NoUpdate {
-		jirix.Logger.Warningf("Project %s(%s) won't be updated due to it's local-config\n\n", project.Name, relativePath)
-		return nil
+	if mirror != "" {
+		err := fetchFromMirror(ctx, jirix, project, mirror)
+		if err == nil {
+			return nil
+		}
+		jirix.Logger.Warningf("Fetching project %s(%s) from mirror failed, fetching it from %s: %v\n\n", project.Name, project.Path, project.Remote, err)
 	}
+	return fetchFromRemote(ctx, jirix, project)
+}
+
+// setRemoteUrl points the git remote of the project at its remote, adding the
+// git remote if the project doesn't have it yet, e.g. because its remote name
+// changed.
+func setRemoteUrl(ctx context.Context, jirix *jiri.X, project Project) error {
+	scm := gitutil.New(ctx, jirix, gitutil.RootDirOpt(project.Path))
+	if _, err := scm.RemoteUrl(project.GitRemoteName()); err != nil {
+		return scm.AddRemote(project.GitRemoteName(), project.Remote)
+	}
+	return git.NewGit(ctx, project.Path).SetRemoteUrl(project.GitRemoteName(), project.Remote)
+}
+
+// fetchFromRemote fetches the project from its remote.
+func fetchFromRemote(ctx context.Context, jirix *jiri.X, project Project) error {
+	remote := project.GitRemoteName()
+	if tag, ok := pinnedTag(project); ok {
+		// Only fetch the pinned tag, fetching all refs is slow for large
+		// projects.
+		refspec := fmt.Sprintf("+%s%s:%s%s", tagRefPrefix, tag, tagRefPrefix, tag)
+		return gitutil.New(ctx, jirix, gitutil.RootDirOpt(project.Path), gitutil.SSHCommandOpt(project.FetchVia)).FetchRefspec(remote, refspec,
+			gitutil.NoTagsOpt(true), gitutil.DepthOpt(project.FetchDepth), gitutil.FilterOpt(project.CloneFilter),
+			gitutil.ShallowSinceOpt(project.ShallowSince))
+	}
+	if project.SingleBranch {
+		opts := append([]gitutil.FetchOpt{gitutil.PruneOpt(true)}, shallowFetchOpts(project)...)
+		if err := gitutil.New(ctx, jirix, gitutil.RootDirOpt(project.Path), gitutil.SSHCommandOpt(project.FetchVia)).FetchRefspec(remote, singleBranchRefspec(project), opts...); err != nil {
+			return err
+		}
+		return fetchMissingRevision(ctx, jirix, project, opts...)
+	}
+	// Fetch atomically, so that a failed fetch doesn't leave only some of the
+	// remote branches updated.
+	if project.FetchDepth > 0 {
+		return gitutil.New(ctx, jirix, gitutil.RootDirOpt(project.Path), gitutil.SSHCommandOpt(project.FetchVia)).Fetch(remote, gitutil.PruneOpt(true),
+			gitutil.AtomicOpt(true), gitutil.DepthOpt(project.FetchDepth), gitutil.UpdateShallowOpt(true))
+	} else if project.ShallowSince != "" {
+		return gitutil.New(ctx, jirix, gitutil.RootDirOpt(project.Path), gitutil.SSHCommandOpt(project.FetchVia)).Fetch(remote, gitutil.PruneOpt(true),
+			gitutil.AtomicOpt(true), gitutil.ShallowSinceOpt(project.ShallowSince), gitutil.UpdateShallowOpt(true), gitutil.FilterOpt(project.CloneFilter))
+	} else {
+		return gitutil.New(ctx, jirix, gitutil.RootDirOpt(project.Path), gitutil.SSHCommandOpt(project.FetchVia)).Fetch(remote, gitutil.PruneOpt(true),
+			gitutil.AtomicOpt(true), gitutil.FilterOpt(project.CloneFilter))
+	}
+}
+
+// shallowFetchOpts returns the options limiting the history and the objects
+// fetched for the project to its depth, shallow-since date and clone filter.
+func shallowFetchOpts(project Project) []gitutil.FetchOpt {
+	opts := []gitutil.FetchOpt{gitutil.DepthOpt(project.FetchDepth),
+		gitutil.ShallowSinceOpt(project.ShallowSince), gitutil.FilterOpt(project.CloneFilter)}
+	if project.FetchDepth > 0 || project.ShallowSince != "" {
+		opts = append(opts, gitutil.UpdateShallowOpt(true))
+	}
+	return opts
+}
+
+// singleBranchRefspec returns the refspec fetching only the remote branch of
+// the project.
+func singleBranchRefspec(project Project) string {
+	branch := project.RemoteBranch
+	if branch == "" {
+		branch = "master"
+	}
+	return fmt.Sprintf("+refs/heads/%s:refs/remotes/%s/%s", branch, project.GitRemoteName(), branch)
+}
+
+// fetchMissingRevision fetches all the branches of a single branch project
+// whose pinned revision wasn't fetched along with its remote branch.
+func fetchMissingRevision(ctx context.Context, jirix *jiri.X, project Project, opts ...gitutil.FetchOpt) error {
+	revision, err := GetHeadRevision(jirix, project)
+	if err != nil {
+		return err
+	}
+	if _, err := git.NewGit(ctx, project.Path).CurrentRevisionForRef(revision); err == nil {
+		return nil
+	}
+	jirix.Logger.Debugf("Revision %q of project %s(%s) is not on its remote branch, fetching all its branches", revision, project.Name, project.Path)
+	refspec := fmt.Sprintf("+refs/heads/*:refs/remotes/%s/*", project.GitRemoteName())
+	return gitutil.New(ctx, jirix, gitutil.RootDirOpt(project.Path), gitutil.SSHCommandOpt(project.FetchVia)).FetchRefspec(project.GitRemoteName(), refspec, opts...)
+}
+
+func GetHeadRevision(jirix *jiri.X, project Project) (string, error) {
+	if err := project.fillDefaults(); err != nil {
+		return "", err
+	}
+	// Having a specific revision trumps everything else.
+	if project.Revision != "HEAD" {
+		return project.Revision, nil
+	}
+	return project.GitRemoteName() + "/" + project.RemoteBranch, nil
+}
+
+// TargetRevisions returns the revisions an update would check the given
+// projects out at: the revisions they are pinned to, or the current tips of
+// their remote branches, which are listed without fetching the projects.
+func TargetRevisions(jirix *jiri.X, projects Projects) (map[ProjectKey]string, error) {
+	targets := make(map[ProjectKey]string, len(projects))
+	multiErr := make(MultiError, 0)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	limit := make(chan struct{}, jirix.Jobs)
+	for key, project := range projects {
+		wg.Add(1)
+		go func(key ProjectKey, project Project) {
+			defer wg.Done()
+			limit <- struct{}{}
+			defer func() { <-limit }()
+			revision, err := targetRevision(jirix, project)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				multiErr = append(multiErr, err)
+				return
+			}
+			targets[key] = revision
+		}(key, project)
+	}
+	wg.Wait()
+	if len(multiErr) != 0 {
+		return nil, multiErr
+	}
+	return targets, nil
+}
+
+// targetRevision returns the commit an update would check the project out at.
+// Short SHAs are expanded in the local repository, and tags are looked up on
+// the remote, like its branches.
+func targetRevision(jirix *jiri.X, project Project) (string, error) {
+	if err := project.fillDefaults(); err != nil {
+		return "", err
+	}
+	if project.Revision != "HEAD" {
+		return resolvePinnedRevision(jirix, project)
+	}
+	branches, err := gitutil.New(context.Background(), jirix, gitutil.SSHCommandOpt(project.FetchVia)).RemoteBranches(project.Remote)
+	if err != nil {
+		return "", fmt.Errorf("Cannot list branches of project %q: %s", project.Name, err)
+	}
+	revision, ok := branches[project.RemoteBranch]
+	if !ok {
+		return "", fmt.Errorf("project %q has no remote branch %q", project.Name, project.RemoteBranch)
+	}
+	return revision, nil
+}
+
+var (
+	fullSHARE  = regexp.MustCompile("^[0-9a-f]{40}$")
+	shortSHARE = regexp.MustCompile("^[0-9a-f]{4,39}$")
+)
+
+// resolvePinnedRevision returns the commit the pinned revision of the project
+// names.
+func resolvePinnedRevision(jirix *jiri.X, project Project) (string, error) {
+	revision := project.Revision
+	if fullSHARE.MatchString(revision) {
+		return revision, nil
+	}
+	g := git.NewGit(context.Background(), project.Path)
+	if shortSHARE.MatchString(revision) {
+		if commit, err := g.CurrentRevisionForRef(revision); err == nil {
+			return commit, nil
+		}
+	}
+	tags, err := gitutil.New(context.Background(), jirix, gitutil.SSHCommandOpt(project.FetchVia)).RemoteTags(project.Remote)
+	if err != nil {
+		return "", fmt.Errorf("Cannot list tags of project %q: %s", project.Name, err)
+	}
+	if commit, ok := tags[strings.TrimPrefix(revision, "refs/tags/")]; ok {
+		return commit, nil
+	}
+	// Other refs, and short SHAs of commits which weren't fetched yet, can
+	// only be resolved once fetched.
+	commit, err := g.CurrentRevisionForRef(revision)
+	if err != nil {
+		return "", fmt.Errorf("project %q has no tag or known commit %q", project.Name, revision)
+	}
+	return commit, nil
+}
+
+// SnapshotDrift describes how the checkout of a project differs from its
+// revision in a snapshot.
+type SnapshotDrift struct {
+	// Missing is set if the project isn't checked out.
+	Missing bool
+	// UnknownRevision is set if the revision of the snapshot isn't in the
+	// local repository, e.g. because the project wasn't fetched since.
+	UnknownRevision bool
+	// Ahead is the number of commits of the checked out revision which are
+	// not in the revision of the snapshot, and Behind the other way around.
+	Ahead, Behind int
+	// Dirty is set if the project has uncommitted changes.
+	Dirty bool
+}
+
+func (d SnapshotDrift) String() string {
+	var s []string
+	switch {
+	case d.Missing:
+		return "missing"
+	case d.UnknownRevision:
+		s = append(s, "unknown snapshot revision")
+	case d.Ahead == 0 && d.Behind == 0:
+		s = append(s, "at-snapshot")
+	default:
+		if d.Ahead != 0 {
+			s = append(s, fmt.Sprintf("ahead %d", d.Ahead))
+		}
+		if d.Behind != 0 {
+			s = append(s, fmt.Sprintf("behind %d", d.Behind))
+		}
+	}
+	if d.Dirty {
+		s = append(s, "dirty")
+	}
+	return strings.Join(s, ", ")
+}
+
+// SnapshotDrifts returns how the local projects differ from the given projects
+// of a snapshot, for every project of the snapshot.
+func SnapshotDrifts(jirix *jiri.X, snapshot, localProjects Projects) (map[ProjectKey]SnapshotDrift, error) {
+	drifts := make(map[ProjectKey]SnapshotDrift, len(snapshot))
+	multiErr := make(MultiError, 0)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	limit := make(chan struct{}, jirix.Jobs)
+	for key, project := range snapshot {
+		local, ok := localProjects[key]
+		if !ok {
+			mutex.Lock()
+			drifts[key] = SnapshotDrift{Missing: true}
+			mutex.Unlock()
+			continue
+		}
+		project.Path = local.Path
+		wg.Add(1)
+		go func(key ProjectKey, project Project) {
+			defer wg.Done()
+			limit <- struct{}{}
+			defer func() { <-limit }()
+			drift, err := snapshotDrift(jirix, project)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				multiErr = append(multiErr, err)
+				return
+			}
+			drifts[key] = drift
+		}(key, project)
+	}
+	wg.Wait()
+	if len(multiErr) != 0 {
+		return nil, multiErr
+	}
+	return drifts, nil
+}
+
+func snapshotDrift(jirix *jiri.X, project Project) (SnapshotDrift, error) {
+	var drift SnapshotDrift
+	g := git.NewGit(context.Background(), project.Path)
+	var err error
+	if drift.Dirty, err = g.HasUncommittedChanges(); err != nil {
+		return drift, fmt.Errorf("Cannot get uncommited changes for project %q: %v", project.Name, err)
+	}
+	headRev, err := GetHeadRevision(jirix, project)
+	if err != nil {
+		return drift, err
+	}
+	revision, err := g.CurrentRevisionForRef(headRev)
+	if err != nil {
+		drift.UnknownRevision = true
+		return drift, nil
+	}
+	scm := gitutil.New(context.Background(), jirix, gitutil.RootDirOpt(project.Path))
+	if drift.Ahead, err = scm.CountCommits("HEAD", revision); err != nil {
+		return drift, fmt.Errorf("Cannot count commits of project %q: %v", project.Name, err)
+	}
+	if drift.Behind, err = scm.CountCommits(revision, "HEAD"); err != nil {
+		return drift, fmt.Errorf("Cannot count commits of project %q: %v", project.Name, err)
+	}
+	return drift, nil
+}
+
+// Commit is a commit of a project, as listed by LogBetweenSnapshots.
+type Commit struct {
+	Hash    string
+	Author  string
+	Subject string
+}
+
+// LogBetweenSnapshots returns, for every project in both snapshots, the
+// commits of its revision in newSnapshot which are not in its revision in
+// oldSnapshot, newest first, e.g. for release notes.  The snapshots are files,
+// URLs or names of snapshots of the update history like "second-latest".
+// Projects added between the snapshots are left out, rather than listing
+// their whole history, as are projects removed between the snapshots and
+// projects which aren't checked out: callers listing the added projects can
+// compare the keys of the snapshots.  The revisions must have been fetched.
+func LogBetweenSnapshots(jirix *jiri.X, oldSnapshot, newSnapshot string) (map[ProjectKey][]Commit, error) {
+	var snapshots [2]Projects
+	for i, snapshot := range []string{oldSnapshot, newSnapshot} {
+		snapshot, err := resolveHistorySnapshot(jirix, snapshot)
+		if err != nil {
+			return nil, err
+		}
+		if snapshots[i], _, err = LoadSnapshotFile(jirix, snapshot); err != nil {
+			return nil, err
+		}
+	}
+	localProjects, err := LocalProjects(jirix, FastScan)
+	if err != nil {
+		return nil, err
+	}
+	logs := make(map[ProjectKey][]Commit)
+	multiErr := make(MultiError, 0)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	limit := make(chan struct{}, jirix.Jobs)
+	for key, newProject := range snapshots[1] {
+		oldProject, ok := snapshots[0][key]
+		if !ok {
+			continue
+		}
+		local, ok := localProjects[key]
+		if !ok {
+			continue
+		}
+		oldProject.Path, newProject.Path = local.Path, local.Path
+		wg.Add(1)
+		go func(key ProjectKey, oldProject, newProject Project) {
+			defer wg.Done()
+			limit <- struct{}{}
+			defer func() { <-limit }()
+			commits, err := logBetween(jirix, oldProject, newProject)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				multiErr = append(multiErr, err)
+				return
+			}
+			logs[key] = commits
+		}(key, oldProject, newProject)
+	}
+	wg.Wait()
+	if len(multiErr) != 0 {
+		return nil, multiErr
+	}
+	return logs, nil
+}
+
+// logBetween returns the commits of the revision of newProject which are not
+// in the revision of oldProject, two versions of the same project.
+func logBetween(jirix *jiri.X, oldProject, newProject Project) ([]Commit, error) {
+	var revisions [2]string
+	g := git.NewGit(context.Background(), newProject.Path)
+	for i, project := range []Project{oldProject, newProject} {
+		headRev, err := GetHeadRevision(jirix, project)
+		if err != nil {
+			return nil, err
+		}
+		if revisions[i], err = g.CurrentRevisionForRef(headRev); err != nil {
+			return nil, fmt.Errorf("revision %q of project %s(%s) not found, run \"jiri update\" to fetch it", headRev, project.Name, project.Path)
+		}
+	}
+	scm := gitutil.New(context.Background(), jirix, gitutil.RootDirOpt(newProject.Path))
+	entries, err := scm.LogLines(revisions[1], revisions[0], "%H%x00%an <%ae>%x00%s")
+	if err != nil {
+		return nil, fmt.Errorf("Cannot get the log of project %q: %v", newProject.Name, err)
+	}
+	var commits []Commit
+	for _, entry := range entries {
+		fields := strings.SplitN(entry, "\x00", 3)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("unexpected log entry %q of project %q", entry, newProject.Name)
+		}
+		commits = append(commits, Commit{Hash: fields[0], Author: fields[1], Subject: fields[2]})
+	}
+	return commits, nil
+}
+
+func checkoutHeadRevision(jirix *jiri.X, project Project, forceCheckout bool) error {
+	revision, err := GetHeadRevision(jirix, project)
+	if err != nil {
+		return err
+	}
+	git := gitutil.New(context.Background(), jirix, gitutil.RootDirOpt(project.Path))
+	return git.CheckoutBranch(revision, gitutil.DetachOpt(true), gitutil.ForceOpt(forceCheckout))
+}
+
+func tryRebase(jirix *jiri.X, project Project, branch string) (bool, error) {
+	scm := gitutil.New(context.Background(), jirix, gitutil.RootDirOpt(project.Path))
+	if err := scm.Rebase(branch); err != nil {
+		err := scm.RebaseAbort()
+		return false, err
+	}
+	return true, nil
+}
+
+// localBranch returns the local branch a project should be on after update:
+// the default branch of its local-config if it exists remotely, or the branch
+// named after its remote branch if jirix.ForbidDetachedHead is set.  It
+// returns an empty string if the project can stay on a detached HEAD.
+func localBranch(jirix *jiri.X, project Project) string {
+	if branch := project.LocalConfig.DefaultBranch; branch != "" {
+		ref := "refs/remotes/" + project.GitRemoteName() + "/" + branch
+		if _, err := git.NewGit(context.Background(), project.Path).CurrentRevisionForRef(ref); err == nil {
+			return branch
+		}
+		jirix.Logger.Warningf("Default branch %q of project %s(%s) does not exist remotely, ignoring it\n\n", branch, project.Name, project.Path)
+	}
+	if !jirix.ForbidDetachedHead {
+		return ""
+	}
+	if project.RemoteBranch == "" {
+		return "master"
+	}
+	return project.RemoteBranch
+}
+
+// ensureOnBranch moves a project which is on a detached HEAD onto the given
+// local branch. The branch is created if needed, tracks the remote branch of
+// the same name and is fast-forwarded to the checked out revision.
+// An existing branch is not moved if the project's local-config sets
+// no-rebase, in which case the project is left on the detached HEAD.
+func ensureOnBranch(jirix *jiri.X, project Project, branch string) error {
+	scm := gitutil.New(context.Background(), jirix, gitutil.RootDirOpt(project.Path))
+	if scm.IsOnBranch() {
+		return nil
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return fmtError(err)
+	}
+	relativePath, err := filepath.Rel(cwd, project.Path)
+	if err != nil {
+		// Just use the full path if an error occurred.
+		relativePath = project.Path
+	}
+	g := git.NewGit(context.Background(), project.Path)
+	revision, err := g.CurrentRevision()
+	if err != nil {
+		return err
+	}
+	if !scm.BranchExists(branch) {
+		if err := g.CreateBranchFromRef(branch, revision); err != nil {
+			return fmt.Errorf("Cannot create branch %q for project %q: %s", branch, project.Name, err)
+		}
+		if err := g.SetUpstream(branch, project.GitRemoteName()+"/"+branch); err != nil {
+			return fmt.Errorf("Cannot set upstream of branch %q for project %q: %s", branch, project.Name, err)
+		}
+		return scm.CheckoutBranch(branch)
+	}
+	branchRevision, err := g.CurrentRevisionForRef(branch)
+	if err != nil {
+		return err
+	}
+	if branchRevision != revision && project.LocalConfig.NoRebase {
+		jirix.Logger.Warningf("For project %s(%s), not moving your local branch %q due to it's local-config\n\n", project.Name, relativePath, branch)
+		return nil
+	}
+	if err := scm.CheckoutBranch(branch); err != nil {
+		return err
+	}
+	if branchRevision == revision {
+		return nil
+	}
+	if err := scm.Merge(revision, gitutil.FfOnlyOpt(true)); err != nil {
+		if err := scm.CheckoutBranch(revision, gitutil.DetachOpt(true)); err != nil {
+			return err
+		}
+		gitCommand := jirix.Color.Yellow("git -C %q checkout %s && git -C %q merge %s", relativePath, branch, relativePath, revision)
+		msg := fmt.Sprintf("For project %s(%s), not able to fast forward your local branch %q to %s", project.Name, relativePath, branch, revision)
+		msg += fmt.Sprintf("\nPlease merge manually use: '%s'\n\n", gitCommand)
+		jirix.Logger.Errorf("%s", msg)
+		jirix.IncrementFailures()
+	}
+	return nil
+}
+
+// syncProjectMaster checks out latest detached head if project is on one
+// else it rebases current branch onto its tracking branch
+func syncProjectMaster(jirix *jiri.X, project Project, state ProjectState, rebaseTracked, rebaseUntracked, rebaseAll, snapshot bool) error {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return fmtError(err)
+	}
+	relativePath, err := filepath.Rel(cwd, project.Path)
+	if err != nil {
+		// Just use the full path if an error occurred.
+		relativePath = project.Path
+	}
+	if project.LocalConfig.Ignore || project.LocalConfig.NoUpdate {
+		jirix.Logger.Warningf("Project %s(%s) won't be updated due to it's local-config\n\n", project.Name, relativePath)
+		return nil
+	}
+
+	scm := gitutil.New(context.Background(), jirix, gitutil.RootDirOpt(project.Path))
+	g := git.NewGit(context.Background(), project.Path)
 
-	scm := gitutil.New(jirix, gitutil.RootDirOpt(project.Path))
-	g := git.NewGit(project.Path)
-
 	if uncommitted, err := g.HasUncommittedChanges(); err != nil {
 		return fmt.Errorf("Cannot get uncommited changes for project %q: %s", project.Name, err)
 	} else if uncommitted {
@@ -1375,7 +3126,7 @@ func syncProjectMaster(jirix *jiri.X, project Project, state ProjectState, rebas
 		return nil
 	}
 
-	if state.CurrentBranch.Name == "" || snapshot { // detached head
+	if state.IsDetached() || snapshot {
 		if err := checkoutHeadRevision(jirix, project, false); err != nil {
 			revision, err2 := GetHeadRevision(jirix, project)
 			if err2 != nil {
@@ -1410,7 +3161,7 @@ func syncProjectMaster(jirix *jiri.X, project Project, state ProjectState, rebas
 	// if rebase flag is false, merge fast forward current branch
 	if !rebaseTracked && !rebaseAll && state.CurrentBranch.Tracking != nil {
 		tracking := state.CurrentBranch.Tracking
-		if tracking.Revision == state.CurrentBranch.Revision {
+		if state.IsUpToDate() {
 			return nil
 		}
 		if project.LocalConfig.NoRebase {
@@ -1528,6 +3279,10 @@ func newManifestLoader(localProjects Projects, update bool) *loader {
 		localProjects: localProjects,
 		update:        update,
 		manifests:     make(map[string]bool),
+		fetched:       make(map[string]bool),
+		sourceNames:   make(map[ProjectKey]string),
+		mirrors:       make(map[string]bool),
+		imports:       make(map[string][]string),
 	}
 }
 
@@ -1539,6 +3294,26 @@ type loader struct {
 	update        bool
 	cycleStack    []cycleInfo
 	manifests     map[string]bool
+	// fetched records the remote manifest projects already fetched by the
+	// loader, keyed by importFetchKey, so that manifest projects imported by
+	// several manifests are only fetched once.  The manifest files themselves
+	// are only parsed once thanks to manifests.
+	fetched map[string]bool
+	// mirror is the mirror the remote manifest projects are fetched from on
+	// updates, if any, like UpdateUniverseOpts.Mirror.
+	mirror string
+	// config holds the jiri settings of the loaded manifests.
+	config JiriConfig
+	// sourceNames are the names of the projects in the manifest files
+	// declaring them, which lack the root of their imports.
+	sourceNames map[ProjectKey]string
+	// mirrors are the names of the loaded projects which mirror another
+	// project, whose hooks are skipped.
+	mirrors map[string]bool
+	// files are the manifest files in the order they were loaded, and imports
+	// the files imported by each of them.
+	files   []string
+	imports map[string][]string
 }
 
 type cycleInfo struct {
@@ -1574,7 +3349,7 @@ type cycleInfo struct {
 // A more complex case would involve a combination of local and remote imports,
 // using the "root" attribute to change paths on the local filesystem.  In this
 // case the key will eventually expose the cycle.
-func (ld *loader) loadNoCycles(jirix *jiri.X, root, file, cycleKey string, localManifest bool) error {
+func (ld *loader) loadNoCycles(ctx context.Context, jirix *jiri.X, root, file, cycleKey string, localManifest bool) error {
 	info := cycleInfo{file, cycleKey}
 	for _, c := range ld.cycleStack {
 		switch {
@@ -1585,7 +3360,7 @@ func (ld *loader) loadNoCycles(jirix *jiri.X, root, file, cycleKey string, local
 		}
 	}
 	ld.cycleStack = append(ld.cycleStack, info)
-	if err := ld.load(jirix, root, file, localManifest); err != nil {
+	if err := ld.load(ctx, jirix, root, file, localManifest); err != nil {
 		return err
 	}
 	ld.cycleStack = ld.cycleStack[:len(ld.cycleStack)-1]
@@ -1601,21 +3376,35 @@ func shortFileName(root, file string) string {
 	return file
 }
 
-func (ld *loader) Load(jirix *jiri.X, root, file, cycleKey string, localManifest bool) error {
+func (ld *loader) Load(ctx context.Context, jirix *jiri.X, root, file, cycleKey string, localManifest bool) error {
 	jirix.TimerPush("load " + shortFileName(jirix.Root, file))
 	defer jirix.TimerPop()
-	return ld.loadNoCycles(jirix, root, file, cycleKey, localManifest)
+	return ld.loadNoCycles(ctx, jirix, root, file, cycleKey, localManifest)
 }
 
-func (ld *loader) load(jirix *jiri.X, root, file string, localManifest bool) error {
+func (ld *loader) load(ctx context.Context, jirix *jiri.X, root, file string, localManifest bool) error {
 	if ld.manifests[file] {
 		return nil
 	}
 	ld.manifests[file] = true
-	m, err := ManifestFromFile(jirix, file)
+	ld.files = append(ld.files, file)
+	m, err := manifestFromSource(file)
 	if err != nil {
 		return err
 	}
+	// The settings of the manifests loaded first, i.e. the importing ones,
+	// take precedence.
+	if c := m.JiriConfig; c != nil {
+		if c.Jobs < 0 || c.UpdateHistoryRetention < 0 {
+			return fmt.Errorf("invalid jiri-config in %s: negative values are not allowed", shortFileName(jirix.Root, file))
+		}
+		if ld.config.Jobs == 0 {
+			ld.config.Jobs = c.Jobs
+		}
+		if ld.config.UpdateHistoryRetention == 0 {
+			ld.config.UpdateHistoryRetention = c.UpdateHistoryRetention
+		}
+	}
 	// Process remote imports.
 	for _, remote := range m.Imports {
 		nextRoot := filepath.Join(root, remote.Root)
@@ -1640,15 +3429,20 @@ func (ld *loader) load(jirix *jiri.X, root, file string, localManifest bool) err
 			if err := os.MkdirAll(path, 0755); err != nil {
 				return fmtError(err)
 			}
-			if err := gitutil.New(jirix).Clone(p.Remote, path, gitutil.NoCheckoutOpt(true)); err != nil {
+			if err := gitutil.New(ctx, jirix).Clone(p.Remote, path, gitutil.NoCheckoutOpt(true)); err != nil {
 				return err
 			}
 			p.Revision = "HEAD"
 			p.RemoteBranch = remote.RemoteBranch
+			ld.fetched[importFetchKey(p)] = true
 			if err := checkoutHeadRevision(jirix, p, false); err != nil {
 				return fmt.Errorf("Not able to checkout head for %s(%s): %v", p.Name, p.Path, err)
 			}
 			ld.localProjects[key] = p
+		} else if remote.FetchProtocol != "" {
+			if p.Remote, err = remote.fetchRemote(); err != nil {
+				return err
+			}
 		}
 		// Reset the project to its specified branch and load the next file.  Note
 		// that we call load() recursively, so multiple files may be loaded by
@@ -1656,7 +3450,8 @@ func (ld *loader) load(jirix *jiri.X, root, file string, localManifest bool) err
 		p.Revision = "HEAD"
 		p.RemoteBranch = remote.RemoteBranch
 		nextFile := filepath.Join(p.Path, remote.Manifest)
-		if err := ld.resetAndLoad(jirix, nextRoot, nextFile, remote.cycleKey(), p, localManifest); err != nil {
+		ld.imports[file] = append(ld.imports[file], nextFile)
+		if err := ld.resetAndLoad(ctx, jirix, nextRoot, nextFile, remote.cycleKey(), p, localManifest); err != nil {
 			return err
 		}
 	}
@@ -1664,8 +3459,12 @@ func (ld *loader) load(jirix *jiri.X, root, file string, localManifest bool) err
 	for _, local := range m.LocalImports {
 		// TODO(toddw): Add our invariant check that the file is in the same
 		// repository as the current remote import repository.
-		nextFile := filepath.Join(filepath.Dir(file), local.File)
-		if err := ld.Load(jirix, root, nextFile, "", localManifest); err != nil {
+		nextFile, err := resolveManifestRef(file, local.File)
+		if err != nil {
+			return err
+		}
+		ld.imports[file] = append(ld.imports[file], nextFile)
+		if err := ld.Load(ctx, jirix, root, nextFile, "", localManifest); err != nil {
 			return err
 		}
 	}
@@ -1682,6 +3481,13 @@ func (ld *loader) load(jirix *jiri.X, root, file string, localManifest bool) err
 
 	// Collect projects.
 	for _, project := range m.Projects {
+		if project.Exclude {
+			ld.excludeProject(filepath.Join(root, project.Name))
+			continue
+		}
+		if project.MirrorOf != "" {
+			ld.mirrors[filepath.Join(root, project.Name)] = true
+		}
 		// Make paths absolute by prepending <root>.
 		project.absolutizePaths(filepath.Join(jirix.Root, root))
 
@@ -1692,40 +3498,89 @@ func (ld *loader) load(jirix *jiri.X, root, file string, localManifest bool) err
 		}
 
 		// Prepend the root to the project name.  This will be a noop if the import is not rooted.
+		name := project.Name
 		project.Name = filepath.Join(root, project.Name)
 		key := project.Key()
-		if dup, ok := ld.Projects[key]; ok && dup != project {
-			// TODO(toddw): Tell the user the other conflicting file.
-			return fmt.Errorf("duplicate project %q found in %v", key, shortFileName(jirix.Root, file))
+		if dup, ok := ld.Projects[key]; ok {
+			if dup.ManifestSource = ""; dup != project {
+				// TODO(toddw): Tell the user the other conflicting file.
+				return fmt.Errorf("duplicate project %q found in %v", key, shortFileName(jirix.Root, file))
+			}
 		}
+		project.ManifestSource = file
 		ld.Projects[key] = project
+		ld.sourceNames[key] = name
 	}
 
 	for _, hook := range m.Hooks {
 		if hook.ActionPath == "" {
 			return fmt.Errorf("invalid hook \"%v\" for project \"%v\"", hook.Name, hook.ProjectName)
 		}
+		if ld.mirrors[filepath.Join(root, hook.ProjectName)] {
+			jirix.Logger.Debugf("Skipping hook(%v) of mirror project %q", hook.Name, hook.ProjectName)
+			continue
+		}
 		key := hook.Key()
 		ld.Hooks[key] = hook
 	}
 	return nil
 }
 
-func (ld *loader) resetAndLoad(jirix *jiri.X, root, file, cycleKey string, project Project, localManifest bool) (e error) {
+// excludeProject removes the loaded projects with the given name, along with
+// their hooks, which are the hooks run in their directory.
+func (ld *loader) excludeProject(name string) {
+	for key, p := range ld.Projects {
+		if p.Name != name {
+			continue
+		}
+		delete(ld.Projects, key)
+		delete(ld.sourceNames, key)
+		for hookKey, hook := range ld.Hooks {
+			if filepath.Clean(hook.ActionPath) == filepath.Clean(p.Path) {
+				delete(ld.Hooks, hookKey)
+			}
+		}
+	}
+	delete(ld.mirrors, name)
+}
+
+// checkDuplicatePaths returns an error if two of the loaded projects share the
+// same path, since their checkouts would overwrite each other.
+func (ld *loader) checkDuplicatePaths() error {
+	var keys ProjectKeys
+	for key := range ld.Projects {
+		keys = append(keys, key)
+	}
+	sort.Sort(keys)
+	paths := make(map[string]ProjectKey)
+	for _, key := range keys {
+		p := ld.Projects[key]
+		path := filepath.Clean(p.Path)
+		if dup, ok := paths[path]; ok {
+			return fmt.Errorf("projects %q and %q have the same path %q", ld.Projects[dup].Name, p.Name, path)
+		}
+		paths[path] = key
+	}
+	return nil
+}
+
+func (ld *loader) resetAndLoad(ctx context.Context, jirix *jiri.X, root, file, cycleKey string, project Project, localManifest bool) (e error) {
 	if localManifest {
-		return ld.Load(jirix, root, file, cycleKey, localManifest)
+		return ld.Load(ctx, jirix, root, file, cycleKey, localManifest)
 	}
 
 	// Reset the local branch to what's specified on the project.  We only
-	// fetch on updates; non-updates just perform the reset.
-	if ld.update {
-		if err := fetchAll(jirix, project); err != nil {
+	// fetch on updates, once per manifest project; non-updates just perform
+	// the reset.
+	if key := importFetchKey(project); ld.update && !ld.fetched[key] {
+		if err := fetchManifestProject(ctx, jirix, project, ld.mirror); err != nil {
 			return fmt.Errorf("Fetch failed for project(%v), %v", project.Path, err)
 		}
+		ld.fetched[key] = true
 	}
 
-	scm := gitutil.New(jirix, gitutil.RootDirOpt(project.Path))
-	g := git.NewGit(project.Path)
+	scm := gitutil.New(context.Background(), jirix, gitutil.RootDirOpt(project.Path))
+	g := git.NewGit(context.Background(), project.Path)
 	var currentRevision string
 	var err error
 	if scm.IsOnBranch() {
@@ -1754,7 +3609,19 @@ func (ld *loader) resetAndLoad(jirix *jiri.X, root, file, cycleKey string, proje
 	if err := checkoutHeadRevision(jirix, project, false); err != nil {
 		return fmt.Errorf("Not able to checkout head for %s(%s): %v", project.Name, project.Path, err)
 	}
-	return ld.Load(jirix, root, file, cycleKey, localManifest)
+	return ld.Load(ctx, jirix, root, file, cycleKey, localManifest)
+}
+
+// fetchManifestProject fetches a remote manifest project while loading
+// manifests.  It is a variable so that tests can count the fetches.
+var fetchManifestProject = fetchAll
+
+// importFetchKey returns the key of a remote manifest project in the fetches
+// of a loader: the path of its checkout and the remote branch it is reset to.
+// Imports of the same remote under different names have their own checkouts,
+// which must each be fetched.
+func importFetchKey(p Project) string {
+	return p.Path + "@" + p.RemoteBranch
 }
 
 // groupByGoogleSourceHosts returns a map of googlesource host to a Projects
@@ -1829,11 +3696,53 @@ func getRemoteHeadRevisions(jirix *jiri.X, remoteProjects Projects) Projects {
 	return ps
 }
 
-// updateCache creates the cache or updates it if already present.
-func updateCache(jirix *jiri.X, remoteProjects Projects) error {
-	if jirix.Cache == "" {
+// cacheProgress displays the progress of cache updates on a single terminal
+// line, which is rewritten on every update.
+type cacheProgress struct {
+	lock  sync.Mutex
+	w     io.Writer
+	shown bool
+}
+
+// progressOpt returns the option reporting the progress of the cache update
+// of the given remote.  It returns a nil option if p is nil.
+func (p *cacheProgress) progressOpt(remote string) gitutil.ProgressOpt {
+	if p == nil {
 		return nil
 	}
+	return func(phase string, percent int) {
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		fmt.Fprintf(p.w, "\r\033[KUpdating cache of %s: %s %d%%", remote, phase, percent)
+		p.shown = true
+	}
+}
+
+// done clears the progress line, if anything was displayed.
+func (p *cacheProgress) done() {
+	if p == nil {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.shown {
+		fmt.Fprint(p.w, "\r\033[K")
+		p.shown = false
+	}
+}
+
+// updateCache creates the cache or updates it if already present.
+func updateCache(ctx context.Context, jirix *jiri.X, remoteProjects Projects) error {
+	if jirix.Cache == "" {
+		return nil
+	}
+
+	// Progress is only displayed on terminals, so that logs stay line
+	// oriented.
+	var progress *cacheProgress
+	if jirix.Logger.LoggerLevel >= log.InfoLevel && osutil.IsTerminal(os.Stdout) {
+		progress = &cacheProgress{w: os.Stdout}
+	}
 
 	errs := make(chan error, len(remoteProjects))
 	var wg sync.WaitGroup
@@ -1851,7 +3760,7 @@ func updateCache(jirix *jiri.X, remoteProjects Projects) error {
 				errs <- err
 				continue
 			}
-			go func(dir, remote string, depth int, branch string) {
+			go func(dir, remote string, depth int, branch, fetchVia string) {
 				defer func() { <-fetchLimit }()
 				defer wg.Done()
 				if isPathDir(dir) {
@@ -1860,12 +3769,12 @@ func updateCache(jirix *jiri.X, remoteProjects Projects) error {
 					if _, err := os.Stat(filepath.Join(dir, "shallow")); err == nil {
 						// Shallow cache, fetch only manifest tracked remote branch
 						refspec := fmt.Sprintf("+refs/heads/%s:refs/heads/%s", branch, branch)
-						if err := gitutil.New(jirix, gitutil.RootDirOpt(dir)).FetchRefspec("origin", refspec, gitutil.PruneOpt(true)); err != nil {
+						if err := gitutil.New(ctx, jirix, gitutil.RootDirOpt(dir), gitutil.SSHCommandOpt(fetchVia)).FetchRefspec("origin", refspec, gitutil.PruneOpt(true), progress.progressOpt(remote)); err != nil {
 							errs <- err
 						}
 						return
 					}
-					if err := gitutil.New(jirix, gitutil.RootDirOpt(dir)).Fetch("origin", gitutil.PruneOpt(true)); err != nil {
+					if err := gitutil.New(ctx, jirix, gitutil.RootDirOpt(dir), gitutil.SSHCommandOpt(fetchVia)).Fetch("origin", gitutil.PruneOpt(true), progress.progressOpt(remote)); err != nil {
 						errs <- err
 					}
 					return
@@ -1873,18 +3782,19 @@ func updateCache(jirix *jiri.X, remoteProjects Projects) error {
 					// Create cache
 					// TODO : If we in future need to support two projects with same remote url,
 					// one with shallow checkout and one with full, we should create two caches
-					if err := gitutil.New(jirix).CloneMirror(remote, dir, depth); err != nil {
+					if err := gitutil.New(ctx, jirix, gitutil.SSHCommandOpt(fetchVia)).CloneMirror(remote, dir, depth, progress.progressOpt(remote)); err != nil {
 						errs <- err
 					}
 					return
 
 				}
-			}(cacheDirPath, project.Remote, project.HistoryDepth, project.RemoteBranch)
+			}(cacheDirPath, project.Remote, project.FetchDepth, project.RemoteBranch, project.FetchVia)
 		} else {
 			errs <- err
 		}
 	}
 	wg.Wait()
+	progress.done()
 	close(errs)
 
 	multiErr := make(MultiError, 0)
@@ -1898,29 +3808,119 @@ func updateCache(jirix *jiri.X, remoteProjects Projects) error {
 	return nil
 }
 
-func fetchLocalProjects(jirix *jiri.X, localProjects, remoteProjects Projects) error {
-	fetchLimit := make(chan struct{}, jirix.Jobs)
-	errs := make(chan error, len(localProjects))
-	var wg sync.WaitGroup
-	for key, project := range localProjects {
+// checkFetchedRevision checks that the revision a project should be advanced
+// to is present locally after a fetch.  Fetches can succeed without bringing
+// the revision in, e.g. because of server-side issues or a restrictive fetch
+// refspec, so if it is missing all branches and tags are fetched once more.
+func checkFetchedRevision(ctx context.Context, jirix *jiri.X, project Project) error {
+	revision, err := GetHeadRevision(jirix, project)
+	if err != nil {
+		return err
+	}
+	g := git.NewGit(ctx, project.Path)
+	if _, err := g.CurrentRevisionForRef(revision); err == nil {
+		return nil
+	}
+	jirix.Logger.Warningf("Revision %q of project %s(%s) not found after fetch, fetching all branches and tags from %q\n\n", revision, project.Name, project.Path, project.Remote)
+	scm := gitutil.New(ctx, jirix, gitutil.RootDirOpt(project.Path), gitutil.SSHCommandOpt(project.FetchVia))
+	refspec := fmt.Sprintf("+refs/heads/*:refs/remotes/%s/*", project.GitRemoteName())
+	opts := append([]gitutil.FetchOpt{gitutil.TagsOpt(true)}, shallowFetchOpts(project)...)
+	if err := scm.FetchRefspec(project.GitRemoteName(), refspec, opts...); err != nil {
+		return fmt.Errorf("fetch failed for %v: %v", project.Name, err)
+	}
+	if _, err := g.CurrentRevisionForRef(revision); err != nil {
+		return missingRevisionError{project, revision}
+	}
+	return nil
+}
+
+// missingRevisionError is the error of a project whose revision can't be
+// fetched from its remote, e.g. because it was rewritten by a force push.
+type missingRevisionError struct {
+	project  Project
+	revision string
+}
+
+func (e missingRevisionError) Error() string {
+	return fmt.Sprintf("revision %q of project %s(%s) no longer present on remote %q (possibly force-pushed)", e.revision, e.project.Name, e.project.Path, e.project.Remote)
+}
+
+// fetchLocalProjects fetches the local projects which are in the manifest.  If
+// opts.SkipMissingRevisions is set, the projects whose revision can't be
+// fetched are returned instead of failing, for update to leave them untouched.
+func fetchLocalProjects(ctx context.Context, jirix *jiri.X, localProjects, remoteProjects Projects, opts UpdateUniverseOpts) (ProjectKeys, error) {
+	// Projects sharing a remote are fetched from it only once: the first of
+	// them is fetched from the remote, and the others from that first one.
+	var groups [][]Project
+	shared := make(map[string]int)
+	var keys ProjectKeys
+	for key := range localProjects {
+		keys = append(keys, key)
+	}
+	sort.Sort(keys)
+	for _, key := range keys {
+		project := localProjects[key]
 		if r, ok := remoteProjects[key]; ok {
 			if project.LocalConfig.Ignore || project.LocalConfig.NoUpdate {
 				jirix.Logger.Warningf("Not updating remotes for project %s(%s) due to its local-config\n\n", project.Name, project.Path)
 				continue
 			}
-			wg.Add(1)
-			fetchLimit <- struct{}{}
-			project.HistoryDepth = r.HistoryDepth
-			go func(project Project) {
-				defer func() { <-fetchLimit }()
-				defer wg.Done()
-				if err := fetchAll(jirix, project); err != nil {
-					errs <- fmt.Errorf("fetch failed for %v: %v", project.Name, err)
-					return
-				}
-			}(project)
+			project.FetchDepth = r.FetchDepth
+			project.CloneFilter = r.CloneFilter
+			project.ShallowSince = r.ShallowSince
+			project.SingleBranch = r.SingleBranch
+			project.Revision = r.Revision
+			project.RemoteBranch = r.RemoteBranch
+			project.RemoteName = r.RemoteName
+			if !canShareFetch(project, opts.Mirror) {
+				groups = append(groups, []Project{project})
+			} else if i, ok := shared[project.Remote]; ok {
+				groups[i] = append(groups[i], project)
+			} else {
+				shared[project.Remote] = len(groups)
+				groups = append(groups, []Project{project})
+			}
 		}
 	}
+
+	var skipped ProjectKeys
+	var skippedMu sync.Mutex
+	fetchLimit := make(chan struct{}, jirix.Jobs)
+	errs := make(chan error, len(localProjects))
+	var wg sync.WaitGroup
+	for _, group := range groups {
+		wg.Add(1)
+		fetchLimit <- struct{}{}
+		go func(group []Project) {
+			defer func() { <-fetchLimit }()
+			defer wg.Done()
+			first := group[0]
+			if err := fetchAll(ctx, jirix, first, opts.Mirror); err != nil {
+				for _, project := range group {
+					errs <- fetchError{projectError{project, fmt.Errorf("fetch failed for %v: %v", project.Name, err)}}
+				}
+				return
+			}
+			for i, project := range group {
+				if i != 0 {
+					if err := fetchFromProject(ctx, jirix, project, first); err != nil {
+						errs <- fetchError{projectError{project, fmt.Errorf("fetch failed for %v: %v", project.Name, err)}}
+						continue
+					}
+				}
+				if err := checkFetchedRevision(ctx, jirix, project); err != nil {
+					if _, ok := err.(missingRevisionError); ok && opts.SkipMissingRevisions {
+						jirix.Logger.Warningf("Skipping project %s(%s): %s\n\n", project.Name, project.Path, err)
+						skippedMu.Lock()
+						skipped = append(skipped, project.Key())
+						skippedMu.Unlock()
+						continue
+					}
+					errs <- fetchError{projectError{project, err}}
+				}
+			}
+		}(group)
+	}
 	wg.Wait()
 	close(errs)
 
@@ -1929,16 +3929,42 @@ func fetchLocalProjects(jirix *jiri.X, localProjects, remoteProjects Projects) e
 		multiErr = append(multiErr, err)
 	}
 	if len(multiErr) != 0 {
-		return multiErr
+		return nil, multiErr
 	}
-	return nil
+	return skipped, nil
+}
+
+// canShareFetch returns whether the project can be fetched from another
+// project with the same remote, i.e. whether it is fetched in full from its
+// remote.  Shallow, partial and single branch projects, projects pinned to a
+// tag and projects fetched from a mirror fetch their own subset of the remote.
+func canShareFetch(project Project, mirror string) bool {
+	if _, ok := pinnedTag(project); ok {
+		return false
+	}
+	return project.Remote != "" && mirror == "" && project.FetchDepth == 0 &&
+		project.ShallowSince == "" && project.CloneFilter == "" && !project.SingleBranch
+}
+
+// fetchFromProject fetches the project from another local project with the
+// same remote which was just fetched, instead of fetching it from the remote
+// again.
+func fetchFromProject(ctx context.Context, jirix *jiri.X, project, from Project) error {
+	if err := setRemoteUrl(ctx, jirix, project); err != nil {
+		return err
+	}
+	refspec := fmt.Sprintf("+refs/remotes/%s/*:refs/remotes/%s/*", from.GitRemoteName(), project.GitRemoteName())
+	return gitutil.New(ctx, jirix, gitutil.RootDirOpt(project.Path)).FetchRefspec(from.Path, refspec, gitutil.PruneOpt(true))
 }
 
 // This function creates worktree and runs create operation in parallel
-func runCreateOperations(jirix *jiri.X, ops []createOperation) MultiError {
+//
+// The projects whose revision is missing from their remote are not created
+// and returned, if the update skips them.
+func runCreateOperations(ctx context.Context, jirix *jiri.X, ops []createOperation) (ProjectKeys, MultiError) {
 	count := len(ops)
 	if count == 0 {
-		return nil
+		return nil, nil
 	}
 
 	type workTree struct {
@@ -1946,13 +3972,13 @@ func runCreateOperations(jirix *jiri.X, ops []createOperation) MultiError {
 		dir string
 		// op is an ordered list of operations that must be performed serially,
 		// affecting dir
-		ops []operation
+		ops []createOperation
 		// after contains a tree of work that must be performed after ops
 		after map[string]*workTree
 	}
 	head := &workTree{
 		dir:   "",
-		ops:   []operation{},
+		ops:   []createOperation{},
 		after: make(map[string]*workTree),
 	}
 
@@ -1969,7 +3995,7 @@ func runCreateOperations(jirix *jiri.X, ops []createOperation) MultiError {
 			if !ok {
 				next = &workTree{
 					dir:   part,
-					ops:   []operation{},
+					ops:   []createOperation{},
 					after: make(map[string]*workTree),
 				}
 				node.after[part] = next
@@ -1981,15 +4007,22 @@ func runCreateOperations(jirix *jiri.X, ops []createOperation) MultiError {
 
 	workQueue := make(chan *workTree, count)
 	errs := make(chan error, count)
+	skipped := make(chan ProjectKey, count)
 	var wg sync.WaitGroup
 	processTree := func(tree *workTree) {
 		defer wg.Done()
 		for _, op := range tree.ops {
 			jirix.Logger.Debugf("%v", op)
-			if err := op.Run(jirix); err != nil {
-				errs <- fmt.Errorf("Creating project %q: %v", op.Project().Name, err)
+			if err := op.Run(ctx, jirix); err != nil {
+				if _, ok := err.(missingRevisionError); ok && op.opts.SkipMissingRevisions {
+					jirix.Logger.Warningf("Skipping project %s(%s): %s\n\n", op.project.Name, op.destination, err)
+					skipped <- op.Project().Key()
+					continue
+				}
+				errs <- projectError{op.Project(), fmt.Errorf("Creating project %q: %v", op.Project().Name, err)}
 				return
 			}
+			observeOperation(op)
 		}
 		for _, v := range tree.after {
 			wg.Add(1)
@@ -2008,12 +4041,17 @@ func runCreateOperations(jirix *jiri.X, ops []createOperation) MultiError {
 	wg.Wait()
 	close(workQueue)
 	close(errs)
+	close(skipped)
 
 	var multiErr MultiError
 	for err := range errs {
 		multiErr = append(multiErr, err)
 	}
-	return multiErr
+	var keys ProjectKeys
+	for key := range skipped {
+		keys = append(keys, key)
+	}
+	return keys, multiErr
 }
 
 type PathTrie struct {
@@ -2062,13 +4100,21 @@ func (p *PathTrie) Insert(path string) {
 	}
 }
 
-func runDeleteOperations(jirix *jiri.X, ops []deleteOperation) error {
+// runDeleteOperations runs the delete operations in order, stopping before
+// the next one when ctx is done.  The same goes for runMoveOperations and
+// runCommonOperations: the local git commands of an operation aren't killed
+// midway, which could leave its project in the middle of a checkout or a
+// rebase.
+func runDeleteOperations(ctx context.Context, jirix *jiri.X, ops []deleteOperation) error {
 	notDeleted := NewPathTrie()
 	for _, op := range ops {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		if !op.gc {
 			jirix.Logger.Debugf("%s", op)
-			if err := op.Run(jirix); err != nil {
-				return fmt.Errorf("Deleting project %q: %s", op.Project().Name, err)
+			if err := op.Run(ctx, jirix); err != nil {
+				return projectError{op.Project(), fmt.Errorf("Deleting project %q: %s", op.Project().Name, err)}
 			}
 			continue
 		}
@@ -2082,8 +4128,8 @@ func runDeleteOperations(jirix *jiri.X, ops []deleteOperation) error {
 			continue
 		}
 		jirix.Logger.Debugf("%s", op)
-		if err := op.Run(jirix); err != nil {
-			return fmt.Errorf("Deleting project %q: %s", op.Project().Name, err)
+		if err := op.Run(ctx, jirix); err != nil {
+			return projectError{op.Project(), fmt.Errorf("Deleting project %q: %s", op.Project().Name, err)}
 		}
 		if _, err := os.Stat(op.source); err == nil {
 			// project not deleted, add it to trie
@@ -2095,10 +4141,13 @@ func runDeleteOperations(jirix *jiri.X, ops []deleteOperation) error {
 	return nil
 }
 
-func runMoveOperations(jirix *jiri.X, ops []moveOperation) error {
+func runMoveOperations(ctx context.Context, jirix *jiri.X, ops []moveOperation) error {
 	parentSrcPath := ""
 	parentDestPath := ""
 	for _, op := range ops {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		if parentSrcPath != "" && strings.HasPrefix(op.source, parentSrcPath) {
 			op.source = filepath.Join(parentDestPath, strings.Replace(op.source, parentSrcPath, "", 1))
 		} else {
@@ -2106,42 +4155,56 @@ func runMoveOperations(jirix *jiri.X, ops []moveOperation) error {
 			parentDestPath = op.destination
 		}
 		jirix.Logger.Debugf("%s", op)
-		if err := op.Run(jirix); err != nil {
-			return fmt.Errorf("Moving and updating project %q: %s", op.Project().Name, err)
+		if err := op.Run(ctx, jirix); err != nil {
+			return projectError{op.Project(), fmt.Errorf("Moving and updating project %q: %s", op.Project().Name, err)}
 		}
+		observeOperation(op)
 	}
 	return nil
 }
 
-func runCommonOperations(jirix *jiri.X, ops operations) error {
+func runCommonOperations(ctx context.Context, jirix *jiri.X, ops operations) error {
 	for _, op := range ops {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		jirix.Logger.Debugf("%s", op)
-		if err := op.Run(jirix); err != nil {
-			return fmt.Errorf("Updating project %q: %s", op.Project().Name, err)
+		if err := op.Run(ctx, jirix); err != nil {
+			return projectError{op.Project(), fmt.Errorf("Updating project %q: %s", op.Project().Name, err)}
 		}
+		observeOperation(op)
 	}
 	return nil
 }
 
-func updateProjects(jirix *jiri.X, localProjects, remoteProjects Projects, hooks Hooks, gc bool, runHookTimeout uint, rebaseTracked, rebaseUntracked, rebaseAll, snapshot bool) error {
+func updateProjects(ctx context.Context, jirix *jiri.X, localProjects, remoteProjects Projects, hooks Hooks, opts UpdateUniverseOpts, snapshot bool) error {
 	jirix.TimerPush("update projects")
 	defer jirix.TimerPop()
+	if err := validateHooks(checkedOutHooks(hooks, opts)); err != nil {
+		return err
+	}
 
+	warnShallowProjects(jirix, localProjects, remoteProjects)
 	jirix.TimerPush("Fetch local projects and get remote revisions")
 	errs := make(chan error)
 	states := make(map[ProjectKey]*ProjectState, len(localProjects))
+	var skipped ProjectKeys
 	go func() {
 		jirix.TimerPush("update cache")
-		if err := updateCache(jirix, remoteProjects); err != nil {
+		if err := updateCache(ctx, jirix, remoteProjects); err != nil {
 			errs <- err
 			return
 		}
 		jirix.TimerPop()
 		jirix.TimerPush("fetch local projects")
-		if err := fetchLocalProjects(jirix, localProjects, remoteProjects); err != nil {
+		var err error
+		if skipped, err = fetchLocalProjects(ctx, jirix, localProjects, remoteProjects, opts); err != nil {
 			errs <- err
 			return
 		}
+		for _, key := range skipped {
+			delete(localProjects, key)
+		}
 		jirix.TimerPop()
 		jirix.TimerPush("get project states")
 		s, err := GetProjectStates(jirix, localProjects, false)
@@ -2166,82 +4229,640 @@ func updateProjects(jirix *jiri.X, localProjects, remoteProjects Projects, hooks
 			multiErr = append(multiErr, err)
 		}
 	}
-	jirix.TimerPop()
-	if len(multiErr) != 0 {
-		return multiErr
+	jirix.TimerPop()
+	if len(multiErr) != 0 {
+		return multiErr
+	}
+	// The projects whose revision is missing are left untouched.
+	for _, key := range skipped {
+		delete(ps, key)
+	}
+	warnInProgressOperations(jirix, states)
+	// Lazy projects which are not checked out yet are only registered.
+	lazyProjects := Projects{}
+	for key, p := range ps {
+		if _, ok := localProjects[key]; !ok && p.Lazy {
+			lazyProjects[key] = p
+			delete(ps, key)
+		}
+	}
+	// A partial update leaves the registered lazy projects it doesn't update
+	// alone.
+	var updated Projects
+	if opts.partial {
+		updated = remoteProjects
+	}
+	if err := registerLazyProjects(jirix, lazyProjects, updated); err != nil {
+		return err
+	}
+	ops := computeOperations(localProjects, ps, states, opts, snapshot)
+	moveOperations := []moveOperation{}
+	deleteOperations := []deleteOperation{}
+	updateOperations := operations{}
+	createOperations := []createOperation{}
+	nullOperations := operations{}
+	updates := newFsUpdates()
+	for _, op := range ops {
+		if err := op.Test(jirix, updates); err != nil {
+			return err
+		}
+		switch o := op.(type) {
+		case deleteOperation:
+			deleteOperations = append(deleteOperations, o)
+		case moveOperation:
+			moveOperations = append(moveOperations, o)
+		case updateOperation:
+			updateOperations = append(updateOperations, o)
+		case createOperation:
+			createOperations = append(createOperations, o)
+		case nullOperation:
+			nullOperations = append(nullOperations, o)
+		}
+	}
+	if err := runDeleteOperations(ctx, jirix, deleteOperations); err != nil {
+		return err
+	}
+	if err := runMoveOperations(ctx, jirix, moveOperations); err != nil {
+		return err
+	}
+	if err := runCommonOperations(ctx, jirix, updateOperations); err != nil {
+		return err
+	}
+	notCreated, createErrs := runCreateOperations(ctx, jirix, createOperations)
+	if len(createErrs) != 0 {
+		return createErrs
+	}
+	if len(notCreated) != 0 {
+		// The projects which weren't created are left out of the rest of
+		// the update, along with their hooks.
+		names := make(map[string]bool)
+		for _, key := range notCreated {
+			names[ps[key].Name] = true
+			delete(ps, key)
+		}
+		kept := operations{}
+		for _, op := range ops {
+			if _, ok := ps[op.Project().Key()]; ok || op.Kind() == "delete" {
+				kept = append(kept, op)
+			}
+		}
+		ops = kept
+		for key, hook := range hooks {
+			if names[hook.ProjectName] {
+				delete(hooks, key)
+			}
+		}
+	}
+	if err := runCommonOperations(ctx, jirix, nullOperations); err != nil {
+		return err
+	}
+	jirix.TimerPush("jiri revision files")
+	for _, project := range ps {
+		if !(project.LocalConfig.Ignore || project.LocalConfig.NoUpdate) {
+			project.writeJiriRevisionFiles(jirix)
+		}
+	}
+	jirix.TimerPop()
+	if !snapshot {
+		jirix.TimerPush("checkout local branches")
+		for key, project := range ps {
+			if local, ok := localProjects[key]; ok {
+				project.LocalConfig = local.LocalConfig
+			}
+			if project.LocalConfig.Ignore || project.LocalConfig.NoUpdate {
+				continue
+			}
+			branch := localBranch(jirix, project)
+			if branch == "" {
+				continue
+			}
+			if err := ensureOnBranch(jirix, project, branch); err != nil {
+				return err
+			}
+		}
+		jirix.TimerPop()
+	}
+	if err := pullLocalProjectsLFS(ctx, jirix, localProjects, ps); err != nil {
+		return err
+	}
+	nestedProjects := ps
+	if opts.partial {
+		// The updated projects may be nested in projects left out of the
+		// update, and the other way around.
+		all, err := LocalProjects(jirix, FastScan)
+		if err != nil {
+			return err
+		}
+		for key, p := range ps {
+			all[key] = p
+		}
+		nestedProjects = all
+	}
+	if err := checkNestedProjects(jirix, nestedProjects, opts.StrictNesting); err != nil {
+		return err
+	}
+	if err := runHooks(jirix, ops, hooks, opts); err != nil {
+		return err
+	}
+	if err := applyGitHooks(jirix, ops); err != nil {
+		return err
+	}
+	return writeMetadataIgnoreFile(jirix)
+}
+
+// lazyProjectsFile returns the path of the manifest listing the lazy projects
+// registered by the last update.
+func lazyProjectsFile(jirix *jiri.X) string {
+	return filepath.Join(jirix.RootMetaDir(), "lazy_projects")
+}
+
+// registeredLazyProjects returns the lazy projects registered by the last
+// update, some of which may have been realized since.
+func registeredLazyProjects(jirix *jiri.X) (Projects, error) {
+	projects := Projects{}
+	file := lazyProjectsFile(jirix)
+	if _, err := os.Stat(file); err != nil {
+		if os.IsNotExist(err) {
+			return projects, nil
+		}
+		return nil, fmtError(err)
+	}
+	m, err := ManifestFromFile(jirix, file)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range m.Projects {
+		p.absolutizePaths(jirix.Root)
+		projects[p.Key()] = p
+	}
+	return projects, nil
+}
+
+// registerLazyProjects writes the metadata of the given lazy projects, which
+// are not checked out, and records them for RealizeProject.  The metadata of
+// the previously registered projects which were not realized, and were
+// removed from the manifest or moved, is deleted.  If updated isn't nil, only
+// the registered projects in it are affected, the others being left out of a
+// partial update.
+func registerLazyProjects(jirix *jiri.X, projects, updated Projects) error {
+	registered, err := registeredLazyProjects(jirix)
+	if err != nil {
+		return err
+	}
+	kept := Projects{}
+	for key, p := range registered {
+		if _, ok := updated[key]; updated != nil && !ok {
+			if !isPathDir(filepath.Join(p.Path, ".git")) {
+				kept[key] = p
+			}
+			continue
+		}
+		if lp, ok := projects[key]; (ok && lp.Path == p.Path) || isPathDir(filepath.Join(p.Path, ".git")) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(p.Path, jiri.ProjectMetaDir)); err != nil {
+			return fmtError(err)
+		}
+		// The directory is kept if other projects are nested in it.
+		os.Remove(p.Path)
+	}
+	m := Manifest{}
+	for _, p := range projects {
+		if err := writeMetadata(jirix, p, p.Path); err != nil {
+			return err
+		}
+		m.Projects = append(m.Projects, p)
+	}
+	for _, p := range kept {
+		m.Projects = append(m.Projects, p)
+	}
+	if len(m.Projects) == 0 {
+		if err := os.RemoveAll(lazyProjectsFile(jirix)); err != nil {
+			return fmtError(err)
+		}
+		return nil
+	}
+	return m.ToFile(jirix, lazyProjectsFile(jirix))
+}
+
+// RealizeProject checks out the lazy project registered by the last update at
+// the given path.
+func RealizeProject(jirix *jiri.X, path string) error {
+	registered, err := registeredLazyProjects(jirix)
+	if err != nil {
+		return err
+	}
+	m := Manifest{}
+	for _, p := range registered {
+		m.Projects = append(m.Projects, p)
+	}
+	project, err := m.FindProjectByPath(path)
+	if err != nil {
+		return fmt.Errorf("no lazy project is registered at %q", path)
+	}
+	if isPathDir(filepath.Join(path, ".git")) {
+		return fmt.Errorf("lazy project %s(%s) is already checked out", project.Name, path)
+	}
+	// The checkout is moved to path, which must not exist, so the directory
+	// of the lazy project, which holds its metadata and the projects nested
+	// in it, is set aside until the project is checked out.
+	tmpDir, err := ioutil.TempDir(filepath.Dir(path), filepath.Base(path)+"-")
+	if err != nil {
+		return fmtError(err)
+	}
+	aside := filepath.Join(tmpDir, "lazy")
+	if err := osutil.Rename(path, aside); err != nil && !os.IsNotExist(err) {
+		os.Remove(tmpDir)
+		return fmtError(err)
+	}
+	op := createOperation{commonOperation: commonOperation{
+		destination: path,
+		project:     *project,
+	}}
+	if err := op.Run(context.Background(), jirix); err != nil {
+		// Put the directory of the lazy project back, unless the failure
+		// came after the checkout was moved to path.
+		if _, statErr := os.Stat(path); !os.IsNotExist(statErr) {
+			jirix.Logger.Warningf("The directory of lazy project %s(%s) was left at %q\n\n", project.Name, path, aside)
+		} else if renameErr := osutil.Rename(aside, path); renameErr != nil && !os.IsNotExist(renameErr) {
+			jirix.Logger.Warningf("Cannot move the directory of lazy project %s(%s) back from %q: %v\n\n", project.Name, path, aside, renameErr)
+		} else {
+			os.Remove(tmpDir)
+		}
+		return err
+	}
+	if err := restoreNestedProjects(aside, path); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return fmtError(err)
+	}
+	// Record the realized project as a local project, for the next update.
+	return WriteUpdateHistorySnapshot(jirix, "", false)
+}
+
+// restoreNestedProjects moves the projects nested in the directory of a lazy
+// project, which was set aside, into its checkout.
+func restoreNestedProjects(aside, path string) error {
+	entries, err := ioutil.ReadDir(aside)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmtError(err)
+	}
+	for _, entry := range entries {
+		if entry.Name() == jiri.ProjectMetaDir {
+			continue
+		}
+		dst := filepath.Join(path, entry.Name())
+		if _, err := os.Lstat(dst); err == nil {
+			return fmt.Errorf("cannot move %q to %q as the destination already exists", filepath.Join(aside, entry.Name()), dst)
+		}
+		if err := osutil.Rename(filepath.Join(aside, entry.Name()), dst); err != nil {
+			return fmtError(err)
+		}
+	}
+	return nil
+}
+
+// ImportLocalProject puts the git repository checked out at the path of the
+// given project, e.g. cloned by hand, under jiri management: the metadata of
+// the project is written to the repository and the project is added to the
+// .jiri_manifest file, so that updates keep it.
+func ImportLocalProject(jirix *jiri.X, project Project) error {
+	if !filepath.IsAbs(project.Path) {
+		return fmt.Errorf("path %q of project %q is not absolute", project.Path, project.Name)
+	}
+	if rel, err := filepath.Rel(jirix.Root, project.Path); err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("project path %q is not in the root directory %q", project.Path, jirix.Root)
+	}
+	if !isPathDir(filepath.Join(project.Path, ".git")) {
+		return fmt.Errorf("%q is not the root of a git repository", project.Path)
+	}
+	if isLocal, err := IsJiriProject(project.Path); err != nil {
+		return err
+	} else if isLocal {
+		return fmt.Errorf("%q is already a jiri project", project.Path)
+	}
+	if project.Name == "" || project.Remote == "" {
+		return fmt.Errorf("project %s(%s) needs a name and a remote", project.Name, project.Path)
+	}
+	if err := project.fillDefaults(); err != nil {
+		return err
+	}
+	manifest, err := ManifestFromFile(jirix, jirix.JiriManifestFile())
+	if err != nil {
+		return err
+	}
+	for _, p := range manifest.Projects {
+		if p.Key() == project.Key() {
+			return fmt.Errorf("project %q with remote %q is already in %q", project.Name, project.Remote, jirix.JiriManifestFile())
+		}
+	}
+	if err := writeMetadata(jirix, project, project.Path); err != nil {
+		return err
+	}
+	manifest.Projects = append(manifest.Projects, project)
+	if err := manifest.ToFile(jirix, jirix.JiriManifestFile()); err != nil {
+		return err
+	}
+	// Record the imported project as a local project, for the fast scans.
+	return WriteUpdateHistorySnapshot(jirix, "", false)
+}
+
+// warnInProgressOperations warns about the projects stuck in an interrupted
+// git operation, which update may fail to or should not advance.
+func warnInProgressOperations(jirix *jiri.X, states map[ProjectKey]*ProjectState) {
+	keys := ProjectKeys{}
+	for key, state := range states {
+		if state.InProgressOperation != "" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Sort(keys)
+	for _, key := range keys {
+		state := states[key]
+		finish := fmt.Sprintf("'git %s --continue' or 'git %s --abort'", state.InProgressOperation, state.InProgressOperation)
+		if state.InProgressOperation == "bisect" {
+			finish = "'git bisect reset'"
+		}
+		jirix.Logger.Warningf("Project %s(%s) has a %s in progress, run %s in it to finish it\n\n", state.Project.Name, state.Project.Path, state.InProgressOperation, finish)
+	}
+}
+
+// checkNestedProjects warns about the checked out projects nested in another
+// project which doesn't ignore them, where they show up as untracked embedded
+// repositories, or fails if strict is set.  Projects nested in a project with
+// IgnoreNested set are excluded in it instead.
+func checkNestedProjects(jirix *jiri.X, projects Projects, strict bool) error {
+	paths := []string{}
+	byPath := map[string]Project{}
+	for _, p := range projects {
+		if !isPathDir(filepath.Join(p.Path, ".git")) {
+			continue
+		}
+		paths = append(paths, p.Path)
+		byPath[p.Path] = p
+	}
+	sort.Strings(paths)
+	msgs := []string{}
+	for _, path := range paths {
+		// Only check the innermost project containing path, which in turn
+		// should be ignored by the project containing it.
+		var parent string
+		for dir := filepath.Dir(path); dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+			if _, ok := byPath[dir]; ok {
+				parent = dir
+				break
+			}
+		}
+		if parent == "" {
+			continue
+		}
+		rel, err := filepath.Rel(parent, path)
+		if err != nil {
+			return fmtError(err)
+		}
+		ignored, err := gitutil.New(context.Background(), jirix, gitutil.RootDirOpt(parent)).IsIgnored(rel)
+		if err != nil {
+			return err
+		}
+		if ignored {
+			continue
+		}
+		p, q := byPath[path], byPath[parent]
+		if q.IgnoreNested {
+			if err := excludeNestedProject(q, rel); err != nil {
+				return err
+			}
+			continue
+		}
+		msgs = append(msgs, fmt.Sprintf("Project %s(%s) is nested in project %s(%s), which doesn't ignore it; add \"%s/\" to its .gitignore or set ignore-nested=\"true\" on it", p.Name, p.Path, q.Name, q.Path, filepath.ToSlash(rel)))
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	if strict {
+		return fmt.Errorf("%s", strings.Join(msgs, "\n"))
+	}
+	for _, msg := range msgs {
+		jirix.Logger.Warningf("%s\n\n", msg)
+	}
+	return nil
+}
+
+// excludeNestedProject appends the pattern matching rel, the path of a
+// project nested in parent, to the .git/info/exclude file of parent.
+func excludeNestedProject(parent Project, rel string) error {
+	excludeDir := filepath.Join(parent.Path, ".git", "info")
+	if err := os.MkdirAll(excludeDir, 0755); err != nil {
+		return fmtError(err)
+	}
+	f, err := os.OpenFile(filepath.Join(excludeDir, "exclude"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmtError(err)
+	}
+	if _, err := fmt.Fprintf(f, "/%s/\n", filepath.ToSlash(rel)); err != nil {
+		f.Close()
+		return fmtError(err)
+	}
+	return fmtError(f.Close())
+}
+
+// writeMetadataIgnoreFile adds the patterns matching the jiri metadata
+// directories to jirix.MetadataIgnoreFile in the root, if they are missing,
+// keeping its other lines.
+func writeMetadataIgnoreFile(jirix *jiri.X) error {
+	if jirix.MetadataIgnoreFile == "" {
+		return nil
+	}
+	ignoreFile := filepath.Join(jirix.Root, jirix.MetadataIgnoreFile)
+	b, err := ioutil.ReadFile(ignoreFile)
+	if err != nil && !os.IsNotExist(err) {
+		return fmtError(err)
+	}
+	lines := make(map[string]bool)
+	for _, line := range strings.Split(string(b), "\n") {
+		lines[strings.TrimSpace(line)] = true
+	}
+	data := string(b)
+	for _, pattern := range []string{"/" + jiri.RootMetaDir + "/", jiri.ProjectMetaDir + "/"} {
+		if lines[pattern] {
+			continue
+		}
+		if data != "" && !strings.HasSuffix(data, "\n") {
+			data += "\n"
+		}
+		data += pattern + "\n"
+	}
+	if data == string(b) {
+		return nil
+	}
+	if err := ioutil.WriteFile(ignoreFile, []byte(data), 0644); err != nil {
+		return fmtError(err)
+	}
+	return nil
+}
+
+// runHooks runs all hooks for the given operations.
+func runHooks(jirix *jiri.X, ops []operation, hooks Hooks, opts UpdateUniverseOpts) error {
+	jirix.TimerPush("run hooks")
+	defer jirix.TimerPop()
+	hooks = skipHooks(jirix, phaseHooks(hooks, ""), opts)
+	if err := validateHooks(hooks); err != nil {
+		return err
+	}
+	stages, err := hookStages(hooks)
+	if err != nil {
+		return err
+	}
+	tmpDir, err := ioutil.TempDir("", "run-hooks")
+	if err != nil {
+		return fmt.Errorf("not able to create tmp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	for _, stage := range stages {
+		if err := runHookStage(jirix, stage, tmpDir, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// phaseHooks returns the hooks of the given phase.
+func phaseHooks(hooks Hooks, phase string) Hooks {
+	result := make(Hooks)
+	for key, hook := range hooks {
+		if hook.Phase == phase {
+			result[key] = hook
+		}
 	}
-	ops := computeOperations(localProjects, ps, states, gc, rebaseTracked, rebaseUntracked, rebaseAll, snapshot)
-	moveOperations := []moveOperation{}
-	deleteOperations := []deleteOperation{}
-	updateOperations := operations{}
-	createOperations := []createOperation{}
-	nullOperations := operations{}
-	updates := newFsUpdates()
-	for _, op := range ops {
-		if err := op.Test(jirix, updates); err != nil {
-			return err
+	return result
+}
+
+// projectError is the error of the update of a project.
+type projectError struct {
+	project Project
+	err     error
+}
+
+func (e projectError) Error() string {
+	return e.err.Error()
+}
+
+// fetchError is the error of a project which failed to fetch.
+type fetchError struct {
+	projectError
+}
+
+// failedProjects adds the errors of the projects whose update failed with the
+// given error to failed.
+func failedProjects(err error, failed map[ProjectKey]projectError) {
+	switch e := err.(type) {
+	case projectError:
+		if _, ok := failed[e.project.Key()]; !ok {
+			failed[e.project.Key()] = e
 		}
-		switch o := op.(type) {
-		case deleteOperation:
-			deleteOperations = append(deleteOperations, o)
-		case moveOperation:
-			moveOperations = append(moveOperations, o)
-		case updateOperation:
-			updateOperations = append(updateOperations, o)
-		case createOperation:
-			createOperations = append(createOperations, o)
-		case nullOperation:
-			nullOperations = append(nullOperations, o)
+	case fetchError:
+		failedProjects(e.projectError, failed)
+	case MultiError:
+		for _, err := range e {
+			failedProjects(err, failed)
 		}
 	}
-	if err := runDeleteOperations(jirix, deleteOperations); err != nil {
-		return err
+}
+
+// runOnFailureHooks runs the OnFailurePhase hooks of the projects whose update
+// failed with the given error.  Their failures are only logged, so that they
+// don't hide the error of the update.
+func runOnFailureHooks(jirix *jiri.X, hooks Hooks, updateErr error, opts UpdateUniverseOpts) {
+	hooks = skipHooks(jirix, phaseHooks(hooks, OnFailurePhase), opts)
+	if len(hooks) == 0 {
+		return
 	}
-	if err := runMoveOperations(jirix, moveOperations); err != nil {
-		return err
+	failed := make(map[ProjectKey]projectError)
+	failedProjects(updateErr, failed)
+	var sorted HooksByName
+	for _, hook := range hooks {
+		sorted = append(sorted, hook)
 	}
-	if err := runCommonOperations(jirix, updateOperations); err != nil {
-		return err
+	sort.Sort(sorted)
+	for _, e := range failed {
+		for _, hook := range sorted {
+			if hook.ActionPath != e.project.Path {
+				continue
+			}
+			jirix.Logger.Infof("running on-failure hook(%v) for project %q", hook.Name, hook.ProjectName)
+			var out bytes.Buffer
+			env := map[string]string{
+				"JIRI_FAILED_PROJECT_PATH": e.project.Path,
+				"JIRI_UPDATE_ERROR":        e.err.Error(),
+			}
+			s := jirix.NewSeq().Verbose(false).Capture(&out, &out).Env(env)
+			if err := s.Dir(hook.ActionPath).Timeout(time.Duration(opts.RunHookTimeout) * time.Minute).Last(filepath.Join(hook.ActionPath, hook.Action)); err != nil {
+				jirix.Logger.Errorf("On-failure hook(%v) for project %q failed: %v\n%s\n", hook.Name, hook.ProjectName, err, out.String())
+			}
+		}
 	}
-	if err := runCreateOperations(jirix, createOperations); err != nil {
-		return err
+}
+
+// skipHooks returns the hooks which are not named in opts.SkipHooks, none if
+// opts.NoHooks is set, and warns about the names which match no hook.
+func skipHooks(jirix *jiri.X, hooks Hooks, opts UpdateUniverseOpts) Hooks {
+	if opts.NoHooks {
+		if len(hooks) != 0 {
+			jirix.Logger.Infof("skipping %d hook(s)", len(hooks))
+		}
+		return make(Hooks)
 	}
-	if err := runCommonOperations(jirix, nullOperations); err != nil {
-		return err
+	if len(opts.SkipHooks) == 0 {
+		return hooks
 	}
-	jirix.TimerPush("jiri revision files")
-	for _, project := range ps {
-		if !(project.LocalConfig.Ignore || project.LocalConfig.NoUpdate) {
-			project.writeJiriRevisionFiles(jirix)
+	found := make(map[string]bool)
+	for _, name := range opts.SkipHooks {
+		found[name] = false
+	}
+	kept := make(Hooks)
+	for key, hook := range hooks {
+		if _, ok := found[hook.Name]; ok {
+			found[hook.Name] = true
+			jirix.Logger.Infof("skipping hook(%v) for project %q", hook.Name, hook.ProjectName)
+			continue
 		}
+		kept[key] = hook
 	}
-	jirix.TimerPop()
-	if err := runHooks(jirix, ops, hooks, runHookTimeout); err != nil {
-		return err
+	for _, name := range opts.SkipHooks {
+		if !found[name] {
+			jirix.Logger.Warningf("No hook named %q to skip\n\n", name)
+			found[name] = true
+		}
 	}
-	return applyGitHooks(jirix, ops)
+	return kept
 }
 
-// runHooks runs all hooks for the given operations.
-func runHooks(jirix *jiri.X, ops []operation, hooks Hooks, runHookTimeout uint) error {
-	jirix.TimerPush("run hooks")
-	defer jirix.TimerPop()
+// runHookStage runs the given hooks in parallel, at most opts.HookJobs at once
+// if set.
+func runHookStage(jirix *jiri.X, hooks []Hook, tmpDir string, opts UpdateUniverseOpts) error {
 	type result struct {
 		outFile *os.File
 		errFile *os.File
 		err     error
 	}
 	ch := make(chan result)
-	tmpDir, err := ioutil.TempDir("", "run-hooks")
-	if err != nil {
-		return fmt.Errorf("not able to create tmp dir: %v", err)
-	}
-	defer os.RemoveAll(tmpDir)
 	// Hack until sequence is changed to use logger or is removed
 	showHookOutput := jirix.Logger.LoggerLevel >= log.DebugLevel
+	var limit chan struct{}
+	if opts.HookJobs > 0 {
+		limit = make(chan struct{}, opts.HookJobs)
+	}
 	for _, hook := range hooks {
-		jirix.Logger.Infof("running hook(%v) for project %q", hook.Name, hook.ProjectName)
 		go func(hook Hook) {
+			if limit != nil {
+				limit <- struct{}{}
+				defer func() { <-limit }()
+			}
+			jirix.Logger.Infof("running hook(%v) for project %q", hook.Name, hook.ProjectName)
 			outFile, err := ioutil.TempFile(tmpDir, hook.Name+"-out")
 			if err != nil {
 				ch <- result{nil, nil, fmtError(err)}
@@ -2257,7 +4878,7 @@ func runHooks(jirix *jiri.X, ops []operation, hooks Hooks, runHookTimeout uint)
 			fmt.Fprintf(errFile, "Error for hook(%v) for project %q\n", hook.Name, hook.ProjectName)
 			// Hack until sequence is changesd to use logger or is removed
 			s := jirix.NewSeq().Verbose(showHookOutput).CaptureAll(outFile, errFile)
-			if err := s.Dir(hook.ActionPath).Timeout(time.Duration(runHookTimeout) * time.Minute).Last(filepath.Join(hook.ActionPath, hook.Action)); err != nil {
+			if err := s.Dir(hook.ActionPath).Timeout(time.Duration(opts.RunHookTimeout) * time.Minute).Last(filepath.Join(hook.ActionPath, hook.Action)); err != nil {
 				ch <- result{outFile, errFile, err}
 				return
 			}
@@ -2316,6 +4937,72 @@ func runHooks(jirix *jiri.X, ops []operation, hooks Hooks, runHookTimeout uint)
 	return nil
 }
 
+// hookStages groups hooks into stages to run one after the other, so that
+// every hook runs after the hooks of the projects listed in its after
+// attribute or, by default, of the projects its project is nested in.
+func hookStages(hooks Hooks) ([][]Hook, error) {
+	sorted := HooksByName{}
+	for _, hook := range hooks {
+		sorted = append(sorted, hook)
+	}
+	sort.Sort(sorted)
+	deps := make(map[HookKey][]Hook)
+	for _, h := range sorted {
+		after := h.afterProjects()
+		for _, d := range sorted {
+			if d.Key() == h.Key() {
+				continue
+			}
+			if len(after) > 0 {
+				for _, name := range after {
+					if d.ProjectName == name {
+						deps[h.Key()] = append(deps[h.Key()], d)
+					}
+				}
+			} else if strings.HasPrefix(h.ActionPath, d.ActionPath+string(filepath.Separator)) {
+				deps[h.Key()] = append(deps[h.Key()], d)
+			}
+		}
+	}
+	stageOf := make(map[HookKey]int)
+	visiting := make(map[HookKey]bool)
+	var visit func(h Hook) (int, error)
+	visit = func(h Hook) (int, error) {
+		if stage, ok := stageOf[h.Key()]; ok {
+			return stage, nil
+		}
+		if visiting[h.Key()] {
+			return 0, fmt.Errorf("hook %q of project %q depends on itself", h.Name, h.ProjectName)
+		}
+		visiting[h.Key()] = true
+		stage := 0
+		for _, d := range deps[h.Key()] {
+			dstage, err := visit(d)
+			if err != nil {
+				return 0, err
+			}
+			if dstage >= stage {
+				stage = dstage + 1
+			}
+		}
+		visiting[h.Key()] = false
+		stageOf[h.Key()] = stage
+		return stage, nil
+	}
+	var stages [][]Hook
+	for _, h := range sorted {
+		stage, err := visit(h)
+		if err != nil {
+			return nil, err
+		}
+		for len(stages) <= stage {
+			stages = append(stages, nil)
+		}
+		stages[stage] = append(stages[stage], h)
+	}
+	return stages, nil
+}
+
 func applyGitHooks(jirix *jiri.X, ops []operation) error {
 	jirix.TimerPush("apply githooks")
 	defer jirix.TimerPop()
@@ -2373,7 +5060,11 @@ func applyGitHooks(jirix *jiri.X, ops []operation) error {
 				if err := os.MkdirAll(excludeDir, 0755); err != nil {
 					return fmtError(err)
 				}
-				if err := ioutil.WriteFile(excludeFile, []byte(excludeString), 0644); err != nil {
+				// Keep the other exclusions, e.g. those of excludeNestedProject.
+				if len(b) > 0 && !bytes.HasSuffix(b, []byte("\n")) {
+					b = append(b, '\n')
+				}
+				if err := ioutil.WriteFile(excludeFile, append(b, excludeString...), 0644); err != nil {
 					return fmtError(err)
 				}
 			}
@@ -2385,6 +5076,9 @@ func applyGitHooks(jirix *jiri.X, ops []operation) error {
 		if op.Kind() == "delete" {
 			continue
 		}
+		if err := validateGitHooks(op.Project()); err != nil {
+			return err
+		}
 		// Apply git hooks, overwriting any existing hooks.  Jiri is in control of
 		// writing all hooks.
 		gitHooksDstDir := filepath.Join(op.Project().Path, ".git", "hooks")
@@ -2407,8 +5101,12 @@ func applyGitHooks(jirix *jiri.X, ops []operation) error {
 			if err != nil {
 				return fmtError(err)
 			}
-			// The file *must* be executable to be picked up by git.
-			return fmtError(ioutil.WriteFile(dst, src, 0755))
+			// The file *must* be executable to be picked up by git.  WriteFile
+			// doesn't change the mode of an existing file, so set it explicitly.
+			if err := ioutil.WriteFile(dst, src, 0755); err != nil {
+				return fmtError(err)
+			}
+			return fmtError(os.Chmod(dst, 0755))
 		}
 		if err := filepath.Walk(op.Project().GitHooks, copyFn); err != nil {
 			return err
@@ -2417,6 +5115,93 @@ func applyGitHooks(jirix *jiri.X, ops []operation) error {
 	return nil
 }
 
+// validateGitHooks checks that the GitHooks directory of the given project
+// exists and that all the hooks it contains are executable.
+func validateGitHooks(project Project) error {
+	info, err := os.Stat(project.GitHooks)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("githooks directory %q of project %q does not exist", project.GitHooks, project.Name)
+		}
+		return fmtError(err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("githooks %q of project %q is not a directory", project.GitHooks, project.Name)
+	}
+	return filepath.Walk(project.GitHooks, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() && info.Mode().Perm()&0111 == 0 {
+			return fmt.Errorf("git hook %q of project %q is not executable", path, project.Name)
+		}
+		return nil
+	})
+}
+
+// HookNotExecutableError is returned by update when the action of a hook is not
+// executable.
+type HookNotExecutableError struct {
+	Hook Hook
+	// Path is the path of the action.
+	Path string
+}
+
+func (e *HookNotExecutableError) Error() string {
+	return fmt.Sprintf("action %q of hook %q for project %q is not executable, run 'chmod +x %s' to fix it", e.Path, e.Hook.Name, e.Hook.ProjectName, e.Path)
+}
+
+// validateHooks checks that the actions of the hooks exist and are
+// executable, so that none of them is run otherwise.
+func validateHooks(hooks Hooks) error {
+	sorted := HooksByName{}
+	for _, hook := range hooks {
+		sorted = append(sorted, hook)
+	}
+	sort.Sort(sorted)
+	multiErr := make(MultiError, 0)
+	for _, hook := range sorted {
+		path := filepath.Join(hook.ActionPath, hook.Action)
+		info, err := os.Stat(path)
+		if err != nil {
+			multiErr = append(multiErr, fmtError(err))
+		} else if info.Mode().Perm()&0111 == 0 {
+			multiErr = append(multiErr, &HookNotExecutableError{hook, path})
+		}
+	}
+	switch len(multiErr) {
+	case 0:
+		return nil
+	case 1:
+		return multiErr[0]
+	}
+	return multiErr
+}
+
+// checkedOutHooks returns the hooks run by update whose action exists before
+// the update, for validateHooks to check them before any project is touched.
+// The hooks of the projects created by the update are checked before running
+// them.
+func checkedOutHooks(hooks Hooks, opts UpdateUniverseOpts) Hooks {
+	checkedOut := make(Hooks)
+	if opts.NoHooks {
+		return checkedOut
+	}
+	skipped := make(map[string]bool)
+	for _, name := range opts.SkipHooks {
+		skipped[name] = true
+	}
+	for key, hook := range phaseHooks(hooks, "") {
+		if skipped[hook.Name] {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(hook.ActionPath, hook.Action)); err == nil {
+			checkedOut[key] = hook
+		}
+	}
+	return checkedOut
+}
+
 // writeMetadata stores the given project metadata in the directory
 // identified by the given path.
 func writeMetadata(jirix *jiri.X, project Project, dir string) (e error) {
@@ -2458,8 +5243,9 @@ type operation interface {
 	Project() Project
 	// Kind returns the kind of operation.
 	Kind() string
-	// Run executes the operation.
-	Run(jirix *jiri.X) error
+	// Run executes the operation, killing its git fetches and clones when ctx
+	// is done.
+	Run(ctx context.Context, jirix *jiri.X) error
 	// String returns a string representation of the operation.
 	String() string
 	// Test checks whether the operation would fail.
@@ -2487,13 +5273,16 @@ func (op commonOperation) Project() Project {
 // createOperation represents the creation of a project.
 type createOperation struct {
 	commonOperation
+	// opts are the options of the update, of which the clone uses Mirror,
+	// References and ShallowBelowFreeSpace.
+	opts UpdateUniverseOpts
 }
 
 func (op createOperation) Kind() string {
 	return "create"
 }
 
-func (op createOperation) Run(jirix *jiri.X) (e error) {
+func (op createOperation) Run(ctx context.Context, jirix *jiri.X) (e error) {
 	path, perm := filepath.Dir(op.destination), os.FileMode(0755)
 	tmpDirPrefix := strings.Replace(op.Project().Name, "/", ".", -1) + "-"
 
@@ -2535,21 +5324,98 @@ func (op createOperation) Run(jirix *jiri.X) (e error) {
 	}
 
 	if jirix.Shared && cache != "" {
-		if err := gitutil.New(jirix).Clone(cache, tmpDir,
-			gitutil.SharedOpt(true),
-			gitutil.NoCheckoutOpt(true), gitutil.DepthOpt(op.project.HistoryDepth)); err != nil {
+		if err := gitutil.New(ctx, jirix).Clone(cache, tmpDir,
+			gitutil.SharedOpt(true), gitutil.OriginOpt(op.project.RemoteName),
+			gitutil.NoCheckoutOpt(true), gitutil.DepthOpt(op.project.FetchDepth)); err != nil {
 			return err
 		}
 	} else {
+		depth := op.project.FetchDepth
+		if depth == 0 && op.project.CloneFilter == "" && op.project.ShallowSince == "" && cache == "" && lowOnDiskSpace(jirix, op.opts.ShallowBelowFreeSpace) {
+			jirix.Logger.Warningf("Free disk space is low, cloning project %s(%s) with a history depth of 1\n\n", op.project.Name, op.destination)
+			depth = 1
+		}
 		ref := cache
-		if op.project.HistoryDepth > 0 {
+		if depth > 0 || op.project.ShallowSince != "" {
 			ref = ""
 		}
-		if err := gitutil.New(jirix).Clone(op.project.Remote, tmpDir,
-			gitutil.ReferenceOpt(ref),
-			gitutil.NoCheckoutOpt(true), gitutil.DepthOpt(op.project.HistoryDepth)); err != nil {
+		opts := []gitutil.CloneOpt{gitutil.ReferenceOpt(ref), gitutil.NoCheckoutOpt(true), gitutil.DepthOpt(depth), gitutil.FilterOpt(op.project.CloneFilter),
+			gitutil.ShallowSinceOpt(op.project.ShallowSince), gitutil.OriginOpt(op.project.RemoteName)}
+		if depth == 0 && op.project.ShallowSince == "" {
+			opts = append(opts, gitutil.ReferenceIfAbleOpt(userReference(op.opts.References, op.project)))
+		}
+		tag, pinned := pinnedTag(op.project)
+		if pinned {
+			opts = append(opts, gitutil.SingleBranchOpt(tag), gitutil.NoTagsOpt(true))
+		} else if op.project.SingleBranch {
+			opts = append(opts, gitutil.SingleBranchOpt(op.project.RemoteBranch))
+		}
+		remote := op.project.Remote
+		if op.opts.Mirror != "" {
+			remote = mirrorRemote(op.opts.Mirror, op.project.Remote)
+		}
+		err := gitutil.New(ctx, jirix, gitutil.SSHCommandOpt(op.project.FetchVia)).Clone(remote, tmpDir, opts...)
+		if err != nil && remote != op.project.Remote {
+			jirix.Logger.Warningf("Cloning project %s(%s) from mirror failed, cloning it from %s: %v\n\n", op.project.Name, op.destination, op.project.Remote, err)
+			if err := os.RemoveAll(tmpDir); err != nil {
+				return fmtError(err)
+			}
+			remote = op.project.Remote
+			err = gitutil.New(ctx, jirix, gitutil.SSHCommandOpt(op.project.FetchVia)).Clone(remote, tmpDir, opts...)
+		}
+		if err != nil {
 			return err
 		}
+		if remote != op.project.Remote {
+			// Keep the canonical remote as the git remote, and fetch from it
+			// if the mirror lacks the revision.
+			if err := gitutil.New(ctx, jirix, gitutil.RootDirOpt(tmpDir)).SetRemoteUrl(op.project.GitRemoteName(), op.project.Remote); err != nil {
+				return err
+			}
+			p := op.project
+			p.Path = tmpDir
+			revision, err := GetHeadRevision(jirix, p)
+			if err != nil {
+				return err
+			}
+			if _, err := git.NewGit(ctx, tmpDir).CurrentRevisionForRef(revision); err != nil {
+				jirix.Logger.Warningf("Revision %q of project %s(%s) not found on mirror, fetching it from %s\n\n", revision, op.project.Name, op.destination, op.project.Remote)
+				if err := fetchFromRemote(ctx, jirix, p); err != nil {
+					return err
+				}
+			}
+		}
+		if op.project.SingleBranch && !pinned {
+			p := op.project
+			p.Path = tmpDir
+			if err := fetchMissingRevision(ctx, jirix, p); err != nil {
+				return err
+			}
+		}
+		if pinned {
+			// Restore the default fetch configuration, which a single branch
+			// clone restricts to the tag, so that the project can later be
+			// moved to a branch.
+			scm := gitutil.New(context.Background(), jirix, gitutil.RootDirOpt(tmpDir))
+			name := op.project.GitRemoteName()
+			if err := scm.Config("remote."+name+".fetch", fmt.Sprintf("+refs/heads/*:refs/remotes/%s/*", name)); err != nil {
+				return err
+			}
+			if err := scm.Config("--unset", "remote."+name+".tagopt"); err != nil {
+				return err
+			}
+		}
+	}
+	// A clone can succeed without the revision, e.g. when it was force-pushed
+	// out of the remote.
+	p := op.project
+	p.Path = tmpDir
+	if err := checkFetchedRevision(ctx, jirix, p); err != nil {
+		if e, ok := err.(missingRevisionError); ok {
+			e.project = op.project
+			return e
+		}
+		return err
 	}
 	if err := os.Chmod(tmpDir, os.FileMode(0755)); err != nil {
 		return fmtError(err)
@@ -2566,19 +5432,100 @@ func (op createOperation) Run(jirix *jiri.X) (e error) {
 	}
 
 	// Delete inital branch(es)
-	if branches, _, err := git.NewGit(op.project.Path).GetBranches(); err != nil {
+	if branches, _, err := git.NewGit(context.Background(), op.project.Path).GetBranches(); err != nil {
 		jirix.Logger.Warningf("not able to get branches for newly created project %s(%s)\n\n", op.project.Name, op.project.Path)
 	} else {
-		scm := gitutil.New(jirix, gitutil.RootDirOpt(op.project.Path))
+		scm := gitutil.New(context.Background(), jirix, gitutil.RootDirOpt(op.project.Path))
 		for _, b := range branches {
 			if err := scm.DeleteBranch(b); err != nil {
 				jirix.Logger.Warningf("not able to delete branch %s for project %s(%s)\n\n", b, op.project.Name, op.project.Path)
 			}
 		}
 	}
+	if op.project.LFS {
+		if err := gitutil.New(ctx, jirix, gitutil.RootDirOpt(op.project.Path)).LFSInstall(); err != nil {
+			return fmt.Errorf("git-lfs install failed for project %s(%s): %v", op.project.Name, op.project.Path, err)
+		}
+		if err := pullLFS(ctx, jirix, op.project); err != nil {
+			return err
+		}
+	}
+	return runPostCloneHook(jirix, op.project)
+}
+
+// pullLocalProjectsLFS pulls the git-lfs objects of the updated projects
+// which were already checked out, up to jirix.Jobs at once.  The projects
+// created by the update pulled theirs already.
+func pullLocalProjectsLFS(ctx context.Context, jirix *jiri.X, localProjects, projects Projects) error {
+	limit := make(chan struct{}, jirix.Jobs)
+	errs := make(chan error, len(projects))
+	var wg sync.WaitGroup
+	for key, project := range projects {
+		local, ok := localProjects[key]
+		if !ok || !project.LFS || local.LocalConfig.Ignore || local.LocalConfig.NoUpdate {
+			continue
+		}
+		wg.Add(1)
+		limit <- struct{}{}
+		go func(project Project) {
+			defer func() { <-limit }()
+			defer wg.Done()
+			if err := pullLFS(ctx, jirix, project); err != nil {
+				errs <- projectError{project, err}
+			}
+		}(project)
+	}
+	wg.Wait()
+	close(errs)
+	multiErr := make(MultiError, 0)
+	for err := range errs {
+		multiErr = append(multiErr, err)
+	}
+	if len(multiErr) != 0 {
+		return multiErr
+	}
+	return nil
+}
+
+// pullLFS pulls the git-lfs objects of the checked out revision of a project
+// using git-lfs, unless jirix.LFSSkip is set.
+func pullLFS(ctx context.Context, jirix *jiri.X, project Project) error {
+	if !project.LFS || jirix.LFSSkip {
+		return nil
+	}
+	if err := gitutil.New(ctx, jirix, gitutil.RootDirOpt(project.Path), gitutil.SSHCommandOpt(project.FetchVia)).LFSPull(); err != nil {
+		return fmt.Errorf("git-lfs pull failed for project %s(%s): %v", project.Name, project.Path, err)
+	}
 	return nil
 }
 
+// postCloneHookDoneFile is the name of the file, in the metadata directory of
+// a project, recording that its post-clone hook ran.
+const postCloneHookDoneFile = "clone-hook-done"
+
+// runPostCloneHook runs the post-clone hook of the project unless its
+// .jiri/clone-hook-done file records that it already ran, and writes that file
+// once it succeeds.  It is run by every operation keeping the project, so that
+// a hook which failed, or was added to an existing project, runs on the next
+// update.
+func runPostCloneHook(jirix *jiri.X, project Project) error {
+	if project.PostCloneHook == "" || project.LocalConfig.Ignore || project.LocalConfig.NoUpdate {
+		return nil
+	}
+	doneFile := filepath.Join(project.Path, jiri.ProjectMetaDir, postCloneHookDoneFile)
+	if _, err := os.Stat(doneFile); err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return fmtError(err)
+	}
+	jirix.Logger.Infof("running post-clone hook %s for project %q", project.PostCloneHook, project.Name)
+	var out bytes.Buffer
+	if err := jirix.NewSeq().Capture(&out, &out).Dir(project.Path).Last(filepath.Join(project.Path, project.PostCloneHook)); err != nil {
+		return fmt.Errorf("post-clone hook %s of project %s(%s) failed: %v\n%s", project.PostCloneHook, project.Name, project.Path, err, out.String())
+	}
+	return safeWriteFile(jirix, doneFile, nil)
+}
+
 func (op createOperation) String() string {
 	return fmt.Sprintf("create project %q in %q and advance it to %q", op.project.Name, op.destination, fmtRevision(op.project.Revision))
 }
@@ -2607,21 +5554,25 @@ type deleteOperation struct {
 	// gc determines whether the operation should be executed or
 	// whether it should only print a notification.
 	gc bool
+	// force makes the operation delete the project even if it contains
+	// local branches or unpushed commits.
+	force bool
 }
 
 func (op deleteOperation) Kind() string {
 	return "delete"
 }
 
-func (op deleteOperation) Run(jirix *jiri.X) error {
+func (op deleteOperation) Run(ctx context.Context, jirix *jiri.X) error {
 	if op.project.LocalConfig.Ignore {
 		jirix.Logger.Warningf("Project %s(%s) won't be deleted due to it's local-config\n\n", op.project.Name, op.source)
 		return nil
 	}
 	if op.gc {
-		// Never delete projects with non-master branches, uncommitted
-		// work, or untracked content.
-		g := git.NewGit(op.project.Path)
+		// Never delete projects with non-master branches, unpushed commits,
+		// uncommitted work, or untracked content.  Branches are not taken
+		// into account when gc is forced.
+		g := git.NewGit(context.Background(), op.project.Path)
 		branches, _, err := g.GetBranches()
 		if err != nil {
 			return fmt.Errorf("Cannot get branches for project %q: %v", op.Project().Name, err)
@@ -2641,7 +5592,33 @@ func (op deleteOperation) Run(jirix *jiri.X) error {
 				break
 			}
 		}
-		if extraBranches || uncommitted || untracked {
+		unpushed, err := unpushedBranches(jirix, op.project, op.state)
+		if err != nil {
+			return err
+		}
+		if len(unpushed) != 0 && !op.force {
+			gcForceCommand := jirix.Color.Yellow("jiri update -gc -gc-force")
+			msg := fmt.Sprintf("Project %q won't be deleted as it contains unpushed commits on branch(es) %s", op.project.Name, strings.Join(unpushed, ", "))
+			msg += fmt.Sprintf("\nIf you no longer need them, invoke '%s'\n\n", gcForceCommand)
+			jirix.Logger.Warningf("%s", msg)
+			return nil
+		}
+		if (op.project.FetchDepth != 0 || op.project.ShallowSince != "") && !op.force {
+			// Commits on top of a shallow history can't be recovered once the
+			// project is deleted, whether they are on a branch or not.
+			commits, err := gitutil.New(context.Background(), jirix, gitutil.RootDirOpt(op.project.Path)).UnpushedCommits()
+			if err != nil {
+				return fmt.Errorf("Cannot get unpushed commits for project %q: %v", op.project.Name, err)
+			}
+			if len(commits) != 0 {
+				gcForceCommand := jirix.Color.Yellow("jiri update -gc -gc-force")
+				msg := fmt.Sprintf("Shallow project %q won't be deleted as it contains %d commit(s) which are not on its remote and could not be recovered", op.project.Name, len(commits))
+				msg += fmt.Sprintf("\nIf you no longer need them, invoke '%s'\n\n", gcForceCommand)
+				jirix.Logger.Warningf("%s", msg)
+				return nil
+			}
+		}
+		if (extraBranches && !op.force) || uncommitted || untracked {
 			rmCommand := jirix.Color.Yellow("rm -rf %q", op.source)
 			unManageCommand := jirix.Color.Yellow("rm -rf %q", filepath.Join(op.source, jiri.ProjectMetaDir))
 			msg := fmt.Sprintf("Project %q won't be deleted as it might contain changes", op.project.Name)
@@ -2662,6 +5639,40 @@ func (op deleteOperation) Run(jirix *jiri.X) error {
 	return nil
 }
 
+// unpushedBranches returns the local branches of a project which contain
+// commits that are not on their tracking branch, or on the project's remote
+// branch for branches which do not track anything.
+func unpushedBranches(jirix *jiri.X, project Project, state ProjectState) ([]string, error) {
+	scm := gitutil.New(context.Background(), jirix, gitutil.RootDirOpt(project.Path))
+	remoteBranch := project.RemoteBranch
+	if remoteBranch == "" {
+		remoteBranch = "master"
+	}
+	g := git.NewGit(context.Background(), project.Path)
+	var unpushed []string
+	for _, branch := range state.Branches {
+		base := "remotes/" + project.GitRemoteName() + "/" + remoteBranch
+		if branch.Tracking != nil {
+			base = branch.Tracking.Name
+		}
+		// All the commits of a branch whose base is gone, e.g. because its
+		// remote branch was deleted, are taken as unpushed.
+		if _, err := g.CurrentRevisionForRef(base); err != nil {
+			jirix.Logger.Warningf("Branch %q of project %s(%s) is based on %q, which no longer exists, its commits are considered unpushed\n\n", branch.Name, project.Name, project.Path, base)
+			unpushed = append(unpushed, branch.Name)
+			continue
+		}
+		commits, err := scm.ExtraCommits(branch.Name, base)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot get unpushed commits of branch %q for project %q: %v", branch.Name, project.Name, err)
+		}
+		if len(commits) != 0 {
+			unpushed = append(unpushed, branch.Name)
+		}
+	}
+	return unpushed, nil
+}
+
 func (op deleteOperation) String() string {
 	return fmt.Sprintf("delete project %q from %q", op.project.Name, op.source)
 }
@@ -2684,17 +5695,43 @@ type moveOperation struct {
 	rebaseUntracked bool
 	rebaseAll       bool
 	snapshot        bool
+	// opts are the options of the update, of which the move uses
+	// MoveReclone, and the options of the clone when it applies.
+	opts UpdateUniverseOpts
 }
 
 func (op moveOperation) Kind() string {
 	return "move"
 }
 
-func (op moveOperation) Run(jirix *jiri.X) error {
+func (op moveOperation) Run(ctx context.Context, jirix *jiri.X) error {
 	if op.project.LocalConfig.Ignore {
 		jirix.Logger.Warningf("Project %s(%s) won't be moved or updated  due to it's local-config\n\n", op.project.Name, op.source)
 		return nil
 	}
+	if op.opts.MoveReclone && op.source != op.destination {
+		nested, err := containsNestedRepository(op.source)
+		if err != nil {
+			return err
+		}
+		sep := string(filepath.Separator)
+		overlap := strings.HasPrefix(op.destination, op.source+sep) || strings.HasPrefix(op.source, op.destination+sep)
+		if !nested && !overlap {
+			// The old directory is only deleted once the clone succeeded,
+			// so that a failed clone leaves the project where it was.
+			if err := (createOperation{op.commonOperation, op.opts}).Run(ctx, jirix); err != nil {
+				return err
+			}
+			jirix.Logger.Warningf("Project %s is cloned at %q, its local branches and changes in %q are discarded\n\n", op.project.Name, op.destination, op.source)
+			return fmtError(os.RemoveAll(op.source))
+		}
+		if nested {
+			jirix.Logger.Warningf("Project %s(%s) contains other repositories, it is moved instead of being cloned again\n\n", op.project.Name, op.source)
+		} else {
+			jirix.Logger.Warningf("Project %s(%s) is moved to %q, which is nested in it or the other way around, instead of being cloned again\n\n", op.project.Name, op.source, op.destination)
+		}
+	}
+	// Move the whole directory, which preserves local branches and changes.
 	// If it was nested project it might have been moved with its parent project
 	if op.source != op.destination {
 		path, perm := filepath.Dir(op.destination), os.FileMode(0755)
@@ -2708,7 +5745,32 @@ func (op moveOperation) Run(jirix *jiri.X) error {
 	if err := syncProjectMaster(jirix, op.project, op.state, op.rebaseTracked, op.rebaseUntracked, op.rebaseAll, op.snapshot); err != nil {
 		return err
 	}
-	return writeMetadata(jirix, op.project, op.project.Path)
+	if err := writeMetadata(jirix, op.project, op.project.Path); err != nil {
+		return err
+	}
+	return runPostCloneHook(jirix, op.project)
+}
+
+// containsNestedRepository returns true if there is a git repository under
+// dir, other than dir itself.
+func containsNestedRepository(dir string) (bool, error) {
+	errFound := errors.New("nested repository found")
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() || info.Name() != ".git" {
+			return nil
+		}
+		if filepath.Dir(path) != dir {
+			return errFound
+		}
+		return filepath.SkipDir
+	})
+	if err == errFound {
+		return true, nil
+	}
+	return false, fmtError(err)
 }
 
 func (op moveOperation) String() string {
@@ -2746,11 +5808,14 @@ func (op updateOperation) Kind() string {
 	return "update"
 }
 
-func (op updateOperation) Run(jirix *jiri.X) error {
+func (op updateOperation) Run(ctx context.Context, jirix *jiri.X) error {
 	if err := syncProjectMaster(jirix, op.project, op.state, op.rebaseTracked, op.rebaseUntracked, op.rebaseAll, op.snapshot); err != nil {
 		return err
 	}
-	return writeMetadata(jirix, op.project, op.project.Path)
+	if err := writeMetadata(jirix, op.project, op.project.Path); err != nil {
+		return err
+	}
+	return runPostCloneHook(jirix, op.project)
 }
 
 func (op updateOperation) String() string {
@@ -2771,8 +5836,11 @@ func (op nullOperation) Kind() string {
 	return "null"
 }
 
-func (op nullOperation) Run(jirix *jiri.X) error {
-	return writeMetadata(jirix, op.project, op.project.Path)
+func (op nullOperation) Run(ctx context.Context, jirix *jiri.X) error {
+	if err := writeMetadata(jirix, op.project, op.project.Path); err != nil {
+		return err
+	}
+	return runPostCloneHook(jirix, op.project)
 }
 
 func (op nullOperation) String() string {
@@ -2837,7 +5905,7 @@ func (ops operations) Swap(i, j int) {
 // system and manifest file respectively) and outputs a collection of
 // operations that describe the actions needed to update the target
 // projects.
-func computeOperations(localProjects, remoteProjects Projects, states map[ProjectKey]*ProjectState, gc, rebaseTracked, rebaseUntracked, rebaseAll, snapshot bool) operations {
+func computeOperations(localProjects, remoteProjects Projects, states map[ProjectKey]*ProjectState, opts UpdateUniverseOpts, snapshot bool) operations {
 	result := operations{}
 	allProjects := map[ProjectKey]bool{}
 	for _, p := range localProjects {
@@ -2858,31 +5926,32 @@ func computeOperations(localProjects, remoteProjects Projects, states map[Projec
 		if s, ok := states[key]; ok {
 			state = s
 		}
-		result = append(result, computeOp(local, remote, state, gc, rebaseTracked, rebaseUntracked, rebaseAll, snapshot))
+		result = append(result, computeOp(local, remote, state, opts, snapshot))
 	}
 	sort.Sort(result)
 	return result
 }
 
-func computeOp(local, remote *Project, state *ProjectState, gc, rebaseTracked, rebaseUntracked, rebaseAll, snapshot bool) operation {
+func computeOp(local, remote *Project, state *ProjectState, opts UpdateUniverseOpts, snapshot bool) operation {
+	rebaseTracked, rebaseUntracked, rebaseAll := opts.RebaseTracked, opts.RebaseUntracked, opts.RebaseAll
 	switch {
 	case local == nil && remote != nil:
 		return createOperation{commonOperation{
 			destination: remote.Path,
 			project:     *remote,
 			source:      "",
-		}}
+		}, opts}
 	case local != nil && remote == nil:
 		return deleteOperation{commonOperation{
 			destination: "",
 			project:     *local,
 			source:      local.Path,
-		}, gc}
+			state:       *state,
+		}, opts.GC, opts.GCForce}
 	case local != nil && remote != nil:
 		remote.LocalConfig = local.LocalConfig
 		localBranchesNeedUpdating := false
 		if !snapshot {
-			cb := state.CurrentBranch
 			if rebaseAll {
 				for _, branch := range state.Branches {
 					if branch.Tracking != nil {
@@ -2896,7 +5965,7 @@ func computeOp(local, remote *Project, state *ProjectState, gc, rebaseTracked, r
 						break
 					}
 				}
-			} else if cb.Name != "" && cb.Tracking != nil && cb.Revision != cb.Tracking.Revision {
+			} else if state.CurrentBranch.Tracking != nil && !state.IsUpToDate() {
 				localBranchesNeedUpdating = true
 			}
 		}
@@ -2909,7 +5978,7 @@ func computeOp(local, remote *Project, state *ProjectState, gc, rebaseTracked, r
 				project:     *remote,
 				source:      local.Path,
 				state:       *state,
-			}, rebaseTracked, rebaseUntracked, rebaseAll, snapshot}
+			}, rebaseTracked, rebaseUntracked, rebaseAll, snapshot, opts}
 		case snapshot && local.Revision != remote.Revision:
 			return updateOperation{commonOperation{
 				destination: remote.Path,
@@ -2917,7 +5986,7 @@ func computeOp(local, remote *Project, state *ProjectState, gc, rebaseTracked, r
 				source:      local.Path,
 				state:       *state,
 			}, rebaseTracked, rebaseUntracked, rebaseAll, snapshot}
-		case localBranchesNeedUpdating || (state.CurrentBranch.Name == "" && local.Revision != remote.Revision):
+		case localBranchesNeedUpdating || (state.IsDetached() && local.Revision != remote.Revision):
 			return updateOperation{commonOperation{
 				destination: remote.Path,
 				project:     *remote,
@@ -6,23 +6,29 @@ package project_test
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"reflect"
 	"sort"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"fuchsia.googlesource.com/jiri"
 	"fuchsia.googlesource.com/jiri/git"
 	"fuchsia.googlesource.com/jiri/gitutil"
 	"fuchsia.googlesource.com/jiri/jiritest"
+	"fuchsia.googlesource.com/jiri/log"
 	"fuchsia.googlesource.com/jiri/project"
+	"fuchsia.googlesource.com/jiri/version"
 )
 
 func dirExists(dirname string) error {
@@ -62,7 +68,7 @@ func checkReadme(t *testing.T, jirix *jiri.X, p project.Project, message string)
 }
 
 func checkJiriRevFiles(t *testing.T, jirix *jiri.X, p project.Project) {
-	g := git.NewGit(p.Path)
+	g := git.NewGit(context.Background(), p.Path)
 
 	file := filepath.Join(p.Path, ".git", "JIRI_HEAD")
 	data, err := ioutil.ReadFile(file)
@@ -128,7 +134,7 @@ func commitFile(t *testing.T, jirix *jiri.X, dir, file, msg string) {
 	if err := os.Chdir(dir); err != nil {
 		t.Fatal(err)
 	}
-	if err := gitutil.New(jirix, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com")).CommitFile(file, msg); err != nil {
+	if err := gitutil.New(context.Background(), jirix, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com")).CommitFile(file, msg); err != nil {
 		t.Fatal(err)
 	}
 }
@@ -182,7 +188,7 @@ func TestLocalProjects(t *testing.T) {
 
 		// Initialize empty git repository.  The commit is necessary, otherwise
 		// "git rev-parse master" fails.
-		git := gitutil.New(jirix, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"), gitutil.RootDirOpt(path))
+		git := gitutil.New(context.Background(), jirix, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"), gitutil.RootDirOpt(path))
 		if err := git.Init(path); err != nil {
 			t.Fatal(err)
 		}
@@ -242,6 +248,79 @@ func TestLocalProjects(t *testing.T) {
 		t.Fatalf("LocalProjects(%v) failed: %v", project.FastScan, err)
 	}
 	checkProjectsMatchPaths(t, foundProjects, projectPaths[1:])
+
+	// Check that a dangling latest snapshot link makes LocalProjects fall back
+	// to a full scan, even if FastScan is specified.
+	if err := os.Remove(jirix.UpdateHistoryLatestLink()); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(jirix.UpdateHistoryDir(), "missing"), jirix.UpdateHistoryLatestLink()); err != nil {
+		t.Fatal(err)
+	}
+	foundProjects, err = project.LocalProjects(jirix, project.FastScan)
+	if err != nil {
+		t.Fatalf("LocalProjects(%v) failed: %v", project.FastScan, err)
+	}
+	checkProjectsMatchPaths(t, foundProjects, projectPaths[1:])
+}
+
+// TestLocalProjectsJiriIgnore checks that full scans skip the directories
+// matched by the .jiriignore file of the root.
+func TestLocalProjectsJiriIgnore(t *testing.T) {
+	jirix, cleanup := jiritest.NewX(t)
+	defer cleanup()
+
+	projectPaths := []string{}
+	for _, rel := range []string{"src", "vendor/src"} {
+		path := filepath.Join(jirix.Root, rel)
+		if err := os.MkdirAll(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+		git := gitutil.New(context.Background(), jirix, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"), gitutil.RootDirOpt(path))
+		if err := git.Init(path); err != nil {
+			t.Fatal(err)
+		}
+		if err := git.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		p := project.Project{
+			Path: path,
+			Name: strings.Replace(rel, "/", "-", -1),
+		}
+		if err := project.InternalWriteMetadata(jirix, p, path); err != nil {
+			t.Fatal(err)
+		}
+		projectPaths = append(projectPaths, path)
+	}
+
+	for _, test := range []struct {
+		ignore string
+		want   []string
+	}{
+		{"", projectPaths},
+		{"# Vendored copies.\nvendor\n", projectPaths[:1]},
+		{"/vendor/\n", projectPaths[:1]},
+		{"vendor/*\n", projectPaths[:1]},
+		{"**/src\n!/src\n", projectPaths[:1]},
+		{"/src\n", projectPaths[1:]},
+		{"vendor/src\n!vendor/src\n", projectPaths},
+	} {
+		if err := ioutil.WriteFile(jirix.JiriIgnoreFile(), []byte(test.ignore), 0644); err != nil {
+			t.Fatal(err)
+		}
+		foundProjects, err := project.LocalProjects(jirix, project.FullScan)
+		if err != nil {
+			t.Fatalf("LocalProjects with .jiriignore %q failed: %v", test.ignore, err)
+		}
+		checkProjectsMatchPaths(t, foundProjects, test.want)
+	}
+
+	if err := ioutil.WriteFile(jirix.JiriIgnoreFile(), []byte("[\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := project.LocalProjects(jirix, project.FullScan); err == nil {
+		t.Errorf("LocalProjects with an invalid .jiriignore should have failed")
+	}
 }
 
 // setupUniverse creates a fake jiri root with 3 remote projects.  Each project
@@ -271,7 +350,7 @@ func setupUniverse(t *testing.T) ([]project.Project, *jiritest.FakeJiriRoot, fun
 		}
 		localProjects = append(localProjects, p)
 	}
-	localProjects[2].HistoryDepth = 1
+	localProjects[2].FetchDepth = 1
 	localProjects[3].Path = filepath.Join(localProjects[2].Path, "path-3")
 	localProjects[4].Path = filepath.Join(localProjects[3].Path, "path-4")
 	localProjects[5].Path = filepath.Join(localProjects[2].Path, "path-5")
@@ -294,6 +373,133 @@ func setupUniverse(t *testing.T) ([]project.Project, *jiritest.FakeJiriRoot, fun
 	return localProjects, fake, cleanup
 }
 
+// TestIsJiriProject checks that only git repositories with jiri metadata are
+// jiri projects.
+func TestIsJiriProject(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	unmanaged := filepath.Join(fake.X.Root, "unmanaged")
+	if err := gitutil.New(context.Background(), fake.X).Init(unmanaged); err != nil {
+		t.Fatal(err)
+	}
+	metadataOnly := filepath.Join(fake.X.Root, "metadata-only")
+	if err := os.MkdirAll(filepath.Join(metadataOnly, jiri.ProjectMetaDir), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(metadataOnly, jiri.ProjectMetaDir, jiri.ProjectMetaFile), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Worktrees and submodules have a .git file.
+	gitFile := filepath.Join(fake.X.Root, "git-file")
+	if err := os.MkdirAll(filepath.Join(gitFile, jiri.ProjectMetaDir), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(gitFile, ".git"), []byte("gitdir: "+filepath.Join(localProjects[1].Path, ".git")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(gitFile, jiri.ProjectMetaDir, jiri.ProjectMetaFile), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{localProjects[1].Path, true},
+		{localProjects[3].Path, true},
+		{gitFile, true},
+		{unmanaged, false},
+		{metadataOnly, false},
+		{filepath.Join(fake.X.Root, "missing"), false},
+	}
+	for _, test := range tests {
+		got, err := project.IsJiriProject(test.path)
+		if err != nil {
+			t.Errorf("IsJiriProject(%q) failed: %v", test.path, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("IsJiriProject(%q): got %v, want %v", test.path, got, test.want)
+		}
+	}
+}
+
+// TestFindProjectForPath checks that the innermost project containing a path
+// owns it.
+func TestFindProjectForPath(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path string
+		want project.Project
+	}{
+		{localProjects[1].Path, localProjects[1]},
+		{filepath.Join(localProjects[1].Path, "README"), localProjects[1]},
+		{filepath.Join(localProjects[2].Path, "src", "missing.go"), localProjects[2]},
+		{filepath.Join(localProjects[3].Path, "README"), localProjects[3]},
+		{filepath.Join(localProjects[4].Path, "README"), localProjects[4]},
+		// A sibling path sharing a prefix with a project is not in it.
+		{localProjects[3].Path + "0", localProjects[2]},
+	}
+	for _, test := range tests {
+		got, err := project.FindProjectForPath(fake.X, test.path)
+		if err != nil {
+			t.Errorf("FindProjectForPath(%q) failed: %v", test.path, err)
+			continue
+		}
+		if got.Name != test.want.Name {
+			t.Errorf("FindProjectForPath(%q): got %s, want %s", test.path, got.Name, test.want.Name)
+		}
+	}
+
+	// Relative paths are relative to the current directory.
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+	if err := os.Chdir(localProjects[5].Path); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := project.FindProjectForPath(fake.X, "README"); err != nil {
+		t.Error(err)
+	} else if got.Name != localProjects[5].Name {
+		t.Errorf("got %s, want %s", got.Name, localProjects[5].Name)
+	}
+
+	if _, err := project.FindProjectForPath(fake.X, filepath.Join(fake.X.Root, "not-a-project", "file")); err == nil {
+		t.Error("expected error for a path outside of any project")
+	}
+
+	// Paths reached through a symlink to the root are in the projects.
+	linkDir, err := ioutil.TempDir("", "link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(linkDir)
+	link := filepath.Join(linkDir, "root")
+	if err := os.Symlink(fake.X.Root, link); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range localProjects[1:3] {
+		rel, err := filepath.Rel(fake.X.Root, p.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(link, rel, "src", "missing.go")
+		if got, err := project.FindProjectForPath(fake.X, path); err != nil {
+			t.Errorf("FindProjectForPath(%q) failed: %v", path, err)
+		} else if got.Name != p.Name {
+			t.Errorf("FindProjectForPath(%q): got %s, want %s", path, got.Name, p.Name)
+		}
+	}
+}
+
 // TestUpdateUniverseSimple tests that UpdateUniverse will pull remote projects
 // locally, and that jiri metadata is ignored in the repos.
 func TestUpdateUniverseSimple(t *testing.T) {
@@ -309,7 +515,7 @@ func TestUpdateUniverseSimple(t *testing.T) {
 		if err := dirExists(p.Path); err != nil {
 			t.Fatalf("expected project to exist at path %q but none found", p.Path)
 		}
-		if branches, _, err := git.NewGit(p.Path).GetBranches(); err != nil {
+		if branches, _, err := git.NewGit(context.Background(), p.Path).GetBranches(); err != nil {
 			t.Fatal(err)
 		} else if len(branches) != 0 {
 			t.Fatalf("expected project %s(%s) to contain no branches but it contains %s", p.Name, p.Path, branches)
@@ -320,1328 +526,4937 @@ func TestUpdateUniverseSimple(t *testing.T) {
 	}
 }
 
-// TestUpdateUniverseWithCache checks that UpdateUniverse can clone and pull
-// from a cache.
-func testWithCache(t *testing.T, shared bool) {
-	localProjects, fake, cleanup := setupUniverse(t)
+// TestUpdateUniverseWithFetchDepth tests that only FetchDepth commits are
+// fetched for projects with a FetchDepth.
+func TestUpdateUniverseWithFetchDepth(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
 	defer cleanup()
-
-	// Create cache directory
-	cacheDir, err := ioutil.TempDir("", "cache")
-	if err != nil {
-		t.Fatalf("TempDir() failed: %v", err)
+	if err := fake.CreateRemoteProject("p"); err != nil {
+		t.Fatal(err)
 	}
-	if err := os.MkdirAll(cacheDir, os.FileMode(0700)); err != nil {
+	for i := 0; i < 10; i++ {
+		writeFile(t, fake.X, fake.Projects["p"], "file", fmt.Sprintf("commit %d", i))
+	}
+	p := project.Project{
+		Name: "p",
+		Path: filepath.Join(fake.X.Root, "p"),
+		// Git ignores --depth for local paths, use a file:// URL instead.
+		Remote:     "file://" + fake.Projects["p"],
+		FetchDepth: 5,
+	}
+	if err := fake.AddProject(p); err != nil {
 		t.Fatal(err)
 	}
-	defer func() {
-		if err := os.RemoveAll(cacheDir); err != nil {
-			t.Fatalf("RemoveAll(%q) failed: %v", cacheDir, err)
+	checkCommits := func() {
+		scm := gitutil.New(context.Background(), fake.X, gitutil.RootDirOpt(p.Path))
+		if got, err := scm.CountCommits("HEAD", ""); err != nil {
+			t.Fatal(err)
+		} else if want := 5; got != want {
+			t.Fatalf("project %q has %d commits, want %d", p.Name, got, want)
 		}
-	}()
-	fake.X.Cache = cacheDir
-	fake.X.Shared = shared
-
+	}
 	if err := fake.UpdateUniverse(false); err != nil {
 		t.Fatal(err)
 	}
-	for _, p := range localProjects {
-		// Check that local clone was referenced from cache
-		err := fileExists(p.Path + "/.git/objects/info/alternates")
-		if shared || p.HistoryDepth == 0 {
-			if err != nil {
-				t.Fatalf("expected %v to exist, but not found", p.Path+"/.git/objects/info/alternates")
-			}
-		} else if err == nil {
-			t.Fatalf("expected %v to not exist, but found", p.Path+"/.git/objects/info/alternates")
-		}
-		checkReadme(t, fake.X, p, "initial readme")
-		checkJiriRevFiles(t, fake.X, p)
-	}
-
-	// Commit to master branch of a project 1.
-	writeReadme(t, fake.X, fake.Projects[localProjects[1].Name], "master commit")
+	checkCommits()
+	writeFile(t, fake.X, fake.Projects["p"], "file", "new commit")
 	if err := fake.UpdateUniverse(false); err != nil {
 		t.Fatal(err)
 	}
-	checkReadme(t, fake.X, localProjects[1], "master commit")
-	checkJiriRevFiles(t, fake.X, localProjects[1])
+	checkCommits()
 
-	// Check that cache was updated
-	cacheDirPath, err := localProjects[1].CacheDirPath(fake.X)
+	// Check that the deprecated historydepth attribute is still supported.
+	m, err := project.ManifestFromBytes([]byte(`<manifest><projects><project name="p" historydepth="5"/></projects></manifest>`))
 	if err != nil {
 		t.Fatal(err)
 	}
-	gCache := git.NewGit(cacheDirPath)
-	cacheRev, err := gCache.CurrentRevision()
+	if got, want := m.Projects[0].FetchDepth, 5; got != want {
+		t.Errorf("got FetchDepth %d, want %d", got, want)
+	}
+}
+
+// TestUpdateUniverseInEphemeralRoot tests that the manifest of a root can be
+// checked out in an ephemeral root, without touching the original one.
+func TestUpdateUniverseInEphemeralRoot(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+
+	dir, err := ioutil.TempDir("", "jiri-ephemeral")
 	if err != nil {
 		t.Fatal(err)
 	}
-	gl := git.NewGit(localProjects[1].Path)
-	localRev, err := gl.CurrentRevision()
+	defer os.RemoveAll(dir)
+	jirix, err := project.NewEphemeralRoot(fake.X, dir)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if cacheRev != localRev {
-		t.Fatalf("Cache revision(%v) not equal to local revision(%v)", cacheRev, localRev)
+	if jirix.Root != dir {
+		t.Errorf("got root %q, want %q", jirix.Root, dir)
+	}
+	if err := project.UpdateUniverse(context.Background(), jirix, project.UpdateUniverseOpts{RunHookTimeout: project.DefaultHookTimeout}); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range localProjects {
+		rel, err := filepath.Rel(fake.X.Root, p.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Path = filepath.Join(dir, rel)
+		checkReadme(t, jirix, p, "initial readme")
+		if err := dirExists(filepath.Join(fake.X.Root, rel)); err == nil {
+			t.Errorf("project %q should not be checked out in the original root", p.Name)
+		}
 	}
 
+	// The ephemeral root must be a new directory.
+	if _, err := project.NewEphemeralRoot(fake.X, dir); err == nil {
+		t.Error("NewEphemeralRoot should fail with a non-empty directory")
+	}
 }
 
-// TestUpdateUniverseWithCache checks that UpdateUniverse can clone and pull
-// from a cache.
-func TestUpdateUniverseWithCache(t *testing.T) {
-	testWithCache(t, false)
-}
-
-// TestUpdateUniverseWithiSharedCache checks that UpdateUniverse can clone and pull
-// from a cache when it is of type "shared"
-func TestUpdateUniverseWithSharedCache(t *testing.T) {
-	testWithCache(t, true)
-}
-
-func TestProjectUpdateWhenNoUpdate(t *testing.T) {
-	localProjects, fake, cleanup := setupUniverse(t)
+// TestUpdateUniverseWithLazyProject tests that lazy projects only have their
+// metadata until realized, and that their metadata follows manifest changes.
+func TestUpdateUniverseWithLazyProject(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
 	defer cleanup()
-	if err := fake.UpdateUniverse(false); err != nil {
+	if err := fake.CreateRemoteProject("lazy"); err != nil {
+		t.Fatal(err)
+	}
+	writeReadme(t, fake.X, fake.Projects["lazy"], "initial readme")
+	p := project.Project{
+		Name:   "lazy",
+		Path:   filepath.Join(fake.X.Root, "lazy"),
+		Remote: fake.Projects["lazy"],
+		Lazy:   true,
+	}
+	if err := fake.AddProject(p); err != nil {
+		t.Fatal(err)
+	}
+	checkLazy := func(p project.Project) {
+		metadataFile := filepath.Join(p.Path, jiri.ProjectMetaDir, jiri.ProjectMetaFile)
+		if _, err := os.Stat(metadataFile); err != nil {
+			t.Fatalf("lazy project has no metadata: %v", err)
+		}
+		for _, file := range []string{".git", "README"} {
+			if _, err := os.Stat(filepath.Join(p.Path, file)); !os.IsNotExist(err) {
+				t.Fatalf("lazy project should not have %s: %v", file, err)
+			}
+		}
+		projects, err := project.LocalProjects(fake.X, project.FullScan)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := projects[p.Key()]; ok {
+			t.Fatalf("lazy project should not be a local project")
+		}
+	}
+	if err := fake.UpdateUniverse(true); err != nil {
 		t.Fatal(err)
 	}
+	checkLazy(p)
 
-	lc := project.LocalConfig{NoUpdate: true}
-	project.WriteLocalConfig(fake.X, localProjects[1], lc)
-	// Commit to master branch of a project 1.
-	writeReadme(t, fake.X, fake.Projects[localProjects[1].Name], "master commit")
-	gitRemote := git.NewGit(fake.Projects[localProjects[1].Name])
-	remoteRev, _ := gitRemote.CurrentRevision()
-	if err := fake.UpdateUniverse(false); err != nil {
+	// Moving the lazy project moves its metadata.
+	editLazy := func(edit func(m *project.Manifest, i int)) {
+		m, err := fake.ReadRemoteManifest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range m.Projects {
+			if m.Projects[i].Name == p.Name {
+				edit(m, i)
+				break
+			}
+		}
+		if err := fake.WriteRemoteManifest(m); err != nil {
+			t.Fatal(err)
+		}
+		if err := fake.UpdateUniverse(true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldPath := p.Path
+	editLazy(func(m *project.Manifest, i int) { m.Projects[i].Path = "moved" })
+	p.Path = filepath.Join(fake.X.Root, "moved")
+	checkLazy(p)
+	if err := dirExists(oldPath); err == nil {
+		t.Errorf("old path %s of lazy project should have been removed", oldPath)
+	}
+
+	// A realized lazy project is updated like other projects.
+	if err := project.RealizeProject(fake.X, p.Path); err != nil {
+		t.Fatal(err)
+	}
+	checkReadme(t, fake.X, p, "initial readme")
+	if err := project.RealizeProject(fake.X, p.Path); err == nil {
+		t.Error("realizing a checked out project should fail")
+	}
+	writeReadme(t, fake.X, fake.Projects["lazy"], "new readme")
+	if err := fake.UpdateUniverse(true); err != nil {
 		t.Fatal(err)
 	}
+	checkReadme(t, fake.X, p, "new readme")
 
-	gitLocal := git.NewGit(localProjects[1].Path)
-	localRev, _ := gitLocal.CurrentRevision()
+	// Renaming the project garbage collects the realized one, and registers the
+	// new one.
+	editLazy(func(m *project.Manifest, i int) {
+		m.Projects[i].Name = "lazy2"
+		m.Projects[i].Path = "lazy"
+	})
+	if err := dirExists(p.Path); err == nil {
+		t.Errorf("realized lazy project %s should have been garbage collected", p.Path)
+	}
+	p.Name, p.Path = "lazy2", oldPath
+	checkLazy(p)
 
-	if remoteRev == localRev {
-		t.Fatal("local project should not be updated")
+	// Removing an unrealized lazy project from the manifest removes it.
+	editLazy(func(m *project.Manifest, i int) {
+		m.Projects = append(m.Projects[:i], m.Projects[i+1:]...)
+	})
+	if err := dirExists(p.Path); err == nil {
+		t.Errorf("lazy project %s removed from the manifest should have been removed", p.Path)
 	}
 }
 
-func TestProjectUpdateWhenIgnore(t *testing.T) {
-	localProjects, fake, cleanup := setupUniverse(t)
+// TestRealizeProjectNested checks that realizing a lazy project keeps the
+// projects nested in its directory.
+func TestRealizeProjectNested(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
 	defer cleanup()
+	lazy := project.Project{Name: "lazy", Path: filepath.Join(fake.X.Root, "lazy"), Lazy: true}
+	nested := project.Project{Name: "nested", Path: filepath.Join(lazy.Path, "nested")}
+	nestedLazy := project.Project{Name: "nested-lazy", Path: filepath.Join(lazy.Path, "nested-lazy"), Lazy: true}
+	for _, p := range []*project.Project{&lazy, &nested, &nestedLazy} {
+		if err := fake.CreateRemoteProject(p.Name); err != nil {
+			t.Fatal(err)
+		}
+		writeReadme(t, fake.X, fake.Projects[p.Name], p.Name+" readme")
+		p.Remote = fake.Projects[p.Name]
+		if err := fake.AddProject(*p); err != nil {
+			t.Fatal(err)
+		}
+	}
 	if err := fake.UpdateUniverse(false); err != nil {
 		t.Fatal(err)
 	}
+	checkReadme(t, fake.X, nested, "nested readme")
 
-	lc := project.LocalConfig{Ignore: true}
-	project.WriteLocalConfig(fake.X, localProjects[1], lc)
-	// Commit to master branch of a project 1.
-	writeReadme(t, fake.X, fake.Projects[localProjects[1].Name], "master commit")
-	gitRemote := git.NewGit(fake.Projects[localProjects[1].Name])
-	remoteRev, _ := gitRemote.CurrentRevision()
-	if err := fake.UpdateUniverse(false); err != nil {
+	if err := project.RealizeProject(fake.X, lazy.Path); err != nil {
 		t.Fatal(err)
 	}
-
-	gitLocal := git.NewGit(localProjects[1].Path)
-	localRev, _ := gitLocal.CurrentRevision()
-
-	if remoteRev == localRev {
-		t.Fatal("local project should not be updated")
+	checkReadme(t, fake.X, lazy, "lazy readme")
+	checkReadme(t, fake.X, nested, "nested readme")
+	if err := project.RealizeProject(fake.X, nestedLazy.Path); err != nil {
+		t.Fatal(err)
+	}
+	checkReadme(t, fake.X, nestedLazy, "nested-lazy readme")
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
 	}
 }
 
-func TestLocalProjectWithConfig(t *testing.T) {
+// TestWriteProjectEnvFile tests that the project env file lists the paths of
+// the local projects after update.
+func TestWriteProjectEnvFile(t *testing.T) {
 	localProjects, fake, cleanup := setupUniverse(t)
 	defer cleanup()
-	if err := fake.UpdateUniverse(false); err != nil {
-		t.Fatal(err)
-	}
-	project.WriteUpdateHistorySnapshot(fake.X, "", false)
-
-	lc := project.LocalConfig{Ignore: true}
-	project.WriteLocalConfig(fake.X, localProjects[1], lc)
-	scanModes := []project.ScanMode{project.FullScan, project.FastScan}
-	for _, scanMode := range scanModes {
-		newLocalProjects, err := project.LocalProjects(fake.X, scanMode)
+	envFile := filepath.Join(fake.X.Root, "jiri.env")
+	checkEnvFile := func(projects []project.Project) {
+		if err := fake.UpdateUniverse(true); err != nil {
+			t.Fatal(err)
+		}
+		if err := project.WriteUpdateHistorySnapshot(fake.X, "", false); err != nil {
+			t.Fatal(err)
+		}
+		if err := project.WriteProjectEnvFile(fake.X, envFile); err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(envFile)
 		if err != nil {
 			t.Fatal(err)
 		}
-		for k, p := range newLocalProjects {
-			expectedIgnore := k == localProjects[1].Key()
-			if p.LocalConfig.Ignore != expectedIgnore {
-				t.Errorf("local config ignore: got %t, want %t", p.LocalConfig.Ignore, expectedIgnore)
-			}
-
-			if p.LocalConfig.NoUpdate != false {
-				t.Errorf("local config no-update: got %t, want %t", p.LocalConfig.NoUpdate, false)
-			}
-
-			if p.LocalConfig.NoRebase != false {
-				t.Errorf("local config no-rebase: got %t, want %t", p.LocalConfig.NoUpdate, false)
+		lines := []string{}
+		for _, line := range strings.Split(string(data), "\n") {
+			if line != "" && !strings.HasPrefix(line, "#") {
+				lines = append(lines, line)
 			}
 		}
+		want := []string{"JIRI_PROJECT_MANIFEST=" + filepath.Join(fake.X.Root, "manifest")}
+		for _, p := range projects {
+			want = append(want, fmt.Sprintf("JIRI_PROJECT_PROJECT_%s=%s", strings.TrimPrefix(p.Name, "project-"), p.Path))
+		}
+		sort.Strings(want)
+		if !reflect.DeepEqual(lines, want) {
+			t.Errorf("got env file\n%s\nwant\n%s", strings.Join(lines, "\n"), strings.Join(want, "\n"))
+		}
 	}
-}
+	checkEnvFile(localProjects)
 
-func TestProjectUpdateWhenNoRebase(t *testing.T) {
-	localProjects, fake, cleanup := setupUniverse(t)
-	defer cleanup()
-	if err := fake.UpdateUniverse(false); err != nil {
+	// Moves and deletions are reflected in the env file.
+	m, err := fake.ReadRemoteManifest()
+	if err != nil {
 		t.Fatal(err)
 	}
-
-	lc := project.LocalConfig{NoRebase: true}
-	project.WriteLocalConfig(fake.X, localProjects[1], lc)
-	// Commit to master branch of a project 1.
-	writeReadme(t, fake.X, fake.Projects[localProjects[1].Name], "master commit")
-	gitRemote := git.NewGit(fake.Projects[localProjects[1].Name])
-	remoteRev, _ := gitRemote.CurrentRevision()
-	if err := fake.UpdateUniverse(false); err != nil {
-		t.Fatal(err)
+	for i := 0; i < len(m.Projects); i++ {
+		switch m.Projects[i].Name {
+		case localProjects[1].Name:
+			m.Projects[i].Path = "moved"
+			localProjects[1].Path = filepath.Join(fake.X.Root, "moved")
+		case localProjects[6].Name:
+			m.Projects = append(m.Projects[:i], m.Projects[i+1:]...)
+			i--
+		}
 	}
-
-	gitLocal := git.NewGit(localProjects[1].Path)
-	localRev, _ := gitLocal.CurrentRevision()
-
-	if remoteRev != localRev {
-		t.Fatal("local project should be updated")
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
 	}
-}
-
-func TestBranchUpdateWhenNoRebase(t *testing.T) {
-	localProjects, fake, cleanup := setupUniverse(t)
-	defer cleanup()
+	checkEnvFile(localProjects[:6])
 
-	if err := fake.UpdateUniverse(false); err != nil {
+	// Paths which would need quoting are refused, and the file is left as it
+	// was.
+	m, err = fake.ReadRemoteManifest()
+	if err != nil {
 		t.Fatal(err)
 	}
-	gitLocal := gitutil.New(fake.X, gitutil.RootDirOpt(localProjects[1].Path))
-	gitLocal.CheckoutBranch("master")
-
-	lc := project.LocalConfig{NoRebase: true}
-	project.WriteLocalConfig(fake.X, localProjects[1], lc)
-	// Commit to master branch of a project 1.
-	writeReadme(t, fake.X, fake.Projects[localProjects[1].Name], "master commit")
-	gitRemote := git.NewGit(fake.Projects[localProjects[1].Name])
-	remoteRev, _ := gitRemote.CurrentRevision()
-	if err := fake.UpdateUniverse(false); err != nil {
+	for i := range m.Projects {
+		if m.Projects[i].Name == localProjects[1].Name {
+			m.Projects[i].Path = "with space"
+		}
+	}
+	if err := fake.WriteRemoteManifest(m); err != nil {
 		t.Fatal(err)
 	}
-
-	gl := git.NewGit(localProjects[1].Path)
-	localRev, _ := gl.CurrentRevision()
-
-	if remoteRev == localRev {
-		t.Fatal("local branch master should not be updated")
+	if err := fake.UpdateUniverse(true); err != nil {
+		t.Fatal(err)
 	}
-}
-
-// TestHookLoadSimple tests that manifest is loaded correctly
-// with correct project path in hook
-func TestHookLoadSimple(t *testing.T) {
-	p, fake, cleanup := setupUniverse(t)
-	defer cleanup()
-	err := fake.AddHook(project.Hook{Name: "hook1",
-		Action:      "action.sh",
-		ProjectName: p[0].Name})
-
+	want, err := ioutil.ReadFile(envFile)
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = fake.UpdateUniverse(false)
-	if err == nil {
-		t.Fatal("run hook should throw error as there is no action.sh script")
+	if err := project.WriteProjectEnvFile(fake.X, envFile); err == nil || !strings.Contains(err.Error(), "with space") {
+		t.Errorf("got error %v, want an error for the path with a space", err)
 	}
-	if !strings.Contains(err.Error(), "no such file or directory") || !strings.Contains(err.Error(), "action.sh") {
+	if got, err := ioutil.ReadFile(envFile); err != nil {
 		t.Fatal(err)
+	} else if !bytes.Equal(got, want) {
+		t.Errorf("env file changed to\n%s", got)
 	}
 }
 
-// TestHookLoadError tests that manifest load
-// throws error for invalid hook
-func TestHookLoadError(t *testing.T) {
-	_, fake, cleanup := setupUniverse(t)
+// TestUpdateUniverseWithCloneFilter tests that projects with a CloneFilter are
+// partial clones, and that invalid filters are rejected.
+func TestUpdateUniverseWithCloneFilter(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
 	defer cleanup()
-	err := fake.AddHook(project.Hook{Name: "hook1",
-		Action:      "action",
-		ProjectName: "non-existant"})
-
-	if err != nil {
+	if err := fake.CreateRemoteProject("p"); err != nil {
 		t.Fatal(err)
 	}
-	err = fake.UpdateUniverse(false)
-	if err == nil {
-		t.Fatal("Update universe should throw error for the hook")
+	writeReadme(t, fake.X, fake.Projects["p"], "initial readme")
+	if err := gitutil.New(context.Background(), fake.X, gitutil.RootDirOpt(fake.Projects["p"])).Config("uploadpack.allowfilter", "true"); err != nil {
+		t.Fatal(err)
 	}
-	if !strings.Contains(err.Error(), "invalid hook") {
+	p := project.Project{
+		Name: "p",
+		Path: filepath.Join(fake.X.Root, "p"),
+		// Git ignores --filter for local paths, use a file:// URL instead.
+		Remote:      "file://" + fake.Projects["p"],
+		CloneFilter: "blob:none",
+	}
+	if err := fake.AddProject(p); err != nil {
 		t.Fatal(err)
 	}
-}
-
-// TestJiriExcludeForRepoUpdate tests that .git/info/exclude contains
-// /.jiri/ after every update
-func TestJiriExcludeForRepoUpdate(t *testing.T) {
-	localProjects, fake, cleanup := setupUniverse(t)
-	defer cleanup()
-
 	if err := fake.UpdateUniverse(false); err != nil {
 		t.Fatal(err)
 	}
-	p := localProjects[0]
-	if _, err := os.Stat(p.Path); err != nil {
-		t.Fatalf("%v", err)
-	}
-	gitInfoExcludeFile := filepath.Join(p.Path, ".git", "info", "exclude")
-
-	// Test when exclude doesn't exist
-	if err := os.RemoveAll(gitInfoExcludeFile); err != nil {
-		t.Fatalf("%v", err)
+	scm := gitutil.New(context.Background(), fake.X, gitutil.RootDirOpt(p.Path))
+	if got, err := scm.ConfigGetKey("remote.origin.partialclonefilter"); err != nil {
+		t.Fatal(err)
+	} else if got != p.CloneFilter {
+		t.Errorf("got partial clone filter %q, want %q", got, p.CloneFilter)
 	}
+	checkReadme(t, fake.X, p, "initial readme")
+	writeReadme(t, fake.X, fake.Projects["p"], "new readme")
 	if err := fake.UpdateUniverse(false); err != nil {
 		t.Fatal(err)
 	}
-	checkMetadataIsIgnored(t, fake.X, p)
+	checkReadme(t, fake.X, p, "new readme")
 
-	// Check when exclude doesn't have /.jiri/
-	if err := ioutil.WriteFile(gitInfoExcludeFile, []byte(""), 0644); err != nil {
-		t.Fatalf("%v", err)
+	for _, attrs := range []string{
+		`clone-filter="blob:limit=1m"`,
+		`clone-filter="tree:0"`,
+		`clone-filter="combine:blob:none+tree:1"`,
+	} {
+		if _, err := project.ManifestFromBytes([]byte(`<manifest><projects><project name="p" ` + attrs + `/></projects></manifest>`)); err != nil {
+			t.Errorf("project with %s rejected: %v", attrs, err)
+		}
 	}
-	if err := fake.UpdateUniverse(false); err != nil {
-		t.Fatal(err)
+	for _, attrs := range []string{
+		`clone-filter="blob:some"`,
+		`clone-filter="tree:x"`,
+		`clone-filter="combine:blob:none+bogus"`,
+		`clone-filter="blob:none" fetchdepth="1"`,
+		`clone-filter="blob:none" historydepth="1"`,
+	} {
+		if _, err := project.ManifestFromBytes([]byte(`<manifest><projects><project name="p" ` + attrs + `/></projects></manifest>`)); err == nil {
+			t.Errorf("project with %s should have been rejected", attrs)
+		}
 	}
-	checkMetadataIsIgnored(t, fake.X, p)
 }
 
-// TestUpdateUniverseWithRevision checks that UpdateUniverse will pull remote
-// projects at the specified revision.
-func TestUpdateUniverseWithRevision(t *testing.T) {
+// TestUpdateUniverseSingleBranch tests that only the remote branch of single
+// branch projects is fetched, unless their pinned revision is not on it.
+func TestUpdateUniverseSingleBranch(t *testing.T) {
 	localProjects, fake, cleanup := setupUniverse(t)
 	defer cleanup()
-
-	// Set project 1's revision in the manifest to the current revision.
-	g := git.NewGit(fake.Projects[localProjects[1].Name])
-	rev, err := g.CurrentRevision()
+	p := localProjects[1]
+	remote := gitutil.New(context.Background(), fake.X, gitutil.RootDirOpt(fake.Projects[p.Name]), gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"))
+	if err := remote.CreateAndCheckoutBranch("other"); err != nil {
+		t.Fatal(err)
+	}
+	writeReadme(t, fake.X, fake.Projects[p.Name], "other readme")
+	other, err := git.NewGit(context.Background(), fake.Projects[p.Name]).CurrentRevision()
 	if err != nil {
 		t.Fatal(err)
 	}
+	if err := remote.CheckoutBranch("master"); err != nil {
+		t.Fatal(err)
+	}
 	m, err := fake.ReadRemoteManifest()
 	if err != nil {
 		t.Fatal(err)
 	}
-	projects := []project.Project{}
-	for _, p := range m.Projects {
-		if p.Name == localProjects[1].Name {
-			p.Revision = rev
-		}
-		projects = append(projects, p)
+	mp, err := m.FindProject(p.Name)
+	if err != nil {
+		t.Fatal(err)
 	}
-	m.Projects = projects
+	mp.SingleBranch = true
+	// Local clones copy all the objects, use a file:// URL instead.
+	mp.Remote = "file://" + mp.Remote
 	if err := fake.WriteRemoteManifest(m); err != nil {
 		t.Fatal(err)
 	}
-	// Update README in all projects.
-	for _, remoteProjectDir := range fake.Projects {
-		writeReadme(t, fake.X, remoteProjectDir, "new revision")
+	checkRemoteBranches := func(want ...string) {
+		out, err := exec.Command("git", "-C", p.Path, "for-each-ref", "--format=%(refname)", "refs/remotes").Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, ref := range strings.Fields(string(out)) {
+			if ref != "refs/remotes/origin/HEAD" {
+				got = append(got, ref)
+			}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got remote branches %v, want %v", got, want)
+		}
 	}
-	// Check that calling UpdateUniverse() updates all projects except for
-	// project 1.
+
 	if err := fake.UpdateUniverse(false); err != nil {
 		t.Fatal(err)
 	}
-	for i, p := range localProjects {
-		if i == 1 {
-			checkReadme(t, fake.X, p, "initial readme")
-		} else {
-			checkReadme(t, fake.X, p, "new revision")
-		}
+	checkReadme(t, fake.X, p, "initial readme")
+	checkRemoteBranches("refs/remotes/origin/master")
+	writeReadme(t, fake.X, fake.Projects[p.Name], "new readme")
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
 	}
-}
+	checkReadme(t, fake.X, p, "new readme")
+	checkRemoteBranches("refs/remotes/origin/master")
 
-func commitChanges(t *testing.T, jirix *jiri.X, dir string) {
-	scm := gitutil.New(jirix, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"), gitutil.RootDirOpt(dir))
-	if err := scm.AddUpdatedFiles(); err != nil {
+	// Pinning the project to a revision of another branch fetches all the
+	// branches.
+	if mp, err = m.FindProject(p.Name); err != nil {
 		t.Fatal(err)
 	}
-	if err := scm.Commit(); err != nil {
+	mp.Revision = other
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.UpdateUniverse(false); err != nil {
 		t.Fatal(err)
 	}
+	checkReadme(t, fake.X, p, "other readme")
+	checkRemoteBranches("refs/remotes/origin/master", "refs/remotes/origin/other")
 }
 
-// TestSubDirToNestedProj checks that UpdateUniverse will correctly update when
-// nested folder is converted to nested project
-func TestSubDirToNestedProj(t *testing.T) {
+// TestUpdateUniverseWarnsShallow tests that update warns once about shallow
+// clones whose manifest entry stops setting a fetch depth.
+func TestUpdateUniverseWarnsShallow(t *testing.T) {
 	localProjects, fake, cleanup := setupUniverse(t)
 	defer cleanup()
-
-	folderName := "nested_folder"
-	nestedFolderPath := filepath.Join(fake.Projects[localProjects[1].Name], folderName)
-	os.MkdirAll(nestedFolderPath, os.FileMode(0755))
-	writeReadme(t, fake.X, nestedFolderPath, "nested folder")
-
 	if err := fake.UpdateUniverse(false); err != nil {
 		t.Fatal(err)
 	}
-	os.RemoveAll(nestedFolderPath)
-	commitChanges(t, fake.X, fake.Projects[localProjects[1].Name])
-
-	// Create nested project
-	if err := fake.CreateRemoteProject(folderName); err != nil {
+	p := localProjects[1]
+	if shallow, err := project.IsShallowClone(p.Path); err != nil {
 		t.Fatal(err)
+	} else if shallow {
+		t.Fatalf("project %s is a shallow clone", p.Name)
 	}
-	writeReadme(t, fake.X, fake.Projects[folderName], "nested folder")
-	p := project.Project{
-		Name:   folderName,
-		Path:   filepath.Join(localProjects[1].Path, folderName),
-		Remote: fake.Projects[folderName],
+	// Truncate the history of the project at its current revision.
+	rev, err := git.NewGit(context.Background(), p.Path).CurrentRevision()
+	if err != nil {
+		t.Fatal(err)
 	}
-	if err := fake.AddProject(p); err != nil {
+	if err := ioutil.WriteFile(filepath.Join(p.Path, ".git", "shallow"), []byte(rev+"\n"), 0644); err != nil {
 		t.Fatal(err)
 	}
-
-	if err := fake.UpdateUniverse(false); err != nil {
+	if shallow, err := project.IsShallowClone(p.Path); err != nil {
 		t.Fatal(err)
+	} else if !shallow {
+		t.Fatalf("project %s is not a shallow clone", p.Name)
 	}
-	checkReadme(t, fake.X, p, "nested folder")
+
+	var buf bytes.Buffer
+	fake.X.Logger.LogFile = &buf
+	defer func() { fake.X.Logger.LogFile = nil }()
+	warning := "Project " + p.Name + "(" + p.Path + ") is a shallow clone"
+	setFetchDepth := func(depth int) {
+		m, err := fake.ReadRemoteManifest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		mp, err := m.FindProject(p.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mp.FetchDepth = depth
+		if err := fake.WriteRemoteManifest(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	update := func(wantWarning bool) {
+		buf.Reset()
+		if err := fake.UpdateUniverse(false); err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Contains(buf.String(), warning); got != wantWarning {
+			t.Errorf("got warning %v about shallow project %s, want %v, in log:\n%s", got, p.Name, wantWarning, buf.String())
+		}
+	}
+
+	// Projects which never had a fetch depth aren't warned about.
+	update(false)
+	setFetchDepth(1)
+	update(false)
+	// Dropping the fetch depth warns once.
+	setFetchDepth(0)
+	update(true)
+	update(false)
 }
 
-// TestMoveNestedProjects checks that UpdateUniverse will correctly move nested projects
-func TestMoveNestedProjects(t *testing.T) {
+// TestUpdateUniverseReference tests that new clones borrow objects from the
+// reference repositories given by the user.
+func TestUpdateUniverseReference(t *testing.T) {
 	localProjects, fake, cleanup := setupUniverse(t)
 	defer cleanup()
+	p := localProjects[1]
+	reference, err := ioutil.TempDir("", "jiri-reference")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(reference)
+	if err := gitutil.New(context.Background(), fake.X).Clone(fake.Projects[p.Name], reference); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.UpdateUniverseWithOpts(project.UpdateUniverseOpts{References: map[string]string{p.Name: reference}}); err != nil {
+		t.Fatal(err)
+	}
+	checkReadme(t, fake.X, p, "initial readme")
+	data, err := ioutil.ReadFile(filepath.Join(p.Path, ".git", "objects", "info", "alternates"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.TrimSpace(string(data)), filepath.Join(reference, ".git", "objects"); got != want {
+		t.Errorf("got alternates %q, want %q", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(localProjects[0].Path, ".git", "objects", "info", "alternates")); !os.IsNotExist(err) {
+		t.Errorf("project %s without reference has alternates: %v", localProjects[0].Name, err)
+	}
+}
 
-	folderName := "nested_proj"
-	// Create nested project
-	if err := fake.CreateRemoteProject(folderName); err != nil {
+// TestUpdateUniverseWithShallowSince tests that projects with shallow-since
+// are cloned without the commits older than the given date.
+func TestUpdateUniverseWithShallowSince(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+	if err := fake.CreateRemoteProject("p"); err != nil {
 		t.Fatal(err)
 	}
-	writeReadme(t, fake.X, fake.Projects[folderName], "nested folder")
+	remote := fake.Projects["p"]
+	commitAt := func(message, date string) {
+		path := writeUncommitedFile(t, fake.X, remote, "README", message)
+		scm := gitutil.New(context.Background(), fake.X, gitutil.RootDirOpt(remote), gitutil.AuthorDateOpt(date), gitutil.CommitterDateOpt(date),
+			gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"))
+		if err := scm.CommitFile(path, message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	commitAt("old readme", "2010-01-01T00:00:00Z")
+	commitAt("old readme 2", "2011-01-01T00:00:00Z")
+	commitAt("new readme", "2020-01-01T00:00:00Z")
 	p := project.Project{
-		Name:   folderName,
-		Path:   filepath.Join(localProjects[1].Path, folderName),
-		Remote: fake.Projects[folderName],
+		Name: "p",
+		Path: filepath.Join(fake.X.Root, "p"),
+		// Git ignores --shallow-since for local paths, use a file:// URL instead.
+		Remote:       "file://" + remote,
+		ShallowSince: "2015-01-01",
 	}
 	if err := fake.AddProject(p); err != nil {
 		t.Fatal(err)
 	}
-
 	if err := fake.UpdateUniverse(false); err != nil {
 		t.Fatal(err)
 	}
+	checkReadme(t, fake.X, p, "new readme")
+	scm := gitutil.New(context.Background(), fake.X, gitutil.RootDirOpt(p.Path))
+	if got, err := scm.CountCommits("HEAD", ""); err != nil {
+		t.Fatal(err)
+	} else if got != 1 {
+		t.Errorf("got %d commits, want 1", got)
+	}
+	if _, err := os.Stat(filepath.Join(p.Path, ".git", "shallow")); err != nil {
+		t.Errorf("project should be a shallow clone: %v", err)
+	}
 
-	oldProjectPath := localProjects[1].Path
-	localProjects[1].Path = filepath.Join(fake.X.Root, "new-project-path")
-	p.Path = filepath.Join(localProjects[1].Path, folderName)
-	m, err := fake.ReadRemoteManifest()
-	if err != nil {
-		t.Fatal(err)
-	}
-	projects := []project.Project{}
-	for _, proj := range m.Projects {
-		if proj.Name == localProjects[1].Name {
-			proj.Path = localProjects[1].Path
-		}
-		if proj.Name == p.Name {
-			proj.Path = p.Path
-		}
-		projects = append(projects, proj)
-	}
-	m.Projects = projects
-	if err := fake.WriteRemoteManifest(m); err != nil {
+	commitAt("newest readme", "2021-01-01T00:00:00Z")
+	if err := fake.UpdateUniverse(false); err != nil {
 		t.Fatal(err)
 	}
-
-	if err := fake.UpdateUniverse(false); err != nil {
+	checkReadme(t, fake.X, p, "newest readme")
+	if got, err := scm.CountCommits("HEAD", ""); err != nil {
 		t.Fatal(err)
+	} else if got != 2 {
+		t.Errorf("got %d commits, want 2", got)
+	}
+
+	for _, attrs := range []string{
+		`shallow-since="2017-01-31"`,
+		`shallow-since="2017-01-31 15:04:05"`,
+		`shallow-since="2017-01-31T15:04:05Z"`,
+		`shallow-since="2017-01-31" clone-filter="blob:none"`,
+	} {
+		if _, err := project.ManifestFromBytes([]byte(`<manifest><projects><project name="p" ` + attrs + `/></projects></manifest>`)); err != nil {
+			t.Errorf("project with %s rejected: %v", attrs, err)
+		}
 	}
-	checkReadme(t, fake.X, localProjects[1], "initial readme")
-	checkReadme(t, fake.X, p, "nested folder")
-	if err := dirExists(oldProjectPath); err == nil {
-		t.Fatalf("expected project %q at path %q not to exist but it did", localProjects[1].Name, oldProjectPath)
+	for _, attrs := range []string{
+		`shallow-since="yesterday"`,
+		`shallow-since="31/01/2017"`,
+		`shallow-since="2017-01-31" fetchdepth="1"`,
+		`shallow-since="2017-01-31" historydepth="1"`,
+	} {
+		if _, err := project.ManifestFromBytes([]byte(`<manifest><projects><project name="p" ` + attrs + `/></projects></manifest>`)); err == nil {
+			t.Errorf("project with %s should have been rejected", attrs)
+		}
 	}
 }
 
-// TestUpdateUniverseWithUncommitted checks that uncommitted files are not droped
-// by UpdateUniverse(). This ensures that the "git reset --hard" mechanism used
-// for pointing the master branch to a fixed revision does not lose work in
-// progress.
-func TestUpdateUniverseWithUncommitted(t *testing.T) {
-	localProjects, fake, cleanup := setupUniverse(t)
+// TestUpdateUniverseWithMirror tests that projects are fetched from the mirror,
+// and from their remote when the mirror lacks them or their revision.
+// TestUpdateUniverseWritesJiriVersion checks that a successful update records
+// the version of jiri in the root.
+func TestUpdateUniverseWritesJiriVersion(t *testing.T) {
+	_, fake, cleanup := setupUniverse(t)
 	defer cleanup()
-	if err := fake.UpdateUniverse(false); err != nil {
-		t.Fatal(err)
-	}
+	defer func(commit string) { version.GitCommit = commit }(version.GitCommit)
 
-	// Create an uncommitted file in project 1.
-	file, perm, want := filepath.Join(localProjects[1].Path, "uncommitted_file"), os.FileMode(0644), []byte("uncommitted work")
-	if err := ioutil.WriteFile(file, want, perm); err != nil {
-		t.Fatalf("WriteFile(%v, %v) failed: %v", file, err, perm)
-	}
+	version.GitCommit = "deadbeef"
 	if err := fake.UpdateUniverse(false); err != nil {
 		t.Fatal(err)
 	}
-	got, err := ioutil.ReadFile(file)
+	data, err := ioutil.ReadFile(fake.X.JiriVersionFile())
 	if err != nil {
-		t.Fatalf("%v", err)
-	}
-	if bytes.Compare(got, want) != 0 {
-		t.Fatalf("unexpected content %v:\ngot\n%s\nwant\n%s\n", localProjects[1], got, want)
-	}
-}
-
-// TestUpdateUniverseMovedProject checks that UpdateUniverse can move a
-// project.
-func TestUpdateUniverseMovedProject(t *testing.T) {
-	localProjects, fake, cleanup := setupUniverse(t)
-	defer cleanup()
-	if err := fake.UpdateUniverse(false); err != nil {
 		t.Fatal(err)
 	}
+	if got, want := string(data), version.FormattedVersion()+"\n"; got != want {
+		t.Errorf("got version %q, want %q", got, want)
+	}
 
-	// Update the local path at which project 1 is located.
-	m, err := fake.ReadRemoteManifest()
-	if err != nil {
+	// A failed update keeps the version of the last successful one.
+	version.GitCommit = "cafebabe"
+	if err := fake.WriteRemoteManifest(&project.Manifest{
+		Projects: []project.Project{{Name: "broken", Path: "broken", Remote: filepath.Join(fake.X.Root, "missing")}},
+	}); err != nil {
 		t.Fatal(err)
 	}
-	oldProjectPath := localProjects[1].Path
-	localProjects[1].Path = filepath.Join(fake.X.Root, "new-project-path")
-	projects := []project.Project{}
-	for _, p := range m.Projects {
-		if p.Name == localProjects[1].Name {
-			p.Path = localProjects[1].Path
-		}
-		projects = append(projects, p)
-	}
-	m.Projects = projects
-	if err := fake.WriteRemoteManifest(m); err != nil {
-		t.Fatal(err)
+	if err := fake.UpdateUniverse(false); err == nil {
+		t.Fatal("update with a missing remote succeeded")
 	}
-	// Check that UpdateUniverse() moves the local copy of the project 1.
-	if err := fake.UpdateUniverse(false); err != nil {
+	if data, err := ioutil.ReadFile(fake.X.JiriVersionFile()); err != nil {
 		t.Fatal(err)
+	} else if !strings.Contains(string(data), "deadbeef") {
+		t.Errorf("got version %q after failed update, want %q", data, "deadbeef")
 	}
-	if err := dirExists(oldProjectPath); err == nil {
-		t.Fatalf("expected project %q at path %q not to exist but it did", localProjects[1].Name, oldProjectPath)
-	}
-	if err := dirExists(localProjects[2].Path); err != nil {
-		t.Fatalf("expected project %q at path %q to exist but it did not", localProjects[1].Name, localProjects[1].Path)
-	}
-	checkReadme(t, fake.X, localProjects[1], "initial readme")
 }
 
-func TestIgnoredProjectsNotMoved(t *testing.T) {
+// TestUpdateUniverseBenignGitWarning checks that the benign warnings of git
+// neither fail nor clutter updates, unless strict git reporting is requested,
+// and that failures report all the stderr output of git.
+func TestUpdateUniverseBenignGitWarning(t *testing.T) {
 	localProjects, fake, cleanup := setupUniverse(t)
 	defer cleanup()
-	if err := fake.UpdateUniverse(false); err != nil {
-		t.Fatal(err)
-	}
 
-	// Update the local path at which project 1 is located.
-	m, err := fake.ReadRemoteManifest()
+	// Make every git command print a benign warning.
+	realGit, err := exec.LookPath("git")
 	if err != nil {
 		t.Fatal(err)
 	}
-	lc := project.LocalConfig{Ignore: true}
-	project.WriteLocalConfig(fake.X, localProjects[1], lc)
-	oldProjectPath := localProjects[1].Path
-	localProjects[1].Path = filepath.Join(fake.X.Root, "new-project-path")
-	projects := []project.Project{}
-	for _, p := range m.Projects {
-		if p.Name == localProjects[1].Name {
-			p.Path = localProjects[1].Path
-		}
-		projects = append(projects, p)
-	}
-	m.Projects = projects
-	if err := fake.WriteRemoteManifest(m); err != nil {
+	bin := filepath.Join(fake.X.Root, "bin")
+	if err := os.MkdirAll(bin, 0755); err != nil {
 		t.Fatal(err)
 	}
-
-	// Check that UpdateUniverse() does not move the local copy of the project 1.
-	if err := fake.UpdateUniverse(false); err != nil {
+	script := fmt.Sprintf("#!/bin/sh\n%s \"$@\"\nstatus=$?\necho 'warning: redirecting to https://example.com/' >&2\nexit $status\n", realGit)
+	if err := ioutil.WriteFile(filepath.Join(bin, "git"), []byte(script), 0755); err != nil {
 		t.Fatal(err)
 	}
-	if err := dirExists(oldProjectPath); err != nil {
-		t.Fatalf("expected project %q at path %q to exist but it did not: %s", localProjects[1].Name, oldProjectPath, err)
-	}
-	if err := dirExists(localProjects[2].Path); err != nil {
-		t.Fatalf("expected project %q at path %q to not exist but it did", localProjects[1].Name, localProjects[1].Path)
-	}
-}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
 
-// TestUpdateUniverseRenamedProject checks that UpdateUniverse can update
-// renamed project.
-func TestUpdateUniverseRenamedProject(t *testing.T) {
-	localProjects, fake, cleanup := setupUniverse(t)
-	defer cleanup()
-	if err := fake.UpdateUniverse(false); err != nil {
-		t.Fatal(err)
+	// update runs the update with a logger writing to a file, and returns the
+	// log and the update error.
+	update := func() (string, error) {
+		logFile, err := ioutil.TempFile("", "jiri-log")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(logFile.Name())
+		defer logFile.Close()
+		stdout, stderr, logger := os.Stdout, os.Stderr, fake.X.Logger
+		os.Stdout, os.Stderr = logFile, logFile
+		fake.X.Logger = log.NewLogger(log.InfoLevel, fake.X.Color)
+		updateErr := fake.UpdateUniverse(true)
+		os.Stdout, os.Stderr, fake.X.Logger = stdout, stderr, logger
+		data, err := ioutil.ReadFile(logFile.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data), updateErr
 	}
 
-	m, err := fake.ReadRemoteManifest()
+	output, err := update()
 	if err != nil {
 		t.Fatal(err)
 	}
-	oldProjectName := localProjects[1].Name
-	localProjects[1].Name = localProjects[1].Name + "new"
-	projects := []project.Project{}
-	for _, p := range m.Projects {
-		if p.Name == oldProjectName {
-			p.Name = localProjects[1].Name
-		}
-		projects = append(projects, p)
+	if strings.Contains(output, "redirecting") {
+		t.Errorf("benign warning reported:\n%s", output)
 	}
-	m.Projects = projects
-	if err := fake.WriteRemoteManifest(m); err != nil {
+	checkReadme(t, fake.X, localProjects[1], "initial readme")
+
+	// Genuine failures are still reported, with all their stderr output.
+	if err := fake.AddProject(project.Project{Name: "broken", Path: "broken", Remote: filepath.Join(fake.X.Root, "missing")}); err != nil {
 		t.Fatal(err)
 	}
+	_, err = update()
+	if err == nil {
+		t.Fatal("update with a missing remote succeeded")
+	}
+	if !strings.Contains(err.Error(), "redirecting") || !strings.Contains(err.Error(), "fatal:") {
+		t.Errorf("got error %q, want the git failure with the benign warning", err)
+	}
 
-	if err := fake.UpdateUniverse(false); err != nil {
+	// Strict reporting reports the benign warnings too.
+	if err := fake.WriteRemoteManifest(&project.Manifest{Projects: localProjects}); err != nil {
 		t.Fatal(err)
 	}
-	newLocalProjects, err := project.LocalProjects(fake.X, project.FullScan)
+	fake.X.StrictGit = true
+	output, err = update()
 	if err != nil {
 		t.Fatal(err)
 	}
-	projectFound := false
-	for _, p := range newLocalProjects {
-		if p.Name == localProjects[1].Name {
-			projectFound = true
-		}
-	}
-	if !projectFound {
-		t.Fatalf("Project with updated name(%v) not found", localProjects[1].Name)
+	if !strings.Contains(output, "warning: redirecting") {
+		t.Errorf("benign warning not reported with strict git:\n%s", output)
 	}
 }
 
-// testUpdateUniverseDeletedProject checks that UpdateUniverse will delete a
-// project if gc=true.
-func testUpdateUniverseDeletedProject(t *testing.T, testDirtyProjectDelete bool) {
+// TestUpdateUniverseWithRemoteName checks that projects can use another git
+// remote than origin, also after they were cloned.
+func TestUpdateUniverseWithRemoteName(t *testing.T) {
 	localProjects, fake, cleanup := setupUniverse(t)
 	defer cleanup()
-	if err := fake.UpdateUniverse(false); err != nil {
-		t.Fatal(err)
-	}
-
-	// Delete project 1.
-	m, err := fake.ReadRemoteManifest()
-	if err != nil {
-		t.Fatal(err)
-	}
-	projects := []project.Project{}
-	if testDirtyProjectDelete {
-		writeUncommitedFile(t, fake.X, localProjects[4].Path, "extra", "")
-	}
-	for _, p := range m.Projects {
-		skip := false
-		for i := 1; i <= 5; i++ {
-			if p.Name == localProjects[i].Name {
-				skip = true
-			}
+	setRemoteName := func(p project.Project, name string) {
+		m, err := fake.ReadRemoteManifest()
+		if err != nil {
+			t.Fatal(err)
 		}
-		if skip {
-			continue
+		mp, err := m.FindProject(p.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mp.RemoteName = name
+		if err := fake.WriteRemoteManifest(m); err != nil {
+			t.Fatal(err)
 		}
-		projects = append(projects, p)
 	}
-	m.Projects = projects
-	if err := fake.WriteRemoteManifest(m); err != nil {
-		t.Fatal(err)
+	checkRemote := func(p project.Project, name string) {
+		scm := gitutil.New(context.Background(), fake.X, gitutil.RootDirOpt(p.Path))
+		if url, err := scm.RemoteUrl(name); err != nil {
+			t.Errorf("project %s: %v", p.Name, err)
+		} else if url != p.Remote {
+			t.Errorf("project %s: got remote %s at %q, want %q", p.Name, name, url, p.Remote)
+		}
+		head, err := ioutil.ReadFile(filepath.Join(p.Path, ".git", "JIRI_HEAD"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := git.NewGit(context.Background(), p.Path).CurrentRevisionForRef("refs/remotes/" + name + "/master")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(head) != want {
+			t.Errorf("project %s: got JIRI_HEAD %s, want %s", p.Name, head, want)
+		}
 	}
-	// Check that UpdateUniverse() with gc=false does not delete the local copy
-	// of the project.
+
+	// A new project is cloned with the remote name.
+	setRemoteName(localProjects[1], "upstream")
 	if err := fake.UpdateUniverse(false); err != nil {
 		t.Fatal(err)
 	}
-	for i := 1; i <= 5; i++ {
-		if err := dirExists(localProjects[i].Path); err != nil {
-			t.Fatalf("expected project %q at path %q to exist but it did not", localProjects[i].Name, localProjects[i].Path)
-		}
-		checkReadme(t, fake.X, localProjects[i], "initial readme")
+	checkRemote(localProjects[1], "upstream")
+	scm := gitutil.New(context.Background(), fake.X, gitutil.RootDirOpt(localProjects[1].Path))
+	if _, err := scm.RemoteUrl("origin"); err == nil {
+		t.Errorf("project %s has an origin remote", localProjects[1].Name)
 	}
-	// Check that UpdateUniverse() with gc=true does delete the local copy of
-	// the project.
-	if err := fake.UpdateUniverse(true); err != nil {
+
+	// An existing project gets the remote when its name changes.
+	setRemoteName(localProjects[0], "upstream")
+	for _, p := range localProjects[:2] {
+		writeReadme(t, fake.X, fake.Projects[p.Name], "new revision")
+	}
+	if err := fake.UpdateUniverse(false); err != nil {
 		t.Fatal(err)
 	}
-	for i := 1; i <= 5; i++ {
-		err := dirExists(localProjects[i].Path)
-		if testDirtyProjectDelete && i >= 2 && i <= 4 {
-			if err != nil {
-				t.Fatalf("expected project %q at path %q to exist but it did not", localProjects[i].Name, localProjects[i].Path)
-			}
-		} else if err == nil {
-			t.Fatalf("expected project %q at path %q not to exist but it did", localProjects[i].Name, localProjects[i].Path)
-		}
+	for _, p := range localProjects[:2] {
+		checkRemote(p, "upstream")
+		checkReadme(t, fake.X, p, "new revision")
 	}
 }
-func TestUpdateUniverseDeletedProject(t *testing.T) {
-	testUpdateUniverseDeletedProject(t, false)
-	testUpdateUniverseDeletedProject(t, true)
-}
 
-func TestIgnoredProjectsNotDeleted(t *testing.T) {
-	localProjects, fake, cleanup := setupUniverse(t)
+func TestUpdateUniverseWithMirror(t *testing.T) {
+	if got, want := project.InternalMirrorRemote("https://mirror.example.com/", "https://host.example.com/repo"), "https://mirror.example.com/host.example.com/repo"; got != want {
+		t.Errorf("got mirror remote %q, want %q", got, want)
+	}
+
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
 	defer cleanup()
-	if err := fake.UpdateUniverse(false); err != nil {
+	mirrorDir := filepath.Join(fake.X.Root, "mirror")
+	for _, name := range []string{"p", "q"} {
+		if err := fake.CreateRemoteProject(name); err != nil {
+			t.Fatal(err)
+		}
+		writeReadme(t, fake.X, fake.Projects[name], "initial readme")
+		if err := fake.AddProject(project.Project{
+			Name:   name,
+			Path:   filepath.Join(fake.X.Root, name),
+			Remote: fake.Projects[name],
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Only p is mirrored, and its mirror lags behind.
+	mirror := project.InternalMirrorRemote(mirrorDir, fake.Projects["p"])
+	if err := gitutil.New(context.Background(), fake.X).Clone(fake.Projects["p"], mirror); err != nil {
 		t.Fatal(err)
 	}
+	writeReadme(t, fake.X, fake.Projects["p"], "new readme")
 
-	// Delete project 1.
+	if err := fake.UpdateUniverseWithOpts(project.UpdateUniverseOpts{Mirror: mirrorDir}); err != nil {
+		t.Fatal(err)
+	}
 	m, err := fake.ReadRemoteManifest()
 	if err != nil {
 		t.Fatal(err)
 	}
-	projects := []project.Project{}
 	for _, p := range m.Projects {
-		if p.Name == localProjects[1].Name {
+		if p.Name != "p" && p.Name != "q" {
 			continue
 		}
-		projects = append(projects, p)
+		p.Path = filepath.Join(fake.X.Root, p.Name)
+		if got, err := gitutil.New(context.Background(), fake.X, gitutil.RootDirOpt(p.Path)).RemoteUrl("origin"); err != nil {
+			t.Fatal(err)
+		} else if got != p.Remote {
+			t.Errorf("project %s: got origin %q, want %q", p.Name, got, p.Remote)
+		}
+		local, err := project.ProjectFromFile(fake.X, filepath.Join(p.Path, jiri.ProjectMetaDir, jiri.ProjectMetaFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if local.Remote != p.Remote {
+			t.Errorf("project %s: got metadata remote %q, want %q", p.Name, local.Remote, p.Remote)
+		}
+		// p is at the lagging revision of the mirror, q was cloned from its
+		// remote.
+		checkReadme(t, fake.X, p, "initial readme")
 	}
-	m.Projects = projects
-	if err := fake.WriteRemoteManifest(m); err != nil {
+
+	// Pin p to the revision missing on the mirror.
+	revision, err := git.NewGit(context.Background(), fake.Projects["p"]).CurrentRevision()
+	if err != nil {
 		t.Fatal(err)
 	}
-	lc := project.LocalConfig{Ignore: true}
-	project.WriteLocalConfig(fake.X, localProjects[1], lc)
-	if err := fake.UpdateUniverse(true); err != nil {
+	p, err := m.FindProject("p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Revision = revision
+	if err := fake.WriteRemoteManifest(m); err != nil {
 		t.Fatal(err)
 	}
-	if err := dirExists(localProjects[1].Path); err != nil {
-		t.Fatalf("expected project %q at path %q to exist but it did not: %s", localProjects[1].Name, localProjects[1].Path, err)
-	}
-}
-
-// TestUpdateUniverseNewProjectSamePath checks that UpdateUniverse can handle a
-// new project with the same path as a deleted project, but a different path.
-func TestUpdateUniverseNewProjectSamePath(t *testing.T) {
-	localProjects, fake, cleanup := setupUniverse(t)
-	defer cleanup()
 	if err := fake.UpdateUniverse(false); err != nil {
 		t.Fatal(err)
 	}
+	checkReadme(t, fake.X, project.Project{Name: "p", Path: filepath.Join(fake.X.Root, "p")}, "new readme")
+}
 
-	// Delete a project 1 and create a new one with a different name but the
-	// same path.
-	m, err := fake.ReadRemoteManifest()
-	if err != nil {
-		t.Fatal(err)
+// TestUpdateUniverseWithLowDiskSpace tests that new projects are cloned with
+// a history depth of 1 when free disk space is low.
+func TestUpdateUniverseWithLowDiskSpace(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+	var free uint64
+	oldFreeDiskSpace := *project.InternalFreeDiskSpace
+	*project.InternalFreeDiskSpace = func(string) (uint64, error) { return free, nil }
+	defer func() { *project.InternalFreeDiskSpace = oldFreeDiskSpace }()
+
+	tests := []struct {
+		free    uint64
+		commits int
+	}{
+		{1 << 40, 4},
+		{1 << 20, 1},
 	}
-	newProjectName := "new-project-name"
-	projects := []project.Project{}
-	for _, p := range m.Projects {
-		if p.Path == localProjects[1].Path {
-			p.Name = newProjectName
+	for i, test := range tests {
+		name := fmt.Sprintf("p%d", i)
+		if err := fake.CreateRemoteProject(name); err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < 3; j++ {
+			writeFile(t, fake.X, fake.Projects[name], "file", fmt.Sprintf("commit %d", j))
+		}
+		p := project.Project{
+			Name: name,
+			Path: filepath.Join(fake.X.Root, name),
+			// Git ignores --depth for local paths, use a file:// URL instead.
+			Remote: "file://" + fake.Projects[name],
+		}
+		if err := fake.AddProject(p); err != nil {
+			t.Fatal(err)
+		}
+		free = test.free
+		if err := fake.UpdateUniverseWithOpts(project.UpdateUniverseOpts{ShallowBelowFreeSpace: 1 << 30}); err != nil {
+			t.Fatal(err)
+		}
+		scm := gitutil.New(context.Background(), fake.X, gitutil.RootDirOpt(p.Path))
+		if got, err := scm.CountCommits("HEAD", ""); err != nil {
+			t.Fatal(err)
+		} else if got != test.commits {
+			t.Errorf("project %q has %d commits with %d bytes free, want %d", name, got, test.free, test.commits)
 		}
-		projects = append(projects, p)
-	}
-	localProjects[1].Name = newProjectName
-	m.Projects = projects
-	if err := fake.WriteRemoteManifest(m); err != nil {
-		t.Fatal(err)
-	}
-	// Check that UpdateUniverse() does not fail.
-	if err := fake.UpdateUniverse(true); err != nil {
-		t.Fatal(err)
 	}
 }
 
-// TestUpdateUniverseRemoteBranch checks that UpdateUniverse can pull from a
-// non-master remote branch.
-func TestUpdateUniverseRemoteBranch(t *testing.T) {
+// TestUpdateUniverseWithCache checks that UpdateUniverse can clone and pull
+// from a cache.
+func testWithCache(t *testing.T, shared bool) {
 	localProjects, fake, cleanup := setupUniverse(t)
 	defer cleanup()
+
+	// Create cache directory
+	cacheDir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatalf("TempDir() failed: %v", err)
+	}
+	if err := os.MkdirAll(cacheDir, os.FileMode(0700)); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(cacheDir); err != nil {
+			t.Fatalf("RemoveAll(%q) failed: %v", cacheDir, err)
+		}
+	}()
+	fake.X.Cache = cacheDir
+	fake.X.Shared = shared
+
 	if err := fake.UpdateUniverse(false); err != nil {
 		t.Fatal(err)
 	}
+	for _, p := range localProjects {
+		// Check that local clone was referenced from cache
+		err := fileExists(p.Path + "/.git/objects/info/alternates")
+		if shared || p.FetchDepth == 0 {
+			if err != nil {
+				t.Fatalf("expected %v to exist, but not found", p.Path+"/.git/objects/info/alternates")
+			}
+		} else if err == nil {
+			t.Fatalf("expected %v to not exist, but found", p.Path+"/.git/objects/info/alternates")
+		}
+		checkReadme(t, fake.X, p, "initial readme")
+		checkJiriRevFiles(t, fake.X, p)
+	}
 
 	// Commit to master branch of a project 1.
 	writeReadme(t, fake.X, fake.Projects[localProjects[1].Name], "master commit")
-	// Create and checkout a new branch of project 1 and make a new commit.
-	git := gitutil.New(fake.X, gitutil.RootDirOpt(fake.Projects[localProjects[1].Name]))
-	if err := git.CreateAndCheckoutBranch("non-master"); err != nil {
+	if err := fake.UpdateUniverse(false); err != nil {
 		t.Fatal(err)
 	}
-	writeReadme(t, fake.X, fake.Projects[localProjects[1].Name], "non-master commit")
-	// Point the manifest to the new non-master branch.
-	m, err := fake.ReadRemoteManifest()
+	checkReadme(t, fake.X, localProjects[1], "master commit")
+	checkJiriRevFiles(t, fake.X, localProjects[1])
+
+	// Check that cache was updated
+	cacheDirPath, err := localProjects[1].CacheDirPath(fake.X)
 	if err != nil {
 		t.Fatal(err)
 	}
-	projects := []project.Project{}
-	for _, p := range m.Projects {
-		if p.Name == localProjects[1].Name {
-			p.RemoteBranch = "non-master"
-		}
-		projects = append(projects, p)
-	}
-	m.Projects = projects
-	if err := fake.WriteRemoteManifest(m); err != nil {
+	gCache := git.NewGit(context.Background(), cacheDirPath)
+	cacheRev, err := gCache.CurrentRevision()
+	if err != nil {
 		t.Fatal(err)
 	}
-	// Check that UpdateUniverse pulls the commit from the non-master branch.
-	if err := fake.UpdateUniverse(false); err != nil {
+	gl := git.NewGit(context.Background(), localProjects[1].Path)
+	localRev, err := gl.CurrentRevision()
+	if err != nil {
 		t.Fatal(err)
 	}
-	checkReadme(t, fake.X, localProjects[1], "non-master commit")
+	if cacheRev != localRev {
+		t.Fatalf("Cache revision(%v) not equal to local revision(%v)", cacheRev, localRev)
+	}
+
 }
 
-// TestUpdateWhenRemoteChangesRebased checks that UpdateUniverse can pull from a
-// non-master remote branch if the local changes were rebased somewhere else(gerrit)
-// before being pushed to remote
-func TestUpdateWhenRemoteChangesRebased(t *testing.T) {
+// TestUpdateUniverseWithCache checks that UpdateUniverse can clone and pull
+// from a cache.
+func TestUpdateUniverseWithCache(t *testing.T) {
+	testWithCache(t, false)
+}
+
+// TestUpdateUniverseWithiSharedCache checks that UpdateUniverse can clone and pull
+// from a cache when it is of type "shared"
+func TestUpdateUniverseWithSharedCache(t *testing.T) {
+	testWithCache(t, true)
+}
+
+func TestProjectUpdateWhenNoUpdate(t *testing.T) {
 	localProjects, fake, cleanup := setupUniverse(t)
 	defer cleanup()
 	if err := fake.UpdateUniverse(false); err != nil {
 		t.Fatal(err)
 	}
 
-	gitRemote := gitutil.New(fake.X, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"), gitutil.RootDirOpt(fake.Projects[localProjects[1].Name]))
-	gr := git.NewGit(fake.Projects[localProjects[1].Name])
-	if err := gitRemote.CreateAndCheckoutBranch("non-master"); err != nil {
+	lc := project.LocalConfig{NoUpdate: true}
+	project.WriteLocalConfig(fake.X, localProjects[1], lc)
+	// Commit to master branch of a project 1.
+	writeReadme(t, fake.X, fake.Projects[localProjects[1].Name], "master commit")
+	gitRemote := git.NewGit(context.Background(), fake.Projects[localProjects[1].Name])
+	remoteRev, _ := gitRemote.CurrentRevision()
+	if err := fake.UpdateUniverse(false); err != nil {
 		t.Fatal(err)
 	}
 
-	gitLocal := gitutil.New(fake.X, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"), gitutil.RootDirOpt(localProjects[1].Path))
-	gl := git.NewGit(localProjects[1].Path)
-	if err := gl.Fetch("origin", git.PruneOpt(true)); err != nil {
-		t.Fatal(err)
-	}
+	gitLocal := git.NewGit(context.Background(), localProjects[1].Path)
+	localRev, _ := gitLocal.CurrentRevision()
 
-	// checkout branch in local repo
-	if err := gitLocal.CheckoutBranch("non-master"); err != nil {
-		t.Fatal(err)
+	if remoteRev == localRev {
+		t.Fatal("local project should not be updated")
 	}
+}
 
-	// Create commits in remote repo
-	writeReadme(t, fake.X, fake.Projects[localProjects[1].Name], "non-master commit")
-	writeFile(t, fake.X, fake.Projects[localProjects[1].Name], "file1", "file1")
-	file1CommitRev, _ := gr.CurrentRevision()
-	writeFile(t, fake.X, fake.Projects[localProjects[1].Name], "file2", "file2")
-	file2CommitRev, _ := gr.CurrentRevision()
-
-	if err := gl.Fetch("origin", git.PruneOpt(true)); err != nil {
+func TestProjectUpdateWhenIgnore(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
 		t.Fatal(err)
 	}
 
-	// Cherry pick creation of file1, so that it acts like been rebased on remote repo
-	// As there is a commit creating README on remote not in local repo
-	if err := gitLocal.CherryPick(file1CommitRev); err != nil {
+	lc := project.LocalConfig{Ignore: true}
+	project.WriteLocalConfig(fake.X, localProjects[1], lc)
+	// Commit to master branch of a project 1.
+	writeReadme(t, fake.X, fake.Projects[localProjects[1].Name], "master commit")
+	gitRemote := git.NewGit(context.Background(), fake.Projects[localProjects[1].Name])
+	remoteRev, _ := gitRemote.CurrentRevision()
+	if err := fake.UpdateUniverse(false); err != nil {
 		t.Fatal(err)
 	}
 
-	if err := project.UpdateUniverse(fake.X, false, false, true /*rebaseTracked*/, false, false, project.DefaultHookTimeout); err != nil {
-		t.Fatal(err)
-	}
+	gitLocal := git.NewGit(context.Background(), localProjects[1].Path)
+	localRev, _ := gitLocal.CurrentRevision()
 
-	// It rebased properly and pulled latest changes
-	localRev, _ := gl.CurrentRevision()
-	if file2CommitRev != localRev {
-		t.Fatalf("Current commit is %v, it should be %v\n", localRev, file2CommitRev)
+	if remoteRev == localRev {
+		t.Fatal("local project should not be updated")
 	}
 }
 
-func TestUpdateWhenConflictMerge(t *testing.T) {
-	localProjects, fake, cleanup := setupUniverse(t)
+// TestUpdateHistorySnapshotCompression tests that large update history
+// snapshots are compressed, and that they can be read back.
+func TestUpdateHistorySnapshotCompression(t *testing.T) {
+	jirix, cleanup := jiritest.NewX(t)
 	defer cleanup()
-	if err := fake.UpdateUniverse(false); err != nil {
-		t.Fatal(err)
-	}
 
-	gitRemote := gitutil.New(fake.X, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"), gitutil.RootDirOpt(fake.Projects[localProjects[1].Name]))
-	gr := git.NewGit(fake.Projects[localProjects[1].Name])
-	if err := gitRemote.CreateAndCheckoutBranch("non-master"); err != nil {
-		t.Fatal(err)
+	small := &project.Manifest{
+		Projects: []project.Project{{
+			Name:   "project",
+			Path:   filepath.Join(jirix.Root, "path"),
+			Remote: "remote",
+		}},
+	}
+	large := &project.Manifest{}
+	for i := 0; i < 20000; i++ {
+		large.Projects = append(large.Projects, project.Project{
+			Name:   fmt.Sprintf("project-%d", i),
+			Path:   filepath.Join(jirix.Root, fmt.Sprintf("path-%d", i)),
+			Remote: fmt.Sprintf("https://example.com/remote-%d", i),
+		})
 	}
-
-	gitLocal := gitutil.New(fake.X, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"), gitutil.RootDirOpt(localProjects[1].Path))
-	gl := git.NewGit(localProjects[1].Path)
-	if err := gl.Fetch("origin", git.PruneOpt(true)); err != nil {
-		t.Fatal(err)
+	tests := []struct {
+		manifest *project.Manifest
+		ext      string
+	}{
+		{small, ".xml"},
+		{large, ".xml.gz"},
 	}
-
-	// checkout branch in local repo
-	if err := gitLocal.CheckoutBranch("non-master"); err != nil {
-		t.Fatal(err)
+	for i, test := range tests {
+		want := len(test.manifest.Projects)
+		file, err := project.InternalWriteUpdateHistoryFile(jirix, test.manifest, time.Unix(int64(i), 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(file, test.ext) {
+			t.Errorf("snapshot %q does not have extension %q", file, test.ext)
+		}
+		// Read the snapshot through a symlink, like the "latest" link.
+		link := filepath.Join(jirix.UpdateHistoryDir(), "link")
+		if err := os.Symlink(filepath.Base(file), link); err != nil {
+			t.Fatal(err)
+		}
+		m, err := project.ReadUpdateHistorySnapshot(jirix, link)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := len(m.Projects); got != want {
+			t.Errorf("snapshot %q has %d projects, want %d", file, got, want)
+		}
+		if err := os.Remove(link); err != nil {
+			t.Fatal(err)
+		}
 	}
+}
 
-	// Create commits in remote repo
-	writeReadme(t, fake.X, fake.Projects[localProjects[1].Name], "non-master commit")
-	writeFile(t, fake.X, fake.Projects[localProjects[1].Name], "file1", "file1")
-	file1CommitRev, _ := gr.CurrentRevision()
-	writeFile(t, fake.X, fake.Projects[localProjects[1].Name], "file2", "file2")
+// TestUpdateHistoryRetention tests that only the configured number of update
+// history snapshots are kept, and that the "latest" link stays valid.
+func TestUpdateHistoryRetention(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	now := time.Unix(1e9, 0)
+	oldNow := *project.InternalUpdateHistoryNow
+	*project.InternalUpdateHistoryNow = func() time.Time {
+		now = now.Add(time.Minute)
+		return now
+	}
+	defer func() { *project.InternalUpdateHistoryNow = oldNow }()
+
+	const keep = 2
+	fake.X.UpdateHistoryRetention = keep
+	var latest string
+	for i := 0; i < keep+3; i++ {
+		writeReadme(t, fake.X, fake.Projects[localProjects[0].Name], fmt.Sprintf("revision %d", i))
+		if err := fake.UpdateUniverse(false); err != nil {
+			t.Fatal(err)
+		}
+		// Like "jiri update", record the update in the history.
+		if err := project.WriteUpdateHistorySnapshot(fake.X, "", false); err != nil {
+			t.Fatal(err)
+		}
+		latest = filepath.Join(fake.X.UpdateHistoryDir(), now.Format(time.RFC3339)+".xml")
+	}
 
-	if err := gl.Fetch("origin", git.PruneOpt(true)); err != nil {
+	infos, err := ioutil.ReadDir(fake.X.UpdateHistoryDir())
+	if err != nil {
 		t.Fatal(err)
 	}
-
-	// Cherry pick creation of file1, so that it acts like been rebased on remote repo
-	// This would act like conflicting merge
-	if err := gitLocal.CherryPick(file1CommitRev); err != nil {
+	var snapshots []string
+	for _, info := range infos {
+		if info.Mode().IsRegular() {
+			snapshots = append(snapshots, info.Name())
+		}
+	}
+	if len(snapshots) != keep {
+		t.Errorf("got snapshots %v, want %d of them", snapshots, keep)
+	}
+	if target, err := filepath.EvalSymlinks(fake.X.UpdateHistoryLatestLink()); err != nil {
 		t.Fatal(err)
+	} else if target != latest {
+		t.Errorf("latest link points to %q, want %q", target, latest)
 	}
-	rev, _ := gl.CurrentRevision()
-
-	if err := fake.UpdateUniverse(false); err != nil {
+	if _, err := project.ReadUpdateHistorySnapshot(fake.X, fake.X.UpdateHistoryLatestLink()); err != nil {
 		t.Fatal(err)
 	}
-
-	localRev, _ := gl.CurrentRevision()
-	if rev != localRev {
-		t.Fatalf("Current commit is %v, it should be %v\n", localRev, rev)
+	if _, err := os.Stat(fake.X.UpdateHistorySecondLatestLink()); err != nil {
+		t.Errorf("second-latest link is invalid: %v", err)
 	}
-	checkJiriRevFiles(t, fake.X, localProjects[1])
-}
-
-// TestCheckoutSnapshotUrl tests checking out snapshot functionality from a url
-func TestCheckoutSnapshotUrl(t *testing.T) {
-	testCheckoutSnapshot(t, true)
-}
-
-// TestCheckoutSnapshotFileSystem tests checking out snapshot functionality from filesystem
-func TestCheckoutSnapshotFileSystem(t *testing.T) {
-	testCheckoutSnapshot(t, false)
 }
 
-func testCheckoutSnapshot(t *testing.T, testURL bool) {
+func TestLocalProjectWithConfig(t *testing.T) {
 	localProjects, fake, cleanup := setupUniverse(t)
 	defer cleanup()
-	var oldCommitRevs []string
-	var latestCommitRevs []string
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	project.WriteUpdateHistorySnapshot(fake.X, "", false)
 
-	for i, localProject := range localProjects {
-		gr := git.NewGit(fake.Projects[localProject.Name])
-		writeFile(t, fake.X, fake.Projects[localProject.Name], "file1"+strconv.Itoa(i), "file1"+strconv.Itoa(i))
-		file1CommitRev, _ := gr.CurrentRevision()
-		oldCommitRevs = append(oldCommitRevs, file1CommitRev)
-		writeFile(t, fake.X, fake.Projects[localProject.Name], "file2"+strconv.Itoa(i), "file2"+strconv.Itoa(i))
-		file2CommitRev, _ := gr.CurrentRevision()
-		latestCommitRevs = append(latestCommitRevs, file2CommitRev)
-	}
-
-	if err := fake.UpdateUniverse(false); err != nil {
-		t.Fatal(err)
-	}
-
-	for i, localProject := range localProjects {
-		gitLocal := gitutil.New(fake.X, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"), gitutil.RootDirOpt(localProject.Path))
-		gl := git.NewGit(localProject.Path)
-		rev, _ := gl.CurrentRevision()
-		if rev != latestCommitRevs[i] {
-			t.Fatalf("Current commit for project %q is %v, it should be %v\n", localProject.Name, rev, latestCommitRevs[i])
+	lc := project.LocalConfig{Ignore: true}
+	project.WriteLocalConfig(fake.X, localProjects[1], lc)
+	scanModes := []project.ScanMode{project.FullScan, project.FastScan}
+	for _, scanMode := range scanModes {
+		newLocalProjects, err := project.LocalProjects(fake.X, scanMode)
+		if err != nil {
+			t.Fatal(err)
 		}
+		for k, p := range newLocalProjects {
+			expectedIgnore := k == localProjects[1].Key()
+			if p.LocalConfig.Ignore != expectedIgnore {
+				t.Errorf("local config ignore: got %t, want %t", p.LocalConfig.Ignore, expectedIgnore)
+			}
 
-		// Test case when local repo in on a branch
-		if i == 1 {
-			if err := gitLocal.CheckoutBranch("master"); err != nil {
-				t.Fatal(err)
+			if p.LocalConfig.NoUpdate != false {
+				t.Errorf("local config no-update: got %t, want %t", p.LocalConfig.NoUpdate, false)
+			}
+
+			if p.LocalConfig.NoRebase != false {
+				t.Errorf("local config no-rebase: got %t, want %t", p.LocalConfig.NoUpdate, false)
 			}
 		}
 	}
-	dir, err := ioutil.TempDir("", "snap")
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer os.RemoveAll(dir)
-	manifest := &project.Manifest{}
-	for _, localProject := range localProjects {
-		manifest.Projects = append(manifest.Projects, localProject)
-	}
-	manifest.Projects[0].Revision = oldCommitRevs[0]
-	manifest.Projects[1].Revision = oldCommitRevs[1]
+}
 
-	// Test case when snapshot specifies latest revision
-	manifest.Projects[2].Revision = latestCommitRevs[2]
+// TestLocalConfigNoPush tests that the no-push local config is written and
+// read back.
+func TestLocalConfigNoPush(t *testing.T) {
+	jirix, cleanup := jiritest.NewX(t)
+	defer cleanup()
 
-	manifest.Projects[3].Revision = oldCommitRevs[3]
-	manifest.Projects[4].Revision = latestCommitRevs[4]
-	manifest.Projects[5].Revision = oldCommitRevs[5]
-	manifest.Projects[6].Revision = latestCommitRevs[6]
-	snapshotFile := filepath.Join(dir, "snapshot")
-	manifest.ToFile(fake.X, snapshotFile)
-	if testURL {
-		snapBytes, err := ioutil.ReadFile(snapshotFile)
+	p := project.Project{Name: "project", Path: filepath.Join(jirix.Root, "project")}
+	for _, noPush := range []bool{true, false} {
+		if err := project.WriteLocalConfig(jirix, p, project.LocalConfig{NoPush: noPush}); err != nil {
+			t.Fatal(err)
+		}
+		configFile := filepath.Join(p.Path, jiri.ProjectMetaDir, jiri.ProjectConfigFile)
+		data, err := ioutil.ReadFile(configFile)
 		if err != nil {
 			t.Fatal(err)
 		}
-		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			w.Header().Set("Content-Type", "html/text")
-			fmt.Fprintln(w, string(snapBytes[:]))
-		}))
-		defer server.Close()
-
-		project.CheckoutSnapshot(fake.X, server.URL, false, project.DefaultHookTimeout)
-	} else {
-		project.CheckoutSnapshot(fake.X, snapshotFile, false, project.DefaultHookTimeout)
-	}
-	sort.Sort(project.ProjectsByPath(localProjects))
-	for i, localProject := range localProjects {
-		gl := git.NewGit(localProject.Path)
-		rev, _ := gl.CurrentRevision()
-		expectedRev := manifest.Projects[i].Revision
-		if rev != expectedRev {
-			t.Fatalf("Current commit for project %q is %v, it should be %v\n", localProject.Name, rev, expectedRev)
+		if want := fmt.Sprintf("<no-push>%t</no-push>", noPush); !strings.Contains(string(data), want) {
+			t.Errorf("local config %q does not contain %q", data, want)
+		}
+		lc, err := project.LocalConfigFromFile(jirix, configFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lc.NoPush != noPush {
+			t.Errorf("local config no-push: got %t, want %t", lc.NoPush, noPush)
 		}
 	}
 }
 
-func testLocalBranchesAreUpdated(t *testing.T, shouldLocalBeOnABranch, rebaseAll bool) {
+func TestProjectUpdateWhenNoRebase(t *testing.T) {
 	localProjects, fake, cleanup := setupUniverse(t)
 	defer cleanup()
 	if err := fake.UpdateUniverse(false); err != nil {
 		t.Fatal(err)
 	}
 
-	gitRemote := gitutil.New(fake.X, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"), gitutil.RootDirOpt(fake.Projects[localProjects[1].Name]))
-	if err := gitRemote.CreateAndCheckoutBranch("non-master"); err != nil {
-		t.Fatal(err)
-	}
-
-	// This will fetch non-master to local
+	lc := project.LocalConfig{NoRebase: true}
+	project.WriteLocalConfig(fake.X, localProjects[1], lc)
+	// Commit to master branch of a project 1.
+	writeReadme(t, fake.X, fake.Projects[localProjects[1].Name], "master commit")
+	gitRemote := git.NewGit(context.Background(), fake.Projects[localProjects[1].Name])
+	remoteRev, _ := gitRemote.CurrentRevision()
 	if err := fake.UpdateUniverse(false); err != nil {
 		t.Fatal(err)
 	}
 
-	writeReadme(t, fake.X, fake.Projects[localProjects[1].Name], "non-master commit")
+	gitLocal := git.NewGit(context.Background(), localProjects[1].Path)
+	localRev, _ := gitLocal.CurrentRevision()
 
-	if err := gitRemote.CheckoutBranch("master"); err != nil {
-		t.Fatal(err)
+	if remoteRev != localRev {
+		t.Fatal("local project should be updated")
 	}
-	writeReadme(t, fake.X, fake.Projects[localProjects[1].Name], "master commit")
+}
 
-	gitLocal := gitutil.New(fake.X, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"), gitutil.RootDirOpt(localProjects[1].Path))
+func TestBranchUpdateWhenNoRebase(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
 
-	// This will create a local branch non-master
-	if err := gitLocal.CheckoutBranch("non-master"); err != nil {
+	if err := fake.UpdateUniverse(false); err != nil {
 		t.Fatal(err)
 	}
+	gitLocal := gitutil.New(context.Background(), fake.X, gitutil.RootDirOpt(localProjects[1].Path))
+	gitLocal.CheckoutBranch("master")
 
-	// Go back to detached HEAD
-	if !shouldLocalBeOnABranch {
-		if err := gitLocal.CheckoutBranch("HEAD", gitutil.DetachOpt(true)); err != nil {
-			t.Fatal(err)
-		}
-	}
-
-	if err := project.UpdateUniverse(fake.X, false, false, false, false, rebaseAll, project.DefaultHookTimeout); err != nil {
+	lc := project.LocalConfig{NoRebase: true}
+	project.WriteLocalConfig(fake.X, localProjects[1], lc)
+	// Commit to master branch of a project 1.
+	writeReadme(t, fake.X, fake.Projects[localProjects[1].Name], "master commit")
+	gitRemote := git.NewGit(context.Background(), fake.Projects[localProjects[1].Name])
+	remoteRev, _ := gitRemote.CurrentRevision()
+	if err := fake.UpdateUniverse(false); err != nil {
 		t.Fatal(err)
 	}
 
-	if shouldLocalBeOnABranch && gitLocal.IsOnBranch() == false {
-		t.Fatalf("local repo should be on the branch after update")
-	} else if !shouldLocalBeOnABranch && gitLocal.IsOnBranch() == true {
-		t.Fatalf("local repo should be on detached head after update")
-	}
-
-	projects, err := project.LocalProjects(fake.X, project.FastScan)
-	if err != nil {
-		t.Fatal(err)
-	}
+	gl := git.NewGit(context.Background(), localProjects[1].Path)
+	localRev, _ := gl.CurrentRevision()
 
-	states, err := project.GetProjectStates(fake.X, projects, false)
-	if err != nil {
-		t.Fatal(err)
+	if remoteRev == localRev {
+		t.Fatal("local branch master should not be updated")
 	}
+}
 
-	state := states[localProjects[1].Key()]
-	if shouldLocalBeOnABranch && state.CurrentBranch.Name != "non-master" {
-		t.Fatalf("local repo should be on branch(non-master) it is on %q", state.CurrentBranch.Name)
-	}
+// TestUpdateUniverseForbidDetachedHead tests that all projects are left on a
+// local branch tracking their remote branch when detached HEAD is forbidden.
+func TestUpdateUniverseForbidDetachedHead(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	fake.X.ForbidDetachedHead = true
 
-	if rebaseAll {
-		for _, branch := range state.Branches {
-			if branch.Tracking != nil {
-				if branch.Revision != branch.Tracking.Revision {
-					t.Fatalf("branch %q has different revision then remote branch %q", branch.Name, branch.Tracking.Name)
-				}
+	checkOnBranch := func() {
+		for _, p := range localProjects {
+			gitLocal := gitutil.New(context.Background(), fake.X, gitutil.RootDirOpt(p.Path))
+			if !gitLocal.IsOnBranch() {
+				t.Fatalf("project %s(%s) is not on a branch", p.Name, p.Path)
 			}
-		}
-	} else {
-		for _, branch := range state.Branches {
-			if branch.Tracking != nil {
-				if branch.Name == state.CurrentBranch.Name {
-					if branch.Revision != branch.Tracking.Revision {
-						t.Fatalf("branch %q has different revision then remote branch %q", branch.Name, branch.Tracking.Name)
-					}
-				} else if branch.Revision == branch.Tracking.Revision {
-					t.Fatalf("branch %q should have different revision then remote branch %q", branch.Name, branch.Tracking.Name)
-				}
+			if tracking, err := gitLocal.TrackingBranchName(); err != nil {
+				t.Fatal(err)
+			} else if got, want := tracking, "origin/master"; got != want {
+				t.Fatalf("project %s(%s) tracks %q, want %q", p.Name, p.Path, got, want)
 			}
 		}
 	}
-}
-
-// TestLocalBranchesAreUpdatedWhenOnHead test that all the local branches are
-// updated on jiri update when local repo is on detached head
-func TestLocalBranchesAreUpdatedWhenOnHead(t *testing.T) {
-	testLocalBranchesAreUpdated(t, false, true)
-}
-
-// TestLocalBranchesAreUpdatedWhenOnBranch test that all the local branches are
-// updated on jiri update when local repo is on a branch
-func TestLocalBranchesAreUpdatedWhenOnBranch(t *testing.T) {
-	testLocalBranchesAreUpdated(t, true, true)
-}
-
-// TestLocalBranchesNotUpdatedWhenOnHead test that all the local branches are not
-// updated on jiri update when local repo is on detached head and rebaseAll is false
-func TestLocalBranchesNotUpdatedWhenOnHead(t *testing.T) {
-	testLocalBranchesAreUpdated(t, false, false)
-}
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	checkOnBranch()
 
-// TestLocalBranchesAreUpdatedWhenOnBranch test that all the local branches are not
-// updated on jiri update when local repo is on a branch and rebaseAll is false
-func TestLocalBranchesNotUpdatedWhenOnBranch(t *testing.T) {
-	testLocalBranchesAreUpdated(t, true, false)
+	// Commit to master branch of a project 1 and check that the local branch
+	// is fast-forwarded even when it was detached.
+	writeReadme(t, fake.X, fake.Projects[localProjects[1].Name], "master commit")
+	gitLocal := gitutil.New(context.Background(), fake.X, gitutil.RootDirOpt(localProjects[1].Path))
+	if err := gitLocal.CheckoutBranch("HEAD", gitutil.DetachOpt(true)); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	checkOnBranch()
+	checkReadme(t, fake.X, localProjects[1], "master commit")
 }
 
-func TestFileImportCycle(t *testing.T) {
-	jirix, cleanup := jiritest.NewX(t)
+// TestUpdateUniverseDefaultBranch tests that update checks out the default
+// branch of a project's local-config instead of a detached HEAD, but only if
+// the branch exists remotely.
+func TestUpdateUniverseDefaultBranch(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
 	defer cleanup()
 
-	// Set up the cycle .jiri_manifest -> A -> B -> A
-	jiriManifest := project.Manifest{
-		LocalImports: []project.LocalImport{
-			{File: "A"},
-		},
+	gitRemote := gitutil.New(context.Background(), fake.X, gitutil.RootDirOpt(fake.Projects[localProjects[1].Name]))
+	if err := gitRemote.CreateBranch("main"); err != nil {
+		t.Fatal(err)
 	}
-	manifestA := project.Manifest{
-		LocalImports: []project.LocalImport{
-			{File: "B"},
-		},
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
 	}
-	manifestB := project.Manifest{
-		LocalImports: []project.LocalImport{
-			{File: "A"},
-		},
+	lc := project.LocalConfig{DefaultBranch: "main"}
+	for _, p := range localProjects[1:3] {
+		if err := project.WriteLocalConfig(fake.X, p, lc); err != nil {
+			t.Fatal(err)
+		}
 	}
-	if err := jiriManifest.ToFile(jirix, jirix.JiriManifestFile()); err != nil {
+	if err := fake.UpdateUniverse(false); err != nil {
 		t.Fatal(err)
 	}
-	if err := manifestA.ToFile(jirix, filepath.Join(jirix.Root, "A")); err != nil {
+
+	gitLocal := gitutil.New(context.Background(), fake.X, gitutil.RootDirOpt(localProjects[1].Path))
+	if branch, err := gitLocal.CurrentBranchName(); err != nil {
 		t.Fatal(err)
+	} else if branch != "main" {
+		t.Fatalf("project %s is on branch %q, want %q", localProjects[1].Name, branch, "main")
 	}
-	if err := manifestB.ToFile(jirix, filepath.Join(jirix.Root, "B")); err != nil {
+	if tracking, err := gitLocal.TrackingBranchName(); err != nil {
 		t.Fatal(err)
+	} else if got, want := tracking, "origin/main"; got != want {
+		t.Fatalf("project %s tracks %q, want %q", localProjects[1].Name, got, want)
 	}
-
-	// The update should complain about the cycle.
-	err := project.UpdateUniverse(jirix, false, false, false, false, false, project.DefaultHookTimeout)
-	if got, want := fmt.Sprint(err), "import cycle detected in local manifest files"; !strings.Contains(got, want) {
-		t.Errorf("got error %v, want substr %v", got, want)
+	// Project 2 has no remote main branch and stays detached.
+	gitLocal = gitutil.New(context.Background(), fake.X, gitutil.RootDirOpt(localProjects[2].Path))
+	if gitLocal.IsOnBranch() {
+		t.Fatalf("project %s is on a branch, want a detached HEAD", localProjects[2].Name)
 	}
 }
 
-func TestRemoteImportCycle(t *testing.T) {
-	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+// TestHookLoadSimple tests that manifest is loaded correctly
+// with correct project path in hook
+func TestHookLoadSimple(t *testing.T) {
+	p, fake, cleanup := setupUniverse(t)
 	defer cleanup()
+	err := fake.AddHook(project.Hook{Name: "hook1",
+		Action:      "action.sh",
+		ProjectName: p[0].Name})
 
-	// Set up two remote manifest projects, remote1 and remote1.
-	if err := fake.CreateRemoteProject("remote1"); err != nil {
+	if err != nil {
 		t.Fatal(err)
 	}
-	if err := fake.CreateRemoteProject("remote2"); err != nil {
+	err = fake.UpdateUniverse(false)
+	if err == nil {
+		t.Fatal("run hook should throw error as there is no action.sh script")
+	}
+	if !strings.Contains(err.Error(), "no such file or directory") || !strings.Contains(err.Error(), "action.sh") {
 		t.Fatal(err)
 	}
-	remote1 := fake.Projects["remote1"]
-	remote2 := fake.Projects["remote2"]
-
-	fileA, fileB := filepath.Join(remote1, "A"), filepath.Join(remote2, "B")
+}
 
-	// Set up the cycle .jiri_manifest -> remote1+A -> remote2+B -> remote1+A
-	jiriManifest := project.Manifest{
-		Imports: []project.Import{
-			{Manifest: "A", Name: "n1", Remote: remote1},
-		},
-	}
-	manifestA := project.Manifest{
-		Imports: []project.Import{
-			{Manifest: "B", Name: "n2", Remote: remote2},
-		},
+// TestHookNotExecutable tests that update reports hooks whose action is not
+// executable, without running them.
+func TestHookNotExecutable(t *testing.T) {
+	p, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	writeFile(t, fake.X, fake.Projects[p[0].Name], "action.sh", "#!/bin/sh\nexit 0\n")
+	if err := fake.AddHook(project.Hook{Name: "hook1",
+		Action:      "action.sh",
+		ProjectName: p[0].Name}); err != nil {
+		t.Fatal(err)
 	}
-	manifestB := project.Manifest{
-		Imports: []project.Import{
-			{Manifest: "A", Name: "n3", Remote: remote1},
-		},
+	// Garbage collection only makes a single, full scan attempt, whose error
+	// is returned as is.
+	err := fake.UpdateUniverse(true)
+	hookErr, ok := err.(*project.HookNotExecutableError)
+	if !ok {
+		t.Fatalf("got error %v, want a HookNotExecutableError", err)
 	}
-	if err := jiriManifest.ToFile(fake.X, fake.X.JiriManifestFile()); err != nil {
+	if want := filepath.Join(p[0].Path, "action.sh"); hookErr.Path != want {
+		t.Errorf("got path %q, want %q", hookErr.Path, want)
+	}
+	if !strings.Contains(err.Error(), "chmod +x") {
+		t.Errorf("error %q should suggest chmod +x", err)
+	}
+
+	if err := os.Chmod(hookErr.Path, 0755); err != nil {
 		t.Fatal(err)
 	}
-	if err := manifestA.ToFile(fake.X, fileA); err != nil {
+	if err := fake.UpdateUniverse(false); err != nil {
 		t.Fatal(err)
 	}
-	if err := manifestB.ToFile(fake.X, fileB); err != nil {
+
+	// The action of a checked out project is checked before any project is
+	// updated.
+	if err := os.Chmod(hookErr.Path, 0644); err != nil {
 		t.Fatal(err)
 	}
-	commitFile(t, fake.X, remote1, fileA, "commit A")
-	commitFile(t, fake.X, remote2, fileB, "commit B")
+	writeReadme(t, fake.X, fake.Projects[p[1].Name], "new readme")
+	if err := fake.UpdateUniverse(true); err == nil {
+		t.Fatalf("update should have failed")
+	} else if _, ok := err.(*project.HookNotExecutableError); !ok {
+		t.Fatalf("got error %v, want a HookNotExecutableError", err)
+	}
+	checkReadme(t, fake.X, p[1], "initial readme")
+}
 
-	// The update should complain about the cycle.
-	err := project.UpdateUniverse(fake.X, false, false, false, false, false, project.DefaultHookTimeout)
-	if got, want := fmt.Sprint(err), "import cycle detected in remote manifest imports"; !strings.Contains(got, want) {
-		t.Errorf("got error %v, want substr %v", got, want)
+// TestHookOrder checks that the hooks of nested projects run after those of
+// their parents, unless their after attribute says otherwise.
+func TestHookOrder(t *testing.T) {
+	p, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	logFile := filepath.Join(fake.X.Root, "hooks.log")
+	// The hook of the outermost project is the slowest, so that it would
+	// finish last if the hooks ran in parallel.
+	for i, delay := range map[int]string{2: "1", 3: "0", 4: "0"} {
+		dir := fake.Projects[p[i].Name]
+		script := fmt.Sprintf("#!/bin/sh\nsleep %s\necho %s >> %s\n", delay, p[i].Name, logFile)
+		if err := ioutil.WriteFile(filepath.Join(dir, "hook.sh"), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+		commitFile(t, fake.X, dir, "hook.sh", "creating hook.sh")
+	}
+	setHooks := func(after map[int]string) {
+		m, err := fake.ReadRemoteManifest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.Hooks = nil
+		for _, i := range []int{2, 3, 4} {
+			m.Hooks = append(m.Hooks, project.Hook{Name: "hook", Action: "hook.sh", ProjectName: p[i].Name, After: after[i]})
+		}
+		if err := fake.WriteRemoteManifest(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkOrder := func(want ...int) {
+		data, err := ioutil.ReadFile(logFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var wantNames []string
+		for _, i := range want {
+			wantNames = append(wantNames, p[i].Name)
+		}
+		if got := strings.Fields(string(data)); !reflect.DeepEqual(got, wantNames) {
+			t.Errorf("got hooks run in order %v, want %v", got, wantNames)
+		}
+		if err := os.Remove(logFile); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	setHooks(nil)
+	if err := fake.UpdateUniverse(true); err != nil {
+		t.Fatal(err)
+	}
+	checkOrder(2, 3, 4)
+
+	// The after attribute overrides the nesting order.
+	setHooks(map[int]string{2: p[3].Name, 3: p[0].Name})
+	if err := fake.UpdateUniverse(true); err != nil {
+		t.Fatal(err)
+	}
+	checkOrder(3, 2, 4)
+
+	setHooks(map[int]string{3: p[4].Name})
+	if err := fake.UpdateUniverse(true); err == nil || !strings.Contains(err.Error(), "depends on itself") {
+		t.Errorf("got error %v, want a dependency cycle", err)
 	}
 }
 
-func TestFileAndRemoteImportCycle(t *testing.T) {
-	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+// TestPostCloneHook checks that the post-clone hook of a project only runs
+// after it is first cloned.
+func TestPostCloneHook(t *testing.T) {
+	p, fake, cleanup := setupUniverse(t)
 	defer cleanup()
+	logFile := filepath.Join(fake.X.Root, "setup.log")
+	dir := fake.Projects[p[1].Name]
+	script := fmt.Sprintf("#!/bin/sh\necho $(pwd) >> %s\n", logFile)
+	if err := ioutil.WriteFile(filepath.Join(dir, "setup.sh"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	commitFile(t, fake.X, dir, "setup.sh", "creating setup.sh")
+	m, err := fake.ReadRemoteManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mp, err := m.FindProject(p[1].Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mp.PostCloneHook = "setup.sh"
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+	checkRuns := func(want int) {
+		data, err := ioutil.ReadFile(logFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Fields(string(data))
+		if len(lines) != want {
+			t.Fatalf("got %d post-clone hook runs, want %d", len(lines), want)
+		}
+		for _, line := range lines {
+			if line != p[1].Path {
+				t.Errorf("post-clone hook ran in %s, want %s", line, p[1].Path)
+			}
+		}
+	}
 
-	// Set up two remote manifest projects, remote1 and remote2.
-	// Set up two remote manifest projects, remote1 and remote1.
-	if err := fake.CreateRemoteProject("remote1"); err != nil {
+	if err := fake.UpdateUniverse(false); err != nil {
 		t.Fatal(err)
 	}
-	if err := fake.CreateRemoteProject("remote2"); err != nil {
+	checkRuns(1)
+	if _, err := os.Stat(filepath.Join(p[1].Path, jiri.ProjectMetaDir, "clone-hook-done")); err != nil {
 		t.Fatal(err)
 	}
-	remote1 := fake.Projects["remote1"]
-	remote2 := fake.Projects["remote2"]
-	fileA, fileD := filepath.Join(remote1, "A"), filepath.Join(remote1, "D")
-	fileB, fileC := filepath.Join(remote2, "B"), filepath.Join(remote2, "C")
 
-	// Set up the cycle .jiri_manifest -> remote1+A -> remote2+B -> C -> remote1+D -> A
-	jiriManifest := project.Manifest{
-		Imports: []project.Import{
-			{Manifest: "A", Root: "r1", Name: "n1", Remote: remote1},
-		},
+	writeReadme(t, fake.X, dir, "new revision")
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
 	}
-	manifestA := project.Manifest{
-		Imports: []project.Import{
-			{Manifest: "B", Root: "r2", Name: "n2", Remote: remote2},
-		},
+	checkReadme(t, fake.X, p[1], "new revision")
+	checkRuns(1)
+
+	// The hook runs again on the next update once its sentinel is gone, e.g.
+	// because it failed.
+	if err := os.Remove(filepath.Join(p[1].Path, jiri.ProjectMetaDir, "clone-hook-done")); err != nil {
+		t.Fatal(err)
 	}
-	manifestB := project.Manifest{
-		LocalImports: []project.LocalImport{
-			{File: "C"},
-		},
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
 	}
-	manifestC := project.Manifest{
-		Imports: []project.Import{
-			{Manifest: "D", Root: "r3", Name: "n3", Remote: remote1},
-		},
+	checkRuns(2)
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
 	}
-	manifestD := project.Manifest{
-		LocalImports: []project.LocalImport{
-			{File: "A"},
-		},
+	checkRuns(2)
+}
+
+// TestSkipHooks tests that update doesn't run the hooks named in
+// SkipHooks, and only warns about the names matching no hook.
+func TestSkipHooks(t *testing.T) {
+	p, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	logFile := filepath.Join(fake.X.Root, "hooks.log")
+	for _, name := range []string{"codegen", "setup"} {
+		dir := fake.Projects[p[1].Name]
+		script := fmt.Sprintf("#!/bin/sh\necho %s >> %s\n", name, logFile)
+		if err := ioutil.WriteFile(filepath.Join(dir, name+".sh"), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+		commitFile(t, fake.X, dir, name+".sh", "creating "+name+".sh")
+		if err := fake.AddHook(project.Hook{Name: name, Action: name + ".sh", ProjectName: p[1].Name}); err != nil {
+			t.Fatal(err)
+		}
 	}
-	if err := jiriManifest.ToFile(fake.X, fake.X.JiriManifestFile()); err != nil {
+
+	if err := fake.UpdateUniverseWithOpts(project.UpdateUniverseOpts{SkipHooks: []string{"codegen", "unknown"}}); err != nil {
 		t.Fatal(err)
 	}
-	if err := manifestA.ToFile(fake.X, fileA); err != nil {
+	data, err := ioutil.ReadFile(logFile)
+	if err != nil {
 		t.Fatal(err)
 	}
-	if err := manifestB.ToFile(fake.X, fileB); err != nil {
+	if got, want := strings.Fields(string(data)), []string{"setup"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got hooks %v run, want %v", got, want)
+	}
+}
+
+// TestNoHooks tests that update runs none of the hooks when NoHooks is set.
+func TestNoHooks(t *testing.T) {
+	p, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	logFile := filepath.Join(fake.X.Root, "hooks.log")
+	dir := fake.Projects[p[1].Name]
+	script := fmt.Sprintf("#!/bin/sh\necho setup >> %s\n", logFile)
+	if err := ioutil.WriteFile(filepath.Join(dir, "setup.sh"), []byte(script), 0755); err != nil {
 		t.Fatal(err)
 	}
-	if err := manifestC.ToFile(fake.X, fileC); err != nil {
+	commitFile(t, fake.X, dir, "setup.sh", "creating setup.sh")
+	if err := fake.AddHook(project.Hook{Name: "setup", Action: "setup.sh", ProjectName: p[1].Name}); err != nil {
 		t.Fatal(err)
 	}
-	if err := manifestD.ToFile(fake.X, fileD); err != nil {
+
+	if err := fake.UpdateUniverseWithOpts(project.UpdateUniverseOpts{NoHooks: true}); err != nil {
 		t.Fatal(err)
 	}
-	commitFile(t, fake.X, remote1, fileA, "commit A")
-	commitFile(t, fake.X, remote2, fileB, "commit B")
-	commitFile(t, fake.X, remote2, fileC, "commit C")
-	commitFile(t, fake.X, remote1, fileD, "commit D")
+	checkReadme(t, fake.X, p[1], "initial readme")
+	if _, err := os.Stat(logFile); !os.IsNotExist(err) {
+		t.Fatalf("hook ran with NoHooks set: %v", err)
+	}
 
-	// The update should complain about the cycle.
-	err := project.UpdateUniverse(fake.X, false, false, false, false, false, project.DefaultHookTimeout)
-	if got, want := fmt.Sprint(err), "import cycle detected"; !strings.Contains(got, want) {
-		t.Errorf("got error %v, want substr %v", got, want)
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(logFile); err != nil {
+		t.Fatalf("hook didn't run: %v", err)
 	}
 }
 
-func TestManifestToFromBytes(t *testing.T) {
-	tests := []struct {
-		Manifest project.Manifest
-		XML      string
-	}{
-		{
-			project.Manifest{},
-			`<manifest>
-</manifest>
-`,
-		},
-		{
-			project.Manifest{
-				Imports: []project.Import{
-					{
-						Manifest:     "manifest1",
-						Name:         "remoteimport1",
-						Remote:       "remote1",
-						RemoteBranch: "master",
-					},
-					{
-						Manifest:     "manifest2",
-						Name:         "remoteimport2",
-						Remote:       "remote2",
-						RemoteBranch: "branch2",
-					},
-				},
-				LocalImports: []project.LocalImport{
-					{File: "fileimport"},
-				},
-				Projects: []project.Project{
-					{
-						Name:         "project1",
-						Path:         "path1",
-						Remote:       "remote1",
-						RemoteBranch: "master",
-						Revision:     "HEAD",
-						GerritHost:   "https://test-review.googlesource.com",
-						GitHooks:     "path/to/githooks",
-					},
-					{
-						Name:         "project2",
-						Path:         "path2",
-						Remote:       "remote2",
-						RemoteBranch: "branch2",
-						Revision:     "rev2",
-					},
-				},
-				Hooks: []project.Hook{
-					{
-						Name:        "testhook",
-						ProjectName: "project1",
-						Action:      "action.sh",
-					},
-				},
-			},
-			`<manifest>
-  <imports>
-    <import manifest="manifest1" name="remoteimport1" remote="remote1"/>
-    <import manifest="manifest2" name="remoteimport2" remote="remote2" remotebranch="branch2"/>
-    <localimport file="fileimport"/>
-  </imports>
+// TestHookJobs tests that with HookJobs set all the hooks run, no more
+// than HookJobs at once, and the errors of all the failing hooks are reported.
+func TestHookJobs(t *testing.T) {
+	p, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	running := filepath.Join(fake.X.Root, "running")
+	if err := os.MkdirAll(running, 0755); err != nil {
+		t.Fatal(err)
+	}
+	logFile := filepath.Join(fake.X.Root, "hooks.log")
+	dir := fake.Projects[p[1].Name]
+	names := []string{"hook1", "hook2", "hook3", "hook4", "hook5", "hook6"}
+	for i, name := range names {
+		// Every hook logs its name along with the number of hooks running.
+		script := fmt.Sprintf("#!/bin/sh\ntouch %[1]s/%[2]s\necho %[2]s $(ls %[1]s | wc -l) >> %[3]s\nsleep 0.2\nrm %[1]s/%[2]s\n", running, name, logFile)
+		if i%3 == 0 {
+			script += "exit 1\n"
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name+".sh"), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+		commitFile(t, fake.X, dir, name+".sh", "creating "+name+".sh")
+		if err := fake.AddHook(project.Hook{Name: name, Action: name + ".sh", ProjectName: p[1].Name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	const hookJobs = 4
+	// Without gc, a failing update is retried with a full scan.
+	err := fake.UpdateUniverseWithOpts(project.UpdateUniverseOpts{GC: true, HookJobs: hookJobs})
+	if multiErr, ok := err.(project.MultiError); !ok {
+		t.Errorf("got error %v, want a project.MultiError", err)
+	} else if got, want := len(multiErr), 2; got != want {
+		t.Errorf("got %d hook errors, want %d: %v", got, want, multiErr)
+	}
+	data, err := ioutil.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ran []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			t.Fatalf("unexpected log line %q", line)
+		}
+		ran = append(ran, fields[0])
+		if n, err := strconv.Atoi(fields[1]); err != nil {
+			t.Fatal(err)
+		} else if n > hookJobs {
+			t.Errorf("hook %s ran along with %d hooks, want at most %d", fields[0], n, hookJobs)
+		}
+	}
+	sort.Strings(ran)
+	if !reflect.DeepEqual(ran, names) {
+		t.Errorf("got hooks %v run, want %v", ran, names)
+	}
+}
+
+// TestMirrorProjectHooks tests that the hooks of mirror projects aren't run,
+// and that they are left out of the environment file.
+func TestMirrorProjectHooks(t *testing.T) {
+	p, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	for _, i := range []int{1, 2} {
+		dir := fake.Projects[p[i].Name]
+		script := fmt.Sprintf("#!/bin/sh\ntouch %s\n", filepath.Join(fake.X.Root, "hook-"+p[i].Name))
+		if err := ioutil.WriteFile(filepath.Join(dir, "hook.sh"), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+		commitFile(t, fake.X, dir, "hook.sh", "creating hook.sh")
+		if err := fake.AddHook(project.Hook{Name: "hook", Action: "hook.sh", ProjectName: p[i].Name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m, err := fake.ReadRemoteManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mp, err := m.FindProject(p[2].Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mp.MirrorOf = p[1].Name
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(fake.X.Root, "hook-"+p[1].Name)); err != nil {
+		t.Errorf("hook of project %s didn't run: %v", p[1].Name, err)
+	}
+	if _, err := os.Stat(filepath.Join(fake.X.Root, "hook-"+p[2].Name)); !os.IsNotExist(err) {
+		t.Errorf("hook of mirror project %s ran: %v", p[2].Name, err)
+	}
+
+	envFile := filepath.Join(fake.X.Root, "env")
+	if err := project.WriteProjectEnvFile(fake.X, envFile); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(envFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "="+p[1].Path+"\n") {
+		t.Errorf("project %s not in environment file:\n%s", p[1].Name, data)
+	}
+	if strings.Contains(string(data), "="+p[2].Path+"\n") {
+		t.Errorf("mirror project %s in environment file:\n%s", p[2].Name, data)
+	}
+}
+
+// TestOnFailureHooks tests that on-failure hooks only run when the update of
+// their project fails, without hiding the error of the update.
+func TestOnFailureHooks(t *testing.T) {
+	p, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	dir := fake.Projects[p[1].Name]
+	logFile := filepath.Join(fake.X.Root, "on-failure.log")
+	script := fmt.Sprintf("#!/bin/sh\necho \"$JIRI_FAILED_PROJECT_PATH\" >> %[1]s\necho \"$JIRI_UPDATE_ERROR\" >> %[1]s\nexit 1\n", logFile)
+	if err := ioutil.WriteFile(filepath.Join(dir, "cleanup.sh"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	commitFile(t, fake.X, dir, "cleanup.sh", "creating cleanup.sh")
+	if err := fake.AddHook(project.Hook{Name: "cleanup", Action: "cleanup.sh", ProjectName: p[1].Name, Phase: project.OnFailurePhase}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(logFile); !os.IsNotExist(err) {
+		t.Fatalf("on-failure hook ran after a successful update: %v", err)
+	}
+
+	// Make the fetch of the project fail.
+	if err := os.Rename(dir, dir+".moved"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Rename(dir+".moved", dir)
+	err := fake.UpdateUniverseWithOpts(project.UpdateUniverseOpts{SkipOnFailureHooks: true})
+	if err == nil {
+		t.Fatalf("update of project %s should have failed", p[1].Name)
+	}
+	if _, err := os.Stat(logFile); !os.IsNotExist(err) {
+		t.Fatalf("on-failure hook ran with SkipOnFailureHooks set: %v", err)
+	}
+
+	// The fast and full scans both fail, the hook runs once.
+	err = fake.UpdateUniverse(false)
+	if err == nil || !strings.Contains(err.Error(), "fetch failed for "+p[1].Name) {
+		t.Fatalf("got error %v, want a fetch failure of project %s", err, p[1].Name)
+	}
+	data, err := ioutil.ReadFile(logFile)
+	if err != nil {
+		t.Fatalf("on-failure hook didn't run: %v", err)
+	}
+	lines := strings.SplitN(string(data), "\n", 2)
+	if len(lines) != 2 || lines[0] != p[1].Path || !strings.Contains(lines[1], "fetch failed for "+p[1].Name) {
+		t.Errorf("on-failure hook got unexpected environment:\n%s", data)
+	}
+	if got := strings.Count(string(data), p[1].Path+"\n"); got != 1 {
+		t.Errorf("on-failure hook ran %d times, want once:\n%s", got, data)
+	}
+}
+
+// TestUpdateUniverseSharedRemote tests that projects sharing a remote are
+// fetched from it only once.
+func TestUpdateUniverseSharedRemote(t *testing.T) {
+	p, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	m, err := fake.ReadRemoteManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mp, err := m.FindProject(p[1].Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dup := *mp
+	dup.Name += "-dup"
+	dup.Path += "-dup"
+	m.Projects = append(m.Projects, dup)
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	copyPath := filepath.Join(fake.X.Root, dup.Path)
+	checkReadme(t, fake.X, project.Project{Path: copyPath}, "initial readme")
+
+	writeReadme(t, fake.X, fake.Projects[p[1].Name], "new readme")
+	var buf bytes.Buffer
+	level := fake.X.Logger.LoggerLevel
+	fake.X.Logger.LoggerLevel = log.TraceLevel
+	fake.X.Logger.LogFile = &buf
+	defer func() {
+		fake.X.Logger.LoggerLevel = level
+		fake.X.Logger.LogFile = nil
+	}()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	fetches := 0
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.Contains(line, "Run: git fetch") && strings.Contains(line, " origin") &&
+			(strings.HasSuffix(line, "("+p[1].Path+")") || strings.HasSuffix(line, "("+copyPath+")")) {
+			fetches++
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("got %d fetches of the shared remote, want 1:\n%s", fetches, buf.String())
+	}
+	checkReadme(t, fake.X, p[1], "new readme")
+	checkReadme(t, fake.X, project.Project{Path: copyPath}, "new readme")
+}
+
+// TestUpdateUniverseRequirePinned tests that update fails on the projects not
+// pinned to a revision if RequirePinned is set.
+func TestUpdateUniverseRequirePinned(t *testing.T) {
+	p, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	m, err := fake.ReadRemoteManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pinned, err := m.FindProject(p[0].Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pinned.Revision, err = git.NewGit(context.Background(), fake.Projects[p[0].Name]).CurrentRevision(); err != nil {
+		t.Fatal(err)
+	}
+	// The manifest file has no revision for the floating projects.
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+
+	err = fake.UpdateUniverseWithOpts(project.UpdateUniverseOpts{GC: true, RequirePinned: true})
+	if err == nil {
+		t.Fatalf("update with floating projects should have failed")
+	}
+	if !strings.Contains(err.Error(), p[1].Name+"(") {
+		t.Errorf("got error %q, want floating project %s listed", err, p[1].Name)
+	}
+	if strings.Contains(err.Error(), p[0].Name+"(") {
+		t.Errorf("got error %q, want pinned project %s not listed", err, p[0].Name)
+	}
+	if _, err := os.Stat(p[0].Path); !os.IsNotExist(err) {
+		t.Errorf("project %s was checked out by the failed update", p[0].Name)
+	}
+
+	if err := fake.UpdateUniverse(true); err != nil {
+		t.Fatal(err)
+	}
+	checkReadme(t, fake.X, p[0], "initial readme")
+}
+
+// TestLFS tests that git-lfs is set up in projects using it after they are
+// cloned, and their git-lfs objects pulled after every update unless
+// jirix.LFSSkip is set.
+func TestLFS(t *testing.T) {
+	p, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+
+	// Replace git-lfs by a script logging its arguments.
+	logFile := filepath.Join(fake.X.Root, "git-lfs.log")
+	bin := filepath.Join(fake.X.Root, "bin")
+	if err := os.MkdirAll(bin, 0755); err != nil {
+		t.Fatal(err)
+	}
+	script := fmt.Sprintf("#!/bin/sh\necho \"$(pwd) $*\" >> %s\n", logFile)
+	if err := ioutil.WriteFile(filepath.Join(bin, "git-lfs"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// git gets the PATH of the jiri environment.
+	env := fake.X.Env()
+	oldPath := env["PATH"]
+	env["PATH"] = bin + string(os.PathListSeparator) + oldPath
+	defer func() { env["PATH"] = oldPath }()
+
+	m, err := fake.ReadRemoteManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mp, err := m.FindProject(p[1].Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mp.LFS = true
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+	checkCalls := func(want ...string) {
+		data, err := ioutil.ReadFile(logFile)
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		var got []string
+		if s := strings.TrimSpace(string(data)); s != "" {
+			got = strings.Split(s, "\n")
+		}
+		for i := range want {
+			want[i] = p[1].Path + " " + want[i]
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("got git-lfs calls %q, want %q", got, want)
+		}
+	}
+
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	checkCalls("install --local", "pull")
+
+	writeReadme(t, fake.X, fake.Projects[p[1].Name], "new revision")
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	checkCalls("install --local", "pull", "pull")
+
+	fake.X.LFSSkip = true
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	checkCalls("install --local", "pull", "pull")
+
+	// Nor are those of a project whose local config forbids its update.
+	fake.X.LFSSkip = false
+	if err := project.WriteLocalConfig(fake.X, p[1], project.LocalConfig{NoUpdate: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	checkCalls("install --local", "pull", "pull")
+}
+
+// TestManifestJiriConfig tests that the jiri settings of the manifest are
+// used, with those of the importing manifests taking precedence.
+func TestManifestJiriConfig(t *testing.T) {
+	_, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+
+	m, err := fake.ReadRemoteManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.JiriConfig = &project.JiriConfig{Jobs: 7, UpdateHistoryRetention: 3}
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fake.X.Jobs, uint(7); got != want {
+		t.Errorf("got %d jobs, want %d", got, want)
+	}
+	if got, want := fake.X.UpdateHistoryRetention, 3; got != want {
+		t.Errorf("got update history retention %d, want %d", got, want)
+	}
+
+	// .jiri_manifest imports the remote manifest.
+	m, err = fake.ReadJiriManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.JiriConfig = &project.JiriConfig{Jobs: 5}
+	if err := fake.WriteJiriManifest(m); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fake.X.Jobs, uint(5); got != want {
+		t.Errorf("got %d jobs, want %d", got, want)
+	}
+	if got, want := fake.X.UpdateHistoryRetention, 3; got != want {
+		t.Errorf("got update history retention %d, want %d", got, want)
+	}
+}
+
+// TestHookLoadError tests that manifest load
+// throws error for invalid hook
+func TestHookLoadError(t *testing.T) {
+	_, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	err := fake.AddHook(project.Hook{Name: "hook1",
+		Action:      "action",
+		ProjectName: "non-existant"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fake.UpdateUniverse(false)
+	if err == nil {
+		t.Fatal("Update universe should throw error for the hook")
+	}
+	if !strings.Contains(err.Error(), "invalid hook") {
+		t.Fatal(err)
+	}
+}
+
+// TestUpdateUniverseWithGitHooks tests that the git hooks of a project are
+// installed on every update, and that invalid git hooks are reported.
+func TestUpdateUniverseWithGitHooks(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+	if err := fake.CreateRemoteProject("p"); err != nil {
+		t.Fatal(err)
+	}
+	writeReadme(t, fake.X, fake.Projects["p"], "initial readme")
+	gitHooksDir := filepath.Join(fake.X.Root, "git-hooks")
+	if err := os.MkdirAll(gitHooksDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	hook := filepath.Join(gitHooksDir, "pre-commit")
+	if err := ioutil.WriteFile(hook, []byte("#!/bin/sh\nexit 0\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	p := project.Project{
+		Name:     "p",
+		Path:     filepath.Join(fake.X.Root, "p"),
+		Remote:   fake.Projects["p"],
+		GitHooks: gitHooksDir,
+	}
+	if err := fake.AddProject(p); err != nil {
+		t.Fatal(err)
+	}
+
+	installedHook := filepath.Join(p.Path, ".git", "hooks", "pre-commit")
+	for i := 0; i < 2; i++ {
+		if err := fake.UpdateUniverse(false); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(installedHook)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm()&0111 == 0 {
+			t.Fatalf("expected hook %q to be executable, got mode %v", installedHook, info.Mode())
+		}
+	}
+
+	if err := os.Chmod(hook, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.UpdateUniverse(false); err == nil {
+		t.Fatalf("expected update to fail with a non-executable git hook")
+	}
+	if err := os.RemoveAll(gitHooksDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.UpdateUniverse(false); err == nil {
+		t.Fatalf("expected update to fail with a missing githooks directory")
+	}
+}
+
+// TestJiriExcludeForRepoUpdate tests that .git/info/exclude contains
+// /.jiri/ after every update
+func TestJiriExcludeForRepoUpdate(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	p := localProjects[0]
+	if _, err := os.Stat(p.Path); err != nil {
+		t.Fatalf("%v", err)
+	}
+	gitInfoExcludeFile := filepath.Join(p.Path, ".git", "info", "exclude")
+
+	// Test when exclude doesn't exist
+	if err := os.RemoveAll(gitInfoExcludeFile); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	checkMetadataIsIgnored(t, fake.X, p)
+
+	// Check when exclude doesn't have /.jiri/
+	if err := ioutil.WriteFile(gitInfoExcludeFile, []byte(""), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	checkMetadataIsIgnored(t, fake.X, p)
+}
+
+// TestMetadataIgnoreFile tests that the metadata ignore file in the root lists
+// the jiri metadata directories after every update, without duplicating them or
+// dropping other patterns.
+func TestMetadataIgnoreFile(t *testing.T) {
+	_, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+
+	fake.X.MetadataIgnoreFile = ".ignore"
+	ignoreFile := filepath.Join(fake.X.Root, ".ignore")
+	patterns := []string{"/.jiri_root/", ".jiri/"}
+	check := func(want string) {
+		data, err := ioutil.ReadFile(ignoreFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(data); got != want {
+			t.Errorf("got %s content %q, want %q", ignoreFile, got, want)
+		}
+	}
+
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	check(strings.Join(patterns, "\n") + "\n")
+
+	// Existing patterns are kept, and missing ones are added once.
+	if err := ioutil.WriteFile(ignoreFile, []byte("out/\n.jiri/"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := fake.UpdateUniverse(false); err != nil {
+			t.Fatal(err)
+		}
+		check("out/\n.jiri/\n/.jiri_root/\n")
+	}
+}
+
+// TestUpdateUniverseWithRevision checks that UpdateUniverse will pull remote
+// projects at the specified revision.
+func TestUpdateUniverseWithRevision(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+
+	// Set project 1's revision in the manifest to the current revision.
+	g := git.NewGit(context.Background(), fake.Projects[localProjects[1].Name])
+	rev, err := g.CurrentRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := fake.ReadRemoteManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	projects := []project.Project{}
+	for _, p := range m.Projects {
+		if p.Name == localProjects[1].Name {
+			p.Revision = rev
+		}
+		projects = append(projects, p)
+	}
+	m.Projects = projects
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+	// Update README in all projects.
+	for _, remoteProjectDir := range fake.Projects {
+		writeReadme(t, fake.X, remoteProjectDir, "new revision")
+	}
+	// Check that calling UpdateUniverse() updates all projects except for
+	// project 1.
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	for i, p := range localProjects {
+		if i == 1 {
+			checkReadme(t, fake.X, p, "initial readme")
+		} else {
+			checkReadme(t, fake.X, p, "new revision")
+		}
+	}
+}
+
+// TestUpdateUniverseWithTag checks that UpdateUniverse checks out the tag a
+// project is pinned to, fetching only that tag.
+func TestUpdateUniverseWithTag(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+	if err := fake.CreateRemoteProject("p"); err != nil {
+		t.Fatal(err)
+	}
+	remote := fake.Projects["p"]
+	scm := gitutil.New(context.Background(), fake.X, gitutil.RootDirOpt(remote))
+	for _, tag := range []string{"v1", "v2"} {
+		writeReadme(t, fake.X, remote, tag)
+		if err := scm.CreateLightweightTag(tag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeReadme(t, fake.X, remote, "latest")
+	p := project.Project{
+		Name:   "p",
+		Path:   filepath.Join(fake.X.Root, "p"),
+		Remote: remote,
+	}
+	if err := fake.AddProject(p); err != nil {
+		t.Fatal(err)
+	}
+
+	setRevision := func(revision string) {
+		m, err := fake.ReadRemoteManifest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		mp, err := m.FindProject(p.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mp.Revision = revision
+		if err := fake.WriteRemoteManifest(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hasTag := func(tag string) bool {
+		_, err := git.NewGit(context.Background(), p.Path).CurrentRevisionForRef("refs/tags/" + tag)
+		return err == nil
+	}
+
+	setRevision("refs/tags/v1")
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	checkReadme(t, fake.X, p, "v1")
+	if hasTag("v2") {
+		t.Errorf("tag v2 should not have been fetched")
+	}
+
+	setRevision("refs/tags/v2")
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	checkReadme(t, fake.X, p, "v2")
+	if !hasTag("v2") {
+		t.Errorf("tag v2 should have been fetched")
+	}
+
+	// The project can move from a tag back to its remote branch.
+	setRevision("")
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	checkReadme(t, fake.X, p, "latest")
+}
+
+// TestUpdateUniverseRevisionMissingAfterFetch checks that UpdateUniverse
+// fetches all branches again when a fetch doesn't bring in the revision of a
+// project, and reports revisions which can't be found at all.
+func TestUpdateUniverseRevisionMissingAfterFetch(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a partial fetch by restricting the fetch refspec of project 1
+	// to a branch which doesn't contain its new revision.
+	p := localProjects[1]
+	scm := gitutil.New(context.Background(), fake.X, gitutil.RootDirOpt(p.Path))
+	if err := scm.Config("remote.origin.fetch", "+refs/heads/other:refs/remotes/origin/other"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gitutil.New(context.Background(), fake.X, gitutil.RootDirOpt(fake.Projects[p.Name])).CreateBranch("other"); err != nil {
+		t.Fatal(err)
+	}
+	writeReadme(t, fake.X, fake.Projects[p.Name], "new revision")
+	rev, err := git.NewGit(context.Background(), fake.Projects[p.Name]).CurrentRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+	setRevision := func(revision string) {
+		m, err := fake.ReadRemoteManifest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		mp, err := m.FindProject(p.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mp.Revision = revision
+		if err := fake.WriteRemoteManifest(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setRevision(rev)
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	checkReadme(t, fake.X, p, "new revision")
+
+	missing := "0123456789abcdef0123456789abcdef01234567"
+	setRevision(missing)
+	err = fake.UpdateUniverse(false)
+	if err == nil {
+		t.Fatal("UpdateUniverse() should have failed")
+	}
+	want := fmt.Sprintf("revision %q of project %s(%s) no longer present on remote %q (possibly force-pushed)", missing, p.Name, p.Path, p.Remote)
+	if !strings.Contains(err.Error(), want) {
+		t.Errorf("got error %q, want it to contain %q", err, want)
+	}
+}
+
+// TestUpdateUniverseRevisionMissingAfterFetchShallow checks that the refetch
+// of a revision missing after fetching a shallow project keeps its depth.
+func TestUpdateUniverseRevisionMissingAfterFetchShallow(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	p := localProjects[1]
+	m, err := fake.ReadRemoteManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mp, err := m.FindProject(p.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mp.FetchDepth = 1
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Restrict the fetch refspec of the project to a branch which doesn't
+	// contain its new revision, which is two commits ahead.
+	scm := gitutil.New(context.Background(), fake.X, gitutil.RootDirOpt(p.Path))
+	if err := scm.Config("remote.origin.fetch", "+refs/heads/other:refs/remotes/origin/other"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gitutil.New(context.Background(), fake.X, gitutil.RootDirOpt(fake.Projects[p.Name])).CreateBranch("other"); err != nil {
+		t.Fatal(err)
+	}
+	writeReadme(t, fake.X, fake.Projects[p.Name], "skipped revision")
+	writeReadme(t, fake.X, fake.Projects[p.Name], "new revision")
+	rev, err := git.NewGit(context.Background(), fake.Projects[p.Name]).CurrentRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, err = fake.ReadRemoteManifest(); err != nil {
+		t.Fatal(err)
+	}
+	if mp, err = m.FindProject(p.Name); err != nil {
+		t.Fatal(err)
+	}
+	mp.Revision = rev
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	checkReadme(t, fake.X, p, "new revision")
+	if out, err := exec.Command("git", "-C", p.Path, "cat-file", "-e", rev+"~1").CombinedOutput(); err == nil {
+		t.Errorf("the parent of %s was fetched, want the project fetched with depth 1: %s", rev, out)
+	}
+}
+
+// TestUpdateUniverseForcePushedRevision checks that update reports a pinned
+// revision which was force-pushed out of the remote, and skips its project
+// when SkipMissingRevisions is set.
+func TestUpdateUniverseForcePushedRevision(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	p, other := localProjects[1], localProjects[2]
+	remote := fake.Projects[p.Name]
+	oldRev, err := git.NewGit(context.Background(), p.Path).CurrentRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Commit a revision to the remote and rewrite it out of its history
+	// before it is fetched.
+	writeReadme(t, fake.X, remote, "force-pushed")
+	rev, err := git.NewGit(context.Background(), remote).CurrentRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"reset", "--hard", "HEAD~1"},
+		{"reflog", "expire", "--expire=now", "--all"},
+		{"gc", "--prune=now", "--quiet"},
+	} {
+		if out, err := exec.Command("git", append([]string{"-C", remote}, args...)...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, out)
+		}
+	}
+	m, err := fake.ReadRemoteManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mp, err := m.FindProject(p.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mp.Revision = rev
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+	writeReadme(t, fake.X, fake.Projects[other.Name], "other readme")
+
+	err = fake.UpdateUniverse(true)
+	if err == nil {
+		t.Fatal("UpdateUniverse() should have failed")
+	}
+	want := fmt.Sprintf("revision %q of project %s(%s) no longer present on remote %q (possibly force-pushed)", rev, p.Name, p.Path, remote)
+	if !strings.Contains(err.Error(), want) {
+		t.Errorf("got error %q, want it to contain %q", err, want)
+	}
+
+	// The project is left untouched, while the others are updated.
+	if err := fake.UpdateUniverseWithOpts(project.UpdateUniverseOpts{GC: true, SkipMissingRevisions: true}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := git.NewGit(context.Background(), p.Path).CurrentRevision(); err != nil {
+		t.Fatal(err)
+	} else if got != oldRev {
+		t.Errorf("project %s moved to %s, want it left at %s", p.Name, got, oldRev)
+	}
+	checkReadme(t, fake.X, other, "other readme")
+}
+
+// TestUpdateUniverseForcePushedRevisionCreate checks that update reports the
+// missing revision of a project it clones, and doesn't create the project
+// when SkipMissingRevisions is set.
+func TestUpdateUniverseForcePushedRevisionCreate(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.CreateRemoteProject("new"); err != nil {
+		t.Fatal(err)
+	}
+	writeReadme(t, fake.X, fake.Projects["new"], "new readme")
+	missing := "0123456789abcdef0123456789abcdef01234567"
+	p := project.Project{
+		Name:     "new",
+		Path:     filepath.Join(fake.X.Root, "new"),
+		Remote:   fake.Projects["new"],
+		Revision: missing,
+	}
+	if err := fake.AddProject(p); err != nil {
+		t.Fatal(err)
+	}
+	other := localProjects[1]
+	writeReadme(t, fake.X, fake.Projects[other.Name], "other readme")
+
+	err := fake.UpdateUniverse(false)
+	if err == nil {
+		t.Fatal("UpdateUniverse() should have failed")
+	}
+	want := fmt.Sprintf("revision %q of project %s(%s) no longer present on remote %q (possibly force-pushed)", missing, p.Name, p.Path, p.Remote)
+	if !strings.Contains(err.Error(), want) {
+		t.Errorf("got error %q, want it to contain %q", err, want)
+	}
+
+	if err := fake.UpdateUniverseWithOpts(project.UpdateUniverseOpts{SkipMissingRevisions: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(p.Path); !os.IsNotExist(err) {
+		t.Errorf("project %s was created at %s, want it skipped: %v", p.Name, p.Path, err)
+	}
+	checkReadme(t, fake.X, other, "other readme")
+}
+
+func commitChanges(t *testing.T, jirix *jiri.X, dir string) {
+	scm := gitutil.New(context.Background(), jirix, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"), gitutil.RootDirOpt(dir))
+	if err := scm.AddUpdatedFiles(); err != nil {
+		t.Fatal(err)
+	}
+	if err := scm.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestSubDirToNestedProj checks that UpdateUniverse will correctly update when
+// nested folder is converted to nested project
+func TestSubDirToNestedProj(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+
+	folderName := "nested_folder"
+	nestedFolderPath := filepath.Join(fake.Projects[localProjects[1].Name], folderName)
+	os.MkdirAll(nestedFolderPath, os.FileMode(0755))
+	writeReadme(t, fake.X, nestedFolderPath, "nested folder")
+
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	os.RemoveAll(nestedFolderPath)
+	commitChanges(t, fake.X, fake.Projects[localProjects[1].Name])
+
+	// Create nested project
+	if err := fake.CreateRemoteProject(folderName); err != nil {
+		t.Fatal(err)
+	}
+	writeReadme(t, fake.X, fake.Projects[folderName], "nested folder")
+	p := project.Project{
+		Name:   folderName,
+		Path:   filepath.Join(localProjects[1].Path, folderName),
+		Remote: fake.Projects[folderName],
+	}
+	if err := fake.AddProject(p); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	checkReadme(t, fake.X, p, "nested folder")
+}
+
+// TestMoveNestedProjects checks that UpdateUniverse will correctly move nested projects
+func TestMoveNestedProjects(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+
+	folderName := "nested_proj"
+	// Create nested project
+	if err := fake.CreateRemoteProject(folderName); err != nil {
+		t.Fatal(err)
+	}
+	writeReadme(t, fake.X, fake.Projects[folderName], "nested folder")
+	p := project.Project{
+		Name:   folderName,
+		Path:   filepath.Join(localProjects[1].Path, folderName),
+		Remote: fake.Projects[folderName],
+	}
+	if err := fake.AddProject(p); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+
+	oldProjectPath := localProjects[1].Path
+	localProjects[1].Path = filepath.Join(fake.X.Root, "new-project-path")
+	p.Path = filepath.Join(localProjects[1].Path, folderName)
+	m, err := fake.ReadRemoteManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	projects := []project.Project{}
+	for _, proj := range m.Projects {
+		if proj.Name == localProjects[1].Name {
+			proj.Path = localProjects[1].Path
+		}
+		if proj.Name == p.Name {
+			proj.Path = p.Path
+		}
+		projects = append(projects, proj)
+	}
+	m.Projects = projects
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	checkReadme(t, fake.X, localProjects[1], "initial readme")
+	checkReadme(t, fake.X, p, "nested folder")
+	if err := dirExists(oldProjectPath); err == nil {
+		t.Fatalf("expected project %q at path %q not to exist but it did", localProjects[1].Name, oldProjectPath)
+	}
+}
+
+// TestNestedProjectNotIgnored checks that update only fails for a project
+// nested in a project which doesn't ignore it when StrictNesting is set.
+func TestNestedProjectNotIgnored(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+
+	folderName := "nested_proj"
+	if err := fake.CreateRemoteProject(folderName); err != nil {
+		t.Fatal(err)
+	}
+	writeReadme(t, fake.X, fake.Projects[folderName], "nested folder")
+	p := project.Project{
+		Name:   folderName,
+		Path:   filepath.Join(localProjects[1].Path, folderName),
+		Remote: fake.Projects[folderName],
+	}
+	if err := fake.AddProject(p); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the new project is reported, the parents of setupUniverse ignore
+	// their nested children.
+	if err := fake.UpdateUniverseWithOpts(project.UpdateUniverseOpts{GC: true, StrictNesting: true}); err == nil {
+		t.Fatalf("expected update to fail for project %s nested in %s", p.Name, localProjects[1].Name)
+	} else if !strings.Contains(err.Error(), p.Path) || !strings.Contains(err.Error(), localProjects[1].Path) || strings.Count(err.Error(), "is nested in") != 1 {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := fake.UpdateUniverse(true); err != nil {
+		t.Fatal(err)
+	}
+	checkReadme(t, fake.X, p, "nested folder")
+
+	writeFile(t, fake.X, fake.Projects[localProjects[1].Name], ".gitignore", folderName+"/\n")
+	if err := fake.UpdateUniverseWithOpts(project.UpdateUniverseOpts{GC: true, StrictNesting: true}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestIgnoreNested checks that update excludes the projects nested in a
+// project with ignore-nested set, instead of failing when StrictNesting is set.
+func TestIgnoreNested(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+
+	folderName := "nested_proj"
+	if err := fake.CreateRemoteProject(folderName); err != nil {
+		t.Fatal(err)
+	}
+	p := project.Project{
+		Name:   folderName,
+		Path:   filepath.Join(localProjects[1].Path, folderName),
+		Remote: fake.Projects[folderName],
+	}
+	if err := fake.AddProject(p); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.UpdateUniverseWithOpts(project.UpdateUniverseOpts{GC: true, StrictNesting: true}); err == nil {
+		t.Fatalf("expected update to fail for project %s nested in %s", p.Name, localProjects[1].Name)
+	} else if want := fmt.Sprintf("Project %s(%s) is nested in project %s(%s), which doesn't ignore it", p.Name, p.Path, localProjects[1].Name, localProjects[1].Path); !strings.Contains(err.Error(), want) {
+		t.Errorf("got error %q, want it to contain %q", err, want)
+	}
+
+	m, err := fake.ReadRemoteManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range m.Projects {
+		if m.Projects[i].Name == localProjects[1].Name {
+			m.Projects[i].IgnoreNested = true
+		}
+	}
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.UpdateUniverse(true); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(localProjects[1].Path, ".git", "info", "exclude"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "/" + folderName + "/\n"; !strings.Contains(string(b), want) {
+		t.Errorf("got exclude file %q, want it to contain %q", b, want)
+	}
+	// The exclusion isn't duplicated by later updates.
+	if err := fake.UpdateUniverse(true); err != nil {
+		t.Fatal(err)
+	}
+	if b, err = ioutil.ReadFile(filepath.Join(localProjects[1].Path, ".git", "info", "exclude")); err != nil {
+		t.Fatal(err)
+	} else if got := strings.Count(string(b), folderName); got != 1 {
+		t.Errorf("got %d exclusions of %s, want 1", got, folderName)
+	}
+}
+
+// TestUpdateUniverseWithUncommitted checks that uncommitted files are not droped
+// by UpdateUniverse(). This ensures that the "git reset --hard" mechanism used
+// for pointing the master branch to a fixed revision does not lose work in
+// progress.
+func TestUpdateUniverseWithUncommitted(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Create an uncommitted file in project 1.
+	file, perm, want := filepath.Join(localProjects[1].Path, "uncommitted_file"), os.FileMode(0644), []byte("uncommitted work")
+	if err := ioutil.WriteFile(file, want, perm); err != nil {
+		t.Fatalf("WriteFile(%v, %v) failed: %v", file, err, perm)
+	}
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if bytes.Compare(got, want) != 0 {
+		t.Fatalf("unexpected content %v:\ngot\n%s\nwant\n%s\n", localProjects[1], got, want)
+	}
+}
+
+// TestUpdateUniverseMovedProject checks that UpdateUniverse can move a
+// project.
+func TestUpdateUniverseMovedProject(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Update the local path at which project 1 is located.
+	m, err := fake.ReadRemoteManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldProjectPath := localProjects[1].Path
+	localProjects[1].Path = filepath.Join(fake.X.Root, "new-project-path")
+	projects := []project.Project{}
+	for _, p := range m.Projects {
+		if p.Name == localProjects[1].Name {
+			p.Path = localProjects[1].Path
+		}
+		projects = append(projects, p)
+	}
+	m.Projects = projects
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+	// Check that UpdateUniverse() moves the local copy of the project 1.
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := dirExists(oldProjectPath); err == nil {
+		t.Fatalf("expected project %q at path %q not to exist but it did", localProjects[1].Name, oldProjectPath)
+	}
+	if err := dirExists(localProjects[2].Path); err != nil {
+		t.Fatalf("expected project %q at path %q to exist but it did not", localProjects[1].Name, localProjects[1].Path)
+	}
+	checkReadme(t, fake.X, localProjects[1], "initial readme")
+}
+
+// TestUpdateUniverseInterruptedMove checks that a project renamed by a move
+// which was interrupted before its metadata was updated is recovered.
+func TestUpdateUniverseInterruptedMove(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	p := localProjects[1]
+	scm := gitutil.New(context.Background(), fake.X, gitutil.RootDirOpt(p.Path))
+	if err := scm.CreateBranch("local"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rename the project as a move would, without updating its metadata.
+	oldPath := p.Path
+	p.Path = filepath.Join(fake.X.Root, "new-project-path")
+	moveProject(t, fake, p.Name, p.Path)
+	if err := os.Rename(oldPath, p.Path); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	checkReadme(t, fake.X, p, "initial readme")
+	if err := dirExists(oldPath); err == nil {
+		t.Errorf("expected %q not to exist", oldPath)
+	}
+	got, err := project.ProjectAtPath(fake.X, p.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Path != p.Path {
+		t.Errorf("got metadata path %q, want %q", got.Path, p.Path)
+	}
+	// The project was not cloned again.
+	if !gitutil.New(context.Background(), fake.X, gitutil.RootDirOpt(p.Path)).BranchExists("local") {
+		t.Errorf("local branch of project %s was lost", p.Name)
+	}
+}
+
+// moveProject changes the path of the given project in the remote manifest.
+func moveProject(t *testing.T, fake *jiritest.FakeJiriRoot, name, path string) {
+	m, err := fake.ReadRemoteManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := m.FindProject(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Path = path
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestUpdateUniverseMovedProjectLocalState checks that moving a project keeps
+// its local branches and changes, unless it is cloned again at its new path.
+func TestUpdateUniverseMovedProjectLocalState(t *testing.T) {
+	for _, reclone := range []bool{false, true} {
+		localProjects, fake, cleanup := setupUniverse(t)
+		if err := fake.UpdateUniverse(false); err != nil {
+			cleanup()
+			t.Fatal(err)
+		}
+
+		oldPath := localProjects[1].Path
+		scm := gitutil.New(context.Background(), fake.X, gitutil.RootDirOpt(oldPath))
+		if err := scm.CreateBranch("local-branch"); err != nil {
+			cleanup()
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(oldPath, "uncommitted"), []byte("change"), 0644); err != nil {
+			cleanup()
+			t.Fatal(err)
+		}
+
+		localProjects[1].Path = filepath.Join(fake.X.Root, "new-project-path")
+		moveProject(t, fake, localProjects[1].Name, localProjects[1].Path)
+		if err := fake.UpdateUniverseWithOpts(project.UpdateUniverseOpts{MoveReclone: reclone}); err != nil {
+			cleanup()
+			t.Fatal(err)
+		}
+		if err := dirExists(oldPath); err == nil {
+			t.Errorf("reclone %t: expected %q not to exist but it did", reclone, oldPath)
+		}
+		checkReadme(t, fake.X, localProjects[1], "initial readme")
+		scm = gitutil.New(context.Background(), fake.X, gitutil.RootDirOpt(localProjects[1].Path))
+		if got := scm.BranchExists("local-branch"); got == reclone {
+			t.Errorf("reclone %t: local branch exists: %t", reclone, got)
+		}
+		_, err := os.Stat(filepath.Join(localProjects[1].Path, "uncommitted"))
+		if got := err == nil; got == reclone {
+			t.Errorf("reclone %t: uncommitted file exists: %t", reclone, got)
+		}
+		cleanup()
+	}
+}
+
+// TestUpdateUniverseMoveRecloneFails checks that a project cloned again at its
+// new path is left at its old path, with its local changes, when the clone
+// fails.
+func TestUpdateUniverseMoveRecloneFails(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	oldPath := localProjects[1].Path
+	if err := ioutil.WriteFile(filepath.Join(oldPath, "uncommitted"), []byte("change"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The new path can't be created, as its parent is a dangling symlink.
+	blocker := filepath.Join(fake.X.Root, "blocker")
+	if err := os.Symlink(filepath.Join(fake.X.Root, "missing"), blocker); err != nil {
+		t.Fatal(err)
+	}
+	moveProject(t, fake, localProjects[1].Name, filepath.Join(blocker, "new-project-path"))
+	if err := fake.UpdateUniverseWithOpts(project.UpdateUniverseOpts{MoveReclone: true}); err == nil {
+		t.Fatal("UpdateUniverse() should have failed")
+	}
+	if _, err := os.Stat(filepath.Join(oldPath, "uncommitted")); err != nil {
+		t.Errorf("project %s should have been left at %q: %v", localProjects[1].Name, oldPath, err)
+	}
+}
+
+func TestIgnoredProjectsNotMoved(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Update the local path at which project 1 is located.
+	m, err := fake.ReadRemoteManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc := project.LocalConfig{Ignore: true}
+	project.WriteLocalConfig(fake.X, localProjects[1], lc)
+	oldProjectPath := localProjects[1].Path
+	localProjects[1].Path = filepath.Join(fake.X.Root, "new-project-path")
+	projects := []project.Project{}
+	for _, p := range m.Projects {
+		if p.Name == localProjects[1].Name {
+			p.Path = localProjects[1].Path
+		}
+		projects = append(projects, p)
+	}
+	m.Projects = projects
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+
+	// Check that UpdateUniverse() does not move the local copy of the project 1.
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := dirExists(oldProjectPath); err != nil {
+		t.Fatalf("expected project %q at path %q to exist but it did not: %s", localProjects[1].Name, oldProjectPath, err)
+	}
+	if err := dirExists(localProjects[2].Path); err != nil {
+		t.Fatalf("expected project %q at path %q to not exist but it did", localProjects[1].Name, localProjects[1].Path)
+	}
+}
+
+// TestUpdateUniverseRenamedProject checks that UpdateUniverse can update
+// renamed project.
+func TestUpdateUniverseRenamedProject(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := fake.ReadRemoteManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldProjectName := localProjects[1].Name
+	localProjects[1].Name = localProjects[1].Name + "new"
+	projects := []project.Project{}
+	for _, p := range m.Projects {
+		if p.Name == oldProjectName {
+			p.Name = localProjects[1].Name
+		}
+		projects = append(projects, p)
+	}
+	m.Projects = projects
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	newLocalProjects, err := project.LocalProjects(fake.X, project.FullScan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	projectFound := false
+	for _, p := range newLocalProjects {
+		if p.Name == localProjects[1].Name {
+			projectFound = true
+		}
+	}
+	if !projectFound {
+		t.Fatalf("Project with updated name(%v) not found", localProjects[1].Name)
+	}
+}
+
+// testUpdateUniverseDeletedProject checks that UpdateUniverse will delete a
+// project if gc=true.
+func testUpdateUniverseDeletedProject(t *testing.T, testDirtyProjectDelete bool) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Delete project 1.
+	m, err := fake.ReadRemoteManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	projects := []project.Project{}
+	if testDirtyProjectDelete {
+		writeUncommitedFile(t, fake.X, localProjects[4].Path, "extra", "")
+	}
+	for _, p := range m.Projects {
+		skip := false
+		for i := 1; i <= 5; i++ {
+			if p.Name == localProjects[i].Name {
+				skip = true
+			}
+		}
+		if skip {
+			continue
+		}
+		projects = append(projects, p)
+	}
+	m.Projects = projects
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+	// Check that UpdateUniverse() with gc=false does not delete the local copy
+	// of the project.
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 5; i++ {
+		if err := dirExists(localProjects[i].Path); err != nil {
+			t.Fatalf("expected project %q at path %q to exist but it did not", localProjects[i].Name, localProjects[i].Path)
+		}
+		checkReadme(t, fake.X, localProjects[i], "initial readme")
+	}
+	// Check that UpdateUniverse() with gc=true does delete the local copy of
+	// the project.
+	if err := fake.UpdateUniverse(true); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 5; i++ {
+		err := dirExists(localProjects[i].Path)
+		if testDirtyProjectDelete && i >= 2 && i <= 4 {
+			if err != nil {
+				t.Fatalf("expected project %q at path %q to exist but it did not", localProjects[i].Name, localProjects[i].Path)
+			}
+		} else if err == nil {
+			t.Fatalf("expected project %q at path %q not to exist but it did", localProjects[i].Name, localProjects[i].Path)
+		}
+	}
+}
+
+// TestUpdateUniverseDeletedProjectWithUnpushedBranch tests that gc does not
+// delete obsolete projects with unpushed commits unless gc is forced.
+func TestUpdateUniverseDeletedProjectWithUnpushedBranch(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Commit to a local master branch of project 1.
+	gitLocal := gitutil.New(context.Background(), fake.X, gitutil.RootDirOpt(localProjects[1].Path))
+	if err := gitLocal.CreateBranchWithUpstream("master", "origin/master"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gitLocal.CheckoutBranch("master"); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fake.X, localProjects[1].Path, "extra", "unpushed")
+
+	// Delete project 1.
+	m, err := fake.ReadRemoteManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	projects := []project.Project{}
+	for _, p := range m.Projects {
+		if p.Name != localProjects[1].Name {
+			projects = append(projects, p)
+		}
+	}
+	m.Projects = projects
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fake.UpdateUniverse(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := dirExists(localProjects[1].Path); err != nil {
+		t.Fatalf("expected project %q at path %q to exist but it did not", localProjects[1].Name, localProjects[1].Path)
+	}
+
+	if err := fake.UpdateUniverseWithOpts(project.UpdateUniverseOpts{GC: true, GCForce: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := dirExists(localProjects[1].Path); err == nil {
+		t.Fatalf("expected project %q at path %q not to exist but it did", localProjects[1].Name, localProjects[1].Path)
+	}
+}
+
+// TestUpdateUniverseDeletedProjectWithGoneUpstream tests that gc keeps
+// obsolete projects with a branch whose base, its tracking branch or the
+// remote branch of the project, no longer exists, unless gc is forced.
+func TestUpdateUniverseDeletedProjectWithGoneUpstream(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Commit to a local branch, and delete the remote branch of the
+	// project, as if it was pruned.
+	p := localProjects[1]
+	gitLocal := gitutil.New(context.Background(), fake.X, gitutil.RootDirOpt(p.Path))
+	if err := gitLocal.CreateAndCheckoutBranch("feature"); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fake.X, p.Path, "extra", "unpushed")
+	if out, err := exec.Command("git", "-C", p.Path, "update-ref", "-d", "refs/remotes/origin/master").CombinedOutput(); err != nil {
+		t.Fatalf("git update-ref failed: %v\n%s", err, out)
+	}
+
+	m, err := fake.ReadRemoteManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	projects := []project.Project{}
+	for _, mp := range m.Projects {
+		if mp.Name != p.Name {
+			projects = append(projects, mp)
+		}
+	}
+	m.Projects = projects
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fake.UpdateUniverse(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := dirExists(p.Path); err != nil {
+		t.Fatalf("expected project %q at path %q to exist but it did not", p.Name, p.Path)
+	}
+
+	if err := fake.UpdateUniverseWithOpts(project.UpdateUniverseOpts{GC: true, GCForce: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := dirExists(p.Path); err == nil {
+		t.Fatalf("expected project %q at path %q not to exist but it did", p.Name, p.Path)
+	}
+}
+
+// TestUpdateUniverseDeletedShallowProjectWithLocalCommits checks that a
+// shallow project is not garbage collected when it contains commits which are
+// not on its remote, even on a detached HEAD.
+func TestUpdateUniverseDeletedShallowProjectWithLocalCommits(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+	if err := fake.CreateRemoteProject("shallow"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		writeReadme(t, fake.X, fake.Projects["shallow"], fmt.Sprintf("commit %d", i))
+	}
+	p := project.Project{
+		Name:       "shallow",
+		Path:       filepath.Join(fake.X.Root, "shallow"),
+		Remote:     "file://" + fake.Projects["shallow"],
+		FetchDepth: 1,
+	}
+	if err := fake.AddProject(p); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Commit on the detached HEAD of the project.
+	writeFile(t, fake.X, p.Path, "extra", "unpushed")
+
+	// Delete the project.
+	m, err := fake.ReadRemoteManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	projects := []project.Project{}
+	for _, mp := range m.Projects {
+		if mp.Name != p.Name {
+			projects = append(projects, mp)
+		}
+	}
+	m.Projects = projects
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fake.UpdateUniverse(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := dirExists(p.Path); err != nil {
+		t.Fatalf("expected project %q at path %q to exist but it did not", p.Name, p.Path)
+	}
+
+	if err := fake.UpdateUniverseWithOpts(project.UpdateUniverseOpts{GC: true, GCForce: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := dirExists(p.Path); err == nil {
+		t.Fatalf("expected project %q at path %q not to exist but it did", p.Name, p.Path)
+	}
+}
+
+func TestUpdateUniverseDeletedProject(t *testing.T) {
+	testUpdateUniverseDeletedProject(t, false)
+	testUpdateUniverseDeletedProject(t, true)
+}
+
+func TestIgnoredProjectsNotDeleted(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Delete project 1.
+	m, err := fake.ReadRemoteManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	projects := []project.Project{}
+	for _, p := range m.Projects {
+		if p.Name == localProjects[1].Name {
+			continue
+		}
+		projects = append(projects, p)
+	}
+	m.Projects = projects
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+	lc := project.LocalConfig{Ignore: true}
+	project.WriteLocalConfig(fake.X, localProjects[1], lc)
+	if err := fake.UpdateUniverse(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := dirExists(localProjects[1].Path); err != nil {
+		t.Fatalf("expected project %q at path %q to exist but it did not: %s", localProjects[1].Name, localProjects[1].Path, err)
+	}
+}
+
+// TestUpdateUniverseNewProjectSamePath checks that UpdateUniverse can handle a
+// new project with the same path as a deleted project, but a different path.
+func TestUpdateUniverseNewProjectSamePath(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Delete a project 1 and create a new one with a different name but the
+	// same path.
+	m, err := fake.ReadRemoteManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newProjectName := "new-project-name"
+	projects := []project.Project{}
+	for _, p := range m.Projects {
+		if p.Path == localProjects[1].Path {
+			p.Name = newProjectName
+		}
+		projects = append(projects, p)
+	}
+	localProjects[1].Name = newProjectName
+	m.Projects = projects
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+	// Check that UpdateUniverse() does not fail.
+	if err := fake.UpdateUniverse(true); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestUpdateUniverseDuplicatePath checks that UpdateUniverse fails when two
+// projects with different names share the same path.
+func TestUpdateUniverseDuplicatePath(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+
+	p := localProjects[1]
+	p.Name = "other-project-name"
+	// Use an unclean path to check that paths are compared after cleaning.
+	p.Path = p.Path + string(filepath.Separator)
+	if err := fake.AddProject(p); err != nil {
+		t.Fatal(err)
+	}
+	err := fake.UpdateUniverse(false)
+	if err == nil {
+		t.Fatal("UpdateUniverse() should have failed")
+	}
+	if !strings.Contains(err.Error(), "same path") || !strings.Contains(err.Error(), p.Name) || !strings.Contains(err.Error(), localProjects[1].Name) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := dirExists(localProjects[1].Path); err == nil {
+		t.Errorf("project %q should not have been created", localProjects[1].Name)
+	}
+}
+
+// TestUpdateUniverseExcludedProject checks that a project included by an
+// import can be excluded by the manifest importing it.
+func TestUpdateUniverseExcludedProject(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+
+	excluded := localProjects[1]
+	// The hooks of the excluded project are dropped along with it.
+	if err := fake.AddHook(project.Hook{Name: "hook", Action: "hook.sh", ProjectName: excluded.Name}); err != nil {
+		t.Fatal(err)
+	}
+	m, err := fake.ReadJiriManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Projects = append(m.Projects, project.Project{Name: excluded.Name, Exclude: true})
+	if err := fake.WriteJiriManifest(m); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+
+	projects, hooks, err := project.LoadManifest(fake.X)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := projects.FindUnique(excluded.Name); err == nil {
+		t.Errorf("project %q should have been excluded", excluded.Name)
+	}
+	for _, hook := range hooks {
+		if hook.ProjectName == excluded.Name {
+			t.Errorf("hook %q of excluded project %q should have been dropped", hook.Name, excluded.Name)
+		}
+	}
+	if err := dirExists(excluded.Path); err == nil {
+		t.Errorf("project %q should not have been created", excluded.Name)
+	}
+	for i, p := range localProjects {
+		if i == 1 {
+			continue
+		}
+		checkReadme(t, fake.X, p, "initial readme")
+	}
+}
+
+// TestUpdateUniverseRemoteBranch checks that UpdateUniverse can pull from a
+// non-master remote branch.
+func TestUpdateUniverseRemoteBranch(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Commit to master branch of a project 1.
+	writeReadme(t, fake.X, fake.Projects[localProjects[1].Name], "master commit")
+	// Create and checkout a new branch of project 1 and make a new commit.
+	git := gitutil.New(context.Background(), fake.X, gitutil.RootDirOpt(fake.Projects[localProjects[1].Name]))
+	if err := git.CreateAndCheckoutBranch("non-master"); err != nil {
+		t.Fatal(err)
+	}
+	writeReadme(t, fake.X, fake.Projects[localProjects[1].Name], "non-master commit")
+	// Point the manifest to the new non-master branch.
+	m, err := fake.ReadRemoteManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	projects := []project.Project{}
+	for _, p := range m.Projects {
+		if p.Name == localProjects[1].Name {
+			p.RemoteBranch = "non-master"
+		}
+		projects = append(projects, p)
+	}
+	m.Projects = projects
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+	// Check that UpdateUniverse pulls the commit from the non-master branch.
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	checkReadme(t, fake.X, localProjects[1], "non-master commit")
+}
+
+// TestUpdateWhenRemoteChangesRebased checks that UpdateUniverse can pull from a
+// non-master remote branch if the local changes were rebased somewhere else(gerrit)
+// before being pushed to remote
+func TestUpdateWhenRemoteChangesRebased(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+
+	gitRemote := gitutil.New(context.Background(), fake.X, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"), gitutil.RootDirOpt(fake.Projects[localProjects[1].Name]))
+	gr := git.NewGit(context.Background(), fake.Projects[localProjects[1].Name])
+	if err := gitRemote.CreateAndCheckoutBranch("non-master"); err != nil {
+		t.Fatal(err)
+	}
+
+	gitLocal := gitutil.New(context.Background(), fake.X, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"), gitutil.RootDirOpt(localProjects[1].Path))
+	gl := git.NewGit(context.Background(), localProjects[1].Path)
+	if err := gl.Fetch("origin", git.PruneOpt(true)); err != nil {
+		t.Fatal(err)
+	}
+
+	// checkout branch in local repo
+	if err := gitLocal.CheckoutBranch("non-master"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Create commits in remote repo
+	writeReadme(t, fake.X, fake.Projects[localProjects[1].Name], "non-master commit")
+	writeFile(t, fake.X, fake.Projects[localProjects[1].Name], "file1", "file1")
+	file1CommitRev, _ := gr.CurrentRevision()
+	writeFile(t, fake.X, fake.Projects[localProjects[1].Name], "file2", "file2")
+	file2CommitRev, _ := gr.CurrentRevision()
+
+	if err := gl.Fetch("origin", git.PruneOpt(true)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cherry pick creation of file1, so that it acts like been rebased on remote repo
+	// As there is a commit creating README on remote not in local repo
+	if err := gitLocal.CherryPick(file1CommitRev); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := project.UpdateUniverse(context.Background(), fake.X, project.UpdateUniverseOpts{RebaseTracked: true, RunHookTimeout: project.DefaultHookTimeout}); err != nil {
+		t.Fatal(err)
+	}
+
+	// It rebased properly and pulled latest changes
+	localRev, _ := gl.CurrentRevision()
+	if file2CommitRev != localRev {
+		t.Fatalf("Current commit is %v, it should be %v\n", localRev, file2CommitRev)
+	}
+}
+
+func TestUpdateWhenConflictMerge(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+
+	gitRemote := gitutil.New(context.Background(), fake.X, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"), gitutil.RootDirOpt(fake.Projects[localProjects[1].Name]))
+	gr := git.NewGit(context.Background(), fake.Projects[localProjects[1].Name])
+	if err := gitRemote.CreateAndCheckoutBranch("non-master"); err != nil {
+		t.Fatal(err)
+	}
+
+	gitLocal := gitutil.New(context.Background(), fake.X, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"), gitutil.RootDirOpt(localProjects[1].Path))
+	gl := git.NewGit(context.Background(), localProjects[1].Path)
+	if err := gl.Fetch("origin", git.PruneOpt(true)); err != nil {
+		t.Fatal(err)
+	}
+
+	// checkout branch in local repo
+	if err := gitLocal.CheckoutBranch("non-master"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Create commits in remote repo
+	writeReadme(t, fake.X, fake.Projects[localProjects[1].Name], "non-master commit")
+	writeFile(t, fake.X, fake.Projects[localProjects[1].Name], "file1", "file1")
+	file1CommitRev, _ := gr.CurrentRevision()
+	writeFile(t, fake.X, fake.Projects[localProjects[1].Name], "file2", "file2")
+
+	if err := gl.Fetch("origin", git.PruneOpt(true)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cherry pick creation of file1, so that it acts like been rebased on remote repo
+	// This would act like conflicting merge
+	if err := gitLocal.CherryPick(file1CommitRev); err != nil {
+		t.Fatal(err)
+	}
+	rev, _ := gl.CurrentRevision()
+
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+
+	localRev, _ := gl.CurrentRevision()
+	if rev != localRev {
+		t.Fatalf("Current commit is %v, it should be %v\n", localRev, rev)
+	}
+	checkJiriRevFiles(t, fake.X, localProjects[1])
+}
+
+// TestCheckoutSnapshotUrl tests checking out snapshot functionality from a url
+func TestCheckoutSnapshotUrl(t *testing.T) {
+	testCheckoutSnapshot(t, true)
+}
+
+// TestCheckoutSnapshotFileSystem tests checking out snapshot functionality from filesystem
+func TestCheckoutSnapshotFileSystem(t *testing.T) {
+	testCheckoutSnapshot(t, false)
+}
+
+func testCheckoutSnapshot(t *testing.T, testURL bool) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	var oldCommitRevs []string
+	var latestCommitRevs []string
+
+	for i, localProject := range localProjects {
+		gr := git.NewGit(context.Background(), fake.Projects[localProject.Name])
+		writeFile(t, fake.X, fake.Projects[localProject.Name], "file1"+strconv.Itoa(i), "file1"+strconv.Itoa(i))
+		file1CommitRev, _ := gr.CurrentRevision()
+		oldCommitRevs = append(oldCommitRevs, file1CommitRev)
+		writeFile(t, fake.X, fake.Projects[localProject.Name], "file2"+strconv.Itoa(i), "file2"+strconv.Itoa(i))
+		file2CommitRev, _ := gr.CurrentRevision()
+		latestCommitRevs = append(latestCommitRevs, file2CommitRev)
+	}
+
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, localProject := range localProjects {
+		gitLocal := gitutil.New(context.Background(), fake.X, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"), gitutil.RootDirOpt(localProject.Path))
+		gl := git.NewGit(context.Background(), localProject.Path)
+		rev, _ := gl.CurrentRevision()
+		if rev != latestCommitRevs[i] {
+			t.Fatalf("Current commit for project %q is %v, it should be %v\n", localProject.Name, rev, latestCommitRevs[i])
+		}
+
+		// Test case when local repo in on a branch
+		if i == 1 {
+			if err := gitLocal.CheckoutBranch("master"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	dir, err := ioutil.TempDir("", "snap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	manifest := &project.Manifest{}
+	for _, localProject := range localProjects {
+		manifest.Projects = append(manifest.Projects, localProject)
+	}
+	manifest.Projects[0].Revision = oldCommitRevs[0]
+	manifest.Projects[1].Revision = oldCommitRevs[1]
+
+	// Test case when snapshot specifies latest revision
+	manifest.Projects[2].Revision = latestCommitRevs[2]
+
+	manifest.Projects[3].Revision = oldCommitRevs[3]
+	manifest.Projects[4].Revision = latestCommitRevs[4]
+	manifest.Projects[5].Revision = oldCommitRevs[5]
+	manifest.Projects[6].Revision = latestCommitRevs[6]
+	snapshotFile := filepath.Join(dir, "snapshot")
+	manifest.ToFile(fake.X, snapshotFile)
+	if testURL {
+		snapBytes, err := ioutil.ReadFile(snapshotFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "html/text")
+			fmt.Fprintln(w, string(snapBytes[:]))
+		}))
+		defer server.Close()
+
+		project.CheckoutSnapshot(context.Background(), fake.X, server.URL, project.UpdateUniverseOpts{RunHookTimeout: project.DefaultHookTimeout})
+	} else {
+		project.CheckoutSnapshot(context.Background(), fake.X, snapshotFile, project.UpdateUniverseOpts{RunHookTimeout: project.DefaultHookTimeout})
+	}
+	sort.Sort(project.ProjectsByPath(localProjects))
+	for i, localProject := range localProjects {
+		gl := git.NewGit(context.Background(), localProject.Path)
+		rev, _ := gl.CurrentRevision()
+		expectedRev := manifest.Projects[i].Revision
+		if rev != expectedRev {
+			t.Fatalf("Current commit for project %q is %v, it should be %v\n", localProject.Name, rev, expectedRev)
+		}
+	}
+}
+
+// TestUpdateUniverseFromSnapshot tests updating to a snapshot of the update
+// history which renames a project, moving it back to an older revision.
+func TestUpdateUniverseFromSnapshot(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := filepath.Join(fake.X.UpdateHistoryDir(), "bisect.xml")
+	if err := os.MkdirAll(fake.X.UpdateHistoryDir(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := project.CreateSnapshot(fake.X, snapshot, false); err != nil {
+		t.Fatal(err)
+	}
+	m, err := project.ManifestFromFile(fake.X, snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := localProjects[1]
+	mp, err := m.FindProject(p.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mp.Name = "renamed"
+	if err := m.ToFile(fake.X, snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	writeReadme(t, fake.X, fake.Projects[p.Name], "new readme")
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	checkReadme(t, fake.X, p, "new readme")
+
+	if err := project.UpdateUniverseFromSnapshot(context.Background(), fake.X, "bisect.xml", project.UpdateUniverseOpts{GC: true, RunHookTimeout: project.DefaultHookTimeout}); err != nil {
+		t.Fatal(err)
+	}
+	checkReadme(t, fake.X, p, "initial readme")
+	projects, err := project.LocalProjects(fake.X, project.FullScan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := projects[project.MakeProjectKey("renamed", p.Remote)]; !ok {
+		t.Errorf("renamed project not found in %v", projects)
+	} else if got.Path != p.Path {
+		t.Errorf("renamed project at %q, want %q", got.Path, p.Path)
+	}
+	if _, ok := projects[p.Key()]; ok {
+		t.Errorf("project %s is still there under its old name", p.Name)
+	}
+}
+
+func testLocalBranchesAreUpdated(t *testing.T, shouldLocalBeOnABranch, rebaseAll bool) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+
+	gitRemote := gitutil.New(context.Background(), fake.X, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"), gitutil.RootDirOpt(fake.Projects[localProjects[1].Name]))
+	if err := gitRemote.CreateAndCheckoutBranch("non-master"); err != nil {
+		t.Fatal(err)
+	}
+
+	// This will fetch non-master to local
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+
+	writeReadme(t, fake.X, fake.Projects[localProjects[1].Name], "non-master commit")
+
+	if err := gitRemote.CheckoutBranch("master"); err != nil {
+		t.Fatal(err)
+	}
+	writeReadme(t, fake.X, fake.Projects[localProjects[1].Name], "master commit")
+
+	gitLocal := gitutil.New(context.Background(), fake.X, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"), gitutil.RootDirOpt(localProjects[1].Path))
+
+	// This will create a local branch non-master
+	if err := gitLocal.CheckoutBranch("non-master"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Go back to detached HEAD
+	if !shouldLocalBeOnABranch {
+		if err := gitLocal.CheckoutBranch("HEAD", gitutil.DetachOpt(true)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := project.UpdateUniverse(context.Background(), fake.X, project.UpdateUniverseOpts{RebaseAll: rebaseAll, RunHookTimeout: project.DefaultHookTimeout}); err != nil {
+		t.Fatal(err)
+	}
+
+	if shouldLocalBeOnABranch && gitLocal.IsOnBranch() == false {
+		t.Fatalf("local repo should be on the branch after update")
+	} else if !shouldLocalBeOnABranch && gitLocal.IsOnBranch() == true {
+		t.Fatalf("local repo should be on detached head after update")
+	}
+
+	projects, err := project.LocalProjects(fake.X, project.FastScan)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	states, err := project.GetProjectStates(fake.X, projects, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state := states[localProjects[1].Key()]
+	if shouldLocalBeOnABranch && state.CurrentBranch.Name != "non-master" {
+		t.Fatalf("local repo should be on branch(non-master) it is on %q", state.CurrentBranch.Name)
+	}
+
+	if rebaseAll {
+		for _, branch := range state.Branches {
+			if branch.Tracking != nil {
+				if branch.Revision != branch.Tracking.Revision {
+					t.Fatalf("branch %q has different revision then remote branch %q", branch.Name, branch.Tracking.Name)
+				}
+			}
+		}
+	} else {
+		for _, branch := range state.Branches {
+			if branch.Tracking != nil {
+				if branch.Name == state.CurrentBranch.Name {
+					if branch.Revision != branch.Tracking.Revision {
+						t.Fatalf("branch %q has different revision then remote branch %q", branch.Name, branch.Tracking.Name)
+					}
+				} else if branch.Revision == branch.Tracking.Revision {
+					t.Fatalf("branch %q should have different revision then remote branch %q", branch.Name, branch.Tracking.Name)
+				}
+			}
+		}
+	}
+}
+
+// TestGetProjectStatesLimited tests that limiting the number of projects whose
+// state is got at once doesn't change the states, nor hide errors.
+func TestGetProjectStatesLimited(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	for i := len(localProjects); i < 20; i++ {
+		name := projectName(i)
+		if err := fake.CreateRemoteProject(name); err != nil {
+			t.Fatal(err)
+		}
+		writeReadme(t, fake.X, fake.Projects[name], "initial readme")
+		p := project.Project{Name: name, Path: filepath.Join(fake.X.Root, fmt.Sprintf("path-%d", i)), Remote: fake.Projects[name]}
+		if err := fake.AddProject(p); err != nil {
+			t.Fatal(err)
+		}
+		localProjects = append(localProjects, p)
+	}
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	dirty := map[project.ProjectKey]bool{}
+	for _, i := range []int{1, 8, 15} {
+		if err := ioutil.WriteFile(filepath.Join(localProjects[i].Path, "README"), []byte("uncommitted"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		dirty[localProjects[i].Key()] = true
+	}
+	projects, err := project.LocalProjects(fake.X, project.FastScan)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, limit := range []uint{1, 3} {
+		states, err := project.GetProjectStatesLimited(fake.X, projects, true, limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(states) != len(projects) {
+			t.Fatalf("limit %d: got %d states, want %d", limit, len(states), len(projects))
+		}
+		for key, p := range projects {
+			state := states[key]
+			if state.HasUncommitted != dirty[key] {
+				t.Errorf("limit %d: project %s has uncommitted changes %t, want %t", limit, p.Name, state.HasUncommitted, dirty[key])
+			}
+			rev, err := git.NewGit(context.Background(), p.Path).CurrentRevision()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if state.CurrentBranch.Revision != rev {
+				t.Errorf("limit %d: project %s is at %s, want %s", limit, p.Name, state.CurrentBranch.Revision, rev)
+			}
+		}
+	}
+
+	missing := project.Project{Name: "missing", Path: filepath.Join(fake.X.Root, "missing"), Remote: "missing"}
+	projects[missing.Key()] = missing
+	if _, err := project.GetProjectStatesLimited(fake.X, projects, true, 2); err == nil {
+		t.Errorf("getting the state of a missing project should have failed")
+	}
+}
+
+// TestProjectStateTracking tests the position of the current branch of a
+// project relative to the branch it tracks reported by its state.
+func TestProjectStateTracking(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	p := localProjects[1]
+	check := func(detached, upToDate, ahead, behind bool) {
+		state, err := project.GetProjectState(fake.X, p.Key(), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := state.IsDetached(); got != detached {
+			t.Errorf("IsDetached: got %t, want %t", got, detached)
+		}
+		if got := state.IsUpToDate(); got != upToDate {
+			t.Errorf("IsUpToDate: got %t, want %t", got, upToDate)
+		}
+		if got, err := state.IsAheadOfTracking(fake.X); err != nil {
+			t.Fatal(err)
+		} else if got != ahead {
+			t.Errorf("IsAheadOfTracking: got %t, want %t", got, ahead)
+		}
+		if got, err := state.IsBehindTracking(fake.X); err != nil {
+			t.Fatal(err)
+		} else if got != behind {
+			t.Errorf("IsBehindTracking: got %t, want %t", got, behind)
+		}
+	}
+	check(true, false, false, false)
+
+	g := gitutil.New(context.Background(), fake.X, gitutil.RootDirOpt(p.Path))
+	if err := g.CreateBranchWithUpstream("local", "origin/master"); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.CheckoutBranch("local"); err != nil {
+		t.Fatal(err)
+	}
+	check(false, true, false, false)
+
+	writeReadme(t, fake.X, p.Path, "local readme")
+	check(false, false, true, false)
+
+	writeReadme(t, fake.X, fake.Projects[p.Name], "remote readme")
+	if err := g.Fetch("origin"); err != nil {
+		t.Fatal(err)
+	}
+	check(false, false, true, true)
+}
+
+// TestProjectStateInProgressOperation tests that the project state reports the
+// interrupted git operation of a project.
+func TestProjectStateInProgressOperation(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+
+	p := localProjects[1]
+	tests := []struct {
+		file, want string
+	}{
+		{"", ""},
+		{"REBASE_HEAD", "rebase"},
+		{"rebase-merge", "rebase"},
+		{"MERGE_HEAD", "merge"},
+		{"CHERRY_PICK_HEAD", "cherry-pick"},
+		{"BISECT_LOG", "bisect"},
+	}
+	for _, test := range tests {
+		file := filepath.Join(p.Path, ".git", test.file)
+		if test.file != "" {
+			if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		state, err := project.GetProjectState(fake.X, p.Key(), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state.InProgressOperation != test.want {
+			t.Errorf("with %q: got in-progress operation %q, want %q", test.file, state.InProgressOperation, test.want)
+		}
+		// Update only warns about the operation.
+		if err := fake.UpdateUniverse(false); err != nil {
+			t.Fatal(err)
+		}
+		// Git may have removed the file during the update.
+		if test.file != "" {
+			if err := os.RemoveAll(file); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// TestProjectStateDivergedSubmodules tests that the project state reports the
+// submodules checked out at another commit than the one recorded in the
+// project.
+func TestProjectStateDivergedSubmodules(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+
+	p := localProjects[1]
+	cmd := exec.Command("git", "-c", "protocol.file.allow=always", "submodule", "add", fake.Projects[localProjects[2].Name], "sub")
+	cmd.Dir = p.Path
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git submodule add failed: %v\n%s", err, out)
+	}
+	g := gitutil.New(context.Background(), fake.X, gitutil.RootDirOpt(p.Path), gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"))
+	if err := g.CommitWithMessage("add submodule"); err != nil {
+		t.Fatal(err)
+	}
+	sub := filepath.Join(p.Path, "sub")
+	recorded, err := git.NewGit(context.Background(), sub).CurrentRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := project.GetProjectState(fake.X, p.Key(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.DivergedSubmodules) != 0 {
+		t.Fatalf("got diverged submodules %v, want none", state.DivergedSubmodules)
+	}
+
+	writeReadme(t, fake.X, sub, "new readme")
+	revision, err := git.NewGit(context.Background(), sub).CurrentRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err = project.GetProjectState(fake.X, p.Key(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []gitutil.Submodule{{Path: "sub", Revision: revision, Recorded: recorded}}
+	if !reflect.DeepEqual(state.DivergedSubmodules, want) {
+		t.Errorf("got diverged submodules %v, want %v", state.DivergedSubmodules, want)
+	}
+	// Projects without submodules report none.
+	state, err = project.GetProjectState(fake.X, localProjects[2].Key(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.DivergedSubmodules) != 0 {
+		t.Errorf("got diverged submodules %v for project without submodules, want none", state.DivergedSubmodules)
+	}
+
+	// A broken submodule is recorded in the state, and doesn't fail getting
+	// the states of the projects.
+	if err := ioutil.WriteFile(filepath.Join(sub, ".git"), []byte("gitdir: "+filepath.Join(fake.X.Root, "missing")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	states, err := project.GetProjectStates(fake.X, project.Projects{p.Key(): p, localProjects[2].Key(): localProjects[2]}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if states[p.Key()].SubmodulesError == nil {
+		t.Errorf("got no submodules error for project %s with a broken submodule", p.Name)
+	}
+	if err := states[localProjects[2].Key()].SubmodulesError; err != nil {
+		t.Errorf("got submodules error %v for project without submodules, want none", err)
+	}
+}
+
+// TestLocalBranchesAreUpdatedWhenOnHead test that all the local branches are
+// updated on jiri update when local repo is on detached head
+func TestLocalBranchesAreUpdatedWhenOnHead(t *testing.T) {
+	testLocalBranchesAreUpdated(t, false, true)
+}
+
+// TestLocalBranchesAreUpdatedWhenOnBranch test that all the local branches are
+// updated on jiri update when local repo is on a branch
+func TestLocalBranchesAreUpdatedWhenOnBranch(t *testing.T) {
+	testLocalBranchesAreUpdated(t, true, true)
+}
+
+// TestLocalBranchesNotUpdatedWhenOnHead test that all the local branches are not
+// updated on jiri update when local repo is on detached head and rebaseAll is false
+func TestLocalBranchesNotUpdatedWhenOnHead(t *testing.T) {
+	testLocalBranchesAreUpdated(t, false, false)
+}
+
+// TestLocalBranchesAreUpdatedWhenOnBranch test that all the local branches are not
+// updated on jiri update when local repo is on a branch and rebaseAll is false
+func TestLocalBranchesNotUpdatedWhenOnBranch(t *testing.T) {
+	testLocalBranchesAreUpdated(t, true, false)
+}
+
+func TestFileImportCycle(t *testing.T) {
+	jirix, cleanup := jiritest.NewX(t)
+	defer cleanup()
+
+	// Set up the cycle .jiri_manifest -> A -> B -> A
+	jiriManifest := project.Manifest{
+		LocalImports: []project.LocalImport{
+			{File: "A"},
+		},
+	}
+	manifestA := project.Manifest{
+		LocalImports: []project.LocalImport{
+			{File: "B"},
+		},
+	}
+	manifestB := project.Manifest{
+		LocalImports: []project.LocalImport{
+			{File: "A"},
+		},
+	}
+	if err := jiriManifest.ToFile(jirix, jirix.JiriManifestFile()); err != nil {
+		t.Fatal(err)
+	}
+	if err := manifestA.ToFile(jirix, filepath.Join(jirix.Root, "A")); err != nil {
+		t.Fatal(err)
+	}
+	if err := manifestB.ToFile(jirix, filepath.Join(jirix.Root, "B")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The update should complain about the cycle.
+	err := project.UpdateUniverse(context.Background(), jirix, project.UpdateUniverseOpts{RunHookTimeout: project.DefaultHookTimeout})
+	if got, want := fmt.Sprint(err), "import cycle detected in local manifest files"; !strings.Contains(got, want) {
+		t.Errorf("got error %v, want substr %v", got, want)
+	}
+}
+
+func TestRemoteImportCycle(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+
+	// Set up two remote manifest projects, remote1 and remote1.
+	if err := fake.CreateRemoteProject("remote1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.CreateRemoteProject("remote2"); err != nil {
+		t.Fatal(err)
+	}
+	remote1 := fake.Projects["remote1"]
+	remote2 := fake.Projects["remote2"]
+
+	fileA, fileB := filepath.Join(remote1, "A"), filepath.Join(remote2, "B")
+
+	// Set up the cycle .jiri_manifest -> remote1+A -> remote2+B -> remote1+A
+	jiriManifest := project.Manifest{
+		Imports: []project.Import{
+			{Manifest: "A", Name: "n1", Remote: remote1},
+		},
+	}
+	manifestA := project.Manifest{
+		Imports: []project.Import{
+			{Manifest: "B", Name: "n2", Remote: remote2},
+		},
+	}
+	manifestB := project.Manifest{
+		Imports: []project.Import{
+			{Manifest: "A", Name: "n3", Remote: remote1},
+		},
+	}
+	if err := jiriManifest.ToFile(fake.X, fake.X.JiriManifestFile()); err != nil {
+		t.Fatal(err)
+	}
+	if err := manifestA.ToFile(fake.X, fileA); err != nil {
+		t.Fatal(err)
+	}
+	if err := manifestB.ToFile(fake.X, fileB); err != nil {
+		t.Fatal(err)
+	}
+	commitFile(t, fake.X, remote1, fileA, "commit A")
+	commitFile(t, fake.X, remote2, fileB, "commit B")
+
+	// The update should complain about the cycle.
+	err := project.UpdateUniverse(context.Background(), fake.X, project.UpdateUniverseOpts{RunHookTimeout: project.DefaultHookTimeout})
+	if got, want := fmt.Sprint(err), "import cycle detected in remote manifest imports"; !strings.Contains(got, want) {
+		t.Errorf("got error %v, want substr %v", got, want)
+	}
+}
+
+func TestFileAndRemoteImportCycle(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+
+	// Set up two remote manifest projects, remote1 and remote2.
+	// Set up two remote manifest projects, remote1 and remote1.
+	if err := fake.CreateRemoteProject("remote1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.CreateRemoteProject("remote2"); err != nil {
+		t.Fatal(err)
+	}
+	remote1 := fake.Projects["remote1"]
+	remote2 := fake.Projects["remote2"]
+	fileA, fileD := filepath.Join(remote1, "A"), filepath.Join(remote1, "D")
+	fileB, fileC := filepath.Join(remote2, "B"), filepath.Join(remote2, "C")
+
+	// Set up the cycle .jiri_manifest -> remote1+A -> remote2+B -> C -> remote1+D -> A
+	jiriManifest := project.Manifest{
+		Imports: []project.Import{
+			{Manifest: "A", Root: "r1", Name: "n1", Remote: remote1},
+		},
+	}
+	manifestA := project.Manifest{
+		Imports: []project.Import{
+			{Manifest: "B", Root: "r2", Name: "n2", Remote: remote2},
+		},
+	}
+	manifestB := project.Manifest{
+		LocalImports: []project.LocalImport{
+			{File: "C"},
+		},
+	}
+	manifestC := project.Manifest{
+		Imports: []project.Import{
+			{Manifest: "D", Root: "r3", Name: "n3", Remote: remote1},
+		},
+	}
+	manifestD := project.Manifest{
+		LocalImports: []project.LocalImport{
+			{File: "A"},
+		},
+	}
+	if err := jiriManifest.ToFile(fake.X, fake.X.JiriManifestFile()); err != nil {
+		t.Fatal(err)
+	}
+	if err := manifestA.ToFile(fake.X, fileA); err != nil {
+		t.Fatal(err)
+	}
+	if err := manifestB.ToFile(fake.X, fileB); err != nil {
+		t.Fatal(err)
+	}
+	if err := manifestC.ToFile(fake.X, fileC); err != nil {
+		t.Fatal(err)
+	}
+	if err := manifestD.ToFile(fake.X, fileD); err != nil {
+		t.Fatal(err)
+	}
+	commitFile(t, fake.X, remote1, fileA, "commit A")
+	commitFile(t, fake.X, remote2, fileB, "commit B")
+	commitFile(t, fake.X, remote2, fileC, "commit C")
+	commitFile(t, fake.X, remote1, fileD, "commit D")
+
+	// The update should complain about the cycle.
+	err := project.UpdateUniverse(context.Background(), fake.X, project.UpdateUniverseOpts{RunHookTimeout: project.DefaultHookTimeout})
+	if got, want := fmt.Sprint(err), "import cycle detected"; !strings.Contains(got, want) {
+		t.Errorf("got error %v, want substr %v", got, want)
+	}
+}
+
+// TestRemoteImportFetchedOnce tests that a remote manifest project imported by
+// several manifests is only fetched once by an update.
+func TestRemoteImportFetchedOnce(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+
+	if err := fake.CreateRemoteProject("remote1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.CreateRemoteProject("remote2"); err != nil {
+		t.Fatal(err)
+	}
+	remote1 := fake.Projects["remote1"]
+	remote2 := fake.Projects["remote2"]
+	fileA, fileB := filepath.Join(remote1, "A"), filepath.Join(remote1, "B")
+	fileCommon := filepath.Join(remote2, "common")
+
+	// .jiri_manifest imports remote1+A and remote1+B, which both import
+	// remote2+common.  The manifest projects are checked out by the update.
+	jiriManifest := project.Manifest{
+		Imports: []project.Import{
+			{Manifest: "A", Name: "n1", Remote: remote1},
+			{Manifest: "B", Name: "n1", Remote: remote1},
+		},
+		Projects: []project.Project{
+			{Name: "n1", Path: "n1", Remote: remote1},
+			{Name: "n2", Path: "n2", Remote: remote2},
+		},
+	}
+	manifestAB := project.Manifest{
+		Imports: []project.Import{
+			{Manifest: "common", Name: "n2", Remote: remote2},
+		},
+	}
+	if err := jiriManifest.ToFile(fake.X, fake.X.JiriManifestFile()); err != nil {
+		t.Fatal(err)
+	}
+	if err := manifestAB.ToFile(fake.X, fileA); err != nil {
+		t.Fatal(err)
+	}
+	if err := manifestAB.ToFile(fake.X, fileB); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&project.Manifest{}).ToFile(fake.X, fileCommon); err != nil {
+		t.Fatal(err)
+	}
+	commitFile(t, fake.X, remote1, fileA, "commit A")
+	commitFile(t, fake.X, remote1, fileB, "commit B")
+	commitFile(t, fake.X, remote2, fileCommon, "commit common")
+
+	fetches := map[string]int{}
+	fetch := *project.InternalFetchManifestProject
+	*project.InternalFetchManifestProject = func(ctx context.Context, jirix *jiri.X, p project.Project, mirror string) error {
+		fetches[p.Remote]++
+		return fetch(ctx, jirix, p, mirror)
+	}
+	defer func() { *project.InternalFetchManifestProject = fetch }()
+
+	// The first update clones the manifest projects, which counts as fetching
+	// them, and the second one fetches their checkouts.
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	if len(fetches) != 0 {
+		t.Errorf("got fetches %v after cloning, want none", fetches)
+	}
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	for _, remote := range []string{remote1, remote2} {
+		if got, want := fetches[remote], 1; got != want {
+			t.Errorf("%s fetched %d times, want %d", remote, got, want)
+		}
+	}
+}
+
+// TestUpdateUniverseInterrupted tests that an update whose context is done
+// fails without touching the projects or retrying with a full scan.
+func TestUpdateUniverseInterrupted(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.CreateRemoteProject("new"); err != nil {
+		t.Fatal(err)
+	}
+	p := project.Project{
+		Name:   "new",
+		Path:   filepath.Join(fake.X.Root, "new"),
+		Remote: fake.Projects["new"],
+	}
+	if err := fake.AddProject(p); err != nil {
+		t.Fatal(err)
+	}
+
+	fetches := 0
+	fetch := *project.InternalFetchManifestProject
+	*project.InternalFetchManifestProject = func(ctx context.Context, jirix *jiri.X, p project.Project, mirror string) error {
+		fetches++
+		return fetch(ctx, jirix, p, mirror)
+	}
+	defer func() { *project.InternalFetchManifestProject = fetch }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := project.UpdateUniverse(ctx, fake.X, project.UpdateUniverseOpts{RunHookTimeout: project.DefaultHookTimeout}); err == nil {
+		t.Fatalf("interrupted update should have failed")
+	}
+	if fetches != 1 {
+		t.Errorf("manifest fetched %d times, want 1", fetches)
+	}
+	if _, err := os.Stat(p.Path); !os.IsNotExist(err) {
+		t.Errorf("project %s was created by the interrupted update", p.Name)
+	}
+	checkReadme(t, fake.X, localProjects[1], "initial readme")
+}
+
+// TestRemoteImportSharedRemoteFetched tests that the checkouts of imports of
+// the same remote under different names are each fetched by an update.
+func TestRemoteImportSharedRemoteFetched(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+
+	if err := fake.CreateRemoteProject("remote"); err != nil {
+		t.Fatal(err)
+	}
+	remote := fake.Projects["remote"]
+	fileA, fileB := filepath.Join(remote, "A"), filepath.Join(remote, "B")
+	// The manifest projects are checked out by the update.
+	jiriManifest := project.Manifest{
+		Imports: []project.Import{
+			{Manifest: "A", Name: "a", Remote: remote},
+			{Manifest: "B", Name: "b", Remote: remote},
+		},
+		Projects: []project.Project{
+			{Name: "a", Path: "a", Remote: remote},
+			{Name: "b", Path: "b", Remote: remote},
+		},
+	}
+	if err := jiriManifest.ToFile(fake.X, fake.X.JiriManifestFile()); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{fileA, fileB} {
+		if err := (&project.Manifest{}).ToFile(fake.X, file); err != nil {
+			t.Fatal(err)
+		}
+		commitFile(t, fake.X, remote, file, "commit "+filepath.Base(file))
+	}
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+
+	fetches := map[string]int{}
+	fetch := *project.InternalFetchManifestProject
+	*project.InternalFetchManifestProject = func(ctx context.Context, jirix *jiri.X, p project.Project, mirror string) error {
+		fetches[p.Path]++
+		return fetch(ctx, jirix, p, mirror)
+	}
+	defer func() { *project.InternalFetchManifestProject = fetch }()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(fetches), 2; got != want {
+		t.Errorf("got %d checkouts fetched, want %d: %v", got, want, fetches)
+	}
+	for path, n := range fetches {
+		if n != 1 {
+			t.Errorf("%s fetched %d times, want 1", path, n)
+		}
+	}
+}
+
+func TestManifestToFromBytes(t *testing.T) {
+	tests := []struct {
+		Manifest project.Manifest
+		XML      string
+	}{
+		{
+			project.Manifest{},
+			`<manifest>
+</manifest>
+`,
+		},
+		{
+			project.Manifest{
+				Imports: []project.Import{
+					{
+						Manifest:     "manifest1",
+						Name:         "remoteimport1",
+						Remote:       "remote1",
+						RemoteBranch: "master",
+					},
+					{
+						Manifest:     "manifest2",
+						Name:         "remoteimport2",
+						Remote:       "remote2",
+						RemoteBranch: "branch2",
+					},
+				},
+				LocalImports: []project.LocalImport{
+					{File: "fileimport"},
+				},
+				Projects: []project.Project{
+					{
+						Name:         "project1",
+						Path:         "path1",
+						Remote:       "remote1",
+						RemoteBranch: "master",
+						Revision:     "HEAD",
+						GerritHost:   "https://test-review.googlesource.com",
+						GitHooks:     "path/to/githooks",
+					},
+					{
+						Name:         "project2",
+						Path:         "path2",
+						Remote:       "remote2",
+						RemoteBranch: "branch2",
+						Revision:     "rev2",
+					},
+				},
+				Hooks: []project.Hook{
+					{
+						Name:        "testhook",
+						ProjectName: "project1",
+						Action:      "action.sh",
+					},
+				},
+			},
+			`<manifest>
+  <imports>
+    <import manifest="manifest1" name="remoteimport1" remote="remote1"/>
+    <import manifest="manifest2" name="remoteimport2" remote="remote2" remotebranch="branch2"/>
+    <localimport file="fileimport"/>
+  </imports>
+  <projects>
+    <project name="project1" path="path1" remote="remote1" gerrithost="https://test-review.googlesource.com" githooks="path/to/githooks"/>
+    <project name="project2" path="path2" remote="remote2" remotebranch="branch2" revision="rev2"/>
+  </projects>
+  <hooks>
+    <hook name="testhook" action="action.sh" project="project1"/>
+  </hooks>
+</manifest>
+`,
+		},
+		{
+			project.Manifest{
+				Projects: []project.Project{
+					{
+						Name:         "project1",
+						Path:         "path1",
+						Remote:       "remote1",
+						RemoteBranch: "master",
+						Revision:     "HEAD",
+						RemoteName:   "upstream",
+					},
+				},
+			},
+			`<manifest>
+  <projects>
+    <project name="project1" path="path1" remote="remote1" remote-name="upstream"/>
+  </projects>
+</manifest>
+`,
+		},
+		{
+			project.Manifest{
+				Projects: []project.Project{
+					{
+						Name:         "project1",
+						Path:         "path1",
+						Remote:       "remote1",
+						RemoteBranch: "master",
+						Revision:     "HEAD",
+						CloneFilter:  "blob:none",
+					},
+				},
+			},
+			`<manifest>
+  <projects>
+    <project name="project1" path="path1" remote="remote1" clone-filter="blob:none"/>
+  </projects>
+</manifest>
+`,
+		},
+		{
+			project.Manifest{
+				Projects: []project.Project{
+					{
+						Name:         "project1",
+						Path:         "path1",
+						Remote:       "remote1",
+						RemoteBranch: "master",
+						Revision:     "HEAD",
+						ShallowSince: "2017-01-31",
+					},
+				},
+			},
+			`<manifest>
+  <projects>
+    <project name="project1" path="path1" remote="remote1" shallow-since="2017-01-31"/>
+  </projects>
+</manifest>
+`,
+		},
+		{
+			project.Manifest{
+				Projects: []project.Project{
+					{
+						Name:         "project1",
+						Path:         "path1",
+						Remote:       "remote1",
+						RemoteBranch: "master",
+						Revision:     "HEAD",
+						SingleBranch: true,
+					},
+				},
+			},
+			`<manifest>
+  <projects>
+    <project name="project1" path="path1" remote="remote1" single-branch="true"/>
+  </projects>
+</manifest>
+`,
+		},
+		{
+			project.Manifest{
+				Projects: []project.Project{
+					{
+						Name:         "project1",
+						Path:         "path1",
+						Remote:       "remote1",
+						RemoteBranch: "master",
+						Revision:     "HEAD",
+						MirrorOf:     "project2",
+					},
+				},
+			},
+			`<manifest>
+  <projects>
+    <project name="project1" path="path1" remote="remote1" mirror-of="project2"/>
+  </projects>
+</manifest>
+`,
+		},
+		{
+			project.Manifest{
+				Projects: []project.Project{
+					{
+						Name:         "project1",
+						RemoteBranch: "master",
+						Revision:     "HEAD",
+						Exclude:      true,
+					},
+				},
+			},
+			`<manifest>
+  <projects>
+    <project name="project1" exclude="true"/>
+  </projects>
+</manifest>
+`,
+		},
+		{
+			project.Manifest{
+				JiriConfig: &project.JiriConfig{Jobs: 10, UpdateHistoryRetention: 20},
+			},
+			`<manifest>
+  <jiri-config jobs="10" update-history-retention="20"/>
+</manifest>
+`,
+		},
+	}
+	for _, test := range tests {
+		gotBytes, err := test.Manifest.ToBytes()
+		if err != nil {
+			t.Errorf("%+v ToBytes failed: %v", test.Manifest, err)
+		}
+		if got, want := string(gotBytes), test.XML; got != want {
+			t.Errorf("%+v ToBytes GOT\n%v\nWANT\n%v", test.Manifest, got, want)
+		}
+		manifest, err := project.ManifestFromBytes([]byte(test.XML))
+		if err != nil {
+			t.Errorf("%+v FromBytes failed: %v", test.Manifest, err)
+		}
+		if got, want := manifest, &test.Manifest; !reflect.DeepEqual(got, want) {
+			t.Errorf("%+v FromBytes got %#v, want %#v", test.Manifest, got, want)
+		}
+	}
+}
+
+// TestManifestToBytesDeterministic tests that the serialization of a manifest
+// doesn't depend on the order its elements were added in.
+func TestManifestToBytesDeterministic(t *testing.T) {
+	jirix, cleanup := jiritest.NewX(t)
+	defer cleanup()
+
+	var forward, reverse project.Manifest
+	for i := 0; i < 3; i++ {
+		forward.Imports = append(forward.Imports, project.Import{Name: "import", Manifest: fmt.Sprintf("manifest%d", i), Remote: "remote"})
+		forward.Projects = append(forward.Projects, project.Project{Name: fmt.Sprintf("project%d", i), Path: fmt.Sprintf("path%d", 3-i), Remote: "remote"})
+		forward.Hooks = append(forward.Hooks, project.Hook{Name: fmt.Sprintf("hook%d", i), Action: "action.sh", ProjectName: "project0"})
+	}
+	for i := 2; i >= 0; i-- {
+		reverse.Imports = append(reverse.Imports, forward.Imports[i])
+		reverse.Projects = append(reverse.Projects, forward.Projects[i])
+		reverse.Hooks = append(reverse.Hooks, forward.Hooks[i])
+	}
+	toCanonicalBytes := func(m *project.Manifest) ([]byte, error) { return m.ToCanonicalBytes(jirix) }
+	for _, f := range []func(m *project.Manifest) ([]byte, error){(*project.Manifest).ToBytes, (*project.Manifest).ToTOML, toCanonicalBytes} {
+		want, err := f(&forward)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := f(&reverse)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("got\n%s\nfor the reverse manifest, want\n%s", got, want)
+		}
+	}
+	// Projects are sorted by name, even though their paths are in the
+	// reverse order.
+	data, err := reverse.ToBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i, j := bytes.Index(data, []byte(`name="project0"`)), bytes.Index(data, []byte(`name="project2"`)); i < 0 || j < 0 || i > j {
+		t.Errorf("projects not sorted by name:\n%s", data)
+	}
+	// The manifest itself is left untouched.
+	if got, want := reverse.Projects[0].Name, "project2"; got != want {
+		t.Errorf("got first project %q, want %q", got, want)
+	}
+	if got, want := reverse.Imports[0].Manifest, "manifest2"; got != want {
+		t.Errorf("got first import %q, want %q", got, want)
+	}
+	if got, want := reverse.Hooks[0].Name, "hook2"; got != want {
+		t.Errorf("got first hook %q, want %q", got, want)
+	}
+}
+
+// TestManifestToTOML tests that manifests round-trip through TOML.
+func TestManifestToTOML(t *testing.T) {
+	project1 := project.Project{
+		Name:         "project1",
+		Path:         "path1",
+		Remote:       "remote1",
+		RemoteBranch: "master",
+		Revision:     "HEAD",
+	}
+	with := func(edit func(p *project.Project)) project.Manifest {
+		p := project1
+		edit(&p)
+		return project.Manifest{Projects: []project.Project{p}}
+	}
+	tests := []struct {
+		name     string
+		manifest project.Manifest
+	}{
+		{"imports", project.Manifest{
+			Imports:      []project.Import{{Manifest: "manifest1", Name: "remoteimport1", Remote: "remote1", RemoteBranch: "branch1"}},
+			LocalImports: []project.LocalImport{{File: "fileimport"}},
+		}},
+		{"project", project.Manifest{Projects: []project.Project{project1}}},
+		{"remote-name", with(func(p *project.Project) { p.RemoteName = "upstream" })},
+		{"clone-filter", with(func(p *project.Project) { p.CloneFilter = "blob:none" })},
+		{"shallow-since", with(func(p *project.Project) { p.ShallowSince = "2017-01-31" })},
+		{"single-branch", with(func(p *project.Project) { p.SingleBranch = true })},
+		{"mirror-of", with(func(p *project.Project) { p.MirrorOf = "project2" })},
+		{"exclude", with(func(p *project.Project) { p.Exclude = true })},
+		{"hooks", project.Manifest{Hooks: []project.Hook{{Name: "testhook", ProjectName: "project1", Action: "action.sh"}}}},
+		{"jiri-config", project.Manifest{JiriConfig: &project.JiriConfig{Jobs: 10, UpdateHistoryRetention: 20}}},
+	}
+	for _, test := range tests {
+		data, err := test.manifest.ToTOML()
+		if err != nil {
+			t.Errorf("%s: ToTOML failed: %v", test.name, err)
+			continue
+		}
+		manifest, err := project.ManifestFromBytes(data)
+		if err != nil {
+			t.Errorf("%s: FromBytes of TOML\n%s\nfailed: %v", test.name, data, err)
+			continue
+		}
+		if got, want := manifest, &test.manifest; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: FromBytes of TOML\n%s\ngot %#v, want %#v", test.name, data, got, want)
+		}
+	}
+}
+
+func TestManifestFromTOML(t *testing.T) {
+	data := `# A TOML manifest.
+[[imports]]
+manifest = "manifest1"
+name = 'remoteimport1' # literal string
+remote = "remote1"
+
+[[projects]]
+name = "project1"
+path = "path1"
+remote = "remote1"
+revision = "rev\u0031"
+fetchdepth = 10
+exclude = true
+
+[[hooks]]
+name = "testhook"
+action = "action.sh"
+project = "project1"
+`
+	want := &project.Manifest{
+		Imports: []project.Import{
+			{
+				Manifest:     "manifest1",
+				Name:         "remoteimport1",
+				Remote:       "remote1",
+				RemoteBranch: "master",
+			},
+		},
+		Projects: []project.Project{
+			{
+				Name:         "project1",
+				Path:         "path1",
+				Remote:       "remote1",
+				RemoteBranch: "master",
+				Revision:     "rev1",
+				FetchDepth:   10,
+				Exclude:      true,
+			},
+		},
+		Hooks: []project.Hook{
+			{
+				Name:        "testhook",
+				ProjectName: "project1",
+				Action:      "action.sh",
+			},
+		},
+	}
+	got, err := project.ManifestFromBytes([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v, want %#v", got, want)
+	}
+
+	for _, bad := range []string{
+		"[[unknown]]\nname = \"a\"\n",
+		"[projects]\nname = \"a\"\n",
+		"name = \"a\"\n",
+		"[[projects]]\nunknown = \"a\"\n",
+		"[[projects]]\nname = \"a\"\nname = \"b\"\n",
+		"[[projects]]\nname = \"a\n",
+		"[[projects]]\nhistorydepth = \"a\"\n",
+		"[[projects]]\nexclude = yes\n",
+		"[jiri-config]\njobs = 1\n[jiri-config]\njobs = 2\n",
+	} {
+		if _, err := project.ManifestFromBytes([]byte(bad)); err == nil {
+			t.Errorf("TOML manifest %q should have been rejected", bad)
+		}
+	}
+}
+
+// TestManifestParseError checks that the errors of invalid XML manifests are
+// located in the manifest, right after the input which couldn't be parsed.
+func TestManifestParseError(t *testing.T) {
+	for _, test := range []struct {
+		data         string
+		line, column int
+	}{
+		// Unclosed element.
+		{"<manifest>\n  <projects>\n    <project name=\"a\"/>\n  </manifest>\n", 4, 14},
+		// Invalid attribute syntax.
+		{"<manifest>\n  <projects>\n    <project name=a/>\n", 3, 20},
+		// Invalid attribute value.
+		{"<manifest>\n  <projects>\n    <project name=\"a\"\n             historydepth=\"x\"/>\n", 4, 32},
+		{"", 1, 1},
+	} {
+		_, err := project.ManifestFromBytes([]byte(test.data))
+		e, ok := err.(*project.ManifestParseError)
+		if !ok {
+			t.Errorf("manifest %q: got error %v, want a ManifestParseError", test.data, err)
+			continue
+		}
+		if e.Line != test.line || e.Column != test.column {
+			t.Errorf("manifest %q: got error at line %d, column %d, want line %d, column %d: %v", test.data, e.Line, e.Column, test.line, test.column, e)
+		}
+		if want := fmt.Sprintf("line %d, column %d: ", e.Line, e.Column); !strings.HasPrefix(e.Error(), want) || e.Message == "" {
+			t.Errorf("manifest %q: got error %q, want it to start with %q", test.data, e, want)
+		}
+	}
+}
+
+func TestManifestFindProject(t *testing.T) {
+	m := project.Manifest{
+		Projects: []project.Project{
+			{Name: "a", Path: "a", Remote: "remote-a"},
+			{Name: "b", Path: "b/c", Remote: "remote-b"},
+		},
+	}
+	p, err := m.FindProject("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Path != "b/c" {
+		t.Errorf("got project at %q, want %q", p.Path, "b/c")
+	}
+	// The project is returned by reference.
+	p.Revision = "rev"
+	if m.Projects[1].Revision != "rev" {
+		t.Errorf("edit of project %q not reflected in manifest", p.Name)
+	}
+	if p, err := m.FindProjectByPath("b/./c/"); err != nil {
+		t.Error(err)
+	} else if p.Name != "b" {
+		t.Errorf("got project %q, want %q", p.Name, "b")
+	}
+	if _, err := m.FindProject("c"); err == nil {
+		t.Errorf("found missing project %q", "c")
+	}
+	if _, err := m.FindProjectByPath("c"); err == nil {
+		t.Errorf("found project at missing path %q", "c")
+	}
+}
+
+func TestManifestValidate(t *testing.T) {
+	valid := project.Manifest{
+		Projects: []project.Project{
+			{Name: "a", Path: "a", Remote: "remote-a"},
+			{Name: "b", Path: "b", Remote: "remote-b"},
+		},
+		Hooks: []project.Hook{{Name: "setup", ProjectName: "a", Action: "setup.sh"}},
+	}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("valid manifest rejected: %v", err)
+	}
+
+	invalid := project.Manifest{
+		Projects: []project.Project{
+			{Name: "a", Path: "a"},
+			{Name: "b", Path: "a", Remote: "remote-b"},
+			{Name: "b", Path: "c", Remote: "remote-b"},
+		},
+		Hooks: []project.Hook{
+			{Name: "setup", ProjectName: "a", After: "b, missing"},
+			{Name: "setup", ProjectName: "missing", Action: "setup.sh"},
+		},
+	}
+	err := invalid.Validate()
+	errs, ok := err.(project.MultiError)
+	if !ok {
+		t.Fatalf("got error %v, want a MultiError", err)
+	}
+	want := []string{
+		`project "a" has no remote`,
+		`projects "a" and "b" have the same path "a"`,
+		`project "b" with remote "remote-b" is declared more than once`,
+		`hook "setup" of project "a" has no action`,
+		`hook "setup" of project "a" runs after project "missing", which is not in the manifest`,
+		`hook "setup" is for project "missing", which is not in the manifest`,
+	}
+	got := []string{}
+	for _, e := range errs {
+		got = append(got, e.Error())
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got errors %q, want %q", got, want)
+	}
+}
+
+// TestRemoteManifest checks that RemoteManifest reads a manifest from a remote
+// that is not part of the local checkout.
+func TestRemoteManifest(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+
+	want, err := fake.ReadRemoteManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := project.RemoteManifest(fake.X, fake.Projects["manifest"], "master", "public")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Projects) != len(want.Projects) {
+		t.Fatalf("got %d projects, want %d", len(got.Projects), len(want.Projects))
+	}
+	for i := range want.Projects {
+		if got.Projects[i].Name != want.Projects[i].Name || got.Projects[i].Remote != want.Projects[i].Remote {
+			t.Errorf("project %d: got %s(%s), want %s(%s)", i, got.Projects[i].Name, got.Projects[i].Remote, want.Projects[i].Name, want.Projects[i].Remote)
+		}
+	}
+	if _, err := os.Stat(localProjects[0].Path); err == nil {
+		t.Errorf("project %s should not have been checked out", localProjects[0].Name)
+	}
+
+	if _, err := project.RemoteManifest(fake.X, fake.Projects["manifest"], "master", "missing"); err == nil {
+		t.Errorf("expected error for missing manifest file")
+	}
+	if _, err := project.RemoteManifest(fake.X, fake.Projects["manifest"], "no-such-branch", "public"); err == nil {
+		t.Errorf("expected error for missing branch")
+	}
+}
+
+// memManifestSource is a project.ManifestSource serving manifests from memory.
+type memManifestSource map[string]string
+
+func (s memManifestSource) Fetch(ref string) ([]byte, error) {
+	data, ok := s[ref]
+	if !ok {
+		return nil, fmt.Errorf("manifest %q not found", ref)
+	}
+	return []byte(data), nil
+}
+
+// TestManifestSource tests that manifests and snapshots are fetched from the
+// source registered for the scheme of their URL, local imports being resolved
+// relative to the URL of the importing manifest.
+func TestManifestSource(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+	project.RegisterManifestSource("mem", memManifestSource{
+		"mem://manifests/root": `<manifest>
+  <imports>
+    <localimport file="sub/projects"/>
+  </imports>
+  <projects>
+    <project name="a" path="a" remote="https://example.com/a"/>
+  </projects>
+</manifest>`,
+		"mem://manifests/sub/projects": `<manifest>
   <projects>
-    <project name="project1" path="path1" remote="remote1" gerrithost="https://test-review.googlesource.com" githooks="path/to/githooks"/>
-    <project name="project2" path="path2" remote="remote2" remotebranch="branch2" revision="rev2"/>
+    <project name="b" path="b" remote="https://example.com/b"/>
   </projects>
-  <hooks>
-    <hook name="testhook" action="action.sh" project="project1"/>
-  </hooks>
-</manifest>
-`,
-		},
+</manifest>`,
+	})
+
+	projects, _, err := project.LoadManifestFile(fake.X, "mem://manifests/root", nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sources := make(map[string]string)
+	for _, p := range projects {
+		sources[p.Name] = p.ManifestSource
+	}
+	want := map[string]string{"a": "mem://manifests/root", "b": "mem://manifests/sub/projects"}
+	if !reflect.DeepEqual(sources, want) {
+		t.Errorf("got projects from %v, want %v", sources, want)
+	}
+
+	projects, _, err = project.LoadSnapshotFile(fake.X, "mem://manifests/sub/projects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(projects) != 1 {
+		t.Errorf("got %d projects in snapshot, want 1", len(projects))
+	}
+	if _, _, err := project.LoadManifestFile(fake.X, "mem://manifests/missing", nil, false); err == nil {
+		t.Errorf("expected error for missing manifest")
+	}
+}
+
+func TestImportFetchProtocol(t *testing.T) {
+	tests := []struct {
+		remote, protocol, want string
+	}{
+		{"https://example.com/manifest", "", "https://example.com/manifest"},
+		{"https://example.com/manifest", "git", "git://example.com/manifest"},
+		{"https://example.com:8443/a/manifest", "ssh", "ssh://example.com:8443/a/manifest"},
+		{"ssh://user@example.com:29418/manifest", "https", "https://user@example.com:29418/manifest"},
+		{"git://example.com/manifest", "git", "git://example.com/manifest"},
+		{"user@example.com:path/manifest", "https", "https://user@example.com/path/manifest"},
+		{"example.com:path/manifest", "git", "git://example.com/path/manifest"},
+		{"user@example.com:path/manifest", "ssh", "user@example.com:path/manifest"},
 	}
 	for _, test := range tests {
-		gotBytes, err := test.Manifest.ToBytes()
-		if err != nil {
-			t.Errorf("%+v ToBytes failed: %v", test.Manifest, err)
-		}
-		if got, want := string(gotBytes), test.XML; got != want {
-			t.Errorf("%+v ToBytes GOT\n%v\nWANT\n%v", test.Manifest, got, want)
-		}
-		manifest, err := project.ManifestFromBytes([]byte(test.XML))
+		i := &project.Import{Manifest: "m", Remote: test.remote, FetchProtocol: test.protocol}
+		got, err := project.InternalImportFetchRemote(i)
 		if err != nil {
-			t.Errorf("%+v FromBytes failed: %v", test.Manifest, err)
+			t.Errorf("%+v: %v", test, err)
+			continue
 		}
-		if got, want := manifest, &test.Manifest; !reflect.DeepEqual(got, want) {
-			t.Errorf("%+v FromBytes got %#v, want %#v", test.Manifest, got, want)
+		if got != test.want {
+			t.Errorf("remote %q with protocol %q: got %q, want %q", test.remote, test.protocol, got, test.want)
 		}
 	}
+	i := &project.Import{Manifest: "m", Remote: "/local/manifest", FetchProtocol: "git"}
+	if _, err := project.InternalImportFetchRemote(i); err == nil {
+		t.Errorf("a local remote should not be fetched with protocol %q", i.FetchProtocol)
+	}
+	m := []byte(`<manifest><imports><import manifest="m" remote="https://example.com/m" fetchprotocol="rsync"/></imports></manifest>`)
+	if _, err := project.ManifestFromBytes(m); err == nil {
+		t.Errorf("an unknown fetch protocol should be rejected")
+	}
 }
 
 func TestProjectToFromFile(t *testing.T) {
@@ -1698,3 +5513,426 @@ func TestProjectToFromFile(t *testing.T) {
 		}
 	}
 }
+
+// TestManifestFromRepoManifest tests that a repo manifest is converted to a
+// jiri manifest whose projects can be updated.
+func TestManifestFromRepoManifest(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+	for _, name := range []string{"a", "b"} {
+		if err := fake.CreateRemoteProject(name); err != nil {
+			t.Fatal(err)
+		}
+		writeReadme(t, fake.X, fake.Projects[name], "readme "+name)
+	}
+	fetch := filepath.Dir(fake.Projects["a"])
+	repoManifest := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<manifest>
+  <remote name="origin" fetch="%s" review="review.example.com"/>
+  <default remote="origin" revision="refs/heads/master" sync-j="4"/>
+  <project name="a" path="path/a" groups="core"/>
+  <project name="b" clone-depth="1">
+    <copyfile src="README" dest="README.b"/>
+  </project>
+  <repo-hooks in-project="a" enabled-list="pre-upload"/>
+</manifest>
+`, fetch)
+	m, warnings, err := project.ManifestFromRepoManifest([]byte(repoManifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dropped := range []string{`"sync-j"`, `"groups"`, "<copyfile>", "<repo-hooks>"} {
+		found := false
+		for _, warning := range warnings {
+			if strings.Contains(warning, dropped) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("no warning about %s in %v", dropped, warnings)
+		}
+	}
+	want := []project.Project{
+		{
+			Name:         "a",
+			Path:         "path/a",
+			Remote:       fetch + "/a",
+			RemoteBranch: "master",
+			Revision:     "HEAD",
+			GerritHost:   "https://review.example.com",
+		},
+		{
+			Name:         "b",
+			Path:         "b",
+			Remote:       fetch + "/b",
+			RemoteBranch: "master",
+			Revision:     "HEAD",
+			GerritHost:   "https://review.example.com",
+			FetchDepth:   1,
+		},
+	}
+	if got := m.Projects; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got projects %#v, want %#v", got, want)
+	}
+
+	for _, p := range m.Projects {
+		// Avoid downloading the commit-msg hook from the fake Gerrit host.
+		p.GerritHost = ""
+		if err := fake.AddProject(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range m.Projects {
+		p.Path = filepath.Join(fake.X.Root, p.Path)
+		checkReadme(t, fake.X, p, "readme "+p.Name)
+	}
+}
+
+// TestServeMetrics checks that the metrics served by ServeMetrics count the
+// updated projects, the fetch errors and the updates.
+func TestServeMetrics(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	l, err := project.ServeMetrics("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	scrape := func() map[string]float64 {
+		resp, err := http.Get("http://" + l.Addr().String() + "/metrics")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		metrics := make(map[string]float64)
+		for _, line := range strings.Split(string(b), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) != 2 || strings.HasPrefix(line, "#") {
+				continue
+			}
+			v, err := strconv.ParseFloat(fields[1], 64)
+			if err != nil {
+				t.Fatalf("invalid metric %q: %v", line, err)
+			}
+			metrics[fields[0]] = v
+		}
+		return metrics
+	}
+	check := func(before, after map[string]float64, name string, want float64) {
+		if got := after[name] - before[name]; got != want {
+			t.Errorf("%s increased by %v, want %v", name, got, want)
+		}
+	}
+
+	before := scrape()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	after := scrape()
+	projects, err := project.LocalProjects(fake.X, project.FastScan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(before, after, "jiri_projects_updated_total", float64(len(projects)))
+	check(before, after, "jiri_fetch_errors_total", 0)
+	check(before, after, "jiri_update_duration_seconds_count", 1)
+	check(before, after, `jiri_update_duration_seconds_bucket{le="+Inf"}`, 1)
+
+	// An update changing nothing updates no project.
+	before = scrape()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	after = scrape()
+	check(before, after, "jiri_projects_updated_total", 0)
+
+	// Only the projects which changed are counted.
+	writeReadme(t, fake.X, fake.Projects[localProjects[0].Name], "new readme")
+	before = scrape()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	after = scrape()
+	check(before, after, "jiri_projects_updated_total", 1)
+
+	// Fetching a project whose remote is gone fails, in both the fast and the
+	// full scans, and is counted once.
+	if err := os.RemoveAll(fake.Projects[localProjects[1].Name]); err != nil {
+		t.Fatal(err)
+	}
+	before = scrape()
+	if err := fake.UpdateUniverse(false); err == nil {
+		t.Fatalf("update should have failed to fetch %s", localProjects[1].Name)
+	}
+	after = scrape()
+	check(before, after, "jiri_projects_updated_total", 0)
+	check(before, after, "jiri_fetch_errors_total", 1)
+	check(before, after, "jiri_update_duration_seconds_count", 1)
+
+	resp, err := http.Get("http://" + l.Addr().String() + "/debug/vars")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	vars := make(map[string]json.RawMessage)
+	if err := json.NewDecoder(resp.Body).Decode(&vars); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"jiri_projects_updated_total", "jiri_fetch_errors_total", "jiri_update_duration_seconds"} {
+		if _, ok := vars[name]; !ok {
+			t.Errorf("expvar output lacks %s", name)
+		}
+	}
+}
+
+// TestUpdateUniverseProjects checks that UpdateUniverseProjects only updates
+// the given projects and the projects nested in them.
+func TestUpdateUniverseProjects(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	readmes := make(map[string][]byte)
+	for _, p := range localProjects {
+		b, err := ioutil.ReadFile(filepath.Join(p.Path, "README"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		readmes[p.Name] = b
+		writeReadme(t, fake.X, fake.Projects[p.Name], "new readme")
+	}
+	// Neither new projects nor obsolete ones are touched.
+	if err := fake.CreateRemoteProject("new"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.AddProject(project.Project{Name: "new", Path: filepath.Join(fake.X.Root, "new"), Remote: fake.Projects["new"]}); err != nil {
+		t.Fatal(err)
+	}
+	m, err := fake.ReadRemoteManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var projects []project.Project
+	for _, p := range m.Projects {
+		if p.Name != localProjects[1].Name {
+			projects = append(projects, p)
+		}
+	}
+	m.Projects = projects
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+
+	// Project 3 contains project 4.
+	if err := project.UpdateUniverseProjects(context.Background(), fake.X, []string{localProjects[3].Name}, project.UpdateUniverseOpts{RunHookTimeout: project.DefaultHookTimeout}); err != nil {
+		t.Fatal(err)
+	}
+	for i, p := range localProjects {
+		if i == 3 || i == 4 {
+			checkReadme(t, fake.X, p, "new readme")
+		} else {
+			checkReadme(t, fake.X, p, string(readmes[p.Name]))
+		}
+	}
+	if _, err := os.Stat(filepath.Join(fake.X.Root, "new")); !os.IsNotExist(err) {
+		t.Errorf("project new should not have been created: %v", err)
+	}
+
+	if err := project.UpdateUniverseProjects(context.Background(), fake.X, []string{"missing"}, project.UpdateUniverseOpts{RunHookTimeout: project.DefaultHookTimeout}); err == nil || !strings.Contains(err.Error(), `"missing"`) {
+		t.Errorf("got error %v, want an error for the missing project", err)
+	}
+}
+
+// TestUpdateUniverseProjectsLazy checks that UpdateUniverseProjects leaves the
+// lazy projects it isn't given registered.
+func TestUpdateUniverseProjectsLazy(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.CreateRemoteProject("lazy"); err != nil {
+		t.Fatal(err)
+	}
+	writeReadme(t, fake.X, fake.Projects["lazy"], "initial readme")
+	p := project.Project{
+		Name:   "lazy",
+		Path:   filepath.Join(fake.X.Root, "lazy"),
+		Remote: fake.Projects["lazy"],
+		Lazy:   true,
+	}
+	if err := fake.AddProject(p); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+
+	writeReadme(t, fake.X, fake.Projects[localProjects[0].Name], "new readme")
+	if err := project.UpdateUniverseProjects(context.Background(), fake.X, []string{localProjects[0].Name}, project.UpdateUniverseOpts{RunHookTimeout: project.DefaultHookTimeout}); err != nil {
+		t.Fatal(err)
+	}
+	checkReadme(t, fake.X, localProjects[0], "new readme")
+	if _, err := os.Stat(filepath.Join(p.Path, jiri.ProjectMetaDir, jiri.ProjectMetaFile)); err != nil {
+		t.Fatalf("lazy project lost its metadata: %v", err)
+	}
+	if err := project.RealizeProject(fake.X, p.Path); err != nil {
+		t.Fatal(err)
+	}
+	checkReadme(t, fake.X, p, "initial readme")
+}
+
+// TestLogBetweenSnapshots checks that LogBetweenSnapshots lists the commits
+// projects gained between two snapshots.
+func TestLogBetweenSnapshots(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	oldSnapshot := filepath.Join(fake.X.Root, "old-snapshot")
+	if err := project.CreateSnapshot(fake.X, oldSnapshot, false); err != nil {
+		t.Fatal(err)
+	}
+
+	p := localProjects[1]
+	for _, msg := range []string{"first change", "second change"} {
+		path := writeUncommitedFile(t, fake.X, fake.Projects[p.Name], "README", msg)
+		commitFile(t, fake.X, fake.Projects[p.Name], path, msg)
+	}
+	// A project added between the snapshots is left out.
+	if err := fake.CreateRemoteProject("added"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.AddProject(project.Project{Name: "added", Path: filepath.Join(fake.X.Root, "added"), Remote: fake.Projects["added"]}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	newSnapshot := filepath.Join(fake.X.Root, "new-snapshot")
+	if err := project.CreateSnapshot(fake.X, newSnapshot, false); err != nil {
+		t.Fatal(err)
+	}
+
+	logs, err := project.LogBetweenSnapshots(fake.X, oldSnapshot, newSnapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The manifest project gained the commit adding the new project.
+	if got, want := len(logs), len(localProjects)+1; got != want {
+		t.Errorf("got logs of %d projects, want %d", got, want)
+	}
+	added := project.Project{Name: "added", Remote: fake.Projects["added"]}
+	if commits, ok := logs[added.Key()]; ok {
+		t.Errorf("got commits %+v of the added project, want it left out", commits)
+	}
+	for key, commits := range logs {
+		if key == p.Key() || strings.HasPrefix(string(key), "manifest"+project.KeySeparator) {
+			continue
+		}
+		if len(commits) != 0 {
+			t.Errorf("project %v: got commits %+v, want none", key, commits)
+		}
+	}
+	commits := logs[p.Key()]
+	if len(commits) != 2 {
+		t.Fatalf("got commits %+v, want 2", commits)
+	}
+	head, err := git.NewGit(context.Background(), p.Path).CurrentRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := project.Commit{Hash: head, Author: "John Doe <john.doe@example.com>", Subject: "second change"}
+	if commits[0] != want {
+		t.Errorf("got commit %+v, want %+v", commits[0], want)
+	}
+	if commits[1].Subject != "first change" {
+		t.Errorf("got commit %+v, want subject %q", commits[1], "first change")
+	}
+}
+
+// TestFetchVia checks that the projects with a fetch-via command are cloned
+// and fetched through it.
+func TestFetchVia(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+	if err := fake.CreateRemoteProject("p"); err != nil {
+		t.Fatal(err)
+	}
+	writeReadme(t, fake.X, fake.Projects["p"], "initial readme")
+
+	// The fetch-via command logs its arguments and runs the git command of
+	// the remote end locally, like ssh on the remote host.
+	logFile := filepath.Join(fake.X.Root, "fetch-via.log")
+	script := filepath.Join(fake.X.Root, "fetch-via")
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\necho \"$@\" >> "+logFile+"\nfor last; do :; done\nexec sh -c \"$last\"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	p := project.Project{
+		Name:     "p",
+		Path:     filepath.Join(fake.X.Root, "p"),
+		Remote:   "ssh://fakehost" + fake.Projects["p"],
+		FetchVia: script,
+	}
+	if err := fake.AddProject(p); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	checkReadme(t, fake.X, p, "initial readme")
+	writeReadme(t, fake.X, fake.Projects["p"], "new readme")
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	checkReadme(t, fake.X, p, "new readme")
+	b, err := ioutil.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The project was cloned, then fetched, through the command.
+	if got := strings.Count(string(b), "git-upload-pack '"+fake.Projects["p"]+"'"); got < 2 {
+		t.Errorf("got %d git-upload-pack invocations, want at least 2:\n%s", got, b)
+	}
+
+	// The attribute round-trips through manifests.
+	m, err := fake.ReadRemoteManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := m.ToBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `fetch-via="`+script+`"`) {
+		t.Errorf("manifest lacks the fetch-via attribute:\n%s", data)
+	}
+	if m, err = project.ManifestFromBytes(data); err != nil {
+		t.Fatal(err)
+	}
+	if mp, err := m.FindProject("p"); err != nil {
+		t.Fatal(err)
+	} else if mp.FetchVia != script {
+		t.Errorf("got fetch-via %q, want %q", mp.FetchVia, script)
+	}
+
+	// The command must exist.
+	for i := range m.Projects {
+		if m.Projects[i].Name == "p" {
+			m.Projects[i].FetchVia = filepath.Join(fake.X.Root, "missing") + " -v"
+		}
+	}
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.UpdateUniverse(true); err == nil || !strings.Contains(err.Error(), "fetch-via command") {
+		t.Errorf("got error %v, want an error for the missing fetch-via command", err)
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2017 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package project
+
+import (
+	"encoding/xml"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// repoManifest represents a manifest of Android's repo tool.  Only the parts
+// which can be converted to a jiri manifest are modeled, everything else is
+// collected so that it can be reported as dropped.
+type repoManifest struct {
+	Remotes  []repoRemote  `xml:"remote"`
+	Default  *repoDefault  `xml:"default"`
+	Projects []repoProject `xml:"project"`
+	Other    []repoElement `xml:",any"`
+	XMLName  struct{}      `xml:"manifest"`
+}
+
+type repoRemote struct {
+	Name     string     `xml:"name,attr"`
+	Fetch    string     `xml:"fetch,attr"`
+	Review   string     `xml:"review,attr"`
+	Revision string     `xml:"revision,attr"`
+	Other    []xml.Attr `xml:",any,attr"`
+}
+
+type repoDefault struct {
+	Remote   string     `xml:"remote,attr"`
+	Revision string     `xml:"revision,attr"`
+	Other    []xml.Attr `xml:",any,attr"`
+}
+
+type repoProject struct {
+	Name       string        `xml:"name,attr"`
+	Path       string        `xml:"path,attr"`
+	Remote     string        `xml:"remote,attr"`
+	Revision   string        `xml:"revision,attr"`
+	Upstream   string        `xml:"upstream,attr"`
+	CloneDepth string        `xml:"clone-depth,attr"`
+	Other      []xml.Attr    `xml:",any,attr"`
+	Children   []repoElement `xml:",any"`
+}
+
+type repoElement struct {
+	XMLName xml.Name
+}
+
+var shaRE = regexp.MustCompile("^[0-9a-f]{40}$")
+
+// ManifestFromRepoManifest converts the contents of a manifest of Android's
+// repo tool to a jiri manifest.  Remotes and defaults are resolved for every
+// project.  Features of repo manifests which have no jiri equivalent are
+// dropped, and a warning describing each of them is returned.
+func ManifestFromRepoManifest(data []byte) (*Manifest, []string, error) {
+	rm := new(repoManifest)
+	if err := xml.Unmarshal(data, rm); err != nil {
+		return nil, nil, fmt.Errorf("invalid repo manifest: %v", err)
+	}
+	var warnings []string
+	warnAttrs := func(elem string, attrs []xml.Attr) {
+		for _, attr := range attrs {
+			warnings = append(warnings, fmt.Sprintf("%s: dropped unsupported attribute %q", elem, attr.Name.Local))
+		}
+	}
+	for _, elem := range rm.Other {
+		warnings = append(warnings, fmt.Sprintf("dropped unsupported element <%s>", elem.XMLName.Local))
+	}
+
+	remotes := make(map[string]repoRemote)
+	for _, remote := range rm.Remotes {
+		warnAttrs(fmt.Sprintf("remote %q", remote.Name), remote.Other)
+		remotes[remote.Name] = remote
+	}
+	var def repoDefault
+	if rm.Default != nil {
+		def = *rm.Default
+		warnAttrs("default", def.Other)
+	}
+
+	m := &Manifest{}
+	for _, rp := range rm.Projects {
+		elem := fmt.Sprintf("project %q", rp.Name)
+		warnAttrs(elem, rp.Other)
+		for _, child := range rp.Children {
+			warnings = append(warnings, fmt.Sprintf("%s: dropped unsupported element <%s>", elem, child.XMLName.Local))
+		}
+		remoteName := rp.Remote
+		if remoteName == "" {
+			remoteName = def.Remote
+		}
+		remote, ok := remotes[remoteName]
+		if !ok {
+			return nil, nil, fmt.Errorf("%s: unknown remote %q", elem, remoteName)
+		}
+		if strings.HasPrefix(remote.Fetch, ".") {
+			warnings = append(warnings, fmt.Sprintf("%s: fetch url %q of remote %q is relative to the manifest url, which is unknown", elem, remote.Fetch, remote.Name))
+		}
+		p := Project{
+			Name:   rp.Name,
+			Path:   rp.Path,
+			Remote: strings.TrimSuffix(remote.Fetch, "/") + "/" + rp.Name,
+		}
+		if p.Path == "" {
+			p.Path = rp.Name
+		}
+		if remote.Review != "" {
+			p.GerritHost = remote.Review
+			if !strings.Contains(p.GerritHost, "://") {
+				p.GerritHost = "https://" + p.GerritHost
+			}
+			p.GerritHost = strings.TrimSuffix(p.GerritHost, "/")
+		}
+		revision := rp.Revision
+		if revision == "" {
+			revision = remote.Revision
+		}
+		if revision == "" {
+			revision = def.Revision
+		}
+		switch {
+		case shaRE.MatchString(revision):
+			p.Revision = revision
+			if rp.Upstream != "" {
+				p.RemoteBranch = strings.TrimPrefix(rp.Upstream, "refs/heads/")
+			}
+		case strings.HasPrefix(revision, "refs/tags/"):
+			p.Revision = revision
+		default:
+			p.RemoteBranch = strings.TrimPrefix(revision, "refs/heads/")
+		}
+		if rp.CloneDepth != "" {
+			depth, err := strconv.Atoi(rp.CloneDepth)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s: invalid clone-depth %q", elem, rp.CloneDepth)
+			}
+			p.FetchDepth = depth
+		}
+		m.Projects = append(m.Projects, p)
+	}
+	if err := m.fillDefaults(); err != nil {
+		return nil, nil, err
+	}
+	return m, warnings, nil
+}
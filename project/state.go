@@ -5,10 +5,14 @@
 package project
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"path/filepath"
 
 	"fuchsia.googlesource.com/jiri"
 	"fuchsia.googlesource.com/jiri/git"
+	"fuchsia.googlesource.com/jiri/gitutil"
 	"fuchsia.googlesource.com/jiri/tool"
 )
 
@@ -27,12 +31,103 @@ type ProjectState struct {
 	CurrentBranch  BranchState
 	HasUncommitted bool
 	HasUntracked   bool
-	Project        Project
+	// InProgressOperation is the interrupted git operation the project is
+	// in, one of "rebase", "merge", "cherry-pick" and "bisect", or empty.
+	InProgressOperation string
+	// DivergedSubmodules are the submodules of the project checked out at
+	// another commit than the one recorded in the project.
+	DivergedSubmodules []gitutil.Submodule
+	// SubmodulesError is the error getting the submodules of the project,
+	// whose DivergedSubmodules are then unknown, e.g. because a submodule
+	// is broken.  It doesn't fail getting the state.
+	SubmodulesError error
+	Project         Project
+}
+
+// IsDetached returns whether the project is on a detached HEAD.
+func (ps *ProjectState) IsDetached() bool {
+	return ps.CurrentBranch.Name == ""
+}
+
+// IsUpToDate returns whether the current branch of the project tracks a
+// branch at the same revision.
+func (ps *ProjectState) IsUpToDate() bool {
+	tracking := ps.CurrentBranch.Tracking
+	return tracking != nil && tracking.Revision == ps.CurrentBranch.Revision
+}
+
+// IsAheadOfTracking returns whether the current branch of the project has
+// commits missing from the branch it tracks.  The commits are only counted
+// when a branch diverged from its tracking branch, unlike the rest of the
+// state which is computed by GetProjectStates.
+func (ps *ProjectState) IsAheadOfTracking(jirix *jiri.X) (bool, error) {
+	tracking := ps.CurrentBranch.Tracking
+	if tracking == nil || ps.IsUpToDate() {
+		return false, nil
+	}
+	n, err := gitutil.New(context.Background(), jirix, gitutil.RootDirOpt(ps.Project.Path)).CountCommits(ps.CurrentBranch.Revision, tracking.Revision)
+	if err != nil {
+		return false, fmt.Errorf("Cannot count commits ahead of %q for project %q: %v", tracking.Name, ps.Project.Name, err)
+	}
+	return n > 0, nil
+}
+
+// IsBehindTracking returns whether the branch the current branch of the project
+// tracks has commits missing from it, counted like in IsAheadOfTracking.
+func (ps *ProjectState) IsBehindTracking(jirix *jiri.X) (bool, error) {
+	tracking := ps.CurrentBranch.Tracking
+	if tracking == nil || ps.IsUpToDate() {
+		return false, nil
+	}
+	n, err := gitutil.New(context.Background(), jirix, gitutil.RootDirOpt(ps.Project.Path)).CountCommits(tracking.Revision, ps.CurrentBranch.Revision)
+	if err != nil {
+		return false, fmt.Errorf("Cannot count commits behind %q for project %q: %v", tracking.Name, ps.Project.Name, err)
+	}
+	return n > 0, nil
+}
+
+// inProgressOperations maps the files git keeps in the .git directory during
+// an operation to the name of the operation.  A rebase stopped to edit a
+// commit only has its rebase-merge or rebase-apply directory.
+var inProgressOperations = []struct {
+	file, operation string
+}{
+	{"REBASE_HEAD", "rebase"},
+	{"rebase-merge", "rebase"},
+	{"rebase-apply", "rebase"},
+	{"MERGE_HEAD", "merge"},
+	{"CHERRY_PICK_HEAD", "cherry-pick"},
+	{"BISECT_LOG", "bisect"},
+}
+
+// inProgressOperation returns the interrupted git operation of the project at
+// the given path, or an empty string.
+func inProgressOperation(path string) (string, error) {
+	for _, op := range inProgressOperations {
+		if _, err := os.Stat(filepath.Join(path, ".git", op.file)); err == nil {
+			return op.operation, nil
+		} else if !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+// divergedSubmodules returns the submodules of the given project whose
+// checked out commit differs from the one recorded in the project.
+func divergedSubmodules(jirix *jiri.X, project Project) ([]gitutil.Submodule, error) {
+	if _, err := os.Stat(filepath.Join(project.Path, ".gitmodules")); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return gitutil.New(context.Background(), jirix, gitutil.RootDirOpt(project.Path)).DivergedSubmodules()
 }
 
 func setProjectState(jirix *jiri.X, state *ProjectState, checkDirty bool, ch chan<- error) {
 	var err error
-	g := git.NewGit(state.Project.Path)
+	g := git.NewGit(context.Background(), state.Project.Path)
 	branches, err := g.GetAllBranchesInfo()
 	if err != nil {
 		ch <- err
@@ -63,12 +158,19 @@ func setProjectState(jirix *jiri.X, state *ProjectState, checkDirty bool, ch cha
 			state.CurrentBranch = b
 		}
 	}
-	if state.CurrentBranch.Name == "" {
+	if state.IsDetached() {
 		if state.CurrentBranch.Revision, err = g.CurrentRevision(); err != nil {
 			ch <- err
 			return
 		}
 	}
+	if state.InProgressOperation, err = inProgressOperation(state.Project.Path); err != nil {
+		ch <- err
+		return
+	}
+	if state.DivergedSubmodules, err = divergedSubmodules(jirix, state.Project); err != nil {
+		state.SubmodulesError = fmt.Errorf("Cannot get submodules for project %q: %v", state.Project.Name, err)
+	}
 	if checkDirty {
 		state.HasUncommitted, err = g.HasUncommittedChanges()
 		if err != nil {
@@ -84,16 +186,41 @@ func setProjectState(jirix *jiri.X, state *ProjectState, checkDirty bool, ch cha
 	ch <- nil
 }
 
+// GetProjectStates returns the states of the given projects, getting at most
+// jirix.Jobs of them at once.
 func GetProjectStates(jirix *jiri.X, projects Projects, checkDirty bool) (map[ProjectKey]*ProjectState, error) {
+	limit := jirix.Jobs
+	if limit == 0 {
+		limit = jiri.DefaultJobs
+	}
+	return GetProjectStatesLimited(jirix, projects, checkDirty, limit)
+}
+
+// GetProjectStatesLimited returns the states of the given projects like
+// GetProjectStates, getting at most limit of them at once, each state running
+// several git commands.  Zero doesn't limit them.
+func GetProjectStatesLimited(jirix *jiri.X, projects Projects, checkDirty bool, limit uint) (map[ProjectKey]*ProjectState, error) {
 	states := make(map[ProjectKey]*ProjectState, len(projects))
 	sem := make(chan error, len(projects))
+	var slots chan struct{}
+	if limit > 0 {
+		slots = make(chan struct{}, limit)
+	}
 	for key, project := range projects {
 		state := &ProjectState{
 			Project: project,
 		}
 		states[key] = state
+		if slots != nil {
+			slots <- struct{}{}
+		}
 		// jirix is not threadsafe, so we make a clone for each goroutine.
-		go setProjectState(jirix.Clone(tool.ContextOpts{}), state, checkDirty, sem)
+		go func(jirix *jiri.X) {
+			if slots != nil {
+				defer func() { <-slots }()
+			}
+			setProjectState(jirix, state, checkDirty, sem)
+		}(jirix.Clone(tool.ContextOpts{}))
 	}
 	for _ = range projects {
 		err := <-sem
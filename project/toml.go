@@ -0,0 +1,312 @@
+// Copyright 2017 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package project
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// A manifest is represented in TOML as arrays of tables, one table per
+// element, whose keys are the attributes of the XML element:
+//
+//   [[imports]]
+//   manifest = "manifest"
+//   name = "manifest"
+//   remote = "https://fuchsia.googlesource.com/manifest"
+//
+//   [[projects]]
+//   name = "jiri"
+//   path = "jiri"
+//   remote = "https://fuchsia.googlesource.com/jiri"
+//
+// Elements which appear at most once, like <jiri-config>, are tables:
+//
+//   [jiri-config]
+//   jobs = 10
+//
+// Only the subset of TOML needed to describe manifests is supported: tables,
+// arrays of tables, and keys with string, integer or boolean values.
+
+// tomlSections maps the arrays of tables of a TOML manifest to the fields of
+// Manifest, in the order in which they are written.
+var tomlSections = []struct {
+	name, field string
+}{
+	{"imports", "Imports"},
+	{"localimports", "LocalImports"},
+	{"projects", "Projects"},
+	{"hooks", "Hooks"},
+}
+
+// tomlTables maps the tables of a TOML manifest to the pointer fields of
+// Manifest, in the order in which they are written after the arrays of tables.
+var tomlTables = []struct {
+	name, field string
+}{
+	{"jiri-config", "JiriConfig"},
+}
+
+// IsTOML returns true if data looks like a TOML manifest rather than an XML
+// one, i.e. its first line which is not blank or a comment is a table header
+// or a key/value pair.
+func IsTOML(data []byte) bool {
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		return line[0] == '[' || (line[0] != '<' && bytes.Contains(line, []byte("=")))
+	}
+	return false
+}
+
+// tomlKey returns the TOML key of the given struct field, which is the name
+// of its XML attribute, and whether the key is omitted when empty.
+func tomlKey(field reflect.StructField) (string, bool, bool) {
+	parts := strings.Split(field.Tag.Get("xml"), ",")
+	if len(parts) < 2 || parts[0] == "" {
+		return "", false, false
+	}
+	attr, omitempty := false, false
+	for _, opt := range parts[1:] {
+		switch opt {
+		case "attr":
+			attr = true
+		case "omitempty":
+			omitempty = true
+		}
+	}
+	return parts[0], omitempty, attr
+}
+
+// ToTOML returns m serialized as TOML, with defaults unfilled, sorted like by
+// ToBytes.
+func (m *Manifest) ToTOML() ([]byte, error) {
+	m = m.deepCopy() // avoid changing manifest when unfilling defaults.
+	if err := m.unfillDefaults(); err != nil {
+		return nil, err
+	}
+	m.sortElements()
+	var buf bytes.Buffer
+	v := reflect.ValueOf(m).Elem()
+	for _, section := range tomlSections {
+		elems := v.FieldByName(section.field)
+		for i := 0; i < elems.Len(); i++ {
+			if err := writeTOMLTable(&buf, "[["+section.name+"]]", elems.Index(i)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, table := range tomlTables {
+		if elem := v.FieldByName(table.field); !elem.IsNil() {
+			if err := writeTOMLTable(&buf, "["+table.name+"]", elem.Elem()); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// writeTOMLTable writes the given header followed by the keys of elem to buf.
+func writeTOMLTable(buf *bytes.Buffer, header string, elem reflect.Value) error {
+	if buf.Len() > 0 {
+		buf.WriteByte('\n')
+	}
+	fmt.Fprintf(buf, "%s\n", header)
+	for j := 0; j < elem.NumField(); j++ {
+		key, omitempty, ok := tomlKey(elem.Type().Field(j))
+		if !ok {
+			continue
+		}
+		value := elem.Field(j)
+		if omitempty && value.Interface() == reflect.Zero(value.Type()).Interface() {
+			continue
+		}
+		switch value.Kind() {
+		case reflect.String:
+			fmt.Fprintf(buf, "%s = %s\n", key, tomlQuote(value.String()))
+		case reflect.Int:
+			fmt.Fprintf(buf, "%s = %d\n", key, value.Int())
+		case reflect.Bool:
+			fmt.Fprintf(buf, "%s = %t\n", key, value.Bool())
+		default:
+			return fmt.Errorf("manifest TOML: unsupported type %v of %s.%s", value.Type(), strings.Trim(header, "[]"), key)
+		}
+	}
+	return nil
+}
+
+// tomlQuote returns s as a TOML basic string.
+func tomlQuote(s string) string {
+	var buf bytes.Buffer
+	buf.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			buf.WriteByte('\\')
+			buf.WriteRune(r)
+		case r == '\n':
+			buf.WriteString(`\n`)
+		case r == '\t':
+			buf.WriteString(`\t`)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&buf, `\u%04x`, r)
+		default:
+			buf.WriteRune(r)
+		}
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
+
+// manifestFromTOML parses a TOML manifest, without filling in defaults.
+func manifestFromTOML(data []byte) (*Manifest, error) {
+	m := new(Manifest)
+	v := reflect.ValueOf(m).Elem()
+	var elem reflect.Value
+	var seen map[string]bool
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if strings.HasPrefix(line, "[[") {
+			end := strings.Index(line, "]]")
+			if end < 0 || !isTOMLComment(line[end+2:]) {
+				return nil, fmt.Errorf("manifest TOML line %d: invalid table header %q", i+1, line)
+			}
+			name := strings.TrimSpace(line[2:end])
+			field := ""
+			for _, section := range tomlSections {
+				if section.name == name {
+					field = section.field
+				}
+			}
+			if field == "" {
+				return nil, fmt.Errorf("manifest TOML line %d: unknown array of tables %q", i+1, name)
+			}
+			elems := v.FieldByName(field)
+			elems.Set(reflect.Append(elems, reflect.Zero(elems.Type().Elem())))
+			elem = elems.Index(elems.Len() - 1)
+			seen = make(map[string]bool)
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			end := strings.Index(line, "]")
+			if end < 0 || !isTOMLComment(line[end+1:]) {
+				return nil, fmt.Errorf("manifest TOML line %d: invalid table header %q", i+1, line)
+			}
+			name := strings.TrimSpace(line[1:end])
+			field := ""
+			for _, table := range tomlTables {
+				if table.name == name {
+					field = table.field
+				}
+			}
+			if field == "" {
+				return nil, fmt.Errorf("manifest TOML line %d: unknown table %q", i+1, name)
+			}
+			ptr := v.FieldByName(field)
+			if !ptr.IsNil() {
+				return nil, fmt.Errorf("manifest TOML line %d: duplicate table %q", i+1, name)
+			}
+			ptr.Set(reflect.New(ptr.Type().Elem()))
+			elem = ptr.Elem()
+			seen = make(map[string]bool)
+			continue
+		}
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			return nil, fmt.Errorf("manifest TOML line %d: expected a table header or a key/value pair, got %q", i+1, line)
+		}
+		if !elem.IsValid() {
+			return nil, fmt.Errorf("manifest TOML line %d: key/value pair outside of a table", i+1)
+		}
+		key := strings.TrimSpace(line[:eq])
+		if seen[key] {
+			return nil, fmt.Errorf("manifest TOML line %d: duplicate key %q", i+1, key)
+		}
+		seen[key] = true
+		var value reflect.Value
+		for j := 0; j < elem.NumField(); j++ {
+			if name, _, ok := tomlKey(elem.Type().Field(j)); ok && name == key {
+				value = elem.Field(j)
+			}
+		}
+		if !value.IsValid() {
+			return nil, fmt.Errorf("manifest TOML line %d: unknown key %q", i+1, key)
+		}
+		if err := setTOMLValue(value, strings.TrimSpace(line[eq+1:])); err != nil {
+			return nil, fmt.Errorf("manifest TOML line %d: key %q: %v", i+1, key, err)
+		}
+	}
+	return m, nil
+}
+
+// isTOMLComment returns true if s is empty or only holds a comment.
+func isTOMLComment(s string) bool {
+	s = strings.TrimSpace(s)
+	return s == "" || s[0] == '#'
+}
+
+// setTOMLValue parses the TOML value s, which may be followed by a comment,
+// into v.
+func setTOMLValue(v reflect.Value, s string) error {
+	if s == "" {
+		return fmt.Errorf("missing value")
+	}
+	if s[0] == '"' || s[0] == '\'' {
+		if v.Kind() != reflect.String {
+			return fmt.Errorf("expected a %v, got a string", v.Kind())
+		}
+		end := 1
+		for ; end < len(s) && s[end] != s[0]; end++ {
+			if s[0] == '"' && s[end] == '\\' {
+				end++
+			}
+		}
+		if end >= len(s) || !isTOMLComment(s[end+1:]) {
+			return fmt.Errorf("invalid string %s", s)
+		}
+		if s[0] == '\'' {
+			// Literal strings have no escape sequences.
+			v.SetString(s[1:end])
+			return nil
+		}
+		str, err := strconv.Unquote(s[:end+1])
+		if err != nil {
+			return fmt.Errorf("invalid string %s", s)
+		}
+		v.SetString(str)
+		return nil
+	}
+	if i := strings.Index(s, "#"); i >= 0 {
+		s = strings.TrimSpace(s[:i])
+	}
+	switch v.Kind() {
+	case reflect.Int:
+		n, err := strconv.ParseInt(strings.Replace(s, "_", "", -1), 10, 0)
+		if err != nil {
+			return fmt.Errorf("invalid integer %s", s)
+		}
+		v.SetInt(n)
+	case reflect.Bool:
+		switch s {
+		case "true":
+			v.SetBool(true)
+		case "false":
+			v.SetBool(false)
+		default:
+			return fmt.Errorf("invalid boolean %s", s)
+		}
+	default:
+		return fmt.Errorf("expected a %v, got %s", v.Kind(), s)
+	}
+	return nil
+}
@@ -7,6 +7,7 @@
 package retry
 
 import (
+	"context"
 	"fmt"
 	"time"
 
@@ -25,6 +26,14 @@ type IntervalOpt time.Duration
 
 func (i IntervalOpt) retryOpt() {}
 
+// ContextOpt stops the retries, and the wait between them, once the context
+// is done, e.g. because the user interrupted the command.
+type ContextOpt struct {
+	context.Context
+}
+
+func (c ContextOpt) retryOpt() {}
+
 const (
 	defaultAttempts = 3
 	defaultInterval = 10 * time.Second
@@ -34,12 +43,15 @@ const (
 // attempts at the given interval.
 func Function(ctx *tool.Context, fn func() error, opts ...RetryOpt) error {
 	attempts, interval := defaultAttempts, defaultInterval
+	done := context.Background().Done()
 	for _, opt := range opts {
 		switch typedOpt := opt.(type) {
 		case AttemptsOpt:
 			attempts = int(typedOpt)
 		case IntervalOpt:
 			interval = time.Duration(typedOpt)
+		case ContextOpt:
+			done = typedOpt.Done()
 		}
 	}
 
@@ -52,9 +64,18 @@ func Function(ctx *tool.Context, fn func() error, opts ...RetryOpt) error {
 			return nil
 		}
 		fmt.Fprintf(ctx.Stderr(), "%v\n", err)
+		select {
+		case <-done:
+			return err
+		default:
+		}
 		if i < attempts {
 			fmt.Fprintf(ctx.Stdout(), "Wait for %v before next attempt...\n", interval)
-			time.Sleep(interval)
+			select {
+			case <-done:
+				return err
+			case <-time.After(interval):
+			}
 		}
 	}
 	return fmt.Errorf("Failed %d times in a row. Last error:\n%v", attempts, err)
@@ -10,12 +10,17 @@ package jiri
 
 import (
 	"encoding/xml"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync/atomic"
+	"time"
 
 	"fuchsia.googlesource.com/jiri/cmdline"
 	"fuchsia.googlesource.com/jiri/color"
@@ -33,6 +38,9 @@ const (
 	ProjectMetaFile    = "metadata.v2"
 	ProjectConfigFile  = "config"
 	JiriManifestFile   = ".jiri_manifest"
+	JiriVersionFile    = ".jiri_version"
+	JiriLockFile       = ".jiri_lock"
+	JiriIgnoreFile     = ".jiriignore"
 
 	// PreservePathEnv is the name of the environment variable that, when set to a
 	// non-empty value, causes jiri tools to use the existing PATH variable,
@@ -42,9 +50,13 @@ const (
 
 // Config represents jiri global config
 type Config struct {
-	CachePath string   `xml:"cache>path,omitempty"`
-	Shared    bool     `xml:"cache>shared,omitempty"`
-	XMLName   struct{} `xml:"config"`
+	CachePath              string   `xml:"cache>path,omitempty"`
+	Shared                 bool     `xml:"cache>shared,omitempty"`
+	ForbidDetachedHead     bool     `xml:"forbid-detached-head,omitempty"`
+	UpdateHistoryRetention int      `xml:"update-history>retention,omitempty"`
+	MetadataIgnoreFile     string   `xml:"metadata-ignore-file,omitempty"`
+	Jobs                   uint     `xml:"jobs,omitempty"`
+	XMLName                struct{} `xml:"config"`
 }
 
 func (c *Config) Write(filename string) error {
@@ -90,6 +102,44 @@ type X struct {
 	Color    color.Color
 	Logger   *log.Logger
 	failures uint32
+	// jobsSet is true if Jobs was set by the -j flag or the config.
+	jobsSet bool
+
+	// ForbidDetachedHead makes update leave every project on a local branch
+	// tracking its remote branch instead of on a detached HEAD.
+	ForbidDetachedHead bool
+
+	// UpdateHistoryRetention is the number of snapshots kept in the update
+	// history directory, older ones are deleted after each update.  Zero keeps
+	// all of them.
+	UpdateHistoryRetention int
+
+	// MetadataIgnoreFile is the name of a file in the root, e.g. ".ignore",
+	// which update keeps listing the jiri metadata directories, for tools which
+	// don't read .git/info/exclude.  Empty disables it.
+	MetadataIgnoreFile string
+
+	// StrictGit makes successful clones and fetches log all their stderr
+	// output, instead of only the warnings not known to be benign, for
+	// debugging.
+	StrictGit bool
+
+	// LFSSkip makes update skip pulling the git-lfs objects of the projects
+	// using git-lfs.
+	LFSSkip bool
+
+	// NetworkTimeout makes git operations fail when they transfer less than
+	// 1 KB/s over HTTP for this long.  Zero disables it.
+	NetworkTimeout time.Duration
+
+	// MetricsAddr is the address, e.g. ":9090", on which update serves its
+	// metrics while it runs.  Empty disables it.
+	MetricsAddr string
+
+	// LogFile receives a copy of the messages of Logger, one per line prefixed
+	// with the time and the level.  It is the file given by the -log-file flag,
+	// if any, which newX also gives to Logger.
+	LogFile io.Writer
 }
 
 func (jirix *X) IncrementFailures() {
@@ -107,6 +157,8 @@ var (
 	quietVerboseFlag bool
 	debugVerboseFlag bool
 	traceVerboseFlag bool
+	lfsSkipFlag      bool
+	logFileFlag      string
 )
 
 func init() {
@@ -117,11 +169,40 @@ func init() {
 	flag.BoolVar(&quietVerboseFlag, "q", false, "Same as -quiet")
 	flag.BoolVar(&debugVerboseFlag, "v", false, "Print debug level output.")
 	flag.BoolVar(&traceVerboseFlag, "vv", false, "Print trace level output.")
+	flag.BoolVar(&lfsSkipFlag, "lfs-skip", false, "Skip pulling the git-lfs objects of projects.")
+	flag.StringVar(&logFileFlag, "log-file", "", "Also append the log messages, with their time and level, to this file.")
 }
 
 // NewX returns a new execution environment, given a cmdline env.
 // It also prepends .jiri_root/bin to the PATH.
 func NewX(env *cmdline.Env) (*X, error) {
+	ctx := tool.NewContextFromEnv(env, false)
+	root, err := findJiriRoot(ctx.Timer())
+	if err != nil {
+		return nil, err
+	}
+	return newX(env, ctx, root)
+}
+
+// NewXAtRoot is like NewX, for the jiri root at the given path rather than the
+// one found from the -root flag or the current directory.
+func NewXAtRoot(env *cmdline.Env, root string) (*X, error) {
+	root, err := cleanPath(root)
+	if err != nil {
+		return nil, err
+	}
+	return newX(env, tool.NewContextFromEnv(env, false), root)
+}
+
+func newX(env *cmdline.Env, ctx *tool.Context, root string) (*X, error) {
+	// The root may come from the -root flag, which is not checked by
+	// findJiriRoot.
+	if fi, err := os.Stat(filepath.Join(root, RootMetaDir)); err != nil || !fi.IsDir() {
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%q is not a jiri root; run 'jiri init' to create one", root)
+	}
 	color := color.NewColor(colorFlag)
 
 	loggerLevel := log.InfoLevel
@@ -134,15 +215,19 @@ func NewX(env *cmdline.Env) (*X, error) {
 	}
 	logger := log.NewLogger(loggerLevel, color)
 
-	ctx := tool.NewContextFromEnv(env, false)
-	root, err := findJiriRoot(ctx.Timer())
-	if err != nil {
-		return nil, err
-	}
-
 	if jobsFlag == 0 {
 		return nil, fmt.Errorf("No of concurrent jobs should be more than zero")
 	}
+	var logFile io.Writer
+	if logFileFlag != "" {
+		// The file is left open for the lifetime of the process.
+		f, err := os.OpenFile(logFileFlag, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open log file: %v", err)
+		}
+		logFile = f
+		logger.LogFile = f
+	}
 
 	x := &X{
 		Context: ctx,
@@ -151,7 +236,14 @@ func NewX(env *cmdline.Env) (*X, error) {
 		Jobs:    jobsFlag,
 		Color:   color,
 		Logger:  logger,
+		LFSSkip: lfsSkipFlag,
+		LogFile: logFile,
 	}
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "j" {
+			x.jobsSet = true
+		}
+	})
 	configPath := filepath.Join(x.RootMetaDir(), ConfigFile)
 	if _, err := os.Stat(configPath); err == nil {
 		x.config, err = ConfigFromFile(configPath)
@@ -161,9 +253,17 @@ func NewX(env *cmdline.Env) (*X, error) {
 	} else if !os.IsNotExist(err) {
 		return nil, err
 	}
+	var err error
 	x.Cache, err = findCache(root, x.config)
 	if x.config != nil {
 		x.Shared = x.config.Shared
+		x.ForbidDetachedHead = x.config.ForbidDetachedHead
+		x.UpdateHistoryRetention = x.config.UpdateHistoryRetention
+		x.MetadataIgnoreFile = x.config.MetadataIgnoreFile
+		if x.config.Jobs != 0 && !x.jobsSet {
+			x.Jobs = x.config.Jobs
+			x.jobsSet = true
+		}
 	}
 
 	if err != nil {
@@ -187,6 +287,9 @@ func NewX(env *cmdline.Env) (*X, error) {
 	return x, nil
 }
 
+// errNotInRoot is returned when no jiri root contains the current directory.
+var errNotInRoot = errors.New("not in a jiri root; run 'jiri init' to create one")
+
 const DefaultJobs = 25
 
 func cleanPath(path string) (string, error) {
@@ -264,7 +367,7 @@ func findJiriRoot(timer *timing.Timer) (string, error) {
 		}
 	}
 
-	return "", fmt.Errorf("cannot find %v", RootMetaDir)
+	return "", errNotInRoot
 }
 
 // FindRoot returns the root directory of the jiri environment.  All state
@@ -287,14 +390,36 @@ func FindRoot() string {
 // Clone returns a clone of the environment.
 func (x *X) Clone(opts tool.ContextOpts) *X {
 	return &X{
-		Context:  x.Context.Clone(opts),
-		Root:     x.Root,
-		Usage:    x.Usage,
-		Jobs:     x.Jobs,
-		Cache:    x.Cache,
-		Color:    x.Color,
-		Logger:   x.Logger,
-		failures: x.failures,
+		Context:                x.Context.Clone(opts),
+		Root:                   x.Root,
+		Usage:                  x.Usage,
+		Jobs:                   x.Jobs,
+		Cache:                  x.Cache,
+		Color:                  x.Color,
+		Logger:                 x.Logger,
+		failures:               x.failures,
+		jobsSet:                x.jobsSet,
+		config:                 x.config,
+		ForbidDetachedHead:     x.ForbidDetachedHead,
+		UpdateHistoryRetention: x.UpdateHistoryRetention,
+		MetadataIgnoreFile:     x.MetadataIgnoreFile,
+		StrictGit:              x.StrictGit,
+		LFSSkip:                x.LFSSkip,
+		NetworkTimeout:         x.NetworkTimeout,
+		LogFile:                x.LogFile,
+		MetricsAddr:            x.MetricsAddr,
+	}
+}
+
+// ApplyManifestConfig applies the default settings shipped with the manifest,
+// zero meaning unset.  The flags and the config of the root take precedence
+// over them.
+func (x *X) ApplyManifestConfig(jobs uint, updateHistoryRetention int) {
+	if jobs != 0 && !x.jobsSet {
+		x.Jobs = jobs
+	}
+	if updateHistoryRetention != 0 && (x.config == nil || x.config.UpdateHistoryRetention == 0) {
+		x.UpdateHistoryRetention = updateHistoryRetention
 	}
 }
 
@@ -318,6 +443,24 @@ func (x *X) JiriManifestFile() string {
 	return filepath.Join(x.Root, JiriManifestFile)
 }
 
+// JiriVersionFile returns the path to the .jiri_version file, which records
+// the version of the jiri binary that last updated the root.
+func (x *X) JiriVersionFile() string {
+	return filepath.Join(x.Root, JiriVersionFile)
+}
+
+// JiriLockFile returns the path to the .jiri_lock file, a snapshot of the
+// revisions the projects are expected to be at.
+func (x *X) JiriLockFile() string {
+	return filepath.Join(x.Root, JiriLockFile)
+}
+
+// JiriIgnoreFile returns the path to the .jiriignore file, which lists the
+// patterns of the paths left out of the scans of the root for projects.
+func (x *X) JiriIgnoreFile() string {
+	return filepath.Join(x.Root, JiriIgnoreFile)
+}
+
 // BinDir returns the path to the bin directory.
 func (x *X) BinDir() string {
 	return filepath.Join(x.RootMetaDir(), "bin")
@@ -345,6 +488,21 @@ func (x *X) UpdateHistorySecondLatestLink() string {
 	return filepath.Join(x.UpdateHistoryDir(), "second-latest")
 }
 
+// CacheDirPath returns the path of the directory in the cache used as a
+// reference repository for the given remote, or an empty string if there is no
+// cache.
+func (x *X) CacheDirPath(remote string) (string, error) {
+	if x.Cache == "" {
+		return "", nil
+	}
+	url, err := url.Parse(remote)
+	if err != nil {
+		return "", err
+	}
+	dirname := url.Host + strings.Replace(strings.Replace(url.Path, "-", "--", -1), "/", "-", -1)
+	return filepath.Join(x.Cache, dirname), nil
+}
+
 // RunnerFunc is an adapter that turns regular functions into cmdline.Runner.
 // This is similar to cmdline.RunnerFunc, but the first function argument is
 // jiri.X, rather than cmdline.Env.
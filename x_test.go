@@ -8,7 +8,11 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"fuchsia.googlesource.com/jiri/cmdline"
 )
 
 // TestFindRootEnvSymlink checks that FindRoot interprets the value of the
@@ -45,3 +49,120 @@ func TestFindRootEnvSymlink(t *testing.T) {
 		t.Fatalf("unexpected output: got %v, want %v", got, want)
 	}
 }
+
+// TestRunnerOutsideRoot checks that commands fail with a helpful error, without
+// running, when they are not run inside a jiri root.
+func TestRunnerOutsideRoot(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir() failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+	if err := os.Chdir(tmpDir); err != nil {
+		t.Fatal(err)
+	}
+	oldRootFlag := rootFlag
+	defer func() { rootFlag = oldRootFlag }()
+
+	runner := RunnerFunc(func(jirix *X, args []string) error {
+		t.Errorf("command run with root %q", jirix.Root)
+		return nil
+	})
+	// The current directory is not in a root, neither is the one given by the
+	// -root flag.
+	for _, flag := range []string{"", tmpDir} {
+		rootFlag = flag
+		err := runner.Run(cmdline.EnvFromOS(), nil)
+		if err == nil {
+			t.Errorf("-root=%q: command should have failed outside a jiri root", flag)
+		} else if !strings.Contains(err.Error(), "run 'jiri init' to create one") {
+			t.Errorf("-root=%q: unexpected error: %v", flag, err)
+		}
+	}
+}
+
+func TestCacheDirPath(t *testing.T) {
+	x := &X{}
+	if got, err := x.CacheDirPath("https://fuchsia.googlesource.com/jiri"); err != nil {
+		t.Fatal(err)
+	} else if got != "" {
+		t.Errorf("got cache dir %q without a cache, want none", got)
+	}
+	x.Cache = "/cache"
+	tests := []struct {
+		remote, want string
+	}{
+		{"https://fuchsia.googlesource.com/jiri", "/cache/fuchsia.googlesource.com-jiri"},
+		{"https://fuchsia.googlesource.com/third_party/foo-bar", "/cache/fuchsia.googlesource.com-third_party-foo--bar"},
+		{"/local/repo", "/cache/-local-repo"},
+	}
+	for _, test := range tests {
+		if got, err := x.CacheDirPath(test.remote); err != nil {
+			t.Errorf("CacheDirPath(%q) failed: %v", test.remote, err)
+		} else if got != test.want {
+			t.Errorf("CacheDirPath(%q): got %q, want %q", test.remote, got, test.want)
+		}
+	}
+}
+
+// TestLogFile checks that the -log-file flag sets X.LogFile, and makes the log
+// messages also be written to it with their time and level.
+func TestLogFile(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir() failed: %v", err)
+	}
+	defer os.RemoveAll(root)
+	if err := os.Mkdir(filepath.Join(root, RootMetaDir), 0755); err != nil {
+		t.Fatal(err)
+	}
+	logFile := filepath.Join(root, "jiri.log")
+	logFileFlag = logFile
+	defer func() { logFileFlag = "" }()
+
+	x, err := NewXAtRoot(cmdline.EnvFromOS(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x.LogFile == nil {
+		t.Fatal("X.LogFile is not set")
+	}
+	defer x.LogFile.(*os.File).Close()
+	if x.Logger.LogFile != x.LogFile {
+		t.Error("the logger doesn't write to X.LogFile")
+	}
+	logger := x.Logger.Capture(ioutil.Discard, ioutil.Discard)
+	logger.Infof("Updating all projects")
+	logger.Debugf("not logged at the info level")
+	logger.Warningf("Project %q is dirty\n\n", "foo")
+	logger.Errorf("Update failed")
+
+	data, err := ioutil.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	want := []string{
+		"INFO Updating all projects",
+		`WARN Project "foo" is dirty`,
+		"ERROR Update failed",
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("got log file %q, want %d lines", data, len(want))
+	}
+	for i, line := range lines {
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 || fields[1] != want[i] {
+			t.Errorf("got log line %q, want a time followed by %q", line, want[i])
+			continue
+		}
+		if _, err := time.Parse(time.RFC3339, fields[0]); err != nil {
+			t.Errorf("log line %q doesn't start with a time: %v", line, err)
+		}
+	}
+}